@@ -73,25 +73,46 @@ if [ ! -z "$RELAY_LIST" ]; then
    set -- ${RELAY_LIST//,/ }
    echo "Starting socat..."
    for ITEM in "$@"; do
-      # Example ITEM: 50002:electrs.embassy:50001
+      # Example ITEM: 50002:electrs.embassy:50001 or 53/udp:dns.local:53
       LISTENING_PORT=${ITEM%%:*}      # 50002
       REST=${ITEM#*:}                 # electrs.embassy:50001
       TARGET_HOST=${REST%%:*}         # electrs.embassy
       TARGET_PORT=${REST#*:}          # 50001
 
+      # Optional protocol suffix on the listening port (tcp, udp or both)
+      PROTOCOL=tcp
+      case "$LISTENING_PORT" in
+         */*)
+            PROTOCOL=${LISTENING_PORT#*/}
+            LISTENING_PORT=${LISTENING_PORT%%/*}
+            ;;
+      esac
+
       # Basic sanity check
       if [ -z "$LISTENING_PORT" ] || [ -z "$TARGET_HOST" ] || [ -z "$TARGET_PORT" ]; then
-         echo "Error: '$ITEM' must be in 'port:TARGET_HOST:TARGET_PORT' format"
+         echo "Error: '$ITEM' must be in 'port[/protocol]:TARGET_HOST:TARGET_PORT' format"
          exit 1
       fi
 
-      echo -n "Relaying $TARGET_HOST:$TARGET_PORT to listening port $LISTENING_PORT... "
-      socat tcp-listen:$LISTENING_PORT,fork,reuseaddr tcp:$TARGET_HOST:$TARGET_PORT < /dev/null &
-      if [ $? -ne 0 ]; then
-         echo "failed!"
-      else
-         echo "success!"
-      fi
+      case "$PROTOCOL" in
+         tcp) PROTOCOLS="tcp" ;;
+         udp) PROTOCOLS="udp" ;;
+         both) PROTOCOLS="tcp udp" ;;
+         *)
+            echo "Error: '$ITEM' has invalid protocol '$PROTOCOL' (expected tcp, udp or both)"
+            exit 1
+            ;;
+      esac
+
+      for PROTO in $PROTOCOLS; do
+         echo -n "Relaying $TARGET_HOST:$TARGET_PORT to listening port $LISTENING_PORT/$PROTO... "
+         socat $PROTO-listen:$LISTENING_PORT,fork,reuseaddr $PROTO:$TARGET_HOST:$TARGET_PORT < /dev/null &
+         if [ $? -ne 0 ]; then
+            echo "failed!"
+         else
+            echo "success!"
+         fi
+      done
 
    done
 fi
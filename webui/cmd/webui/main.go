@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/sudocarlos/tailrelay/internal/auth"
 	"github.com/sudocarlos/tailrelay/internal/caddy"
 	"github.com/sudocarlos/tailrelay/internal/config"
 	"github.com/sudocarlos/tailrelay/internal/logger"
@@ -68,17 +69,17 @@ func main() {
 	// Warn once if a legacy proxy file is present; file-based configs are no longer migrated automatically.
 	caddy.WarnIfLegacyProxyFile(cfg.Paths.CaddyProxyConfig)
 
-	// Load or generate authentication token
-	authToken, err := config.LoadOrGenerateToken(cfg.Auth.TokenFile)
+	// Load or generate authentication token (stored as a salted hash)
+	tokens, newToken, err := auth.LoadOrCreateTokenStore(cfg.Auth.TokenFile)
 	if err != nil {
 		logger.Error("main", "Failed to load/generate auth token: %v", err)
 		os.Exit(1)
 	}
 
-	// Only display token on first run
-	if _, err := os.Stat(cfg.Auth.TokenFile); os.IsNotExist(err) {
+	// The plaintext token is only available when it was just generated
+	if newToken != "" {
 		logger.Info("main", "========================================")
-		logger.Info("main", "AUTHENTICATION TOKEN (save this!): %s", authToken)
+		logger.Info("main", "AUTHENTICATION TOKEN (save this!): %s", newToken)
 		logger.Info("main", "========================================")
 	} else {
 		logger.Info("main", "Using existing authentication token from %s", cfg.Auth.TokenFile)
@@ -97,7 +98,7 @@ func main() {
 	}
 
 	// Create and start web server
-	server, err := web.NewServer(cfg, authToken, staticFS, templateFS)
+	server, err := web.NewServer(cfg, tokens, staticFS, templateFS)
 	if err != nil {
 		logger.Error("main", "Failed to create server: %v", err)
 		os.Exit(1)
@@ -106,6 +107,10 @@ func main() {
 	logger.Info("main", "Web UI available at http://0.0.0.0:%d", cfg.Server.Port)
 	if cfg.Auth.EnableTailscaleAuth {
 		logger.Info("main", "Tailscale network authentication: ENABLED")
+		if cfg.Auth.HasTailnetRules() {
+			logger.Info("main", "Tailnet identity rules: %d users, %d tags, %d read-only users",
+				len(cfg.Auth.AllowedUsers), len(cfg.Auth.AllowedTags), len(cfg.Auth.ReadOnlyUsers))
+		}
 	}
 	if cfg.Auth.EnableTokenAuth {
 		logger.Info("main", "Token authentication: ENABLED")
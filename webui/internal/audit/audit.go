@@ -0,0 +1,255 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actor identifies who made a change
+type Actor struct {
+	Method   string   `json:"method"` // session, token, api_key, tailscale or system
+	Session  string   `json:"session,omitempty"`
+	KeyID    string   `json:"key_id,omitempty"`
+	KeyName  string   `json:"key_name,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Node     string   `json:"node,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	RemoteIP string   `json:"remote_ip,omitempty"`
+}
+
+// Change is the before and after value of a single changed field
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Entry is one line of the audit journal
+type Entry struct {
+	Time       time.Time         `json:"time"`
+	Actor      Actor             `json:"actor"`
+	Resource   string            `json:"resource"` // proxy, relay, backup, logs, tailscale, auth
+	Action     string            `json:"action"`   // create, update, delete, toggle, ...
+	ResourceID string            `json:"resource_id,omitempty"`
+	Before     json.RawMessage   `json:"before,omitempty"`
+	After      json.RawMessage   `json:"after,omitempty"`
+	Changes    map[string]Change `json:"changes,omitempty"`
+}
+
+// Filter selects journal entries. Zero values match everything.
+type Filter struct {
+	Resource   string
+	Action     string
+	ResourceID string
+	Actor      string // case-insensitive match on user, node, key name/ID, session or IP
+	Since      time.Time
+	Until      time.Time
+	Offset     int
+	Limit      int
+}
+
+// Page is a window of matching entries, newest first
+type Page struct {
+	Entries []Entry `json:"entries"`
+	Total   int     `json:"total"`
+	Offset  int     `json:"offset"`
+	Limit   int     `json:"limit"`
+}
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// Journal is an append-only JSON lines file of audit entries
+type Journal struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewJournal creates a journal that appends to path
+func NewJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+// Append writes an entry to the end of the journal
+func (j *Journal) Append(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal audit entry: %w", err)
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("create audit directory: %w", err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open audit journal: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write audit entry: %w", err)
+	}
+	return f.Sync()
+}
+
+// Query returns the entries matching f, newest first
+func (j *Journal) Query(f Filter) (Page, error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultLimit
+	}
+	if f.Limit > maxLimit {
+		f.Limit = maxLimit
+	}
+	if f.Offset < 0 {
+		f.Offset = 0
+	}
+
+	page := Page{Entries: []Entry{}, Offset: f.Offset, Limit: f.Limit}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return page, nil
+	}
+	if err != nil {
+		return page, fmt.Errorf("open audit journal: %w", err)
+	}
+	defer file.Close()
+
+	var matched []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // Skip a torn or corrupt line rather than failing the query
+		}
+		if f.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return page, fmt.Errorf("read audit journal: %w", err)
+	}
+
+	// The journal is in append order; present newest first
+	sort.SliceStable(matched, func(a, b int) bool { return matched[a].Time.After(matched[b].Time) })
+
+	page.Total = len(matched)
+	if f.Offset < len(matched) {
+		end := f.Offset + f.Limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page.Entries = matched[f.Offset:end]
+	}
+	return page, nil
+}
+
+func (f Filter) matches(e Entry) bool {
+	if f.Resource != "" && e.Resource != f.Resource {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.ResourceID != "" && e.ResourceID != f.ResourceID {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Actor != "" {
+		needle := strings.ToLower(f.Actor)
+		found := false
+		for _, v := range []string{e.Actor.User, e.Actor.Node, e.Actor.KeyName, e.Actor.KeyID, e.Actor.Session, e.Actor.RemoteIP, e.Actor.Method} {
+			if v != "" && strings.Contains(strings.ToLower(v), needle) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// NewEntry builds an entry with the before/after snapshots and the
+// field-level differences between them
+func NewEntry(actor Actor, resource, action, resourceID string, before, after interface{}) Entry {
+	e := Entry{
+		Time:       time.Now(),
+		Actor:      actor,
+		Resource:   resource,
+		Action:     action,
+		ResourceID: resourceID,
+		Before:     marshalValue(before),
+		After:      marshalValue(after),
+	}
+	if e.Before != nil && e.After != nil {
+		e.Changes = diff(e.Before, e.After)
+	}
+	return e
+}
+
+func marshalValue(v interface{}) json.RawMessage {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// diff compares two JSON objects field by field. Non-object values are
+// compared as a whole under the empty key.
+func diff(before, after json.RawMessage) map[string]Change {
+	var b, a map[string]interface{}
+	if json.Unmarshal(before, &b) != nil || json.Unmarshal(after, &a) != nil {
+		var bv, av interface{}
+		json.Unmarshal(before, &bv)
+		json.Unmarshal(after, &av)
+		if reflect.DeepEqual(bv, av) {
+			return nil
+		}
+		return map[string]Change{"": {Before: bv, After: av}}
+	}
+
+	changes := make(map[string]Change)
+	for k, bv := range b {
+		if av, ok := a[k]; !ok || !reflect.DeepEqual(bv, av) {
+			changes[k] = Change{Before: bv, After: a[k]}
+		}
+	}
+	for k, av := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = Change{Before: nil, After: av}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type proxy struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Enabled  bool   `json:"enabled"`
+}
+
+func TestNewEntry_Diff(t *testing.T) {
+	before := proxy{ID: "p1", Hostname: "a.example", Enabled: true}
+	after := proxy{ID: "p1", Hostname: "b.example", Enabled: true}
+
+	e := NewEntry(Actor{Method: "token"}, "proxy", "update", "p1", before, after)
+	if len(e.Changes) != 1 {
+		t.Fatalf("expected 1 change, got %v", e.Changes)
+	}
+	c, ok := e.Changes["hostname"]
+	if !ok || c.Before != "a.example" || c.After != "b.example" {
+		t.Errorf("unexpected hostname change: %+v", c)
+	}
+
+	created := NewEntry(Actor{Method: "token"}, "proxy", "create", "p1", nil, after)
+	if created.Before != nil || created.After == nil || created.Changes != nil {
+		t.Errorf("create entry should only have an after snapshot: %+v", created)
+	}
+
+	var nilProxy *proxy
+	deleted := NewEntry(Actor{Method: "token"}, "proxy", "delete", "p1", nilProxy, nil)
+	if deleted.Before != nil {
+		t.Errorf("nil pointer should not be recorded, got %s", deleted.Before)
+	}
+}
+
+func TestJournal_AppendQuery(t *testing.T) {
+	j := NewJournal(filepath.Join(t.TempDir(), "state", "audit.jsonl"))
+
+	page, err := j.Query(Filter{})
+	if err != nil || page.Total != 0 {
+		t.Fatalf("empty journal: total=%d err=%v", page.Total, err)
+	}
+
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: base, Actor: Actor{Method: "tailscale", User: "alice@example.com"}, Resource: "proxy", Action: "create", ResourceID: "p1"},
+		{Time: base.Add(time.Hour), Actor: Actor{Method: "api_key", KeyName: "ci"}, Resource: "relay", Action: "delete", ResourceID: "r1"},
+		{Time: base.Add(2 * time.Hour), Actor: Actor{Method: "tailscale", User: "alice@example.com"}, Resource: "proxy", Action: "update", ResourceID: "p1"},
+	}
+	for _, e := range entries {
+		if err := j.Append(e); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string // actions, newest first
+	}{
+		{"all", Filter{}, []string{"update", "delete", "create"}},
+		{"resource", Filter{Resource: "proxy"}, []string{"update", "create"}},
+		{"actor", Filter{Actor: "CI"}, []string{"delete"}},
+		{"since", Filter{Since: base.Add(30 * time.Minute)}, []string{"update", "delete"}},
+		{"until", Filter{Until: base.Add(30 * time.Minute)}, []string{"create"}},
+		{"page", Filter{Offset: 1, Limit: 1}, []string{"delete"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := j.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			var got []string
+			for _, e := range page.Entries {
+				got = append(got, e.Action)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	page, _ = j.Query(Filter{Offset: 1, Limit: 1})
+	if page.Total != 3 {
+		t.Errorf("Total = %d, want 3", page.Total)
+	}
+}
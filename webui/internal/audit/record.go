@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/sudocarlos/tailrelay/internal/auth"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+var (
+	defaultMu      sync.RWMutex
+	defaultJournal *Journal
+)
+
+// Init sets the journal used by Record and RecordSystem
+func Init(path string) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultJournal = NewJournal(path)
+	logger.Info("audit", "Audit journal at %s", path)
+}
+
+// Default returns the journal set by Init, or nil
+func Default() *Journal {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultJournal
+}
+
+// Record appends an entry for a change made by the caller of r. Failures
+// are logged; they never fail the request that made the change.
+func Record(r *http.Request, resource, action, resourceID string, before, after interface{}) {
+	write(NewEntry(ActorFromRequest(r), resource, action, resourceID, before, after))
+}
+
+// RecordSystem appends an entry for a change made by the application
+// itself, such as a scheduled backup
+func RecordSystem(component, resource, action, resourceID string, before, after interface{}) {
+	write(NewEntry(Actor{Method: "system", User: component}, resource, action, resourceID, before, after))
+}
+
+func write(e Entry) {
+	j := Default()
+	if j == nil {
+		return
+	}
+	if err := j.Append(e); err != nil {
+		logger.Error("audit", "Failed to record %s %s %s: %v", e.Resource, e.Action, e.ResourceID, err)
+	}
+}
+
+// ActorFromRequest describes the authenticated caller of r
+func ActorFromRequest(r *http.Request) Actor {
+	p := auth.PrincipalFromContext(r.Context())
+	if p == nil {
+		host := r.RemoteAddr
+		return Actor{Method: "anonymous", RemoteIP: host}
+	}
+	return Actor{
+		Method:   p.Method,
+		Session:  p.Session,
+		KeyID:    p.KeyID,
+		KeyName:  p.KeyName,
+		User:     p.User,
+		Node:     p.Node,
+		Tags:     p.Tags,
+		RemoteIP: p.RemoteIP,
+	}
+}
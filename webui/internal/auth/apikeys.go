@@ -0,0 +1,383 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key scopes. A write scope implies the matching read scope; ScopeAdmin
+// grants everything, including key management.
+const (
+	ScopeAdmin          = "admin"
+	ScopeCaddyRead      = "caddy:read"
+	ScopeCaddyWrite     = "caddy:write"
+	ScopeSocatRead      = "socat:read"
+	ScopeSocatWrite     = "socat:write"
+	ScopeBackupRead     = "backup:read"
+	ScopeBackupWrite    = "backup:write"
+	ScopeBackupRestore  = "backup:restore"
+	ScopeTailscaleRead  = "tailscale:read"
+	ScopeTailscaleWrite = "tailscale:write"
+	ScopeLogsRead       = "logs:read"
+	ScopeLogsWrite      = "logs:write"
+	ScopeMetricsRead    = "metrics:read"
+	ScopeAuditRead      = "audit:read"
+)
+
+// Scopes lists every scope that can be granted to an API key
+var Scopes = []string{
+	ScopeAdmin,
+	ScopeCaddyRead, ScopeCaddyWrite,
+	ScopeSocatRead, ScopeSocatWrite,
+	ScopeBackupRead, ScopeBackupWrite, ScopeBackupRestore,
+	ScopeTailscaleRead, ScopeTailscaleWrite,
+	ScopeLogsRead, ScopeLogsWrite,
+	ScopeMetricsRead,
+	ScopeAuditRead,
+}
+
+// apiKeyPrefix marks bearer tokens that are API keys rather than the admin token
+const apiKeyPrefix = "trk_"
+
+// lastUsedPersistInterval limits how often key usage is written to disk
+const lastUsedPersistInterval = time.Minute
+
+// ErrAPIKeyNotFound is returned when no key has the requested ID
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey describes a named API key. The secret itself is never stored.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the key has passed its expiry time
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// HasScope reports whether the key grants scope
+func (k APIKey) HasScope(scope string) bool {
+	return scopesAllow(k.Scopes, scope)
+}
+
+// apiKeyRecord is the on-disk form of an API key
+type apiKeyRecord struct {
+	APIKey
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+
+	// lastPersisted is when LastUsedAt was last written to disk
+	lastPersisted time.Time
+}
+
+// apiKeyFile is the JSON document stored under the state directory
+type apiKeyFile struct {
+	Keys []*apiKeyRecord `json:"keys"`
+}
+
+// APIKeyStore persists API keys as salted hashes in a JSON file
+type APIKeyStore struct {
+	path string
+
+	mu   sync.Mutex
+	keys []*apiKeyRecord
+	now  func() time.Time
+}
+
+// NewAPIKeyStore loads the API keys stored at path. A missing file means
+// no keys have been created yet.
+func NewAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path, now: time.Now}
+
+	keys, err := readAPIKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+
+	return s, nil
+}
+
+// Reload replaces the keys in memory with the ones stored on disk, for
+// when the file was replaced, e.g. by restoring a backup. On error the
+// current keys are kept.
+func (s *APIKeyStore) Reload() error {
+	keys, err := readAPIKeys(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	return nil
+}
+
+// readAPIKeys reads the keys stored at path. A missing file holds no keys.
+func readAPIKeys(path string) ([]*apiKeyRecord, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %w", err)
+	}
+
+	var file apiKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys: %w", err)
+	}
+	return file.Keys, nil
+}
+
+// List returns all keys, including expired ones
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, len(s.keys))
+	for i, k := range s.keys {
+		keys[i] = k.APIKey
+	}
+	return keys
+}
+
+// Get returns the key with the given ID
+func (s *APIKeyStore) Get(id string) (APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k := s.findLocked(id); k != nil {
+		return k.APIKey, true
+	}
+	return APIKey{}, false
+}
+
+// Create adds a key and returns it together with the plaintext secret,
+// which is only available at this point
+func (s *APIKeyStore) Create(name string, scopes []string, expiresAt *time.Time) (APIKey, string, error) {
+	if err := validateKey(name, scopes); err != nil {
+		return APIKey{}, "", err
+	}
+
+	idBytes := make([]byte, 6)
+	secretBytes := make([]byte, 32)
+	salt := make([]byte, 16)
+	for _, b := range [][]byte{idBytes, secretBytes, salt} {
+		if _, err := rand.Read(b); err != nil {
+			return APIKey{}, "", fmt.Errorf("failed to generate api key: %w", err)
+		}
+	}
+
+	id := hex.EncodeToString(idBytes)
+	secret := hex.EncodeToString(secretBytes)
+	record := &apiKeyRecord{
+		APIKey: APIKey{
+			ID:        id,
+			Name:      name,
+			Scopes:    scopes,
+			CreatedAt: s.now(),
+			ExpiresAt: expiresAt,
+		},
+		Salt: hex.EncodeToString(salt),
+		Hash: hex.EncodeToString(hashToken(salt, secret)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append(s.keys, record)
+	if err := s.saveLocked(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return APIKey{}, "", err
+	}
+
+	return record.APIKey, apiKeyPrefix + id + "_" + secret, nil
+}
+
+// Update changes the name, scopes and expiry of a key
+func (s *APIKeyStore) Update(id, name string, scopes []string, expiresAt *time.Time) (APIKey, error) {
+	if err := validateKey(name, scopes); err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.findLocked(id)
+	if record == nil {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	previous := record.APIKey
+	record.Name = name
+	record.Scopes = scopes
+	record.ExpiresAt = expiresAt
+	if err := s.saveLocked(); err != nil {
+		record.APIKey = previous
+		return APIKey{}, err
+	}
+
+	return record.APIKey, nil
+}
+
+// Delete revokes a key
+func (s *APIKeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, k := range s.keys {
+		if k.ID == id {
+			previous := s.keys
+			s.keys = append(append([]*apiKeyRecord{}, s.keys[:i]...), s.keys[i+1:]...)
+			if err := s.saveLocked(); err != nil {
+				s.keys = previous
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// Authenticate returns the key matching a bearer token. It reports false for
+// unknown, mismatched or expired keys and records the time of use.
+func (s *APIKeyStore) Authenticate(token string) (APIKey, bool) {
+	rest, ok := strings.CutPrefix(token, apiKeyPrefix)
+	if !ok {
+		return APIKey{}, false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return APIKey{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.findLocked(id)
+	if record == nil {
+		return APIKey{}, false
+	}
+
+	salt, err := hex.DecodeString(record.Salt)
+	if err != nil {
+		return APIKey{}, false
+	}
+	hash, err := hex.DecodeString(record.Hash)
+	if err != nil {
+		return APIKey{}, false
+	}
+	if subtle.ConstantTimeCompare(hashToken(salt, secret), hash) != 1 {
+		return APIKey{}, false
+	}
+
+	now := s.now()
+	if record.Expired(now) {
+		return APIKey{}, false
+	}
+
+	record.LastUsedAt = &now
+	if now.Sub(record.lastPersisted) >= lastUsedPersistInterval {
+		record.lastPersisted = now
+		if err := s.saveLocked(); err != nil {
+			// Usage tracking is best effort; the key is still valid
+			record.lastPersisted = time.Time{}
+		}
+	}
+
+	return record.APIKey, true
+}
+
+// IsAPIKey reports whether a bearer token has the API key format
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func (s *APIKeyStore) findLocked(id string) *apiKeyRecord {
+	for _, k := range s.keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// saveLocked writes all keys to disk. The caller must hold s.mu.
+func (s *APIKeyStore) saveLocked() error {
+	data, err := json.MarshalIndent(apiKeyFile{Keys: s.keys}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal api keys: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write api keys: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save api keys: %w", err)
+	}
+	return nil
+}
+
+// validateKey checks the user-editable fields of a key
+func validateKey(name string, scopes []string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !isKnownScope(scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopesAllow reports whether granted covers the required scope. An empty
+// required scope only needs a valid credential.
+func scopesAllow(granted []string, required string) bool {
+	if required == "" {
+		return true
+	}
+
+	area, access, _ := strings.Cut(required, ":")
+	for _, g := range granted {
+		switch {
+		case g == ScopeAdmin, g == required:
+			return true
+		case access == "read" && g == area+":write":
+			return true
+		}
+	}
+	return false
+}
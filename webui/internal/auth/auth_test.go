@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/tailscale"
+)
+
+// TestTokenStore_LegacyPlaintextIsHashed verifies old plaintext token files
+// keep working and are rewritten as a salted hash
+func TestTokenStore_LegacyPlaintextIsHashed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".webui_token")
+	if err := os.WriteFile(path, []byte("legacy-token"), 0600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	store, generated, err := LoadOrCreateTokenStore(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateTokenStore failed: %v", err)
+	}
+	if generated != "" {
+		t.Errorf("expected no new token for an existing file, got %q", generated)
+	}
+	if !store.Verify("legacy-token") {
+		t.Error("expected legacy token to verify")
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "legacy-token") || !strings.HasPrefix(string(data), "sha256$") {
+		t.Errorf("expected token file to hold a hash, got %q", data)
+	}
+
+	// Reload from the hashed file
+	reloaded, _, err := LoadOrCreateTokenStore(path)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !reloaded.Verify("legacy-token") || reloaded.Verify("wrong") {
+		t.Error("reloaded store verified incorrectly")
+	}
+}
+
+// TestMiddleware_RotateTokenRevokesSessions verifies rotation invalidates the
+// old token and all existing sessions
+func TestMiddleware_RotateTokenRevokesSessions(t *testing.T) {
+	store, token, err := LoadOrCreateTokenStore(filepath.Join(t.TempDir(), ".webui_token"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateTokenStore failed: %v", err)
+	}
+	if token == "" {
+		t.Fatal("expected a generated token")
+	}
+
+	m := NewMiddleware(store, nil, config.AuthConfig{EnableTokenAuth: true}, nil)
+	protected := m.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	if err := m.SetSessionCookie(rec, httptest.NewRequest(http.MethodPost, "/login", nil)); err != nil {
+		t.Fatalf("SetSessionCookie failed: %v", err)
+	}
+	cookie := rec.Result().Cookies()[0]
+	if cookie.Value == token {
+		t.Fatal("session cookie must not contain the token")
+	}
+
+	do := func(setup func(*http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+		setup(req)
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	withCookie := func(r *http.Request) { r.AddCookie(cookie) }
+	withBearer := func(tok string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tok) }
+	}
+
+	if code := do(withCookie); code != http.StatusOK {
+		t.Errorf("session: expected 200, got %d", code)
+	}
+	if code := do(withBearer(token)); code != http.StatusOK {
+		t.Errorf("bearer: expected 200, got %d", code)
+	}
+
+	newToken, err := m.RotateToken()
+	if err != nil {
+		t.Fatalf("RotateToken failed: %v", err)
+	}
+
+	if code := do(withCookie); code != http.StatusSeeOther {
+		t.Errorf("revoked session: expected redirect, got %d", code)
+	}
+	if code := do(withBearer(token)); code != http.StatusUnauthorized {
+		t.Errorf("old token: expected 401, got %d", code)
+	}
+	if code := do(withBearer(newToken)); code != http.StatusOK {
+		t.Errorf("new token: expected 200, got %d", code)
+	}
+}
+
+// TestSessionStore_Expiry verifies sessions stop validating after their TTL
+func TestSessionStore_Expiry(t *testing.T) {
+	s := NewSessionStore(time.Hour)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	session, err := s.Create("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if !s.Validate(session.ID) {
+		t.Fatal("expected new session to be valid")
+	}
+
+	now = now.Add(time.Hour)
+	if s.Validate(session.ID) {
+		t.Error("expected expired session to be invalid")
+	}
+}
+
+// TestLoginNonces verifies a pending Tailscale login can only be completed
+// once, by the browser that started it, before it expires, and that login
+// attempts never overlap
+func TestLoginNonces(t *testing.T) {
+	l := NewLoginNonces(10 * time.Minute)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	nonce, err := l.Begin("")
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+
+	// While the attempt runs, nothing else can start and the nonce is unusable
+	if _, err := l.Begin(nonce); !errors.Is(err, ErrLoginPending) {
+		t.Fatalf("expected ErrLoginPending while the attempt runs, got %v", err)
+	}
+	if l.Consume(nonce) {
+		t.Fatal("expected the nonce of a running attempt to be rejected")
+	}
+	if !l.Ready(nonce) {
+		t.Fatal("expected Ready to accept the pending nonce")
+	}
+
+	// A second browser cannot take over the pending login
+	if _, err := l.Begin(""); !errors.Is(err, ErrLoginPending) {
+		t.Fatalf("expected ErrLoginPending, got %v", err)
+	}
+	if l.Consume("") || l.Consume("not-the-nonce") {
+		t.Fatal("expected consume without the nonce to fail")
+	}
+
+	// The same browser may restart its own login
+	restarted, err := l.Begin(nonce)
+	if err != nil {
+		t.Fatalf("restarting own login failed: %v", err)
+	}
+	l.Ready(restarted)
+	if l.Consume(nonce) || l.Ready(nonce) {
+		t.Error("expected the replaced nonce to be invalid")
+	}
+	if !l.Consume(restarted) {
+		t.Fatal("expected the current nonce to be accepted")
+	}
+	if l.Consume(restarted) {
+		t.Error("expected the nonce to be single use")
+	}
+
+	// A cancelled attempt frees the login
+	cancelled, _ := l.Begin("")
+	l.Cancel(cancelled)
+	if l.Ready(cancelled) || l.Consume(cancelled) {
+		t.Error("expected the cancelled nonce to be invalid")
+	}
+
+	// Expired logins can neither be completed nor block new ones
+	expired, err := l.Begin("")
+	if err != nil {
+		t.Fatalf("Begin after cancel failed: %v", err)
+	}
+	l.Ready(expired)
+	now = now.Add(10 * time.Minute)
+	if l.Consume(expired) {
+		t.Error("expected expired nonce to be rejected")
+	}
+	if _, err := l.Begin(""); err != nil {
+		t.Fatalf("Begin after expiry failed: %v", err)
+	}
+	now = now.Add(10 * time.Minute)
+	if _, err := l.Begin(""); err != nil {
+		t.Errorf("expected an expired login not to block a new one, got %v", err)
+	}
+}
+
+// TestMiddleware_APIKeyScopes verifies API keys are limited to their scopes
+// and stop working once expired or deleted
+func TestMiddleware_APIKeyScopes(t *testing.T) {
+	dir := t.TempDir()
+	tokens, _, err := LoadOrCreateTokenStore(filepath.Join(dir, ".webui_token"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateTokenStore failed: %v", err)
+	}
+	keys, err := NewAPIKeyStore(filepath.Join(dir, "api_keys.json"))
+	if err != nil {
+		t.Fatalf("NewAPIKeyStore failed: %v", err)
+	}
+
+	key, secret, err := keys.Create("ci", []string{ScopeCaddyWrite}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, _, err := keys.Create("bad", []string{"caddy:everything"}, nil); err == nil {
+		t.Error("expected unknown scope to be rejected")
+	}
+
+	m := NewMiddleware(tokens, keys, config.AuthConfig{EnableTokenAuth: true}, nil)
+	var seen *Principal
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = PrincipalFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    int
+	}{
+		{"write scope", m.RequireScope(ScopeCaddyWrite, ok), http.StatusOK},
+		{"write implies read", m.RequireScope(ScopeCaddyRead, ok), http.StatusOK},
+		{"other area", m.RequireScope(ScopeSocatWrite, ok), http.StatusForbidden},
+		{"admin only", m.RequireAuth(ok), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/caddy/create", nil)
+			req.Header.Set("Authorization", "Bearer "+secret)
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+
+	if seen == nil || seen.Method != MethodAPIKey || seen.KeyID != key.ID {
+		t.Errorf("expected API key principal, got %+v", seen)
+	}
+
+	// Keys persist across reloads
+	reloaded, err := NewAPIKeyStore(filepath.Join(dir, "api_keys.json"))
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if _, ok := reloaded.Authenticate(secret); !ok {
+		t.Error("expected key to authenticate after reload")
+	}
+
+	past := time.Now().Add(-time.Minute)
+	if _, err := keys.Update(key.ID, key.Name, key.Scopes, &past); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, ok := keys.Authenticate(secret); ok {
+		t.Error("expected expired key to be rejected")
+	}
+
+	if err := keys.Delete(key.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := keys.Delete(key.ID); err != ErrAPIKeyNotFound {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	// Reload picks up a file replaced underneath the store, as a restore does
+	if err := keys.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, ok := reloaded.Authenticate(secret); !ok {
+		t.Fatal("expected the stale store to still hold the key")
+	}
+	if err := reloaded.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, ok := reloaded.Authenticate(secret); ok {
+		t.Error("expected the deleted key to be gone after Reload")
+	}
+}
+
+// fakeResolver returns fixed identities keyed by IP
+type fakeResolver map[string]*tailscale.Identity
+
+func (f fakeResolver) WhoIs(addr string) (*tailscale.Identity, error) {
+	if id, ok := f[addr]; ok {
+		return id, nil
+	}
+	return nil, fmt.Errorf("no identity for %s", addr)
+}
+
+// TestMiddleware_TailnetRules verifies WhoIs identities are checked against
+// the allow rules and recorded on the request
+func TestMiddleware_TailnetRules(t *testing.T) {
+	resolver := fakeResolver{
+		"100.64.0.1": {LoginName: "Alice@example.com", NodeName: "laptop"},
+		"100.64.0.2": {LoginName: "bob@example.com", NodeName: "phone"},
+		"100.64.0.3": {NodeName: "ci-runner", Tags: []string{"tag:ci"}},
+		"100.64.0.4": {LoginName: "mallory@example.com", NodeName: "shared-in"},
+	}
+	cfg := config.AuthConfig{
+		EnableTailscaleAuth: true,
+		AllowedUsers:        []string{"alice@example.com"},
+		AllowedTags:         []string{"tag:ci"},
+		ReadOnlyUsers:       []string{"bob@example.com"},
+	}
+	m := NewMiddleware(nil, nil, cfg, resolver)
+
+	var seen *Principal
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = PrincipalFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name    string
+		ip      string
+		method  string
+		path    string
+		handler http.Handler
+		want    int
+	}{
+		{"allowed user writes", "100.64.0.1", http.MethodPost, "/api/caddy/create", m.RequireScope(ScopeCaddyWrite, ok), http.StatusOK},
+		{"allowed tag writes", "100.64.0.3", http.MethodPost, "/api/socat/restart", m.RequireScope(ScopeSocatWrite, ok), http.StatusOK},
+		{"read-only user reads", "100.64.0.2", http.MethodGet, "/api/caddy/proxies", m.RequireScope(ScopeCaddyRead, ok), http.StatusOK},
+		{"read-only user views page", "100.64.0.2", http.MethodGet, "/", m.RequireAuth(ok), http.StatusOK},
+		{"read-only user cannot write", "100.64.0.2", http.MethodPost, "/api/caddy/create", m.RequireScope(ScopeCaddyWrite, ok), http.StatusForbidden},
+		{"read-only user cannot manage keys", "100.64.0.2", http.MethodGet, "/api/auth/keys", m.RequireAuth(ok), http.StatusForbidden},
+		{"unlisted user denied", "100.64.0.4", http.MethodGet, "/api/caddy/proxies", m.RequireScope(ScopeCaddyRead, ok), http.StatusForbidden},
+		{"unknown node denied", "100.64.0.9", http.MethodGet, "/api/caddy/proxies", m.RequireScope(ScopeCaddyRead, ok), http.StatusForbidden},
+		{"tailnet-only route allows user", "100.64.0.2", http.MethodGet, "/metrics", m.RequireTailnet(ok), http.StatusOK},
+		{"tailnet-only route denies unlisted user", "100.64.0.4", http.MethodGet, "/metrics", m.RequireTailnet(ok), http.StatusForbidden},
+		{"tailnet-only route denies unknown node", "100.64.0.9", http.MethodGet, "/metrics", m.RequireTailnet(ok), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.RemoteAddr = tt.ip + ":41641"
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+
+	// The identity of the last admitted caller is recorded on the request
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	req.RemoteAddr = "100.64.0.1:41641"
+	m.RequireScope("", ok).ServeHTTP(httptest.NewRecorder(), req)
+	if seen == nil || seen.User != "Alice@example.com" || seen.Node != "laptop" {
+		t.Errorf("expected identity on request, got %+v", seen)
+	}
+}
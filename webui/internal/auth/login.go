@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	loginCookieName = "tailrelay_login"
+	loginCookiePath = "/api/tailscale/"
+	// loginNonceTTL bounds how long a browser may wait for the Tailscale
+	// login it started before it has to start over
+	loginNonceTTL = 10 * time.Minute
+)
+
+// ErrLoginPending is returned when another browser already has a Tailscale
+// login in progress
+var ErrLoginPending = errors.New("another Tailscale login is in progress")
+
+// pendingLogin is the Tailscale login currently in progress. Only the hash
+// of its nonce is kept.
+type pendingLogin struct {
+	hash      [sha256.Size]byte
+	expiresAt time.Time
+	// ready is set once the login attempt returned an auth URL; until then
+	// the attempt is still running and the nonce cannot be used
+	ready bool
+}
+
+// LoginNonces tracks the single pending Tailscale login. The browser that
+// starts the login receives a one-time nonce; only that browser can turn the
+// completed login into a session.
+type LoginNonces struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	pending *pendingLogin
+	now     func() time.Time
+}
+
+// NewLoginNonces creates a nonce store whose nonces expire after ttl
+func NewLoginNonces(ttl time.Duration) *LoginNonces {
+	return &LoginNonces{ttl: ttl, now: time.Now}
+}
+
+// Begin reserves the pending login for a new attempt and returns its nonce,
+// which only becomes usable once Ready is called. It fails with
+// ErrLoginPending while another attempt is still running, or while another
+// browser's login is pending. The browser holding the nonce of a pending
+// login (current) may restart it; every earlier nonce is then invalid.
+func (l *LoginNonces) Begin(current string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate login nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(b)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.pending != nil && now.Before(l.pending.expiresAt) &&
+		(!l.pending.ready || !l.matchesLocked(current)) {
+		return "", ErrLoginPending
+	}
+
+	l.pending = &pendingLogin{
+		hash:      sha256.Sum256([]byte(nonce)),
+		expiresAt: now.Add(l.ttl),
+	}
+	return nonce, nil
+}
+
+// Ready marks the login started with nonce as having an auth URL, so the
+// nonce can be consumed. It reports false if that login is no longer
+// pending.
+func (l *LoginNonces) Ready(nonce string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.matchesLocked(nonce) {
+		return false
+	}
+	l.pending.ready = true
+	return true
+}
+
+// Cancel discards the pending login if nonce belongs to it
+func (l *LoginNonces) Cancel(nonce string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.matchesLocked(nonce) {
+		l.pending = nil
+	}
+}
+
+// Consume reports whether nonce belongs to the pending, ready and unexpired
+// login and clears it, so a nonce can only be used once
+func (l *LoginNonces) Consume(nonce string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending == nil {
+		return false
+	}
+	if !l.now().Before(l.pending.expiresAt) {
+		l.pending = nil
+		return false
+	}
+	if !l.pending.ready || !l.matchesLocked(nonce) {
+		return false
+	}
+
+	l.pending = nil
+	return true
+}
+
+// matchesLocked compares nonce with the pending login. The caller must hold
+// l.mu.
+func (l *LoginNonces) matchesLocked(nonce string) bool {
+	if nonce == "" || l.pending == nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(nonce))
+	return subtle.ConstantTimeCompare(hash[:], l.pending.hash[:]) == 1
+}
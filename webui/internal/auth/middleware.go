@@ -5,58 +5,208 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
 )
 
 const (
 	sessionCookieName = "tailrelay_session"
-	sessionDuration   = 24 * 3600 // 24 hours in seconds
+	sessionDuration   = 24 * time.Hour
 )
 
 // Middleware provides authentication functionality
 type Middleware struct {
-	token               string
+	tokens              *TokenStore
+	apiKeys             *APIKeyStore
+	sessions            *SessionStore
+	logins              *LoginNonces
 	enableTailscaleAuth bool
 	enableTokenAuth     bool
+
+	// Tailnet identity checks
+	resolver   IdentityResolver
+	policy     tailnetPolicy
+	identities identityCache
 }
 
-// NewMiddleware creates a new authentication middleware
-func NewMiddleware(token string, enableTailscaleAuth, enableTokenAuth bool) *Middleware {
+// NewMiddleware creates a new authentication middleware. The resolver is used
+// to identify tailnet callers and may be nil to skip WhoIs lookups.
+func NewMiddleware(tokens *TokenStore, apiKeys *APIKeyStore, authCfg config.AuthConfig, resolver IdentityResolver) *Middleware {
 	return &Middleware{
-		token:               token,
-		enableTailscaleAuth: enableTailscaleAuth,
-		enableTokenAuth:     enableTokenAuth,
+		tokens:              tokens,
+		apiKeys:             apiKeys,
+		sessions:            NewSessionStore(sessionDuration),
+		logins:              NewLoginNonces(loginNonceTTL),
+		enableTailscaleAuth: authCfg.EnableTailscaleAuth,
+		enableTokenAuth:     authCfg.EnableTokenAuth,
+		resolver:            resolver,
+		policy:              newTailnetPolicy(authCfg),
 	}
 }
 
-// RequireAuth is middleware that requires authentication
+// RequireAuth is middleware that requires authentication. API keys need the
+// admin scope.
 func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
+	return m.RequireScope(ScopeAdmin, next)
+}
+
+// RequireScope is middleware that requires authentication and, for API keys,
+// the given scope. An empty scope admits any authenticated caller.
+func (m *Middleware) RequireScope(scope string, next http.Handler) http.Handler {
+	return m.requireScope(func(*http.Request) string { return scope }, next)
+}
+
+// RequireReadWrite is RequireScope with readScope for GET and HEAD requests
+// and writeScope for everything else
+func (m *Middleware) RequireReadWrite(readScope, writeScope string, next http.Handler) http.Handler {
+	return m.requireScope(func(r *http.Request) string {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return readScope
+		}
+		return writeScope
+	}, next)
+}
+
+func (m *Middleware) requireScope(scopeFor func(*http.Request) string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check 1: Valid session cookie
-		if m.enableTokenAuth && m.hasValidSession(r) {
-			next.ServeHTTP(w, r)
+		principal, status := m.authenticate(r)
+		switch status {
+		case http.StatusOK:
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tailrelay"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case http.StatusForbidden:
+			http.Error(w, "Forbidden: tailnet identity not allowed", http.StatusForbidden)
 			return
+		default:
+			// Not authenticated - redirect to login
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if scope := scopeFor(r); !principal.allows(scope, r) {
+			log.Printf("%s lacks scope %s for %s %s", principal, scope, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden: missing scope "+scope, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, withPrincipal(r, principal))
+	})
+}
+
+// authenticate identifies the caller. It returns http.StatusOK with the
+// principal on success, http.StatusUnauthorized for a rejected bearer token,
+// http.StatusForbidden for a tailnet caller denied by the auth rules and
+// http.StatusSeeOther when no credentials were presented.
+func (m *Middleware) authenticate(r *http.Request) (*Principal, int) {
+	remoteIP := remoteHost(r)
+
+	// Check 1: Valid session cookie
+	if m.enableTokenAuth {
+		if id, ok := m.validSession(r); ok {
+			return &Principal{Method: MethodSession, Session: sessionRef(id), RemoteIP: remoteIP}, http.StatusOK
+		}
+	}
+
+	// Check 2: Bearer token (admin token or API key) on API requests
+	if token, ok := bearerToken(r); ok && acceptsBearer(r) {
+		if IsAPIKey(token) && m.apiKeys != nil {
+			if key, ok := m.apiKeys.Authenticate(token); ok {
+				return &Principal{
+					Method:   MethodAPIKey,
+					KeyID:    key.ID,
+					KeyName:  key.Name,
+					Scopes:   key.Scopes,
+					RemoteIP: remoteIP,
+				}, http.StatusOK
+			}
+		} else if m.ValidateToken(token) {
+			return &Principal{Method: MethodToken, RemoteIP: remoteIP}, http.StatusOK
+		}
+		log.Printf("Rejected invalid bearer token from %s", r.RemoteAddr)
+		return nil, http.StatusUnauthorized
+	}
+
+	// Check 3: Request from Tailscale IP, subject to the identity rules
+	if m.enableTailscaleAuth && m.isTailscaleIP(r) {
+		if principal := m.tailnetPrincipal(r); principal != nil {
+			return principal, http.StatusOK
 		}
+		return nil, http.StatusForbidden
+	}
+
+	return nil, http.StatusSeeOther
+}
 
-		// Check 2: Request from Tailscale IP
-		if m.enableTailscaleAuth && m.isTailscaleIP(r) {
-			next.ServeHTTP(w, r)
+// RequireTailnet is middleware that only admits requests from Tailscale IPs,
+// without requiring a session. Callers are still subject to the tailnet
+// identity rules, so a device denied elsewhere is denied here too.
+func (m *Middleware) RequireTailnet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.isTailscaleIP(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		principal := m.tailnetPrincipal(r)
+		if principal == nil {
+			http.Error(w, "Forbidden: tailnet identity not allowed", http.StatusForbidden)
 			return
 		}
+		next.ServeHTTP(w, withPrincipal(r, principal))
+	})
+}
 
-		// Not authenticated - redirect to login
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+// RequireLoopback is middleware that only admits requests from the local
+// host, for endpoints Caddy calls from inside the container
+func (m *Middleware) RequireLoopback(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := net.ParseIP(remoteHost(r)); ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
-// hasValidSession checks if the request has a valid session cookie
-func (m *Middleware) hasValidSession(r *http.Request) bool {
+// validSession returns the session ID from the request's cookie if the
+// session is valid
+func (m *Middleware) validSession(r *http.Request) (string, bool) {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
-		return false
+		return "", false
 	}
 
-	// Simple token validation
-	return cookie.Value == m.token
+	return cookie.Value, m.sessions.Validate(cookie.Value)
+}
+
+// sessionRef shortens a session ID to a reference that is safe to log
+func sessionRef(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// acceptsBearer reports whether bearer credentials are accepted for the
+// request path: the JSON API and the metrics endpoint
+func acceptsBearer(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/metrics"
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
 }
 
 // isTailscaleIP checks if the request comes from a Tailscale IP
@@ -92,27 +242,121 @@ func (m *Middleware) isTailscaleIP(r *http.Request) bool {
 	return false
 }
 
-// SetSessionCookie sets the authentication session cookie
-func (m *Middleware) SetSessionCookie(w http.ResponseWriter, r *http.Request) {
+// remoteHost returns the IP part of the request's remote address
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SetSessionCookie starts a new server-side session and sets its ID as the
+// session cookie
+func (m *Middleware) SetSessionCookie(w http.ResponseWriter, r *http.Request) error {
+	session, err := m.sessions.Create(remoteHost(r))
+	if err != nil {
+		return err
+	}
+
 	cookie := &http.Cookie{
 		Name:     sessionCookieName,
-		Value:    m.token,
+		Value:    session.ID,
 		Path:     "/",
-		MaxAge:   sessionDuration,
+		MaxAge:   int(sessionDuration.Seconds()),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	}
 
 	// Set Secure flag if using HTTPS
-	if r.TLS != nil || strings.HasPrefix(r.Header.Get("X-Forwarded-Proto"), "https") {
-		cookie.Secure = true
-	}
+	cookie.Secure = isHTTPS(r)
 
 	http.SetCookie(w, cookie)
+	return nil
+}
+
+// BeginTailscaleLogin starts the pending Tailscale login for this browser.
+// start runs the login attempt while the login is reserved, so attempts
+// never overlap; if it succeeds the login's one-time nonce is set as a
+// cookie, replacing any earlier nonce, and if it fails the login is
+// discarded. It returns ErrLoginPending if another login is in progress.
+func (m *Middleware) BeginTailscaleLogin(w http.ResponseWriter, r *http.Request, start func() error) error {
+	var current string
+	if cookie, err := r.Cookie(loginCookieName); err == nil {
+		current = cookie.Value
+	}
+
+	nonce, err := m.logins.Begin(current)
+	if err != nil {
+		return err
+	}
+
+	if err := start(); err != nil {
+		m.logins.Cancel(nonce)
+		clearLoginCookie(w)
+		return err
+	}
+	if !m.logins.Ready(nonce) {
+		clearLoginCookie(w)
+		return ErrLoginPending
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    nonce,
+		Path:     loginCookiePath,
+		MaxAge:   int(loginNonceTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   isHTTPS(r),
+	})
+	return nil
+}
+
+// CancelTailscaleLogin discards the pending Tailscale login whose nonce the
+// request carries and clears the nonce cookie
+func (m *Middleware) CancelTailscaleLogin(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(loginCookieName); err == nil {
+		m.logins.Cancel(cookie.Value)
+	}
+	clearLoginCookie(w)
+}
+
+// CompleteTailscaleLogin starts a session if the request carries the nonce
+// of the pending Tailscale login. The nonce is consumed, so this succeeds at
+// most once per login. The caller must check that Tailscale is connected.
+func (m *Middleware) CompleteTailscaleLogin(w http.ResponseWriter, r *http.Request) (bool, error) {
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil || !m.logins.Consume(cookie.Value) {
+		return false, nil
+	}
+
+	clearLoginCookie(w)
+
+	if err := m.SetSessionCookie(w, r); err != nil {
+		return false, err
+	}
+	log.Printf("Tailscale login completed from %s", r.RemoteAddr)
+	return true, nil
 }
 
-// ClearSessionCookie clears the authentication session cookie
-func (m *Middleware) ClearSessionCookie(w http.ResponseWriter) {
+// clearLoginCookie removes the Tailscale login nonce cookie
+func clearLoginCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    "",
+		Path:     loginCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// ClearSessionCookie revokes the request's session and clears the cookie
+func (m *Middleware) ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		m.sessions.Revoke(cookie.Value)
+	}
+
 	cookie := &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    "",
@@ -123,7 +367,45 @@ func (m *Middleware) ClearSessionCookie(w http.ResponseWriter) {
 	http.SetCookie(w, cookie)
 }
 
+// isHTTPS reports whether the request arrived over HTTPS, directly or via a
+// TLS-terminating proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
 // ValidateToken checks if the provided token matches the configured token
 func (m *Middleware) ValidateToken(token string) bool {
-	return m.enableTokenAuth && token == m.token
+	return m.enableTokenAuth && m.tokens.Verify(token)
+}
+
+// TokenAuthEnabled reports whether token login is enabled
+func (m *Middleware) TokenAuthEnabled() bool {
+	return m.enableTokenAuth
+}
+
+// RotateToken replaces the API token and revokes every session. The new
+// plaintext token is returned so it can be shown to the caller once.
+func (m *Middleware) RotateToken() (string, error) {
+	token, err := m.tokens.Rotate()
+	if err != nil {
+		return "", err
+	}
+	revoked := m.sessions.RevokeAll()
+	log.Printf("API token rotated; revoked %d sessions", revoked)
+	return token, nil
+}
+
+// RevokeSessions ends every session and returns how many were active
+func (m *Middleware) RevokeSessions() int {
+	return m.sessions.RevokeAll()
+}
+
+// APIKeys returns the API key store
+func (m *Middleware) APIKeys() *APIKeyStore {
+	return m.apiKeys
+}
+
+// Sessions returns the active sessions
+func (m *Middleware) Sessions() []Session {
+	return m.sessions.List()
 }
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authentication methods recorded on a Principal
+const (
+	MethodSession   = "session"
+	MethodToken     = "token"
+	MethodAPIKey    = "api_key"
+	MethodTailscale = "tailscale"
+)
+
+// Principal describes the authenticated caller of a request
+type Principal struct {
+	Method   string   `json:"method"`
+	KeyID    string   `json:"key_id,omitempty"`
+	KeyName  string   `json:"key_name,omitempty"`
+	Session  string   `json:"session,omitempty"` // short reference to the session ID
+	Scopes   []string `json:"scopes,omitempty"`  // only set for API keys
+	RemoteIP string   `json:"remote_ip"`
+
+	// Tailnet identity from WhoIs, set for tailnet callers when available
+	User     string   `json:"user,omitempty"`
+	Node     string   `json:"node,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	ReadOnly bool     `json:"read_only,omitempty"`
+}
+
+// HasScope reports whether the caller may use routes requiring scope.
+// Sessions, the admin token and full tailnet access are not scoped;
+// read-only tailnet users only hold the read scopes.
+func (p *Principal) HasScope(scope string) bool {
+	switch {
+	case p.Method == MethodAPIKey:
+		return scopesAllow(p.Scopes, scope)
+	case p.ReadOnly:
+		return scope == "" || strings.HasSuffix(scope, ":read")
+	default:
+		return true
+	}
+}
+
+// allows reports whether the caller may make request r to a route requiring
+// scope. Read-only users may additionally view the UI pages.
+func (p *Principal) allows(scope string, r *http.Request) bool {
+	if p.HasScope(scope) {
+		return true
+	}
+	return p.ReadOnly && scope == ScopeAdmin &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		!strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// String describes the caller for log messages
+func (p *Principal) String() string {
+	switch {
+	case p.Method == MethodAPIKey:
+		return fmt.Sprintf("API key %s (%s)", p.KeyName, p.KeyID)
+	case p.User != "":
+		return fmt.Sprintf("%s (%s via %s)", p.User, p.Method, p.RemoteIP)
+	case p.Node != "":
+		return fmt.Sprintf("node %s (%s via %s)", p.Node, p.Method, p.RemoteIP)
+	default:
+		return fmt.Sprintf("%s from %s", p.Method, p.RemoteIP)
+	}
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of r carrying the principal
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// PrincipalFromContext returns the caller recorded by the middleware, or nil
+// for unauthenticated requests
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
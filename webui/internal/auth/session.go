@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Session is a server-side login session referenced by the session cookie
+type Session struct {
+	ID        string    `json:"-"`
+	Ref       string    `json:"ref"` // short, loggable reference to ID
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RemoteIP  string    `json:"remote_ip"`
+}
+
+// SessionStore keeps active sessions in memory. Sessions do not survive a
+// restart, which simply requires users to log in again.
+type SessionStore struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	now      func() time.Time
+}
+
+// NewSessionStore creates a session store whose sessions expire after ttl
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		ttl:      ttl,
+		sessions: make(map[string]*Session),
+		now:      time.Now,
+	}
+}
+
+// Create starts a new session with a random ID
+func (s *SessionStore) Create(remoteIP string) (*Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
+	now := s.now()
+	id := hex.EncodeToString(b)
+	session := &Session{
+		ID:        id,
+		Ref:       sessionRef(id),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+		RemoteIP:  remoteIP,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	s.sessions[session.ID] = session
+
+	return session, nil
+}
+
+// Validate reports whether id refers to an active, unexpired session
+func (s *SessionStore) Validate(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return false
+	}
+	if !s.now().Before(session.ExpiresAt) {
+		delete(s.sessions, id)
+		return false
+	}
+	return true
+}
+
+// Revoke ends a single session
+func (s *SessionStore) Revoke(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// RevokeAll ends every session and returns how many were active
+func (s *SessionStore) RevokeAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := len(s.sessions)
+	s.sessions = make(map[string]*Session)
+	return count
+}
+
+// List returns the active sessions
+func (s *SessionStore) List() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(s.now())
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, *session)
+	}
+	return sessions
+}
+
+// pruneLocked drops expired sessions. The caller must hold s.mu.
+func (s *SessionStore) pruneLocked(now time.Time) {
+	for id, session := range s.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
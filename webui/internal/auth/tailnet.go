@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/tailscale"
+)
+
+// identityCacheTTL bounds how long a WhoIs result is reused for an address
+const identityCacheTTL = 30 * time.Second
+
+// IdentityResolver looks up the tailnet identity behind an address.
+// tailscale.Client implements it.
+type IdentityResolver interface {
+	WhoIs(addr string) (*tailscale.Identity, error)
+}
+
+// tailnetAccess is the level granted to a tailnet caller
+type tailnetAccess int
+
+const (
+	tailnetDenied tailnetAccess = iota
+	tailnetReadOnly
+	tailnetFull
+)
+
+// tailnetPolicy evaluates the allow rules from AuthConfig
+type tailnetPolicy struct {
+	allowedUsers  map[string]bool
+	allowedTags   map[string]bool
+	readOnlyUsers map[string]bool
+}
+
+func newTailnetPolicy(cfg config.AuthConfig) tailnetPolicy {
+	return tailnetPolicy{
+		allowedUsers:  lowerSet(cfg.AllowedUsers),
+		allowedTags:   lowerSet(cfg.AllowedTags),
+		readOnlyUsers: lowerSet(cfg.ReadOnlyUsers),
+	}
+}
+
+// enabled reports whether any rule is configured
+func (p tailnetPolicy) enabled() bool {
+	return len(p.allowedUsers) > 0 || len(p.allowedTags) > 0 || len(p.readOnlyUsers) > 0
+}
+
+// access returns the access level for an identity
+func (p tailnetPolicy) access(id *tailscale.Identity) tailnetAccess {
+	for _, tag := range id.Tags {
+		if p.allowedTags[strings.ToLower(tag)] {
+			return tailnetFull
+		}
+	}
+
+	login := strings.ToLower(id.LoginName)
+	if login == "" {
+		return tailnetDenied
+	}
+	if p.allowedUsers[login] {
+		return tailnetFull
+	}
+	if p.readOnlyUsers[login] {
+		return tailnetReadOnly
+	}
+	return tailnetDenied
+}
+
+func lowerSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			set[strings.ToLower(v)] = true
+		}
+	}
+	return set
+}
+
+// identityCache memoizes WhoIs lookups per IP
+type identityCache struct {
+	mu      sync.Mutex
+	entries map[string]identityEntry
+}
+
+type identityEntry struct {
+	identity *tailscale.Identity
+	err      error
+	expires  time.Time
+}
+
+// tailnetPrincipal resolves the caller's tailnet identity and applies the
+// allow rules. It returns nil when the caller is denied. Without rules,
+// every tailnet address is admitted and the identity is recorded when
+// WhoIs succeeds.
+func (m *Middleware) tailnetPrincipal(r *http.Request) *Principal {
+	principal := &Principal{Method: MethodTailscale, RemoteIP: remoteHost(r)}
+
+	var identity *tailscale.Identity
+	var err error
+	if m.resolver != nil {
+		identity, err = m.lookupIdentity(principal.RemoteIP)
+	}
+	if identity != nil {
+		principal.User = identity.LoginName
+		principal.Node = identity.NodeName
+		principal.Tags = identity.Tags
+	}
+
+	if !m.policy.enabled() {
+		return principal
+	}
+
+	if identity == nil {
+		log.Printf("Denied tailnet request from %s: identity lookup failed: %v", principal.RemoteIP, err)
+		return nil
+	}
+
+	switch m.policy.access(identity) {
+	case tailnetFull:
+		return principal
+	case tailnetReadOnly:
+		principal.ReadOnly = true
+		return principal
+	default:
+		log.Printf("Denied tailnet request from %s (user %q, node %q, tags %v): not allowed by auth rules",
+			principal.RemoteIP, identity.LoginName, identity.NodeName, identity.Tags)
+		return nil
+	}
+}
+
+// LookupIdentity returns the tailnet identity behind ip, sharing the WhoIs
+// cache used to authenticate requests
+func (m *Middleware) LookupIdentity(ip string) (*tailscale.Identity, error) {
+	if m.resolver == nil {
+		return nil, errors.New("tailnet identity lookups are not available")
+	}
+	return m.lookupIdentity(ip)
+}
+
+// lookupIdentity returns the cached WhoIs result for ip, querying tailscaled
+// when the entry is missing or stale
+func (m *Middleware) lookupIdentity(ip string) (*tailscale.Identity, error) {
+	now := time.Now()
+
+	m.identities.mu.Lock()
+	entry, ok := m.identities.entries[ip]
+	m.identities.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.identity, entry.err
+	}
+
+	identity, err := m.resolver.WhoIs(ip)
+
+	m.identities.mu.Lock()
+	if m.identities.entries == nil {
+		m.identities.entries = make(map[string]identityEntry)
+	}
+	// Drop stale entries so the cache does not grow without bound
+	for k, e := range m.identities.entries {
+		if !now.Before(e.expires) {
+			delete(m.identities.entries, k)
+		}
+	}
+	m.identities.entries[ip] = identityEntry{identity: identity, err: err, expires: now.Add(identityCacheTTL)}
+	m.identities.mu.Unlock()
+
+	return identity, err
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// tokenHashScheme prefixes hashed entries in the token file
+const tokenHashScheme = "sha256"
+
+// TokenStore keeps the salted hash of the API token. The plaintext token is
+// only ever shown once, when it is generated or rotated.
+type TokenStore struct {
+	path string
+
+	mu   sync.RWMutex
+	salt []byte
+	hash []byte
+}
+
+// LoadOrCreateTokenStore loads the token hash from filename, generating a new
+// token when the file does not exist. Legacy files holding a plaintext token
+// are converted to a hash in place so the existing token keeps working.
+// The returned string is the new plaintext token when one was generated, or
+// empty otherwise.
+func LoadOrCreateTokenStore(filename string) (*TokenStore, string, error) {
+	s := &TokenStore{path: filename}
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		token, err := s.Rotate()
+		if err != nil {
+			return nil, "", err
+		}
+		return s, token, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	content := strings.TrimSpace(string(data))
+	if strings.HasPrefix(content, tokenHashScheme+"$") {
+		if err := s.parse(content); err != nil {
+			return nil, "", err
+		}
+		return s, "", nil
+	}
+
+	if content == "" {
+		return nil, "", fmt.Errorf("token file %s is empty", filename)
+	}
+
+	// Plaintext token from an older version: hash it and rewrite the file
+	if err := s.set(content); err != nil {
+		return nil, "", err
+	}
+	log.Printf("Converted plaintext token in %s to a salted hash", filename)
+	return s, "", nil
+}
+
+// Verify reports whether token matches the stored hash
+func (s *TokenStore) Verify(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return subtle.ConstantTimeCompare(hashToken(s.salt, token), s.hash) == 1
+}
+
+// Rotate generates a new token, stores its hash and returns the plaintext
+func (s *TokenStore) Rotate() (string, error) {
+	token, err := config.GenerateToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	if err := s.set(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// set hashes token with a fresh salt and persists it
+func (s *TokenStore) set(token string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	hash := hashToken(salt, token)
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	line := fmt.Sprintf("%s$%s$%s\n", tokenHashScheme, hex.EncodeToString(salt), hex.EncodeToString(hash))
+	if err := os.WriteFile(s.path, []byte(line), 0600); err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+
+	s.mu.Lock()
+	s.salt = salt
+	s.hash = hash
+	s.mu.Unlock()
+	return nil
+}
+
+// parse reads a "sha256$<salt>$<hash>" entry
+func (s *TokenStore) parse(content string) error {
+	parts := strings.Split(content, "$")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid token file %s", s.path)
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid token salt in %s: %w", s.path, err)
+	}
+	hash, err := hex.DecodeString(parts[2])
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid token hash in %s", s.path)
+	}
+
+	s.mu.Lock()
+	s.salt = salt
+	s.hash = hash
+	s.mu.Unlock()
+	return nil
+}
+
+// hashToken returns SHA-256(salt || token). Tokens are 256-bit random values,
+// so a fast hash is sufficient; the salt keeps equal tokens from matching.
+func hashToken(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
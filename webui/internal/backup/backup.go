@@ -89,6 +89,9 @@ func (m *Manager) Create(backupType string) (string, error) {
 	// Add auth token if it exists (for restoring admin access)
 	filesToBackup = append(filesToBackup, m.cfg.Auth.TokenFile)
 
+	// Add API keys (stored as hashes)
+	filesToBackup = append(filesToBackup, filepath.Join(m.cfg.Paths.StateDir, "api_keys.json"))
+
 	for _, filePath := range filesToBackup {
 		if filePath == "" {
 			continue
@@ -116,8 +119,10 @@ func (m *Manager) Create(backupType string) (string, error) {
 	return backupPath, nil
 }
 
-// Restore restores a backup from a tar.gz file
-func (m *Manager) Restore(backupPath string) error {
+// Restore restores a backup from a tar.gz file. The admin token and API
+// keys are only restored when withCredentials is set; otherwise the current
+// ones are kept.
+func (m *Manager) Restore(backupPath string, withCredentials bool) error {
 	// Open backup file
 	file, err := os.Open(backupPath)
 	if err != nil {
@@ -166,7 +171,15 @@ func (m *Manager) Restore(backupPath string) error {
 		case strings.HasSuffix(header.Name, "tailscaled.state"):
 			targetPath = filepath.Join(m.cfg.Paths.StateDir, "tailscaled.state")
 		case strings.HasSuffix(header.Name, ".webui_token"):
+			if !withCredentials {
+				continue
+			}
 			targetPath = m.cfg.Auth.TokenFile
+		case strings.HasSuffix(header.Name, "api_keys.json"):
+			if !withCredentials {
+				continue
+			}
+			targetPath = filepath.Join(m.cfg.Paths.StateDir, "api_keys.json")
 		default:
 			// Unknown file, skip
 			continue
@@ -86,7 +86,7 @@ func TestBackupAndRestore(t *testing.T) {
 	}
 
 	// Restore backup
-	if err := manager.Restore(backupPath); err != nil {
+	if err := manager.Restore(backupPath, true); err != nil {
 		t.Fatalf("Restore backup failed: %v", err)
 	}
 
@@ -103,3 +103,64 @@ func TestBackupAndRestore(t *testing.T) {
 		}
 	}
 }
+
+func TestRestoreWithoutCredentials(t *testing.T) {
+	stateDir := t.TempDir()
+	tokenFile := filepath.Join(stateDir, ".webui_token")
+	keysFile := filepath.Join(stateDir, "api_keys.json")
+	relaysFile := filepath.Join(stateDir, "relays.json")
+
+	cfg := &config.Config{
+		Paths: config.PathsConfig{
+			SocatRelayConfig: relaysFile,
+			StateDir:         stateDir,
+			BackupDir:        filepath.Join(stateDir, "backups"),
+		},
+		Auth: config.AuthConfig{TokenFile: tokenFile},
+	}
+	manager := NewManager(cfg)
+
+	for path, content := range map[string]string{
+		tokenFile:  "backup-token",
+		keysFile:   `{"keys":[{"id":"backup"}]}`,
+		relaysFile: `[{"id":"backup"}]`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	backupPath, err := manager.Create("full")
+	if err != nil {
+		t.Fatalf("Create backup failed: %v", err)
+	}
+
+	current := map[string]string{
+		tokenFile:  "current-token",
+		keysFile:   `{"keys":[]}`,
+		relaysFile: `[]`,
+	}
+	for path, content := range current {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	if err := manager.Restore(backupPath, false); err != nil {
+		t.Fatalf("Restore backup failed: %v", err)
+	}
+
+	want := map[string]string{
+		tokenFile:  current[tokenFile],
+		keysFile:   current[keysFile],
+		relaysFile: `[{"id":"backup"}]`,
+	}
+	for path, expected := range want {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if string(content) != expected {
+			t.Errorf("content mismatch for %s: got %s, want %s", path, content, expected)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package caddy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// ForwardAuthPath is the web UI endpoint Caddy asks before proxying a
+// request to a proxy with an access policy
+const ForwardAuthPath = "/api/caddy/forward-auth"
+
+// DefaultForwardAuthDial is where Caddy reaches the web UI in the container
+const DefaultForwardAuthDial = "127.0.0.1:8021"
+
+// Identity headers passed to the upstreams of proxies with an access policy.
+// Client-supplied values are always removed first.
+const (
+	HeaderUserLogin = "Tailscale-User-Login"
+	HeaderUserName  = "Tailscale-User-Name"
+)
+
+// NormalizeAccess cleans up a proxy's access policy. Logins and tags are
+// compared case-insensitively, so they are stored in lower case.
+func NormalizeAccess(proxy *config.CaddyProxy) error {
+	a := proxy.Access
+	if a == nil {
+		return nil
+	}
+
+	a.AllowedUsers = uniqueTrimmed(lowerAll(a.AllowedUsers))
+	a.AllowedGroups = uniqueTrimmed(a.AllowedGroups)
+	a.AllowedTags = uniqueTrimmed(lowerAll(a.AllowedTags))
+	for _, tag := range a.AllowedTags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("allowed tag %q must start with tag:", tag)
+		}
+	}
+	return nil
+}
+
+func lowerAll(values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = strings.ToLower(v)
+	}
+	return out
+}
+
+// AccessAllowed reports whether a tailnet caller may use a proxy. groups
+// maps group names to the logins in them. A policy without any rule admits
+// every identified caller, which still gives the upstream its identity
+// headers.
+func AccessAllowed(access *config.ProxyAccess, groups map[string][]string, login string, tags []string) bool {
+	if access == nil {
+		return true
+	}
+	login = strings.ToLower(login)
+	if login == "" && len(tags) == 0 {
+		return false
+	}
+	if len(access.AllowedUsers) == 0 && len(access.AllowedGroups) == 0 && len(access.AllowedTags) == 0 {
+		return true
+	}
+
+	for _, tag := range tags {
+		for _, allowed := range access.AllowedTags {
+			if strings.EqualFold(tag, allowed) {
+				return true
+			}
+		}
+	}
+	if login == "" {
+		return false
+	}
+	for _, allowed := range access.AllowedUsers {
+		if login == allowed {
+			return true
+		}
+	}
+	for _, group := range access.AllowedGroups {
+		for _, member := range groups[group] {
+			if strings.EqualFold(strings.TrimSpace(member), login) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardAuthAddress returns where Caddy reaches the forward auth endpoint
+func (pm *ProxyManager) forwardAuthAddress() string {
+	if pm.forwardAuthDial == "" {
+		return DefaultForwardAuthDial
+	}
+	return pm.forwardAuthDial
+}
+
+// buildForwardAuthRoute builds the subroute entry that runs before a proxy's
+// handlers when it has an access policy. It works like Caddy's forward_auth
+// directive: the request is checked against the web UI, which answers 2xx
+// with the caller's identity headers or an error that is sent to the client.
+func (pm *ProxyManager) buildForwardAuthRoute(proxy config.CaddyProxy) Route {
+	dial := pm.forwardAuthAddress()
+
+	identity := []string{HeaderUserLogin, HeaderUserName}
+	var copyRoutes []Route
+	for _, header := range identity {
+		placeholder := "{http.reverse_proxy.header." + header + "}"
+		copyRoutes = append(copyRoutes, Route{
+			Match: []MatcherSet{{Not: []MatcherSet{
+				{Vars: map[string][]string{placeholder: {""}}},
+			}}},
+			Handle: []Handler{{
+				"handler": "headers",
+				"request": HeaderOps{Set: map[string][]string{header: {placeholder}}},
+			}},
+		})
+	}
+
+	auth := Handler{
+		"handler":   "reverse_proxy",
+		"upstreams": []Upstream{{Dial: dial}},
+		"rewrite": map[string]string{
+			"method": "GET",
+			"uri":    ForwardAuthPath + "?proxy=" + url.QueryEscape(proxy.ID),
+		},
+		"headers": HeaderConfig{Request: &HeaderOps{Set: map[string][]string{
+			"X-Forwarded-For":    {"{http.request.remote.host}"},
+			"X-Forwarded-Method": {"{http.request.method}"},
+			"X-Forwarded-Uri":    {"{http.request.uri}"},
+		}}},
+		"handle_response": []map[string]interface{}{{
+			"match":  map[string][]int{"status_code": {2}},
+			"routes": copyRoutes,
+		}},
+	}
+
+	return Route{
+		Handle: []Handler{
+			{"handler": "headers", "request": HeaderOps{Delete: identity}},
+			auth,
+		},
+	}
+}
+
+// isForwardAuthHandler reports whether a handler decoded from Caddy's JSON
+// config is the access check built by buildForwardAuthRoute
+func isForwardAuthHandler(handler map[string]interface{}) bool {
+	if handler["handler"] != "reverse_proxy" {
+		return false
+	}
+	rewrite, _ := handler["rewrite"].(map[string]interface{})
+	uri, _ := rewrite["uri"].(string)
+	return strings.HasPrefix(uri, ForwardAuthPath+"?")
+}
@@ -61,16 +61,22 @@ func NewAPIClient(baseURL string) *APIClient {
 	}
 }
 
-// doRequestWithHeaders performs an HTTP request and returns the response body and headers
-func (c *APIClient) doRequestWithHeaders(method, path string, body interface{}) ([]byte, http.Header, error) {
+// doRequestWithHeaders performs an HTTP request with optional extra request
+// headers and returns the response body and headers
+func (c *APIClient) doRequestWithHeaders(method, path string, body interface{}, header http.Header) ([]byte, http.Header, error) {
 	var reqBody io.Reader
 	var bodyPreview string
 
 	if body != nil {
-		data, err := json.Marshal(body)
-		if err != nil {
-			logger.Error("caddy", "Failed to marshal request body: %v", err)
-			return nil, nil, fmt.Errorf("marshal request body: %w", err)
+		// Bodies that are not JSON, such as a Caddyfile to adapt, are sent
+		// as they are
+		data, isRaw := body.([]byte)
+		if !isRaw {
+			var err error
+			if data, err = json.Marshal(body); err != nil {
+				logger.Error("caddy", "Failed to marshal request body: %v", err)
+				return nil, nil, fmt.Errorf("marshal request body: %w", err)
+			}
 		}
 		reqBody = bytes.NewBuffer(data)
 		bodyPreview = c.formatBodyPreview(data)
@@ -91,6 +97,9 @@ func (c *APIClient) doRequestWithHeaders(method, path string, body interface{})
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
@@ -144,7 +153,7 @@ func (c *APIClient) formatBodyPreview(data []byte) string {
 
 // doRequest performs an HTTP request and returns the response body
 func (c *APIClient) doRequest(method, path string, body interface{}) ([]byte, error) {
-	respBody, _, err := c.doRequestWithHeaders(method, path, body)
+	respBody, _, err := c.doRequestWithHeaders(method, path, body, nil)
 	return respBody, err
 }
 
@@ -160,6 +169,19 @@ func (c *APIClient) GetConfig(path string) (json.RawMessage, error) {
 	return json.RawMessage(data), nil
 }
 
+// GetConfigWithETag retrieves configuration along with the ETag Caddy
+// computed for it, for use in If-Match
+func (c *APIClient) GetConfigWithETag(path string) (json.RawMessage, string, error) {
+	if path == "" {
+		path = "/"
+	}
+	data, headers, err := c.doRequestWithHeaders("GET", "/config"+path, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return json.RawMessage(data), headers.Get("Etag"), nil
+}
+
 // PostConfig adds or appends to configuration at the specified path
 // For arrays, this appends. For objects, this creates or replaces.
 func (c *APIClient) PostConfig(path string, config interface{}) error {
@@ -169,7 +191,7 @@ func (c *APIClient) PostConfig(path string, config interface{}) error {
 
 // PostConfigWithLocation adds or appends to configuration and returns Location header
 func (c *APIClient) PostConfigWithLocation(path string, config interface{}) (string, string, error) {
-	respBody, headers, err := c.doRequestWithHeaders("POST", "/config"+path, config)
+	respBody, headers, err := c.doRequestWithHeaders("POST", "/config"+path, config, nil)
 	if err != nil {
 		return "", "", err
 	}
@@ -280,12 +302,54 @@ func (c *APIClient) DeleteByID(id string) error {
 	return err
 }
 
-// LoadConfig loads a complete configuration (replaces entire config)
-func (c *APIClient) LoadConfig(config interface{}) error {
-	_, err := c.doRequest("POST", "/load", config)
+// LoadConfig loads a complete configuration (replaces entire config). With
+// an etag from GetConfigWithETag, Caddy refuses the load with 412
+// Precondition Failed if the config changed since. Caddy only checks
+// If-Match on /config/ requests, so a conditional load replaces the root
+// there, which is equivalent to /load.
+func (c *APIClient) LoadConfig(config interface{}, etag string) error {
+	if etag == "" {
+		_, err := c.doRequest("POST", "/load", config)
+		return err
+	}
+	_, _, err := c.doRequestWithHeaders("POST", "/config/", config, http.Header{"If-Match": {etag}})
 	return err
 }
 
+// AdaptWarning is a problem Caddy's config adapter found in its input
+type AdaptWarning struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Directive string `json:"directive,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (w AdaptWarning) String() string {
+	if w.File == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", w.File, w.Line, w.Message)
+}
+
+// Adapt converts a config in another format, such as a Caddyfile, to JSON
+// with the /adapt endpoint. contentType names the format, for example
+// text/caddyfile.
+func (c *APIClient) Adapt(data []byte, contentType string) (json.RawMessage, []AdaptWarning, error) {
+	respBody, _, err := c.doRequestWithHeaders("POST", "/adapt", data, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var adapted struct {
+		Result   json.RawMessage `json:"result"`
+		Warnings []AdaptWarning  `json:"warnings"`
+	}
+	if err := json.Unmarshal(respBody, &adapted); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal adapted config: %w", err)
+	}
+	return adapted.Result, adapted.Warnings, nil
+}
+
 // GetReverseProxyUpstreams returns the status of all reverse proxy upstreams
 func (c *APIClient) GetReverseProxyUpstreams() ([]UpstreamStatus, error) {
 	data, err := c.doRequest("GET", "/reverse_proxy/upstreams", nil)
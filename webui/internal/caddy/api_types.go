@@ -18,9 +18,10 @@ type HTTPApp struct {
 
 // HTTPServer represents a Caddy HTTP server
 type HTTPServer struct {
-	Listen []string    `json:"listen,omitempty"`
-	Routes []Route     `json:"routes,omitempty"`
-	Logs   *ServerLogs `json:"logs,omitempty"`
+	Listen           []string    `json:"listen,omitempty"`
+	ListenerWrappers []Handler   `json:"listener_wrappers,omitempty"`
+	Routes           []Route     `json:"routes,omitempty"`
+	Logs             *ServerLogs `json:"logs,omitempty"`
 }
 
 // Route represents a Caddy route with matchers and handlers
@@ -34,8 +35,16 @@ type Route struct {
 
 // MatcherSet represents a set of matchers (all must match)
 type MatcherSet struct {
-	Host []string `json:"host,omitempty"`
-	Path []string `json:"path,omitempty"`
+	Host     []string            `json:"host,omitempty"`
+	Path     []string            `json:"path,omitempty"`
+	Vars     map[string][]string `json:"vars,omitempty"`
+	RemoteIP *RemoteIPMatcher    `json:"remote_ip,omitempty"`
+	Not      []MatcherSet        `json:"not,omitempty"`
+}
+
+// RemoteIPMatcher matches the address of the immediate client
+type RemoteIPMatcher struct {
+	Ranges []string `json:"ranges"`
 }
 
 // Handler represents a Caddy handler (interface type)
@@ -116,6 +125,9 @@ type HeaderOperation struct {
 // HTTPTransport represents HTTP transport configuration for reverse proxy
 type HTTPTransport struct {
 	Protocol        string     `json:"protocol"`
+	DialTimeout     string     `json:"dial_timeout,omitempty"`
+	ReadTimeout     string     `json:"read_timeout,omitempty"`
+	WriteTimeout    string     `json:"write_timeout,omitempty"`
 	TLS             *TLSConfig `json:"tls,omitempty"`
 	KeepAlive       *KeepAlive `json:"keep_alive,omitempty"`
 	Compression     *bool      `json:"compression,omitempty"`
@@ -147,7 +159,7 @@ type KeepAlive struct {
 	ProbeInterval       string `json:"probe_interval,omitempty"`
 	MaxIdleConns        int    `json:"max_idle_conns,omitempty"`
 	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty"`
-	IdleConnTimeout     string `json:"idle_conn_timeout,omitempty"`
+	IdleConnTimeout     string `json:"idle_timeout,omitempty"`
 }
 
 // ServerLogs represents server-level logging configuration
@@ -169,8 +181,10 @@ type TLSAutomation struct {
 
 // TLSPolicy represents a TLS automation policy
 type TLSPolicy struct {
-	Subjects []string    `json:"subjects,omitempty"`
-	Issuers  []TLSIssuer `json:"issuers,omitempty"`
+	ID             string              `json:"@id,omitempty"`
+	Subjects       []string            `json:"subjects,omitempty"`
+	Issuers        []TLSIssuer         `json:"issuers,omitempty"`
+	GetCertificate []map[string]string `json:"get_certificate,omitempty"`
 }
 
 // TLSIssuer represents a certificate issuer configuration
@@ -186,6 +200,7 @@ type TLSCertificates struct {
 
 // TLSCertificateFile represents a TLS certificate file pair
 type TLSCertificateFile struct {
+	ID          string   `json:"@id,omitempty"`
 	Certificate string   `json:"certificate"`
 	Key         string   `json:"key"`
 	Tags        []string `json:"tags,omitempty"`
@@ -0,0 +1,200 @@
+package caddy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+// Batch operations
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+	BatchToggle = "toggle"
+)
+
+// ErrConfigChanged is returned when the running config no longer matches
+// the ETag a batch was made against
+var ErrConfigChanged = errors.New("caddy config changed since it was read")
+
+// BatchOp is one proxy change in a batch. Create and update carry the
+// proxy; delete and toggle name it by ID.
+type BatchOp struct {
+	Op      string             `json:"op"`
+	Proxy   *config.CaddyProxy `json:"proxy,omitempty"`
+	ID      string             `json:"id,omitempty"`
+	Enabled bool               `json:"enabled,omitempty"`
+}
+
+// BatchOpError reports the operation that made a batch fail
+type BatchOpError struct {
+	Index int
+	Op    string
+	Err   error
+}
+
+func (e *BatchOpError) Error() string {
+	return fmt.Sprintf("operation %d (%s): %v", e.Index, e.Op, e.Err)
+}
+
+func (e *BatchOpError) Unwrap() error {
+	return e.Err
+}
+
+// BatchResult describes an applied or previewed batch: the proxy each
+// operation concerns, how the running config changes, and the ETag of the
+// config the batch leaves
+type BatchResult struct {
+	Proxies []config.CaddyProxy `json:"proxies"`
+	Changes []ConfigChange      `json:"changes"`
+	ETag    string              `json:"etag,omitempty"`
+}
+
+// ConfigETag returns the ETag of the running config, for ApplyBatch
+func (pm *ProxyManager) ConfigETag() (string, error) {
+	_, etag, err := pm.client.GetConfigWithETag("/")
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	return etag, nil
+}
+
+// ApplyBatch makes a set of proxy changes as one: it builds the config they
+// lead to and loads it into Caddy in a single request, guarded by etag (or
+// the ETag of the config read here when etag is empty). Metadata and the
+// server map are saved first and put back if Caddy rejects the config, so
+// either every change is made or none is; if putting them back fails, the
+// returned error says so. A dry run only reports the changes.
+func (pm *ProxyManager) ApplyBatch(ops []BatchOp, etag string, dryRun bool) (*BatchResult, error) {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+	pm.routeMu.Lock()
+	defer pm.routeMu.Unlock()
+
+	plan, err := pm.newPlan()
+	if err != nil {
+		return nil, err
+	}
+	if etag == "" {
+		etag = plan.etag
+	} else if etag != plan.etag {
+		return nil, ErrConfigChanged
+	}
+	before, err := decodeConfig(plan.root)
+	if err != nil {
+		return nil, fmt.Errorf("copy config: %w", err)
+	}
+
+	result := &BatchResult{Proxies: []config.CaddyProxy{}}
+	for i, op := range ops {
+		proxy, err := plan.apply(op)
+		if err != nil {
+			return nil, &BatchOpError{Index: i, Op: op.Op, Err: err}
+		}
+		result.Proxies = append(result.Proxies, *proxy)
+	}
+	ports := make([]int, 0, len(result.Proxies))
+	for _, proxy := range result.Proxies {
+		ports = append(ports, proxy.Port)
+	}
+	if err := checkPortHTTPS(plan.proxies, ports...); err != nil {
+		return nil, err
+	}
+	result.Changes = diffConfig(before, plan.root)
+	if dryRun {
+		result.ETag = plan.etag
+		return result, nil
+	}
+
+	servers, err := plan.servers()
+	if err != nil {
+		return nil, err
+	}
+	previous, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata: %w", err)
+	}
+	if err := SaveProxyMetadata(pm.metadataPath, plan.proxies); err != nil {
+		return nil, fmt.Errorf("save metadata: %w", err)
+	}
+
+	pm.mapMu.Lock()
+	previousMap := pm.serverMap.clone()
+	pm.rebuildServerMap(servers)
+	pm.serverMap.NextIndex = max(pm.serverMap.NextIndex, plan.nextIndex)
+	if err := SaveServerMap(pm.serverMapPath, pm.serverMap); err != nil {
+		logger.Error("caddy", "Failed to save server map: %v", err)
+	}
+	pm.mapMu.Unlock()
+
+	if err := pm.client.LoadConfig(plan.root, etag); err != nil {
+		logger.Error("caddy", "Caddy rejected batch of %d proxy changes, rolling back: %v", len(ops), err)
+		var rollbackErrs []error
+		if err := SaveProxyMetadata(pm.metadataPath, previous); err != nil {
+			rollbackErrs = append(rollbackErrs, fmt.Errorf("restore proxy metadata: %w", err))
+		}
+		pm.mapMu.Lock()
+		pm.serverMap = previousMap
+		if err := SaveServerMap(pm.serverMapPath, pm.serverMap); err != nil {
+			rollbackErrs = append(rollbackErrs, fmt.Errorf("restore server map: %w", err))
+		}
+		pm.mapMu.Unlock()
+
+		if rollbackErr := errors.Join(rollbackErrs...); rollbackErr != nil {
+			logger.Error("caddy", "Failed to roll back rejected batch: %v", rollbackErr)
+			return nil, fmt.Errorf("load config: %w; rolling back failed, proxy metadata may not match Caddy: %w", err, rollbackErr)
+		}
+
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusPreconditionFailed {
+			return nil, ErrConfigChanged
+		}
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	if _, newETag, err := pm.client.GetConfigWithETag("/"); err == nil {
+		result.ETag = newETag
+	}
+	pm.syncCaddyfile()
+	logger.Info("caddy", "Applied batch of %d proxy changes", len(ops))
+	return result, nil
+}
+
+// apply makes one batch operation on the plan and returns the proxy it
+// concerns
+func (p *configPlan) apply(op BatchOp) (*config.CaddyProxy, error) {
+	switch op.Op {
+	case BatchCreate:
+		if op.Proxy == nil {
+			return nil, fmt.Errorf("proxy is required")
+		}
+		proxy := *op.Proxy
+		proxy.Hostname = NormalizeHostname(proxy.Hostname)
+		if proxy.ID == "" {
+			id, err := config.GenerateToken()
+			if err != nil {
+				return nil, fmt.Errorf("generate proxy id: %w", err)
+			}
+			proxy.ID = id
+		} else if p.index(proxy.ID) >= 0 {
+			return nil, fmt.Errorf("proxy with ID %s already exists", proxy.ID)
+		}
+		return &proxy, p.add(proxy)
+	case BatchUpdate:
+		if op.Proxy == nil || op.Proxy.ID == "" {
+			return nil, fmt.Errorf("proxy with an ID is required")
+		}
+		proxy := *op.Proxy
+		proxy.Hostname = NormalizeHostname(proxy.Hostname)
+		return &proxy, p.update(proxy)
+	case BatchDelete:
+		return p.remove(op.ID)
+	case BatchToggle:
+		return p.toggle(op.ID, op.Enabled)
+	}
+	return nil, fmt.Errorf("unknown operation %q: must be create, update, delete or toggle", op.Op)
+}
@@ -0,0 +1,120 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// TestApplyBatch verifies that a batch is applied in one load, and that a
+// stale ETag, an invalid operation or a load Caddy rejects leave the
+// config, metadata and server map as they were
+func TestApplyBatch(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	result, err := pm.ApplyBatch([]BatchOp{
+		{Op: BatchCreate, Proxy: &config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true}},
+		{Op: BatchCreate, Proxy: &config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2", Enabled: true}},
+		{Op: BatchCreate, Proxy: &config.CaddyProxy{ID: "c", Hostname: "c.example", Port: 9000, Target: "localhost:3", Enabled: true}},
+		{Op: BatchToggle, ID: "c", Enabled: false},
+	}, "", false)
+	if err != nil {
+		t.Fatalf("ApplyBatch() returned unexpected error: %v", err)
+	}
+	if len(result.Proxies) != 4 || result.ETag == "" {
+		t.Errorf("ApplyBatch() = %+v, want 4 proxies and the new ETag", result)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"a", "b"}})
+	if pm.serverMap.ByProxyID["a"] == "" || pm.serverMap.ByProxyID["a"] != pm.serverMap.ByListen[":8443"] {
+		t.Errorf("server map = %+v, want a mapped to the :8443 server", pm.serverMap)
+	}
+
+	unchanged := func(name string) {
+		t.Helper()
+		proxies, _ := LoadProxyMetadata(pm.metadataPath)
+		if len(proxies) != 3 || !proxies[0].Enabled || proxies[2].Enabled {
+			t.Errorf("%s: metadata = %+v", name, proxies)
+		}
+		assertLayout(t, pm, map[string][]string{":8443": {"a", "b"}})
+		saved, _ := LoadServerMap(pm.serverMapPath)
+		if !reflect.DeepEqual(saved.ByProxyID, map[string]string{"a": "srv0", "b": "srv0"}) {
+			t.Errorf("%s: saved server map = %+v", name, saved)
+		}
+	}
+	deleteA := []BatchOp{{Op: BatchDelete, ID: "a"}}
+
+	if _, err := pm.ApplyBatch(deleteA, `"/config/ stale"`, false); !errors.Is(err, ErrConfigChanged) {
+		t.Errorf("ApplyBatch() with a stale ETag returned %v, want ErrConfigChanged", err)
+	}
+	unchanged("stale etag")
+
+	var opErr *BatchOpError
+	_, err = pm.ApplyBatch(append(deleteA, BatchOp{Op: BatchUpdate, Proxy: &config.CaddyProxy{ID: "missing"}}), "", false)
+	if !errors.As(err, &opErr) || opErr.Index != 1 {
+		t.Errorf("ApplyBatch() with an unknown proxy returned %v, want an error for operation 1", err)
+	}
+	unchanged("invalid operation")
+
+	fake.rejectLoads = http.StatusBadRequest
+	if _, err := pm.ApplyBatch(deleteA, "", false); err == nil || errors.Is(err, ErrConfigChanged) {
+		t.Errorf("ApplyBatch() returned %v when Caddy rejected the config, want a load error", err)
+	}
+	unchanged("rejected load")
+
+	// Caddy's own ETag check fails when the config changes after it was read
+	fake.rejectLoads = http.StatusPreconditionFailed
+	if _, err := pm.ApplyBatch(deleteA, "", false); !errors.Is(err, ErrConfigChanged) {
+		t.Errorf("ApplyBatch() returned %v when Caddy failed the precondition, want ErrConfigChanged", err)
+	}
+	unchanged("failed precondition")
+	fake.rejectLoads = 0
+
+	result, err = pm.ApplyBatch(deleteA, "", true)
+	if err != nil || len(result.Changes) == 0 {
+		t.Errorf("ApplyBatch() dry run = %+v, %v; want the changes", result, err)
+	}
+	unchanged("dry run")
+}
+
+// TestApplyBatch_RollbackFailure verifies that a batch whose metadata
+// cannot be restored after Caddy rejects it reports the failed rollback
+func TestApplyBatch_RollbackFailure(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	if _, err := pm.ApplyBatch([]BatchOp{
+		{Op: BatchCreate, Proxy: &config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true}},
+	}, "", false); err != nil {
+		t.Fatalf("ApplyBatch() returned unexpected error: %v", err)
+	}
+
+	// Replace the metadata file with a directory once the batch has saved
+	// it, so it cannot be put back
+	fake.rejectLoads = http.StatusPreconditionFailed
+	fake.onLoad = func() {
+		os.Remove(pm.metadataPath)
+		os.Mkdir(pm.metadataPath, 0755)
+	}
+	_, err := pm.ApplyBatch([]BatchOp{{Op: BatchDelete, ID: "a"}}, "", false)
+	if err == nil || errors.Is(err, ErrConfigChanged) || !strings.Contains(err.Error(), "restore proxy metadata") {
+		t.Errorf("ApplyBatch() returned %v, want an error reporting the failed rollback", err)
+	}
+
+	// The server map is still put back
+	assertLayout(t, pm, map[string][]string{":8443": {"a"}})
+	saved, _ := LoadServerMap(pm.serverMapPath)
+	if !reflect.DeepEqual(saved.ByProxyID, map[string]string{"a": "srv0"}) {
+		t.Errorf("saved server map = %+v, want a restored", saved)
+	}
+}
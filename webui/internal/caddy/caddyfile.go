@@ -3,64 +3,325 @@ package caddy
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/sudocarlos/tailrelay/internal/config"
 )
 
-// GenerateCaddyfile generates a Caddyfile from proxy configurations
-func GenerateCaddyfile(proxies []config.CaddyProxy, outputPath string) error {
+// GenerateCaddyfile renders proxies as a Caddyfile that configures the same
+// routes buildRoute gives them in the JSON config. Disabled proxies are left
+// out, as they are not running.
+func (pm *ProxyManager) GenerateCaddyfile(proxies []config.CaddyProxy) string {
 	var sb strings.Builder
 
 	sb.WriteString("# Generated by Tailrelay Web UI\n")
 	sb.WriteString("# Do not edit manually - changes will be overwritten\n\n")
 
+	// Ports that redirect plain HTTP to HTTPS need a listener wrapper,
+	// which can only be set in the global options
+	var redirectPorts []int
+	for _, proxy := range proxies {
+		if proxy.Enabled && proxy.HTTPS != nil && proxy.HTTPS.RedirectHTTP && !slices.Contains(redirectPorts, proxy.Port) {
+			redirectPorts = append(redirectPorts, proxy.Port)
+		}
+	}
+	if len(redirectPorts) > 0 {
+		sb.WriteString("{\n")
+		for _, port := range redirectPorts {
+			sb.WriteString(fmt.Sprintf("\tservers :%d {\n", port))
+			sb.WriteString("\t\tlistener_wrappers {\n\t\t\thttp_redirect\n\t\t\ttls\n\t\t}\n")
+			sb.WriteString("\t}\n")
+		}
+		sb.WriteString("}\n\n")
+	}
+
 	for _, proxy := range proxies {
 		if !proxy.Enabled {
 			continue // Skip disabled proxies
 		}
 
 		// Site block: hostname:port
-		sb.WriteString(fmt.Sprintf("%s:%d {\n", proxy.Hostname, proxy.Port))
+		if proxy.HTTPS != nil {
+			sb.WriteString(fmt.Sprintf("https://%s:%d {\n", proxy.Hostname, proxy.Port))
+			if proxy.HTTPS.CertSource == config.CertSourceFiles {
+				sb.WriteString(fmt.Sprintf("\ttls %s %s\n", proxy.HTTPS.CertFile, proxy.HTTPS.KeyFile))
+			} else {
+				sb.WriteString("\ttls {\n\t\tget_certificate tailscale\n\t}\n")
+			}
+		} else {
+			sb.WriteString(fmt.Sprintf("%s:%d {\n", proxy.Hostname, proxy.Port))
+		}
 
-		// Reverse proxy directive
-		sb.WriteString(fmt.Sprintf("\treverse_proxy %s {\n", proxy.Target))
+		// Caddy sorts top-level directives into its own order, which would run
+		// the address filters after forward_auth and request_header after
+		// both. A route block keeps them in the order the JSON route has.
+		indent := "\t"
+		if proxy.Access != nil {
+			sb.WriteString("\troute {\n")
+			indent = "\t\t"
+		}
 
-		// Header passthrough
-		sb.WriteString("\t\theader_up Host {upstream_hostport}\n")
+		// Address filters answer 403 before anything else is handled
+		if f := proxy.IPFilter; f != nil {
+			if len(f.Deny) > 0 {
+				sb.WriteString(fmt.Sprintf("%s@ip_denied remote_ip %s\n", indent, strings.Join(expandRanges(f.Deny), " ")))
+				sb.WriteString(indent + "handle @ip_denied {\n" + indent + "\trespond 403\n" + indent + "}\n")
+			}
+			if len(f.Allow) > 0 {
+				sb.WriteString(fmt.Sprintf("%s@ip_not_allowed not remote_ip %s\n", indent, strings.Join(expandRanges(f.Allow), " ")))
+				sb.WriteString(indent + "handle @ip_not_allowed {\n" + indent + "\trespond 403\n" + indent + "}\n")
+			}
+		}
 
-		// Trusted proxies if enabled
-		if proxy.TrustedProxies {
-			sb.WriteString("\t\ttrusted_proxies private_ranges\n")
+		// Access policy, checked by the web UI before anything is proxied.
+		// Identity headers from the client are dropped first, so only the
+		// ones forward_auth copies reach the upstream.
+		if proxy.Access != nil {
+			sb.WriteString(fmt.Sprintf("%srequest_header -%s\n%srequest_header -%s\n", indent, HeaderUserLogin, indent, HeaderUserName))
+			sb.WriteString(fmt.Sprintf("%sforward_auth %s {\n", indent, pm.forwardAuthAddress()))
+			sb.WriteString(fmt.Sprintf("%s\turi %s?proxy=%s\n", indent, ForwardAuthPath, url.QueryEscape(proxy.ID)))
+			sb.WriteString(indent + "\theader_up X-Forwarded-For {remote_host}\n")
+			sb.WriteString(fmt.Sprintf("%s\tcopy_headers %s %s\n", indent, HeaderUserLogin, HeaderUserName))
+			sb.WriteString(indent + "}\n")
 		}
 
-		// Custom headers
-		if len(proxy.CustomHeaders) > 0 {
-			for key, value := range proxy.CustomHeaders {
-				sb.WriteString(fmt.Sprintf("\t\theader_up %s %s\n", key, value))
+		// Other route types go in a handle block, so the address filters'
+		// handle blocks still come first; then path rules in order, then
+		// everything else
+		if !isReverseProxy(proxy) {
+			sb.WriteString(indent + "handle {\n")
+			pm.writeSite(&sb, proxy, indent+"\t")
+			sb.WriteString(indent + "}\n")
+		} else if len(proxy.Routes) > 0 {
+			for i, rule := range proxy.Routes {
+				sb.WriteString(fmt.Sprintf("%s@route%d path %s\n", indent, i+1, strings.Join(rule.Paths, " ")))
+				sb.WriteString(fmt.Sprintf("%shandle @route%d {\n", indent, i+1))
+				if rule.StripPrefix != "" {
+					sb.WriteString(fmt.Sprintf("%s\turi strip_prefix %s\n", indent, rule.StripPrefix))
+				}
+				if rule.Rewrite != "" {
+					sb.WriteString(fmt.Sprintf("%s\trewrite * %s\n", indent, rule.Rewrite))
+				}
+				writeReverseProxy(&sb, proxy, ruleUpstreams(proxy, rule), indent+"\t")
+				sb.WriteString(indent + "}\n")
 			}
+			sb.WriteString(indent + "handle {\n")
+			writeReverseProxy(&sb, proxy, proxy.UpstreamList(), indent+"\t")
+			sb.WriteString(indent + "}\n")
+		} else {
+			writeReverseProxy(&sb, proxy, proxy.UpstreamList(), indent)
 		}
 
-		// TLS configuration for HTTPS targets
-		if strings.HasPrefix(proxy.Target, "https://") {
-			sb.WriteString("\t\ttransport http {\n")
-			sb.WriteString("\t\t\ttls_insecure_skip_verify\n")
-			sb.WriteString("\t\t}\n")
+		if proxy.Access != nil {
+			sb.WriteString("\t}\n")
 		}
-
-		sb.WriteString("\t}\n")
 		sb.WriteString("}\n\n")
 	}
 
-	// Write to file
-	if err := os.WriteFile(outputPath, []byte(sb.String()), 0644); err != nil {
-		return fmt.Errorf("failed to write Caddyfile: %w", err)
+	return sb.String()
+}
+
+// WriteCaddyfile renders proxies with GenerateCaddyfile and replaces the
+// file at outputPath with the result
+func (pm *ProxyManager) WriteCaddyfile(proxies []config.CaddyProxy, outputPath string) error {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("failed to create Caddyfile directory: %w", err)
 	}
 
+	// Written aside and renamed, so Caddy never starts from half a file
+	tmp := outputPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(pm.GenerateCaddyfile(proxies)), 0644); err != nil {
+		return fmt.Errorf("failed to write Caddyfile: %w", err)
+	}
+	if err := os.Rename(tmp, outputPath); err != nil {
+		return fmt.Errorf("failed to save Caddyfile: %w", err)
+	}
 	return nil
 }
 
+// writeSite writes the directives for routes that are not reverse proxies,
+// like buildSiteHandler
+func (pm *ProxyManager) writeSite(sb *strings.Builder, proxy config.CaddyProxy, indent string) {
+	switch proxy.Type {
+	case config.ProxyTypeRedirect:
+		if proxy.Redirect == nil {
+			return
+		}
+		location := proxy.Redirect.To
+		if proxy.Redirect.PreservePath {
+			location += requestURIPlaceholder
+		}
+		sb.WriteString(fmt.Sprintf("%sredir %s %d\n", indent, location, proxy.Redirect.Status))
+	case config.ProxyTypeStatic:
+		static := proxy.Static
+		if static == nil {
+			static = &config.ProxyStatic{Status: 200}
+		}
+		if static.ContentType != "" {
+			sb.WriteString(fmt.Sprintf("%sheader Content-Type %q\n", indent, static.ContentType))
+		}
+		sb.WriteString(fmt.Sprintf("%srespond %q %d\n", indent, static.Body, static.Status))
+	case config.ProxyTypeFileServer:
+		if proxy.FileServer == nil {
+			return
+		}
+		sb.WriteString(fmt.Sprintf("%sroot * %s\n", indent, pm.SiteRoot(proxy.FileServer.Root)))
+		if proxy.FileServer.Browse {
+			sb.WriteString(indent + "file_server browse\n")
+		} else {
+			sb.WriteString(indent + "file_server\n")
+		}
+	}
+}
+
+// writeReverseProxy writes a reverse_proxy directive to the given upstreams
+// carrying the proxy's settings, indented by indent
+func writeReverseProxy(sb *strings.Builder, proxy config.CaddyProxy, upstreams []string, indent string) {
+	// Reverse proxy directive
+	sb.WriteString(fmt.Sprintf(indent+"reverse_proxy %s {\n", strings.Join(upstreams, " ")))
+
+	// Load balancing across multiple upstreams
+	if lb := proxy.LoadBalancing; lb != nil {
+		if lb.Policy != "" {
+			sb.WriteString(fmt.Sprintf(indent+"\tlb_policy %s\n", lb.Policy))
+		}
+		if lb.Retries > 0 {
+			sb.WriteString(fmt.Sprintf(indent+"\tlb_retries %d\n", lb.Retries))
+		}
+		if lb.TryDuration != "" {
+			sb.WriteString(fmt.Sprintf(indent+"\tlb_try_duration %s\n", lb.TryDuration))
+		}
+		if lb.TryInterval != "" {
+			sb.WriteString(fmt.Sprintf(indent+"\tlb_try_interval %s\n", lb.TryInterval))
+		}
+	}
+
+	// Health checks
+	if hc := proxy.HealthChecks; hc != nil {
+		if a := hc.Active; a != nil {
+			sb.WriteString(fmt.Sprintf(indent+"\thealth_uri %s\n", a.URI))
+			if a.Interval != "" {
+				sb.WriteString(fmt.Sprintf(indent+"\thealth_interval %s\n", a.Interval))
+			}
+			if a.Timeout != "" {
+				sb.WriteString(fmt.Sprintf(indent+"\thealth_timeout %s\n", a.Timeout))
+			}
+			if a.ExpectStatus != 0 {
+				sb.WriteString(fmt.Sprintf(indent+"\thealth_status %d\n", a.ExpectStatus))
+			}
+			if a.ExpectBody != "" {
+				sb.WriteString(fmt.Sprintf(indent+"\thealth_body %q\n", a.ExpectBody))
+			}
+		}
+		if p := hc.Passive; p != nil {
+			if p.FailDuration != "" {
+				sb.WriteString(fmt.Sprintf(indent+"\tfail_duration %s\n", p.FailDuration))
+			}
+			if p.MaxFails > 0 {
+				sb.WriteString(fmt.Sprintf(indent+"\tmax_fails %d\n", p.MaxFails))
+			}
+			if p.UnhealthyLatency != "" {
+				sb.WriteString(fmt.Sprintf(indent+"\tunhealthy_latency %s\n", p.UnhealthyLatency))
+			}
+		}
+	}
+
+	// Trusted proxies if enabled
+	if ranges := trustedProxyRanges(proxy); ranges != nil {
+		sb.WriteString(fmt.Sprintf(indent+"\ttrusted_proxies %s\n", strings.Join(ranges, " ")))
+	}
+
+	// Host passthrough, custom headers, header rules and presets, in the
+	// same form as the JSON config
+	headers := buildHeaderConfig(proxy)
+	if r := headers.Request; r != nil {
+		writeHeaderOps(sb, indent+"\theader_up", r)
+	}
+	if r := headers.Response; r != nil {
+		writeHeaderOps(sb, indent+"\theader_down", r)
+	}
+
+	writeTransport(sb, indent+"\t", buildTransport(proxy), upstreams)
+	sb.WriteString(indent + "}\n")
+}
+
+// writeTransport writes the transport subdirective for the http transport
+// buildTransport gives a proxy, or nothing when Caddy's defaults apply.
+// Upstreams with an https:// address already use TLS.
+func writeTransport(sb *strings.Builder, indent string, t *HTTPTransport, upstreams []string) {
+	if t == nil {
+		return
+	}
+	httpsTarget := len(upstreams) > 0 && strings.HasPrefix(upstreams[0], "https://")
+
+	var lines []string
+	for _, d := range [][2]string{{"dial_timeout", t.DialTimeout}, {"read_timeout", t.ReadTimeout}, {"write_timeout", t.WriteTimeout}} {
+		if d[1] != "" {
+			lines = append(lines, d[0]+" "+d[1])
+		}
+	}
+	if ka := t.KeepAlive; ka != nil {
+		if ka.Enabled != nil && !*ka.Enabled {
+			lines = append(lines, "keepalive off")
+		} else if ka.IdleConnTimeout != "" {
+			lines = append(lines, "keepalive "+ka.IdleConnTimeout)
+		}
+		if ka.MaxIdleConnsPerHost > 0 {
+			lines = append(lines, fmt.Sprintf("keepalive_idle_conns_per_host %d", ka.MaxIdleConnsPerHost))
+		}
+	}
+	if tls := t.TLS; tls != nil {
+		if !httpsTarget {
+			lines = append(lines, "tls")
+		}
+		if tls.CA != nil && len(tls.CA.PEMFiles) > 0 {
+			lines = append(lines, "tls_trust_pool file "+strings.Join(tls.CA.PEMFiles, " "))
+		}
+		if tls.InsecureSkipVerify {
+			lines = append(lines, "tls_insecure_skip_verify")
+		}
+		if tls.ServerName != "" {
+			lines = append(lines, "tls_server_name "+tls.ServerName)
+		}
+		if tls.ClientCertificateFile != "" {
+			lines = append(lines, fmt.Sprintf("tls_client_auth %s %s", tls.ClientCertificateFile, tls.ClientCertificateKey))
+		}
+	}
+
+	sb.WriteString(indent + "transport http {\n")
+	for _, line := range lines {
+		sb.WriteString(indent + "\t" + line + "\n")
+	}
+	sb.WriteString(indent + "}\n")
+}
+
+// writeHeaderOps writes header operations as header_up or header_down
+// subdirectives, in a stable order
+func writeHeaderOps(sb *strings.Builder, directive string, ops *HeaderOps) {
+	for _, field := range ops.Delete {
+		sb.WriteString(fmt.Sprintf("%s -%s\n", directive, field))
+	}
+	for _, field := range sortedKeys(ops.Set) {
+		sb.WriteString(fmt.Sprintf("%s %s %q\n", directive, field, ops.Set[field][0]))
+	}
+	for _, field := range sortedKeys(ops.Add) {
+		sb.WriteString(fmt.Sprintf("%s +%s %q\n", directive, field, ops.Add[field][0]))
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
 // LoadProxies loads proxy configurations from JSON file
 func LoadProxies(filePath string) ([]config.CaddyProxy, error) {
 	data, err := os.ReadFile(filePath)
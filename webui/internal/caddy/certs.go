@@ -0,0 +1,401 @@
+package caddy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+// tlsIDPrefix tags the tls app entries that belong to a proxy, so they can
+// be found and removed by @id
+const tlsIDPrefix = "tls-"
+
+// CertificateStatus describes the certificate a proxy serves
+type CertificateStatus struct {
+	Source   string     `json:"source"`
+	Subject  string     `json:"subject,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// ErrMixedHTTPS is returned when HTTPS and plain HTTP proxies would be
+// enabled on the same port. Proxies on a port share one Caddy server, whose
+// TLS and redirect settings apply to all of them.
+var ErrMixedHTTPS = errors.New("https and plain http proxies cannot share a port")
+
+// NormalizeHTTPS validates a proxy's HTTPS settings. Tailscale only issues
+// certificates for MagicDNS names.
+func NormalizeHTTPS(proxy *config.CaddyProxy) error {
+	h := proxy.HTTPS
+	if h == nil {
+		return nil
+	}
+
+	h.CertSource = strings.ToLower(strings.TrimSpace(h.CertSource))
+	switch h.CertSource {
+	case "", config.CertSourceTailscale:
+		h.CertSource = config.CertSourceTailscale
+		h.CertFile, h.KeyFile = "", ""
+	case config.CertSourceFiles:
+	default:
+		return fmt.Errorf("invalid certificate source %q: must be tailscale or files", h.CertSource)
+	}
+
+	if !strings.HasSuffix(proxy.Hostname, ".ts.net") {
+		return fmt.Errorf("https requires the proxy's MagicDNS name (*.ts.net) as hostname")
+	}
+	return nil
+}
+
+// CertificateFiles returns where the certificate and key for hostname are
+// kept in dir, using the names `tailscale cert` picks by default
+func CertificateFiles(dir, hostname string) (string, string) {
+	return filepath.Join(dir, hostname+".crt"), filepath.Join(dir, hostname+".key")
+}
+
+// applyTLS replaces a proxy's tls app entry: an automation policy that gets
+// certificates from Tailscale, or the certificate files to load
+func (pm *ProxyManager) applyTLS(proxy config.CaddyProxy) error {
+	if err := pm.removeTLS(proxy.ID); err != nil {
+		return err
+	}
+
+	h := proxy.HTTPS
+	if h == nil || !proxy.Enabled {
+		return nil
+	}
+
+	id := tlsIDPrefix + proxy.ID
+	if h.CertSource == config.CertSourceFiles {
+		return pm.appendConfig("/apps/tls/certificates/load_files", TLSCertificateFile{
+			ID:          id,
+			Certificate: h.CertFile,
+			Key:         h.KeyFile,
+		})
+	}
+	return pm.appendConfig("/apps/tls/automation/policies", TLSPolicy{
+		ID:             id,
+		Subjects:       []string{proxy.Hostname},
+		GetCertificate: []map[string]string{{"via": "tailscale"}},
+	})
+}
+
+// removeTLS removes a proxy's tls app entry if it has one
+func (pm *ProxyManager) removeTLS(proxyID string) error {
+	id := tlsIDPrefix + proxyID
+	if _, err := pm.client.GetByID(id); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get tls entry: %w", err)
+	}
+	if err := pm.client.DeleteByID(id); err != nil {
+		return fmt.Errorf("delete tls entry: %w", err)
+	}
+	return nil
+}
+
+// applyRedirect adds or removes the http_redirect listener wrapper on the
+// server for port, depending on whether an enabled proxy there asks for
+// plain HTTP to be redirected to HTTPS
+func (pm *ProxyManager) applyRedirect(port int) error {
+	proxies, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return fmt.Errorf("load metadata: %w", err)
+	}
+	want := wantsRedirect(proxies, port)
+
+	pm.routeMu.Lock()
+	defer pm.routeMu.Unlock()
+
+	servers, err := pm.listServers()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	name, ok := pm.serverForListen(servers, listenAddress(port))
+	if !ok {
+		return nil
+	}
+
+	current := servers[name].ListenerWrappers
+	wrappers, changed := redirectWrappers(current, want)
+	if !changed {
+		return nil
+	}
+
+	path := serverPath(name) + "/listener_wrappers"
+	switch {
+	case wrappers == nil:
+		return pm.client.DeleteConfig(path)
+	case len(current) == 0:
+		return pm.client.PutConfig(path, wrappers)
+	}
+	return pm.client.PatchConfig(path, wrappers)
+}
+
+// wantsRedirect reports whether an enabled proxy on port asks for plain
+// HTTP to be redirected to HTTPS
+func wantsRedirect(proxies []config.CaddyProxy, port int) bool {
+	for _, p := range proxies {
+		if p.Enabled && p.Port == port && p.HTTPS != nil && p.HTTPS.RedirectHTTP {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPortHTTPS returns ErrMixedHTTPS if the enabled proxies on any of
+// ports mix HTTPS and plain HTTP
+func checkPortHTTPS(proxies []config.CaddyProxy, ports ...int) error {
+	for _, port := range ports {
+		var https, plain *config.CaddyProxy
+		for i, p := range proxies {
+			if !p.Enabled || p.Port != port {
+				continue
+			}
+			if p.HTTPS != nil {
+				https = &proxies[i]
+			} else {
+				plain = &proxies[i]
+			}
+		}
+		if https != nil && plain != nil {
+			return fmt.Errorf("%w: port %d would serve %s over https and %s over plain http",
+				ErrMixedHTTPS, port, https.Hostname, plain.Hostname)
+		}
+	}
+	return nil
+}
+
+// withProxy returns a copy of proxies with proxy added, or replacing the
+// proxy with its ID
+func withProxy(proxies []config.CaddyProxy, proxy config.CaddyProxy) []config.CaddyProxy {
+	out := make([]config.CaddyProxy, 0, len(proxies)+1)
+	for _, p := range proxies {
+		if p.ID != proxy.ID {
+			out = append(out, p)
+		}
+	}
+	return append(out, proxy)
+}
+
+// redirectWrappers returns the listener wrappers a server needs for the
+// redirect setting, and whether they differ from current. It returns nil
+// when no wrappers are left, including a tls wrapper only the redirect
+// needed.
+func redirectWrappers(current []Handler, want bool) ([]Handler, bool) {
+	var wrappers []Handler
+	hasRedirect, hasTLS := false, false
+	for _, w := range current {
+		switch w["wrapper"] {
+		case "http_redirect":
+			hasRedirect = true
+			continue
+		case "tls":
+			hasTLS = true
+		}
+		wrappers = append(wrappers, w)
+	}
+	if want == hasRedirect {
+		return current, false
+	}
+
+	if !want {
+		if len(wrappers) == 1 && hasTLS {
+			return nil, true
+		}
+		return wrappers, true
+	}
+
+	// http_redirect has to see connections before the tls wrapper does
+	wrappers = append([]Handler{{"wrapper": "http_redirect"}}, wrappers...)
+	if !hasTLS {
+		wrappers = append(wrappers, Handler{"wrapper": "tls"})
+	}
+	return wrappers, true
+}
+
+// syncRedirect applies the redirect setting for port, logging failures
+func (pm *ProxyManager) syncRedirect(port int) {
+	if err := pm.applyRedirect(port); err != nil {
+		logger.Warn("caddy", "Failed to update HTTP to HTTPS redirect on port %d: %v", port, err)
+	}
+}
+
+// appendConfig appends items to the array at path, creating the array when
+// it does not exist yet. Caddy would otherwise store a lone item in place of
+// the missing array.
+func (pm *ProxyManager) appendConfig(path string, items ...interface{}) error {
+	data, err := pm.client.GetConfig(path)
+	if err != nil {
+		if isNotFound(err) {
+			return pm.client.PutConfig(path, items)
+		}
+		return err
+	}
+	if strings.TrimSpace(string(data)) == "null" {
+		return pm.client.PatchConfig(path, items)
+	}
+
+	if len(items) == 1 {
+		return pm.client.PostConfig(path, items[0])
+	}
+	return pm.client.PostConfig(path+"/...", items)
+}
+
+// isNotFound reports whether err is Caddy saying a path or @id does not
+// exist
+func isNotFound(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusNotFound ||
+		(httpErr.StatusCode == http.StatusBadRequest && strings.Contains(httpErr.Body, "invalid traversal path"))
+}
+
+// ProbeCertificate reports the certificate a running HTTPS proxy serves on
+// its port. For the files source it falls back to reading the certificate
+// file. It returns nil for proxies without HTTPS.
+func ProbeCertificate(proxy config.CaddyProxy, timeout time.Duration) *CertificateStatus {
+	if proxy.HTTPS == nil {
+		return nil
+	}
+	status := &CertificateStatus{Source: proxy.HTTPS.CertSource}
+
+	// Only the expiry is read, so the chain does not need to verify
+	dialer := &net.Dialer{Timeout: timeout}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(proxy.Port))
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName:         proxy.Hostname,
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		defer conn.Close()
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			status.set(certs[0])
+			return status
+		}
+		err = fmt.Errorf("no certificate presented")
+	}
+
+	if proxy.HTTPS.CertFile != "" {
+		cert, fileErr := readCertificateFile(proxy.HTTPS.CertFile)
+		if fileErr == nil {
+			status.set(cert)
+			return status
+		}
+		logger.Debug("caddy", "Failed to read certificate file for proxy %s: %v", proxy.ID, fileErr)
+	}
+
+	status.Error = err.Error()
+	return status
+}
+
+// ProbeCertificates probes the proxies' certificates concurrently, so the
+// whole check takes at most timeout however many proxies do not answer.
+// Results are keyed by proxy ID; proxies without HTTPS are left out.
+func ProbeCertificates(proxies []config.CaddyProxy, timeout time.Duration) map[string]*CertificateStatus {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		statuses = make(map[string]*CertificateStatus)
+	)
+	for _, proxy := range proxies {
+		if proxy.HTTPS == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(proxy config.CaddyProxy) {
+			defer wg.Done()
+			status := ProbeCertificate(proxy, timeout)
+			mu.Lock()
+			statuses[proxy.ID] = status
+			mu.Unlock()
+		}(proxy)
+	}
+	wg.Wait()
+	return statuses
+}
+
+func (s *CertificateStatus) set(cert *x509.Certificate) {
+	notAfter := cert.NotAfter
+	s.NotAfter = &notAfter
+	s.Subject = cert.Subject.CommonName
+	if len(cert.DNSNames) > 0 {
+		s.Subject = cert.DNSNames[0]
+	}
+}
+
+// CertificatesDue lists the enabled proxies that load certificate files
+// whose certificate expires within the given time or cannot be read. Caddy
+// does not fetch these from Tailscale itself, so they must be renewed.
+func (pm *ProxyManager) CertificatesDue(within time.Duration) ([]config.CaddyProxy, error) {
+	proxies, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata: %w", err)
+	}
+
+	var due []config.CaddyProxy
+	for _, proxy := range proxies {
+		if !proxy.Enabled || proxy.HTTPS == nil || proxy.HTTPS.CertSource != config.CertSourceFiles {
+			continue
+		}
+		cert, err := readCertificateFile(proxy.HTTPS.CertFile)
+		if err != nil {
+			logger.Debug("caddy", "Certificate for proxy %s unreadable, renewing: %v", proxy.ID, err)
+			due = append(due, proxy)
+			continue
+		}
+		if time.Until(cert.NotAfter) < within {
+			due = append(due, proxy)
+		}
+	}
+	return due, nil
+}
+
+// ReloadCertificate re-applies a proxy's tls entry, which makes Caddy load
+// its certificate files again after they were renewed
+func (pm *ProxyManager) ReloadCertificate(id string) error {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+
+	proxy, err := GetProxyMetadata(pm.metadataPath, id)
+	if err != nil {
+		return fmt.Errorf("get proxy: %w", err)
+	}
+	if !proxy.Enabled || proxy.HTTPS == nil || proxy.HTTPS.CertSource != config.CertSourceFiles {
+		return nil
+	}
+	if err := pm.applyTLS(*proxy); err != nil {
+		return fmt.Errorf("apply tls: %w", err)
+	}
+	logger.Info("caddy", "Reloaded certificate files for proxy %s", id)
+	return nil
+}
+
+// readCertificateFile parses the first certificate in a PEM file
+func readCertificateFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,251 @@
+package caddy
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// TestApplyTLS_ManagesPoliciesAndRedirect verifies that HTTPS proxies get a
+// tls app entry and that the redirect wrapper follows the proxies asking
+// for it.
+func TestApplyTLS_ManagesPoliciesAndRedirect(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	a := config.CaddyProxy{
+		ID: "a", Hostname: "box.tail1234.ts.net", Port: 8443, Target: "localhost:1", Enabled: true,
+		HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale, RedirectHTTP: true},
+	}
+	b := config.CaddyProxy{
+		ID: "b", Hostname: "box.tail1234.ts.net", Port: 9443, Target: "localhost:2", Enabled: true,
+		HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceFiles, CertFile: "/data/box.crt", KeyFile: "/data/box.key"},
+	}
+	for _, p := range []config.CaddyProxy{a, b} {
+		if _, err := pm.AddProxy(p); err != nil {
+			t.Fatalf("AddProxy(%s) returned unexpected error: %v", p.ID, err)
+		}
+	}
+
+	var policy TLSPolicy
+	data, err := pm.client.GetByID(tlsIDPrefix + "a")
+	if err != nil {
+		t.Fatalf("GetByID() returned unexpected error: %v", err)
+	}
+	json.Unmarshal(data, &policy)
+	if len(policy.Subjects) != 1 || policy.Subjects[0] != a.Hostname || len(policy.GetCertificate) != 1 || policy.GetCertificate[0]["via"] != "tailscale" {
+		t.Errorf("policy = %+v, want tailscale policy for %s", policy, a.Hostname)
+	}
+
+	var files TLSCertificateFile
+	data, err = pm.client.GetByID(tlsIDPrefix + "b")
+	if err != nil {
+		t.Fatalf("GetByID() returned unexpected error: %v", err)
+	}
+	json.Unmarshal(data, &files)
+	if files.Certificate != "/data/box.crt" || files.Key != "/data/box.key" {
+		t.Errorf("load_files entry = %+v", files)
+	}
+
+	wrappers := func(port int) []string {
+		servers, err := pm.listServers()
+		if err != nil {
+			t.Fatalf("listServers() returned unexpected error: %v", err)
+		}
+		name, ok := pm.serverForListen(servers, listenAddress(port))
+		if !ok {
+			t.Fatalf("no server listens on %d", port)
+		}
+		var out []string
+		for _, w := range servers[name].ListenerWrappers {
+			out = append(out, w["wrapper"].(string))
+		}
+		return out
+	}
+	if got := wrappers(8443); len(got) != 2 || got[0] != "http_redirect" || got[1] != "tls" {
+		t.Errorf("listener wrappers on 8443 = %v, want [http_redirect tls]", got)
+	}
+	if got := wrappers(9443); len(got) != 0 {
+		t.Errorf("listener wrappers on 9443 = %v, want none", got)
+	}
+
+	// Turning HTTPS off removes the policy and the redirect
+	a.HTTPS = nil
+	if err := pm.UpdateProxy(a); err != nil {
+		t.Fatalf("UpdateProxy() returned unexpected error: %v", err)
+	}
+	if _, err := pm.client.GetByID(tlsIDPrefix + "a"); !isNotFound(err) {
+		t.Errorf("GetByID() after disabling HTTPS: err = %v, want not found", err)
+	}
+	if got := wrappers(8443); len(got) != 0 {
+		t.Errorf("listener wrappers on 8443 = %v, want none", got)
+	}
+
+	if err := pm.DeleteProxy("b"); err != nil {
+		t.Fatalf("DeleteProxy() returned unexpected error: %v", err)
+	}
+	if _, err := pm.client.GetByID(tlsIDPrefix + "b"); !isNotFound(err) {
+		t.Errorf("GetByID() after delete: err = %v, want not found", err)
+	}
+}
+
+func TestNormalizeHTTPS(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		https    config.ProxyHTTPS
+		want     string
+		wantErr  bool
+	}{
+		{name: "defaults to tailscale", hostname: "box.tail1.ts.net", want: config.CertSourceTailscale},
+		{name: "tailscale drops files", hostname: "box.tail1.ts.net", https: config.ProxyHTTPS{CertSource: "Tailscale", CertFile: "x"}, want: config.CertSourceTailscale},
+		{name: "files", hostname: "box.tail1.ts.net", https: config.ProxyHTTPS{CertSource: "files"}, want: config.CertSourceFiles},
+		{name: "unknown source", hostname: "box.tail1.ts.net", https: config.ProxyHTTPS{CertSource: "acme"}, wantErr: true},
+		{name: "not a MagicDNS name", hostname: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			https := tt.https
+			proxy := config.CaddyProxy{Hostname: tt.hostname, HTTPS: &https}
+			err := NormalizeHTTPS(&proxy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeHTTPS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (proxy.HTTPS.CertSource != tt.want || (tt.want == config.CertSourceTailscale && proxy.HTTPS.CertFile != "")) {
+				t.Errorf("HTTPS = %+v, want source %s", proxy.HTTPS, tt.want)
+			}
+		})
+	}
+}
+
+// TestProbeCertificate verifies that the served certificate is reported, and
+// that the certificate file is read when nothing is listening.
+func TestProbeCertificate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, portStr, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	served := srv.Certificate()
+
+	proxy := config.CaddyProxy{ID: "a", Hostname: "example.com", Port: port, HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale}}
+	status := ProbeCertificate(proxy, time.Second)
+	if status == nil || status.Error != "" || status.NotAfter == nil || !status.NotAfter.Equal(served.NotAfter) {
+		t.Fatalf("ProbeCertificate() = %+v, want expiry %v", status, served.NotAfter)
+	}
+
+	// Nothing listens once the server is closed, so the file is used
+	certFile := filepath.Join(t.TempDir(), "box.crt")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: served.Raw})
+	if err := os.WriteFile(certFile, pemData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	proxy.HTTPS = &config.ProxyHTTPS{CertSource: config.CertSourceFiles, CertFile: certFile}
+	status = ProbeCertificate(proxy, time.Second)
+	if status == nil || status.Error != "" || status.NotAfter == nil || !status.NotAfter.Equal(served.NotAfter) {
+		t.Errorf("ProbeCertificate() from file = %+v, want expiry %v", status, served.NotAfter)
+	}
+
+	proxy.HTTPS.CertFile = ""
+	if status = ProbeCertificate(proxy, time.Second); status == nil || status.Error == "" {
+		t.Errorf("ProbeCertificate() = %+v, want an error", status)
+	}
+
+	proxy.HTTPS = nil
+	if status = ProbeCertificate(proxy, time.Second); status != nil {
+		t.Errorf("ProbeCertificate() without HTTPS = %+v, want nil", status)
+	}
+}
+
+// TestCertificatesDue verifies that certificate files expiring within the
+// renewal window, or missing, are due and that other sources are not
+func TestCertificatesDue(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsSrv.Close()
+	served := tlsSrv.Certificate()
+	certFile := filepath.Join(t.TempDir(), "a.crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: served.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	proxies := []config.CaddyProxy{
+		{ID: "a", Hostname: "a.tail.ts.net", Port: 8443, Enabled: true, HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceFiles, CertFile: certFile}},
+		{ID: "b", Hostname: "b.tail.ts.net", Port: 8443, Enabled: true, HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceFiles, CertFile: certFile + ".missing"}},
+		{ID: "c", Hostname: "c.tail.ts.net", Port: 8443, Enabled: true, HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale}},
+		{ID: "d", Hostname: "d.tail.ts.net", Port: 8443, Enabled: false, HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceFiles}},
+	}
+	if err := SaveProxyMetadata(pm.metadataPath, proxies); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(within time.Duration) []string {
+		t.Helper()
+		due, err := pm.CertificatesDue(within)
+		if err != nil {
+			t.Fatalf("CertificatesDue() returned unexpected error: %v", err)
+		}
+		var ids []string
+		for _, proxy := range due {
+			ids = append(ids, proxy.ID)
+		}
+		return ids
+	}
+	if got := ids(30 * 24 * time.Hour); len(got) != 1 || got[0] != "b" {
+		t.Errorf("CertificatesDue(30 days) = %v, want [b]", got)
+	}
+	if got := ids(time.Until(served.NotAfter) + time.Hour); len(got) != 2 || got[0] != "a" {
+		t.Errorf("CertificatesDue(past expiry) = %v, want [a b]", got)
+	}
+}
+
+// TestProbeCertificates verifies that ports that never answer the TLS
+// handshake are probed together rather than one timeout after another
+func TestProbeCertificates(t *testing.T) {
+	// Accepts connections but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	var proxies []config.CaddyProxy
+	for _, id := range []string{"a", "b", "c", "d"} {
+		proxies = append(proxies, config.CaddyProxy{ID: id, Hostname: id + ".tail.ts.net", Port: port, HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale}})
+	}
+	proxies = append(proxies, config.CaddyProxy{ID: "plain", Port: port})
+
+	start := time.Now()
+	statuses := ProbeCertificates(proxies, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("ProbeCertificates() took %v, want about one timeout", elapsed)
+	}
+	if len(statuses) != 4 || statuses["a"] == nil || statuses["a"].Error == "" || statuses["plain"] != nil {
+		t.Errorf("ProbeCertificates() = %+v, want an error for each HTTPS proxy", statuses)
+	}
+}
@@ -0,0 +1,81 @@
+package caddy
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// Export is the managed proxies as a Caddyfile and as the part of the
+// running JSON config that serves them. The Caddyfile is rendered from the
+// metadata, so it only matches the running config while there is no drift.
+type Export struct {
+	Caddyfile string                 `json:"caddyfile"`
+	Config    map[string]interface{} `json:"config"`
+	InSync    bool                   `json:"in_sync"`
+	Drift     []DriftEvent           `json:"drift,omitempty"` // how the running config differs from the metadata
+}
+
+// Export renders every managed proxy as a Caddyfile and takes the servers,
+// routes and tls entries of the running config that belong to them
+func (pm *ProxyManager) Export() (*Export, error) {
+	plan, err := pm.newPlan()
+	if err != nil {
+		return nil, err
+	}
+	drift, err := pm.detectDrift()
+	if err != nil {
+		return nil, fmt.Errorf("detect drift: %w", err)
+	}
+
+	return &Export{
+		Caddyfile: pm.GenerateCaddyfile(plan.proxies),
+		Config:    managedConfig(plan.root, plan.proxies),
+		InSync:    len(drift) == 0,
+		Drift:     drift,
+	}, nil
+}
+
+// managedConfig returns the part of a config decoded from JSON that serves
+// proxies: their routes, the servers holding them and their tls entries.
+// Servers keep their other settings, such as listener wrappers.
+func managedConfig(root map[string]interface{}, proxies []config.CaddyProxy) map[string]interface{} {
+	plan := &configPlan{root: root}
+	ids := make(map[string]bool, len(proxies))
+	for _, proxy := range proxies {
+		ids[proxy.ID] = true
+		ids[tlsIDPrefix+proxy.ID] = true
+	}
+	managed := func(item interface{}) bool {
+		entry, _ := item.(map[string]interface{})
+		id, _ := entry["@id"].(string)
+		return ids[id]
+	}
+
+	out := &configPlan{root: map[string]interface{}{}}
+	for name, raw := range plan.object(false, "apps", "http", "servers") {
+		server, _ := raw.(map[string]interface{})
+		routes, _ := server["routes"].([]interface{})
+		routes = slices.DeleteFunc(slices.Clone(routes), func(route interface{}) bool { return !managed(route) })
+		if len(routes) == 0 {
+			continue
+		}
+		copied := make(map[string]interface{}, len(server))
+		for key, value := range server {
+			copied[key] = value
+		}
+		copied["routes"] = routes
+		out.object(true, "apps", "http", "servers")[name] = copied
+	}
+
+	for _, path := range tlsEntryPaths {
+		parent, key := plan.object(false, path[:len(path)-1]...), path[len(path)-1]
+		items, _ := parent[key].([]interface{})
+		items = slices.DeleteFunc(slices.Clone(items), func(item interface{}) bool { return !managed(item) })
+		if len(items) > 0 {
+			out.object(true, path[:len(path)-1]...)[key] = items
+		}
+	}
+	return out.root
+}
@@ -0,0 +1,169 @@
+package caddy
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// TestExport verifies that the export holds only the managed part of the
+// running config, renders the Caddyfile like buildRoute and reports drift
+func TestExport(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+	pm.SetSitesDir("/srv/sites")
+
+	for _, p := range []config.CaddyProxy{
+		{ID: "a", Hostname: "a.example", Port: 8443, Target: "https://localhost:1", Enabled: true, CustomHeaders: map[string]string{"X-App": "a"}},
+		{ID: "b", Hostname: "b.example", Port: 8443, Type: config.ProxyTypeFileServer, FileServer: &config.ProxyFileServer{Root: "b"}, Enabled: true},
+		{ID: "c", Hostname: "c.example", Port: 9000, Target: "localhost:3", TLSCertFile: "/data/ca.pem", Enabled: false},
+		{ID: "d", Hostname: "d.example", Port: 8443, Target: "localhost:4", Enabled: true,
+			Access: &config.ProxyAccess{AllowedUsers: []string{"alice@example.com"}}, IPFilter: &config.ProxyIPFilter{Deny: []string{"10.0.0.0/8"}}},
+	} {
+		if _, err := pm.AddProxy(p); err != nil {
+			t.Fatalf("AddProxy(%s) returned unexpected error: %v", p.ID, err)
+		}
+	}
+	// A route Caddy serves that no proxy manages
+	if err := pm.client.PostConfig(serverPath(pm.serverMap.ByProxyID["a"])+"/routes", Route{Handle: []Handler{{"handler": "static_response"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := pm.Export()
+	if err != nil {
+		t.Fatalf("Export() returned unexpected error: %v", err)
+	}
+	if !export.InSync || len(export.Drift) != 0 {
+		t.Errorf("Export() drift = %+v, want in sync", export.Drift)
+	}
+
+	servers, _ := export.Config["apps"].(map[string]interface{})["http"].(map[string]interface{})["servers"].(map[string]interface{})
+	if len(servers) != 1 {
+		t.Fatalf("exported servers = %+v, want only the :8443 server", servers)
+	}
+	for _, server := range servers {
+		routes := server.(map[string]interface{})["routes"].([]interface{})
+		if len(routes) != 3 || routes[0].(map[string]interface{})["@id"] != "a" || routes[1].(map[string]interface{})["@id"] != "b" {
+			t.Errorf("exported routes = %+v, want the routes of a, b and d", routes)
+		}
+	}
+
+	for _, want := range []string{
+		"a.example:8443 {",
+		"\treverse_proxy https://localhost:1 {",
+		"\t\theader_up Host \"{http.reverse_proxy.upstream.hostport}\"",
+		"\t\theader_up X-App \"a\"",
+		"\t\troot * /srv/sites/b",
+	} {
+		if !strings.Contains(export.Caddyfile, want+"\n") {
+			t.Errorf("Caddyfile is missing %q:\n%s", want, export.Caddyfile)
+		}
+	}
+	for _, unwanted := range []string{"tls_insecure_skip_verify", "c.example"} {
+		if strings.Contains(export.Caddyfile, unwanted) {
+			t.Errorf("Caddyfile contains %q:\n%s", unwanted, export.Caddyfile)
+		}
+	}
+
+	// Caddy reorders top-level directives, so an access-controlled site
+	// keeps the JSON route's order in a route block: address filters, then
+	// dropping client identity headers, then forward_auth, then the proxy
+	site := export.Caddyfile[strings.Index(export.Caddyfile, "d.example:8443 {"):]
+	site = site[:strings.Index(site, "\n}\n")]
+	last := -1
+	for _, want := range []string{
+		"\troute {\n",
+		"\t\t@ip_denied remote_ip 10.0.0.0/8\n",
+		"\t\trequest_header -" + HeaderUserLogin + "\n",
+		"\t\tforward_auth 127.0.0.1:8021 {\n",
+		"\t\t\tcopy_headers " + HeaderUserLogin + " " + HeaderUserName + "\n",
+		"\t\treverse_proxy localhost:4 {\n",
+	} {
+		i := strings.Index(site, want)
+		if i <= last {
+			t.Errorf("access-controlled site has %q missing or out of order:\n%s", want, site)
+		}
+		last = i
+	}
+
+	a, _ := GetProxyMetadata(pm.metadataPath, "a")
+	a.Target = "localhost:99"
+	if err := UpdateProxyMetadata(pm.metadataPath, *a); err != nil {
+		t.Fatal(err)
+	}
+	if export, err = pm.Export(); err != nil || export.InSync || len(export.Drift) != 1 {
+		t.Errorf("Export() after metadata changed = %+v, %v; want a's drift", export, err)
+	}
+}
+
+// TestWriteTransport verifies that the Caddyfile transport matches the
+// JSON one: a trusted CA file, and no transport when Caddy's defaults apply
+func TestWriteTransport(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy config.CaddyProxy
+		want  string
+	}{
+		{"https target", config.CaddyProxy{Target: "https://localhost:1"}, ""},
+		{"ca file", config.CaddyProxy{Target: "localhost:1", TLSCertFile: "/data/ca.pem"},
+			"transport http {\n\ttls\n\ttls_trust_pool file /data/ca.pem\n}\n"},
+		{"skip verify", config.CaddyProxy{Target: "https://localhost:1", Transport: &config.ProxyTransport{InsecureSkipVerify: true, DialTimeout: "5s"}},
+			"transport http {\n\tdial_timeout 5s\n\ttls_insecure_skip_verify\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			writeTransport(&sb, "", buildTransport(tt.proxy), tt.proxy.UpstreamList())
+			if sb.String() != tt.want {
+				t.Errorf("writeTransport() = %q, want %q", sb.String(), tt.want)
+			}
+		})
+	}
+}
+
+// TestSyncCaddyfile verifies that the Caddyfile set with SetCaddyfilePath
+// follows proxy changes
+func TestSyncCaddyfile(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+	path := filepath.Join(t.TempDir(), "caddy", "Caddyfile")
+	pm.SetCaddyfilePath(path)
+
+	read := func() string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read Caddyfile: %v", err)
+		}
+		return string(data)
+	}
+
+	if _, err := pm.AddProxy(config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true}); err != nil {
+		t.Fatalf("AddProxy() returned unexpected error: %v", err)
+	}
+	if !strings.Contains(read(), "a.example:8443 {") {
+		t.Errorf("Caddyfile after AddProxy:\n%s", read())
+	}
+
+	if _, err := pm.ApplyBatch([]BatchOp{{Op: BatchCreate, Proxy: &config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2", Enabled: true}}}, "", false); err != nil {
+		t.Fatalf("ApplyBatch() returned unexpected error: %v", err)
+	}
+	if !strings.Contains(read(), "b.example:8443 {") {
+		t.Errorf("Caddyfile after ApplyBatch:\n%s", read())
+	}
+
+	if err := pm.DeleteProxy("a"); err != nil {
+		t.Fatalf("DeleteProxy() returned unexpected error: %v", err)
+	}
+	if got := read(); strings.Contains(got, "a.example") || !strings.Contains(got, "b.example") {
+		t.Errorf("Caddyfile after DeleteProxy:\n%s", got)
+	}
+}
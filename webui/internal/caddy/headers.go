@@ -0,0 +1,265 @@
+package caddy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// headerPresetOrder lists the presets in the order they are stored and
+// applied
+var headerPresetOrder = []string{
+	config.HeaderPresetHSTS,
+	config.HeaderPresetFrameAncestors,
+	config.HeaderPresetNoSniff,
+	config.HeaderPresetCORS,
+}
+
+// headerPresetFields maps each preset to the response header it sets
+var headerPresetFields = map[string]string{
+	config.HeaderPresetHSTS:           "Strict-Transport-Security",
+	config.HeaderPresetFrameAncestors: "Content-Security-Policy",
+	config.HeaderPresetNoSniff:        "X-Content-Type-Options",
+	config.HeaderPresetCORS:           "Access-Control-Allow-Origin",
+}
+
+// headerPresetValue returns the value a preset sets
+func headerPresetValue(headers *config.ProxyHeaders, preset string) string {
+	switch preset {
+	case config.HeaderPresetHSTS:
+		return "max-age=31536000; includeSubDomains"
+	case config.HeaderPresetFrameAncestors:
+		return "frame-ancestors 'self'"
+	case config.HeaderPresetNoSniff:
+		return "nosniff"
+	case config.HeaderPresetCORS:
+		if headers.CORSOrigin != "" {
+			return headers.CORSOrigin
+		}
+		return "*"
+	}
+	return ""
+}
+
+// NormalizeHeaders validates a proxy's header rules. Request headers to set
+// are kept in CustomHeaders, so request set rules are moved there. Header
+// names are canonicalized and presets are put in their fixed order.
+func NormalizeHeaders(proxy *config.CaddyProxy) error {
+	h := proxy.Headers
+	if h == nil {
+		return nil
+	}
+
+	enabled := make(map[string]bool)
+	for _, preset := range h.Presets {
+		preset = strings.ToLower(strings.TrimSpace(preset))
+		if _, ok := headerPresetFields[preset]; !ok {
+			return fmt.Errorf("unknown header preset %q: must be hsts, frame_ancestors, nosniff or cors", preset)
+		}
+		enabled[preset] = true
+	}
+	h.Presets = nil
+	for _, preset := range headerPresetOrder {
+		if enabled[preset] {
+			h.Presets = append(h.Presets, preset)
+		}
+	}
+	h.CORSOrigin = strings.TrimSpace(h.CORSOrigin)
+	if !enabled[config.HeaderPresetCORS] || h.CORSOrigin == "*" {
+		h.CORSOrigin = ""
+	}
+
+	if r := h.Request; r != nil {
+		for field, value := range r.Set {
+			if proxy.CustomHeaders == nil {
+				proxy.CustomHeaders = make(map[string]string)
+			}
+			proxy.CustomHeaders[http.CanonicalHeaderKey(strings.TrimSpace(field))] = value
+		}
+		r.Set = nil
+	}
+	h.Request = normalizeHeaderRules(h.Request)
+	h.Response = normalizeHeaderRules(h.Response)
+
+	if h.Request == nil && h.Response == nil && len(h.Presets) == 0 {
+		proxy.Headers = nil
+	}
+	return nil
+}
+
+// normalizeHeaderRules canonicalizes header names and returns nil for rules
+// without any operation
+func normalizeHeaderRules(rules *config.HeaderRules) *config.HeaderRules {
+	if rules == nil {
+		return nil
+	}
+	canonical := func(in map[string]string) map[string]string {
+		if len(in) == 0 {
+			return nil
+		}
+		out := make(map[string]string, len(in))
+		for field, value := range in {
+			if field = strings.TrimSpace(field); field != "" {
+				out[http.CanonicalHeaderKey(field)] = value
+			}
+		}
+		return out
+	}
+	rules.Set = canonical(rules.Set)
+	rules.Add = canonical(rules.Add)
+
+	deletes := make([]string, len(rules.Delete))
+	for i, field := range rules.Delete {
+		deletes[i] = http.CanonicalHeaderKey(strings.TrimSpace(field))
+	}
+	rules.Delete = uniqueTrimmed(deletes)
+
+	if len(rules.Set) == 0 && len(rules.Add) == 0 && len(rules.Delete) == 0 {
+		return nil
+	}
+	return rules
+}
+
+// buildHeaderConfig builds the reverse_proxy headers block: the upstream
+// Host, custom and request rules going up, and response rules and presets
+// coming down
+func buildHeaderConfig(proxy config.CaddyProxy) HeaderConfig {
+	headers := HeaderConfig{
+		Request: &HeaderOps{
+			Set: map[string][]string{
+				"Host": {"{http.reverse_proxy.upstream.hostport}"},
+			},
+		},
+	}
+	for key, value := range proxy.CustomHeaders {
+		headers.Request.Set[key] = []string{value}
+	}
+
+	h := proxy.Headers
+	if h == nil {
+		return headers
+	}
+	if r := h.Request; r != nil {
+		headers.Request.Add = headerValues(r.Add)
+		headers.Request.Delete = r.Delete
+	}
+
+	response := &HeaderOps{}
+	for _, preset := range h.Presets {
+		if response.Set == nil {
+			response.Set = make(map[string][]string)
+		}
+		response.Set[headerPresetFields[preset]] = []string{headerPresetValue(h, preset)}
+	}
+	if r := h.Response; r != nil {
+		// Explicit rules win over presets for the same header
+		for field, value := range r.Set {
+			if response.Set == nil {
+				response.Set = make(map[string][]string)
+			}
+			response.Set[field] = []string{value}
+		}
+		response.Add = headerValues(r.Add)
+		response.Delete = r.Delete
+	}
+	if response.Set != nil || response.Add != nil || response.Delete != nil {
+		headers.Response = response
+	}
+	return headers
+}
+
+func headerValues(in map[string]string) map[string][]string {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string][]string, len(in))
+	for field, value := range in {
+		out[field] = []string{value}
+	}
+	return out
+}
+
+// parseHeaderConfig reads a reverse_proxy headers block decoded from Caddy's
+// JSON config back into a proxy. Response headers holding a preset's value
+// are read back as that preset.
+func parseHeaderConfig(raw map[string]interface{}, proxy *config.CaddyProxy) {
+	h := &config.ProxyHeaders{}
+
+	if request, ok := raw["request"].(map[string]interface{}); ok {
+		set := parseHeaderValues(request["set"])
+		for field := range set {
+			if strings.EqualFold(field, "Host") {
+				delete(set, field)
+			}
+		}
+		if len(set) > 0 {
+			proxy.CustomHeaders = set
+		}
+		h.Request = &config.HeaderRules{
+			Add:    parseHeaderValues(request["add"]),
+			Delete: parseHeaderNames(request["delete"]),
+		}
+	}
+
+	if response, ok := raw["response"].(map[string]interface{}); ok {
+		set := parseHeaderValues(response["set"])
+		for _, preset := range headerPresetOrder {
+			field := headerPresetFields[preset]
+			value, ok := set[field]
+			if !ok {
+				continue
+			}
+			if preset == config.HeaderPresetCORS {
+				if value != "*" {
+					h.CORSOrigin = value
+				}
+			} else if value != headerPresetValue(h, preset) {
+				continue
+			}
+			h.Presets = append(h.Presets, preset)
+			delete(set, field)
+		}
+		h.Response = &config.HeaderRules{
+			Set:    set,
+			Add:    parseHeaderValues(response["add"]),
+			Delete: parseHeaderNames(response["delete"]),
+		}
+	}
+
+	if len(h.Presets) == 0 {
+		h.Presets = nil
+	}
+	h.Request = normalizeHeaderRules(h.Request)
+	h.Response = normalizeHeaderRules(h.Response)
+	if h.Request != nil || h.Response != nil || h.Presets != nil {
+		proxy.Headers = h
+	}
+}
+
+// parseHeaderValues reads a decoded header map, keeping the first value of
+// each field
+func parseHeaderValues(v interface{}) map[string]string {
+	raw, _ := v.(map[string]interface{})
+	out := make(map[string]string)
+	for field, val := range raw {
+		if values, ok := val.([]interface{}); ok && len(values) > 0 {
+			if value, ok := values[0].(string); ok {
+				out[field] = value
+			}
+		}
+	}
+	return out
+}
+
+func parseHeaderNames(v interface{}) []string {
+	raw, _ := v.([]interface{})
+	var out []string
+	for _, field := range raw {
+		if s, ok := field.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package caddy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// defaultFailDuration enables passive health checks when a proxy sets
+// passive options without saying how long failures are remembered; Caddy
+// treats a zero fail_duration as "passive checks off"
+const defaultFailDuration = "30s"
+
+// ProxyUpstream is the live state of one of a proxy's upstreams
+type ProxyUpstream struct {
+	Address     string `json:"address"`
+	NumRequests int    `json:"num_requests"`
+	Fails       int    `json:"fails"`
+	Healthy     bool   `json:"healthy"`
+}
+
+// NormalizeHealthChecks validates a proxy's health check settings and fills
+// in defaults. Empty sections are dropped.
+func NormalizeHealthChecks(proxy *config.CaddyProxy) error {
+	hc := proxy.HealthChecks
+	if hc == nil {
+		return nil
+	}
+
+	if a := hc.Active; a != nil {
+		a.URI = strings.TrimSpace(a.URI)
+		if *a == (config.ProxyActiveHealthCheck{}) {
+			hc.Active = nil
+		} else {
+			if !strings.HasPrefix(a.URI, "/") {
+				return fmt.Errorf("health check uri must start with /")
+			}
+			if a.ExpectStatus != 0 && (a.ExpectStatus < 100 || a.ExpectStatus > 599) {
+				return fmt.Errorf("invalid expected status %d", a.ExpectStatus)
+			}
+			if a.ExpectBody != "" {
+				if _, err := regexp.Compile(a.ExpectBody); err != nil {
+					return fmt.Errorf("invalid expected body pattern: %w", err)
+				}
+			}
+			if err := validateDurations(map[string]string{"interval": a.Interval, "timeout": a.Timeout}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p := hc.Passive; p != nil {
+		if *p == (config.ProxyPassiveHealthCheck{}) {
+			hc.Passive = nil
+		} else {
+			if p.MaxFails < 0 {
+				return fmt.Errorf("max_fails must not be negative")
+			}
+			if err := validateDurations(map[string]string{"fail_duration": p.FailDuration, "unhealthy_latency": p.UnhealthyLatency}); err != nil {
+				return err
+			}
+			if p.FailDuration == "" {
+				p.FailDuration = defaultFailDuration
+			}
+		}
+	}
+
+	if hc.Active == nil && hc.Passive == nil {
+		proxy.HealthChecks = nil
+	}
+	return nil
+}
+
+// validateDurations checks that each named value is empty or a valid,
+// non-negative duration
+func validateDurations(values map[string]string) error {
+	for name, value := range values {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q: must be a duration such as 5s", name, value)
+		}
+	}
+	return nil
+}
+
+// buildHealthChecks converts a proxy's health check settings to the
+// reverse_proxy health_checks block
+func buildHealthChecks(hc *config.ProxyHealthChecks) *HealthChecks {
+	if hc == nil || (hc.Active == nil && hc.Passive == nil) {
+		return nil
+	}
+
+	out := &HealthChecks{}
+	if a := hc.Active; a != nil {
+		out.Active = &ActiveHealthChecks{
+			URI:          a.URI,
+			Interval:     a.Interval,
+			Timeout:      a.Timeout,
+			ExpectStatus: a.ExpectStatus,
+			ExpectBody:   a.ExpectBody,
+		}
+	}
+	if p := hc.Passive; p != nil {
+		out.Passive = &PassiveHealthChecks{
+			FailDuration:     p.FailDuration,
+			MaxFails:         p.MaxFails,
+			UnhealthyLatency: p.UnhealthyLatency,
+		}
+	}
+	return out
+}
+
+// parseHealthChecks reads a reverse_proxy health_checks block decoded from
+// Caddy's JSON config
+func parseHealthChecks(raw map[string]interface{}) *config.ProxyHealthChecks {
+	hc := &config.ProxyHealthChecks{}
+
+	if active, ok := raw["active"].(map[string]interface{}); ok {
+		a := &config.ProxyActiveHealthCheck{
+			Interval: durationString(active["interval"]),
+			Timeout:  durationString(active["timeout"]),
+		}
+		// Older Caddy versions call the field "path"
+		if uri, ok := active["uri"].(string); ok {
+			a.URI = uri
+		} else if path, ok := active["path"].(string); ok {
+			a.URI = path
+		}
+		if status, ok := active["expect_status"].(float64); ok {
+			a.ExpectStatus = int(status)
+		}
+		if body, ok := active["expect_body"].(string); ok {
+			a.ExpectBody = body
+		}
+		hc.Active = a
+	}
+
+	if passive, ok := raw["passive"].(map[string]interface{}); ok {
+		p := &config.ProxyPassiveHealthCheck{
+			FailDuration:     durationString(passive["fail_duration"]),
+			UnhealthyLatency: durationString(passive["unhealthy_latency"]),
+		}
+		if maxFails, ok := passive["max_fails"].(float64); ok {
+			p.MaxFails = int(maxFails)
+		}
+		hc.Passive = p
+	}
+
+	if hc.Active == nil && hc.Passive == nil {
+		return nil
+	}
+	return hc
+}
+
+// JoinUpstreams matches Caddy's upstream statuses to each proxy's
+// configured upstreams, including those of its path rules, keyed by proxy ID. Caddy tracks upstreams by dial
+// address, so proxies sharing an upstream see the same counters. Caddy only
+// reports passive failure counts: an upstream is considered unhealthy once
+// its recent failures reach the proxy's max_fails (default 1).
+func JoinUpstreams(proxies []config.CaddyProxy, statuses []UpstreamStatus) map[string][]ProxyUpstream {
+	byAddress := make(map[string]UpstreamStatus, len(statuses))
+	for _, s := range statuses {
+		byAddress[s.Address] = s
+	}
+
+	joined := make(map[string][]ProxyUpstream, len(proxies))
+	for _, proxy := range proxies {
+		maxFails := 1
+		if hc := proxy.HealthChecks; hc != nil && hc.Passive != nil && hc.Passive.MaxFails > 0 {
+			maxFails = hc.Passive.MaxFails
+		}
+
+		addresses := append([]string{}, proxy.UpstreamList()...)
+		for _, rule := range proxy.Routes {
+			addresses = append(addresses, rule.Upstreams...)
+		}
+
+		upstreams := make([]ProxyUpstream, 0, len(addresses))
+		for _, address := range uniqueTrimmed(addresses) {
+			status := byAddress[address]
+			upstreams = append(upstreams, ProxyUpstream{
+				Address:     address,
+				NumRequests: status.NumRequests,
+				Fails:       status.Fails,
+				Healthy:     status.Fails < maxFails,
+			})
+		}
+		joined[proxy.ID] = upstreams
+	}
+	return joined
+}
@@ -0,0 +1,219 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// ImportCandidate is a site from an imported Caddyfile that maps to a proxy
+type ImportCandidate struct {
+	Key      string            `json:"key"` // hostname:port, for picking sites to import
+	Proxy    config.CaddyProxy `json:"proxy"`
+	Warnings []string          `json:"warnings,omitempty"` // parts of the site the proxy leaves out
+	Conflict string            `json:"conflict,omitempty"` // ID of the proxy already serving hostname:port
+}
+
+// ImportSkipped is a part of an imported Caddyfile that no proxy can
+// represent
+type ImportSkipped struct {
+	Path   string `json:"path"` // where it is in the adapted JSON config
+	Reason string `json:"reason"`
+}
+
+// ImportReport lists what a Caddyfile would import as
+type ImportReport struct {
+	Candidates []ImportCandidate `json:"candidates"`
+	Skipped    []ImportSkipped   `json:"skipped"`
+	Warnings   []string          `json:"warnings,omitempty"` // from Caddy's adapter
+}
+
+// ImportCaddyfile adapts a Caddyfile with Caddy's /adapt endpoint and maps
+// each site to a proxy the way routes in the running config are read.
+// Nothing is imported; the candidates are created with ApplyBatch.
+func (pm *ProxyManager) ImportCaddyfile(caddyfile []byte) (*ImportReport, error) {
+	adapted, warnings, err := pm.client.Adapt(caddyfile, "text/caddyfile")
+	if err != nil {
+		return nil, fmt.Errorf("adapt caddyfile: %w", err)
+	}
+
+	var root struct {
+		Apps map[string]json.RawMessage `json:"apps"`
+	}
+	if err := json.Unmarshal(adapted, &root); err != nil {
+		return nil, fmt.Errorf("parse adapted config: %w", err)
+	}
+	var httpApp struct {
+		Servers map[string]*HTTPServer `json:"servers"`
+	}
+	if raw, ok := root.Apps["http"]; ok {
+		if err := json.Unmarshal(raw, &httpApp); err != nil {
+			return nil, fmt.Errorf("parse adapted http app: %w", err)
+		}
+	}
+
+	proxies, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata: %w", err)
+	}
+	existing := make(map[string]string, len(proxies))
+	for _, proxy := range proxies {
+		existing[importKey(proxy)] = proxy.ID
+	}
+
+	report := &ImportReport{Candidates: []ImportCandidate{}, Skipped: []ImportSkipped{}}
+	for _, w := range warnings {
+		report.Warnings = append(report.Warnings, w.String())
+	}
+
+	apps := make([]string, 0, len(root.Apps))
+	for app := range root.Apps {
+		if app != "http" {
+			apps = append(apps, app)
+		}
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		report.Skipped = append(report.Skipped, ImportSkipped{
+			Path:   "/apps/" + app,
+			Reason: fmt.Sprintf("the %s app is not managed by proxies", app),
+		})
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range sortedServerNames(httpApp.Servers) {
+		server := httpApp.Servers[name]
+		if server == nil {
+			continue
+		}
+		for i, route := range server.Routes {
+			path := fmt.Sprintf("%s/routes/%d", serverPath(name), i)
+			skip := func(reason string) {
+				report.Skipped = append(report.Skipped, ImportSkipped{Path: path, Reason: reason})
+			}
+
+			proxy, err := pm.routeToProxyWithListen(route, server.Listen)
+			if err != nil {
+				skip(err.Error())
+				continue
+			}
+			if proxy.Hostname == "" {
+				skip("site has no hostname")
+				continue
+			}
+			if proxy.Port == 0 {
+				skip("site has no port")
+				continue
+			}
+			proxy.ID = ""
+			proxy.Autostart = true
+			if err := NormalizeProxy(proxy); err != nil {
+				skip(err.Error())
+				continue
+			}
+
+			key := importKey(*proxy)
+			if seen[key] {
+				skip(fmt.Sprintf("another site already serves %s", key))
+				continue
+			}
+			seen[key] = true
+
+			candidate := ImportCandidate{Key: key, Proxy: *proxy, Conflict: existing[key]}
+			if hosts := len(route.Match[0].Host); hosts > 1 {
+				candidate.Warnings = append(candidate.Warnings, fmt.Sprintf("only the first of %d hostnames is imported", hosts))
+			}
+			candidate.Warnings = append(candidate.Warnings, pm.droppedHandlers(route, *proxy)...)
+			report.Candidates = append(report.Candidates, candidate)
+		}
+	}
+	return report, nil
+}
+
+// Select returns the batch that creates the candidates with the given
+// keys, or every candidate without a conflict when keys is just "all"
+func (r *ImportReport) Select(keys []string) ([]BatchOp, error) {
+	all := len(keys) == 1 && keys[0] == "all"
+	byKey := make(map[string]ImportCandidate, len(r.Candidates))
+	for _, candidate := range r.Candidates {
+		byKey[candidate.Key] = candidate
+	}
+
+	var ops []BatchOp
+	add := func(candidate ImportCandidate) {
+		proxy := candidate.Proxy
+		ops = append(ops, BatchOp{Op: BatchCreate, Proxy: &proxy})
+	}
+	if all {
+		for _, candidate := range r.Candidates {
+			if candidate.Conflict == "" {
+				add(candidate)
+			}
+		}
+		return ops, nil
+	}
+	for _, key := range keys {
+		candidate, ok := byKey[key]
+		if !ok {
+			return nil, fmt.Errorf("no site to import for %s", key)
+		}
+		if candidate.Conflict != "" {
+			return nil, fmt.Errorf("%s is already served by proxy %s", key, candidate.Conflict)
+		}
+		add(candidate)
+	}
+	return ops, nil
+}
+
+// importKey identifies a site by the hostname and port it serves
+func importKey(proxy config.CaddyProxy) string {
+	return fmt.Sprintf("%s:%d", proxy.Hostname, proxy.Port)
+}
+
+// droppedHandlers lists the handlers in an imported route that the proxy
+// read from it does not build again
+func (pm *ProxyManager) droppedHandlers(route Route, proxy config.CaddyProxy) []string {
+	rebuilt, err := pm.buildRoute(proxy)
+	if err != nil {
+		return []string{fmt.Sprintf("route could not be rebuilt: %v", err)}
+	}
+
+	decodedRebuilt, _ := decodeConfig(rebuilt)
+	decodedRoute, _ := decodeConfig(route)
+	kept := make(map[string]bool)
+	collectHandlers(decodedRebuilt, kept)
+	found := make(map[string]bool)
+	collectHandlers(decodedRoute, found)
+
+	var dropped []string
+	for handler := range found {
+		if !kept[handler] {
+			dropped = append(dropped, handler)
+		}
+	}
+	sort.Strings(dropped)
+	warnings := make([]string, len(dropped))
+	for i, handler := range dropped {
+		warnings[i] = fmt.Sprintf("%s handler is not imported", handler)
+	}
+	return warnings
+}
+
+// collectHandlers records the name of every handler in a decoded config
+func collectHandlers(v interface{}, names map[string]bool) {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if name, ok := node["handler"].(string); ok {
+			names[name] = true
+		}
+		for _, child := range node {
+			collectHandlers(child, names)
+		}
+	case []interface{}:
+		for _, child := range node {
+			collectHandlers(child, names)
+		}
+	}
+}
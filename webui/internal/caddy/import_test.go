@@ -0,0 +1,127 @@
+package caddy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// adaptedCaddyfile is what Caddy's /adapt returns for
+//
+//	app.example:8443 {
+//		encode gzip
+//		reverse_proxy localhost:3000 localhost:3001
+//	}
+//	old.example:8443 {
+//		redir https://new.example{uri} permanent
+//	}
+//	taken.example:9000 {
+//		reverse_proxy localhost:4000
+//	}
+//	:8080 {
+//		respond "hello"
+//	}
+//	{ email admin@example.com }
+const adaptedCaddyfile = `{
+  "result": {
+    "apps": {
+      "http": {"servers": {
+        "srv0": {"listen": [":8443"], "routes": [
+          {"match": [{"host": ["app.example"]}], "handle": [{"handler": "subroute", "routes": [
+            {"handle": [{"handler": "encode", "encodings": {"gzip": {}}}]},
+            {"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "localhost:3000"}, {"dial": "localhost:3001"}]}]}
+          ]}], "terminal": true},
+          {"match": [{"host": ["old.example"]}], "handle": [{"handler": "subroute", "routes": [
+            {"handle": [{"handler": "static_response", "status_code": 301, "headers": {"Location": ["https://new.example{http.request.uri}"]}}]}
+          ]}], "terminal": true}
+        ]},
+        "srv1": {"listen": [":9000"], "routes": [
+          {"match": [{"host": ["taken.example"]}], "handle": [{"handler": "subroute", "routes": [
+            {"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "localhost:4000"}]}]}
+          ]}], "terminal": true}
+        ]},
+        "srv2": {"listen": [":8080"], "routes": [
+          {"handle": [{"handler": "subroute", "routes": [
+            {"handle": [{"handler": "static_response", "body": "hello"}]}
+          ]}], "terminal": true}
+        ]}
+      }},
+      "tls": {"automation": {"policies": [{"issuers": [{"module": "acme", "email": "admin@example.com"}]}]}}
+    }
+  },
+  "warnings": [{"file": "Caddyfile", "line": 2, "message": "Caddyfile input is not formatted"}]
+}`
+
+// TestImportCaddyfile verifies that adapted sites map to proxies, that what
+// cannot be mapped is reported, and that the picked sites are imported
+func TestImportCaddyfile(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/adapt" {
+			if body, _ := io.ReadAll(r.Body); r.Header.Get("Content-Type") != "text/caddyfile" || string(body) != "Caddyfile" {
+				http.Error(w, "unexpected adapt request", http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, adaptedCaddyfile)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	if _, err := pm.AddProxy(config.CaddyProxy{ID: "taken", Hostname: "taken.example", Port: 9000, Target: "localhost:1", Enabled: true}); err != nil {
+		t.Fatalf("AddProxy() returned unexpected error: %v", err)
+	}
+
+	report, err := pm.ImportCaddyfile([]byte("Caddyfile"))
+	if err != nil {
+		t.Fatalf("ImportCaddyfile() returned unexpected error: %v", err)
+	}
+
+	if want := []string{"Caddyfile:2: Caddyfile input is not formatted"}; !reflect.DeepEqual(report.Warnings, want) {
+		t.Errorf("Warnings = %v, want %v", report.Warnings, want)
+	}
+	wantSkipped := []ImportSkipped{
+		{Path: "/apps/tls", Reason: "the tls app is not managed by proxies"},
+		{Path: "/apps/http/servers/srv2/routes/0", Reason: "site has no hostname"},
+	}
+	if !reflect.DeepEqual(report.Skipped, wantSkipped) {
+		t.Errorf("Skipped = %+v, want %+v", report.Skipped, wantSkipped)
+	}
+
+	if len(report.Candidates) != 3 {
+		t.Fatalf("Candidates = %+v, want 3", report.Candidates)
+	}
+	app, redirect, taken := report.Candidates[0], report.Candidates[1], report.Candidates[2]
+	if app.Key != "app.example:8443" || !reflect.DeepEqual(app.Proxy.Upstreams, []string{"localhost:3000", "localhost:3001"}) ||
+		!reflect.DeepEqual(app.Warnings, []string{"encode handler is not imported"}) {
+		t.Errorf("app candidate = %+v", app)
+	}
+	if redirect.Proxy.Type != config.ProxyTypeRedirect || redirect.Proxy.Redirect == nil ||
+		*redirect.Proxy.Redirect != (config.ProxyRedirect{To: "https://new.example", Status: 301, PreservePath: true}) {
+		t.Errorf("redirect candidate = %+v", redirect.Proxy)
+	}
+	if taken.Conflict != "taken" {
+		t.Errorf("taken candidate conflict = %q, want taken", taken.Conflict)
+	}
+
+	if _, err := report.Select([]string{"taken.example:9000"}); err == nil {
+		t.Error("Select() of a site a proxy already serves returned no error")
+	}
+	ops, err := report.Select([]string{"all"})
+	if err != nil || len(ops) != 2 {
+		t.Fatalf("Select(all) = %+v, %v; want the two sites without a conflict", ops, err)
+	}
+	if _, err := pm.ApplyBatch(ops, "", false); err != nil {
+		t.Fatalf("ApplyBatch() returned unexpected error: %v", err)
+	}
+	proxies, _ := pm.ListProxies()
+	if len(proxies) != 3 || proxies[1].Hostname != "app.example" || !proxies[1].Autostart || proxies[1].ID == "" {
+		t.Errorf("proxies after import = %+v", proxies)
+	}
+}
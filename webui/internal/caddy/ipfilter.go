@@ -0,0 +1,218 @@
+package caddy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// ipShortcuts are names that can stand in for their ranges in allow, deny
+// and trusted proxy lists. They are expanded in place when a route is built
+// and collapsed again when it is read back.
+var ipShortcuts = map[string][]string{
+	config.IPRangeTailnet:   {"100.64.0.0/10", "fd7a:115c:a1e0::/48"},
+	config.IPRangeLAN:       {"192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8", "fd00::/8"},
+	config.IPRangeLocalhost: {"127.0.0.1/8", "::1"},
+}
+
+// ipShortcutOrder fixes the order shortcuts are tried in when collapsing
+var ipShortcutOrder = []string{config.IPRangeTailnet, config.IPRangeLAN, config.IPRangeLocalhost}
+
+// defaultTrustedProxies are trusted when a proxy enables trusted proxies
+// without listing any, matching Caddy's private_ranges
+var defaultTrustedProxies = []string{config.IPRangeLAN, config.IPRangeLocalhost}
+
+// NormalizeIPFilter validates a proxy's allow and deny lists and its trusted
+// proxy ranges. Entries are CIDRs, single IPs or shortcut names.
+func NormalizeIPFilter(proxy *config.CaddyProxy) error {
+	if f := proxy.IPFilter; f != nil {
+		var err error
+		if f.Allow, err = normalizeRanges(f.Allow); err != nil {
+			return fmt.Errorf("allow: %w", err)
+		}
+		if f.Deny, err = normalizeRanges(f.Deny); err != nil {
+			return fmt.Errorf("deny: %w", err)
+		}
+		if len(f.Allow) == 0 && len(f.Deny) == 0 {
+			proxy.IPFilter = nil
+		}
+	}
+
+	ranges, err := normalizeRanges(proxy.TrustedProxyRanges)
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %w", err)
+	}
+	proxy.TrustedProxyRanges = ranges
+	if len(ranges) > 0 {
+		proxy.TrustedProxies = true
+	}
+	return nil
+}
+
+func normalizeRanges(values []string) ([]string, error) {
+	ranges := make([]string, len(values))
+	for i, v := range values {
+		ranges[i] = strings.TrimSpace(v)
+		if lower := strings.ToLower(ranges[i]); ipShortcuts[lower] != nil {
+			ranges[i] = lower
+		}
+	}
+	ranges = uniqueTrimmed(ranges)
+
+	for _, r := range ranges {
+		if ipShortcuts[r] != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(r); err == nil {
+			continue
+		}
+		if net.ParseIP(r) == nil {
+			return nil, fmt.Errorf("%q is not an IP, CIDR or one of tailnet, lan, localhost", r)
+		}
+	}
+	return ranges, nil
+}
+
+// expandRanges replaces shortcut names with their ranges
+func expandRanges(values []string) []string {
+	var out []string
+	for _, v := range values {
+		if ranges, ok := ipShortcuts[v]; ok {
+			out = append(out, ranges...)
+		} else {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// collapseRanges is the reverse of expandRanges for a list read from Caddy
+func collapseRanges(values []string) []string {
+	var out []string
+	for i := 0; i < len(values); i++ {
+		collapsed := false
+		for _, name := range ipShortcutOrder {
+			ranges := ipShortcuts[name]
+			if i+len(ranges) <= len(values) && equalStrings(values[i:i+len(ranges)], ranges) {
+				out = append(out, name)
+				i += len(ranges) - 1
+				collapsed = true
+				break
+			}
+		}
+		if !collapsed {
+			out = append(out, values[i])
+		}
+	}
+	return out
+}
+
+// trustedProxyRanges returns the ranges a proxy's reverse_proxy trusts
+// X-Forwarded-* headers from, or nil when it trusts none
+func trustedProxyRanges(proxy config.CaddyProxy) []string {
+	if !proxy.TrustedProxies {
+		return nil
+	}
+	if len(proxy.TrustedProxyRanges) > 0 {
+		return expandRanges(proxy.TrustedProxyRanges)
+	}
+	return expandRanges(defaultTrustedProxies)
+}
+
+// parseTrustedProxies reads a reverse_proxy trusted_proxies list back into
+// a proxy, leaving the range list empty when it is the default. Routes from
+// before ranges were configurable list the defaults in another order.
+func parseTrustedProxies(raw []interface{}, proxy *config.CaddyProxy) {
+	var ranges []string
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			ranges = append(ranges, s)
+		}
+	}
+	if len(ranges) == 0 {
+		return
+	}
+	proxy.TrustedProxies = true
+
+	sorted, defaults := slices.Clone(ranges), expandRanges(defaultTrustedProxies)
+	slices.Sort(sorted)
+	slices.Sort(defaults)
+	if !slices.Equal(sorted, defaults) {
+		proxy.TrustedProxyRanges = collapseRanges(ranges)
+	}
+}
+
+// buildIPFilterRoutes compiles a proxy's deny and allow lists into subroute
+// entries that answer 403 to callers they exclude
+func buildIPFilterRoutes(filter *config.ProxyIPFilter) []Route {
+	if filter == nil {
+		return nil
+	}
+
+	forbidden := []Handler{{"handler": "static_response", "status_code": 403}}
+	var routes []Route
+	if len(filter.Deny) > 0 {
+		routes = append(routes, Route{
+			Match:    []MatcherSet{{RemoteIP: &RemoteIPMatcher{Ranges: expandRanges(filter.Deny)}}},
+			Handle:   forbidden,
+			Terminal: true,
+		})
+	}
+	if len(filter.Allow) > 0 {
+		routes = append(routes, Route{
+			Match:    []MatcherSet{{Not: []MatcherSet{{RemoteIP: &RemoteIPMatcher{Ranges: expandRanges(filter.Allow)}}}}},
+			Handle:   forbidden,
+			Terminal: true,
+		})
+	}
+	return routes
+}
+
+// parseIPFilterRoute reads a subroute entry built by buildIPFilterRoutes
+// into filter. It reports false for any other entry.
+func parseIPFilterRoute(raw map[string]interface{}, filter *config.ProxyIPFilter) bool {
+	handles, _ := raw["handle"].([]interface{})
+	if len(handles) != 1 {
+		return false
+	}
+	handle, _ := handles[0].(map[string]interface{})
+	if handle["handler"] != "static_response" || handle["status_code"] != float64(403) {
+		return false
+	}
+	matchers, _ := raw["match"].([]interface{})
+	if len(matchers) != 1 {
+		return false
+	}
+	matcher, _ := matchers[0].(map[string]interface{})
+
+	if ranges := remoteIPRanges(matcher); ranges != nil {
+		filter.Deny = collapseRanges(ranges)
+		return true
+	}
+	if not, ok := matcher["not"].([]interface{}); ok && len(not) == 1 {
+		inner, _ := not[0].(map[string]interface{})
+		if ranges := remoteIPRanges(inner); ranges != nil {
+			filter.Allow = collapseRanges(ranges)
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIPRanges(matcher map[string]interface{}) []string {
+	remoteIP, ok := matcher["remote_ip"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	raw, _ := remoteIP["ranges"].([]interface{})
+	var ranges []string
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			ranges = append(ranges, s)
+		}
+	}
+	return ranges
+}
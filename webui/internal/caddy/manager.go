@@ -1,8 +1,10 @@
 package caddy
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/sudocarlos/tailrelay/internal/config"
 )
@@ -29,6 +31,39 @@ func NewManager(apiURL, serverMapPath string) *Manager {
 	}
 }
 
+// SetForwardAuthDial sets the address Caddy reaches the web UI's forward
+// auth endpoint on, e.g. 127.0.0.1:8021
+func (m *Manager) SetForwardAuthDial(addr string) {
+	m.proxyManager.SetForwardAuthDial(addr)
+}
+
+// SetSitesDir sets the directory file_server roots are resolved in
+func (m *Manager) SetSitesDir(dir string) {
+	m.proxyManager.SetSitesDir(dir)
+}
+
+// SetCaddyfilePath sets a Caddyfile to rewrite from the proxies after every
+// change
+func (m *Manager) SetCaddyfilePath(path string) {
+	m.proxyManager.SetCaddyfilePath(path)
+}
+
+// SyncCaddyfile rewrites the Caddyfile set with SetCaddyfilePath now
+func (m *Manager) SyncCaddyfile() {
+	m.proxyManager.syncCaddyfile()
+}
+
+// Export renders the managed proxies as a Caddyfile and as the part of the
+// running JSON config that serves them
+func (m *Manager) Export() (*Export, error) {
+	return m.proxyManager.Export()
+}
+
+// SiteRoot returns the directory a file_server route serves
+func (m *Manager) SiteRoot(root string) string {
+	return m.proxyManager.SiteRoot(root)
+}
+
 // AddProxy adds a new reverse proxy via Caddy API
 func (m *Manager) AddProxy(proxy config.CaddyProxy) (*config.CaddyProxy, error) {
 	created, err := m.proxyManager.AddProxy(proxy)
@@ -62,6 +97,49 @@ func (m *Manager) DeleteProxy(id string) error {
 	return nil
 }
 
+// PreviewAddProxy shows what adding a proxy would change in Caddy
+func (m *Manager) PreviewAddProxy(proxy config.CaddyProxy) (*Preview, error) {
+	return m.proxyManager.PreviewAddProxy(proxy)
+}
+
+// PreviewUpdateProxy shows what updating a proxy would change in Caddy
+func (m *Manager) PreviewUpdateProxy(proxy config.CaddyProxy) (*Preview, error) {
+	return m.proxyManager.PreviewUpdateProxy(proxy)
+}
+
+// PreviewDeleteProxy shows what deleting a proxy would change in Caddy
+func (m *Manager) PreviewDeleteProxy(id string) (*Preview, error) {
+	return m.proxyManager.PreviewDeleteProxy(id)
+}
+
+// PreviewToggleProxy shows what enabling or disabling a proxy would change
+// in Caddy
+func (m *Manager) PreviewToggleProxy(id string, enabled bool) (*Preview, error) {
+	return m.proxyManager.PreviewToggleProxy(id, enabled)
+}
+
+// ApplyBatch applies a set of proxy changes in one Caddy config load
+func (m *Manager) ApplyBatch(ops []BatchOp, etag string, dryRun bool) (*BatchResult, error) {
+	result, err := m.proxyManager.ApplyBatch(ops, etag, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		log.Printf("Applied batch of %d proxy changes", len(ops))
+	}
+	return result, nil
+}
+
+// ConfigETag returns the ETag of the running Caddy config
+func (m *Manager) ConfigETag() (string, error) {
+	return m.proxyManager.ConfigETag()
+}
+
+// ImportCaddyfile reports the sites of a Caddyfile that map to proxies
+func (m *Manager) ImportCaddyfile(caddyfile []byte) (*ImportReport, error) {
+	return m.proxyManager.ImportCaddyfile(caddyfile)
+}
+
 // ListProxies retrieves all proxies
 func (m *Manager) ListProxies() ([]config.CaddyProxy, error) {
 	return m.proxyManager.ListProxies()
@@ -90,6 +168,39 @@ func (m *Manager) GetUpstreams() ([]UpstreamStatus, error) {
 	return m.proxyManager.GetUpstreams()
 }
 
+// GetProxyUpstreams returns the live state of each proxy's upstreams
+func (m *Manager) GetProxyUpstreams(proxies []config.CaddyProxy) (map[string][]ProxyUpstream, error) {
+	return m.proxyManager.GetProxyUpstreams(proxies)
+}
+
+// MonitorDrift periodically re-applies proxies that drifted from their
+// metadata in the running config
+func (m *Manager) MonitorDrift(ctx context.Context, interval time.Duration) {
+	m.proxyManager.MonitorDrift(ctx, interval)
+}
+
+// Reconcile compares the running config with the proxy metadata now and
+// repairs any drift
+func (m *Manager) Reconcile() ([]DriftEvent, error) {
+	return m.proxyManager.Reconcile()
+}
+
+// DriftReport returns the reconciler's last result and recent drift
+func (m *Manager) DriftReport() DriftReport {
+	return m.proxyManager.DriftReport()
+}
+
+// CertificatesDue lists the proxies whose certificate files expire within
+// the given time
+func (m *Manager) CertificatesDue(within time.Duration) ([]config.CaddyProxy, error) {
+	return m.proxyManager.CertificatesDue(within)
+}
+
+// ReloadCertificate makes Caddy load a proxy's renewed certificate files
+func (m *Manager) ReloadCertificate(id string) error {
+	return m.proxyManager.ReloadCertificate(id)
+}
+
 // GetProxiesStatus returns a map of proxy IDs to their running status in Caddy
 func (m *Manager) GetProxiesStatus() (map[string]bool, error) {
 	return m.proxyManager.GetProxiesStatus()
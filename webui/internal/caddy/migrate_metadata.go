@@ -12,6 +12,11 @@ import (
 func (pm *ProxyManager) MigrateExistingProxies() error {
 	logger.Info("caddy", "Discovering existing proxies in Caddy...")
 
+	// Earlier versions ran one server per proxy; share one per listen address
+	if err := pm.consolidateServers(); err != nil {
+		logger.Warn("caddy", "Failed to consolidate Caddy servers by listen address: %v", err)
+	}
+
 	// Load existing metadata
 	existing, err := LoadProxyMetadata(pm.metadataPath)
 	if err != nil && err.Error() != "open : no such file or directory" {
@@ -85,8 +90,11 @@ func (pm *ProxyManager) MigrateExistingProxies() error {
 
 			// Check if this proxy already exists in metadata
 			if existingProxy != nil {
-				// Preserve existing settings (especially autostart)
+				// Preserve existing settings (especially autostart) and
+				// those kept outside the route, like HTTPS
 				proxy.Autostart = existingProxy.Autostart
+				proxy.HTTPS = existingProxy.HTTPS
+				proxy.Access = existingProxy.Access
 				proxy.Enabled = true // If it's in Caddy, it's enabled
 				logger.Debug("caddy", "Found existing proxy in metadata: %s (ID: %s)", proxy.Hostname, proxy.ID)
 				updated++
@@ -81,8 +81,9 @@ func (mh *MigrationHelper) MigrateFromFile() error {
 	return nil
 }
 
-// MigrateFromCaddyfile migrates proxies from a Caddyfile to Caddy API
-// This is a best-effort parser for simple reverse_proxy configurations
+// MigrateFromCaddyfile imports the sites of a Caddyfile as proxies. Caddy
+// adapts the Caddyfile; sites that do not map to a proxy, or whose hostname
+// and port a proxy already serves, are logged and left out.
 func (mh *MigrationHelper) MigrateFromCaddyfile(caddyfilePath string) error {
 	// Read Caddyfile
 	data, err := os.ReadFile(caddyfilePath)
@@ -91,17 +92,38 @@ func (mh *MigrationHelper) MigrateFromCaddyfile(caddyfilePath string) error {
 	}
 
 	log.Printf("Parsing Caddyfile from: %s", caddyfilePath)
-	log.Println("Note: Automatic Caddyfile parsing is limited. Manual verification recommended.")
-
-	// This is a simplified parser. For production, use Caddy's adapt endpoint.
-	// For now, we'll just log a warning and skip automatic migration
-	log.Println("Automatic Caddyfile migration not implemented.")
-	log.Println("Please use: curl localhost:2019/adapt -H 'Content-Type: text/caddyfile' --data-binary @Caddyfile")
-	log.Println("Then load the resulting JSON with: curl localhost:2019/load -H 'Content-Type: application/json' -d @config.json")
+	report, err := mh.proxyManager.ImportCaddyfile(data)
+	if err != nil {
+		return err
+	}
+	for _, warning := range report.Warnings {
+		log.Printf("Caddyfile warning: %s", warning)
+	}
+	for _, skipped := range report.Skipped {
+		log.Printf("Skipping %s: %s", skipped.Path, skipped.Reason)
+	}
+	for _, candidate := range report.Candidates {
+		if candidate.Conflict != "" {
+			log.Printf("Skipping %s: already served by proxy %s", candidate.Key, candidate.Conflict)
+		}
+		for _, warning := range candidate.Warnings {
+			log.Printf("Warning: %s: %s", candidate.Key, warning)
+		}
+	}
 
-	// Keep the data variable used to avoid unused warning
-	_ = data
+	ops, err := report.Select([]string{"all"})
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		log.Println("No sites to migrate")
+		return nil
+	}
+	if _, err := mh.proxyManager.ApplyBatch(ops, "", false); err != nil {
+		return fmt.Errorf("import sites: %w", err)
+	}
 
+	log.Printf("Migration complete: %d sites imported from %s", len(ops), caddyfilePath)
 	return nil
 }
 
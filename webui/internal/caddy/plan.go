@@ -0,0 +1,406 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// tlsEntryPaths are the tls app arrays that hold proxies' entries
+var tlsEntryPaths = [][]string{
+	{"apps", "tls", "certificates", "load_files"},
+	{"apps", "tls", "automation", "policies"},
+}
+
+// configPlan applies proxy changes to a copy of the running config the way
+// ProxyManager applies them through the admin API, so their effect can be
+// seen before anything is changed
+type configPlan struct {
+	pm        *ProxyManager
+	root      map[string]interface{}
+	etag      string              // of the config the plan started from
+	proxies   []config.CaddyProxy // the metadata as the changes leave it
+	nextIndex int                 // server map index after the servers the plan added
+
+	// What the last change put into the config
+	server string
+	route  *Route
+	tls    interface{}
+}
+
+// newPlan starts a plan from the running config and the stored metadata
+func (pm *ProxyManager) newPlan() (*configPlan, error) {
+	proxies, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata: %w", err)
+	}
+
+	root := map[string]interface{}{}
+	data, etag, err := pm.client.GetConfigWithETag("/")
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("get config: %w", err)
+	}
+	if s := strings.TrimSpace(string(data)); err == nil && s != "" && s != "null" {
+		if err := json.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+	}
+	return &configPlan{pm: pm, root: root, etag: etag, proxies: proxies}, nil
+}
+
+// object returns the object at path in the plan's config. Missing objects
+// are created when create is set, and nil is returned otherwise.
+func (p *configPlan) object(create bool, path ...string) map[string]interface{} {
+	obj := p.root
+	for _, key := range path {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil
+			}
+			next = map[string]interface{}{}
+			obj[key] = next
+		}
+		obj = next
+	}
+	return obj
+}
+
+// servers returns the plan's HTTP servers, for looking routes up with the
+// same code the admin API changes use
+func (p *configPlan) servers() (map[string]*HTTPServer, error) {
+	servers := map[string]*HTTPServer{}
+	raw := p.object(false, "apps", "http", "servers")
+	if raw == nil {
+		return servers, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("marshal servers: %w", err)
+	}
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("unmarshal servers: %w", err)
+	}
+	return servers, nil
+}
+
+// add saves a new proxy, like AddProxy
+func (p *configPlan) add(proxy config.CaddyProxy) error {
+	p.proxies = append(p.proxies, proxy)
+	return p.save(proxy, nil)
+}
+
+// update saves an existing proxy, like UpdateProxy
+func (p *configPlan) update(proxy config.CaddyProxy) error {
+	index := p.index(proxy.ID)
+	if index < 0 {
+		return fmt.Errorf("proxy with ID %s not found", proxy.ID)
+	}
+	previous := p.proxies[index]
+	p.proxies[index] = proxy
+	return p.save(proxy, &previous)
+}
+
+// toggle enables or disables a proxy, like ToggleProxy
+func (p *configPlan) toggle(id string, enabled bool) (*config.CaddyProxy, error) {
+	index := p.index(id)
+	if index < 0 {
+		return nil, fmt.Errorf("proxy with ID %s not found", id)
+	}
+	proxy := p.proxies[index]
+	proxy.Enabled = enabled
+	return &proxy, p.update(proxy)
+}
+
+// remove deletes a proxy, like DeleteProxy
+func (p *configPlan) remove(id string) (*config.CaddyProxy, error) {
+	index := p.index(id)
+	if index < 0 {
+		return nil, fmt.Errorf("proxy with ID %s not found", id)
+	}
+	proxy := p.proxies[index]
+	p.proxies = slices.Delete(p.proxies, index, index+1)
+	p.server, p.route, p.tls = "", nil, nil
+
+	if err := p.removeRoute(proxy); err != nil {
+		return nil, err
+	}
+	p.removeTLS(id)
+	if proxy.Port != 0 {
+		if err := p.syncRedirect(proxy.Port); err != nil {
+			return nil, err
+		}
+	}
+	return &proxy, nil
+}
+
+func (p *configPlan) index(id string) int {
+	return slices.IndexFunc(p.proxies, func(proxy config.CaddyProxy) bool { return proxy.ID == id })
+}
+
+// save applies a stored proxy's route, tls entry and redirect setting
+func (p *configPlan) save(proxy config.CaddyProxy, previous *config.CaddyProxy) error {
+	p.server, p.route, p.tls = "", nil, nil
+	p.removeTLS(proxy.ID)
+
+	if proxy.Enabled {
+		route, err := p.pm.buildRoute(proxy)
+		if err != nil {
+			return fmt.Errorf("build route: %w", err)
+		}
+		if err := p.addTLS(proxy); err != nil {
+			return err
+		}
+		if err := p.placeRoute(proxy, route); err != nil {
+			return err
+		}
+	} else if err := p.removeRoute(proxy); err != nil {
+		return err
+	}
+
+	if err := p.syncRedirect(proxy.Port); err != nil {
+		return err
+	}
+	if previous != nil && previous.Port != proxy.Port {
+		return p.syncRedirect(previous.Port)
+	}
+	return nil
+}
+
+// placeRoute puts a proxy's route into the server for its port, like
+// applyRoute
+func (p *configPlan) placeRoute(proxy config.CaddyProxy, route *Route) error {
+	raw, err := decodeConfig(route)
+	if err != nil {
+		return fmt.Errorf("encode route: %w", err)
+	}
+	servers, err := p.servers()
+	if err != nil {
+		return err
+	}
+	addr := listenAddress(proxy.Port)
+	p.route = route
+
+	if name, index, ok := p.pm.findProxyRoute(servers, proxy); ok {
+		if slices.Contains(servers[name].Listen, addr) {
+			p.routes(name)[index] = raw
+			p.server = name
+			return nil
+		}
+
+		// The proxy moved to another port
+		p.deleteRoute(servers, name, index)
+	}
+
+	if name, ok := p.pm.serverForListen(servers, addr); ok {
+		server := p.object(false, "apps", "http", "servers", name)
+		server["routes"] = append(p.routes(name), raw)
+		p.server = name
+		return nil
+	}
+
+	p.pm.mapMu.Lock()
+	name, next := p.pm.nextServerName(servers)
+	p.pm.mapMu.Unlock()
+	p.nextIndex = max(p.nextIndex, next)
+	p.object(true, "apps", "http", "servers")[name] = map[string]interface{}{
+		"listen": []interface{}{addr},
+		"routes": []interface{}{raw},
+	}
+	p.server = name
+	return nil
+}
+
+// removeRoute takes a proxy's route out of the plan, like removeRoute
+func (p *configPlan) removeRoute(proxy config.CaddyProxy) error {
+	servers, err := p.servers()
+	if err != nil {
+		return err
+	}
+	if name, index, ok := p.pm.findProxyRoute(servers, proxy); ok {
+		p.deleteRoute(servers, name, index)
+	}
+	return nil
+}
+
+// deleteRoute removes route index from server name, and the server itself
+// when that was its last route. servers is updated to match.
+func (p *configPlan) deleteRoute(servers map[string]*HTTPServer, name string, index int) {
+	if len(servers[name].Routes) <= 1 {
+		delete(p.object(false, "apps", "http", "servers"), name)
+		delete(servers, name)
+		return
+	}
+	server := p.object(false, "apps", "http", "servers", name)
+	server["routes"] = slices.Delete(p.routes(name), index, index+1)
+	servers[name].Routes = slices.Delete(servers[name].Routes, index, index+1)
+}
+
+func (p *configPlan) routes(server string) []interface{} {
+	routes, _ := p.object(false, "apps", "http", "servers", server)["routes"].([]interface{})
+	return routes
+}
+
+// removeTLS drops a proxy's tls app entry, like removeTLS
+func (p *configPlan) removeTLS(proxyID string) {
+	id := tlsIDPrefix + proxyID
+	for _, path := range tlsEntryPaths {
+		parent, key := p.object(false, path[:len(path)-1]...), path[len(path)-1]
+		items, ok := parent[key].([]interface{})
+		if !ok {
+			continue
+		}
+		parent[key] = slices.DeleteFunc(items, func(item interface{}) bool {
+			entry, _ := item.(map[string]interface{})
+			return entry["@id"] == id
+		})
+	}
+}
+
+// addTLS adds a proxy's tls app entry, like applyTLS
+func (p *configPlan) addTLS(proxy config.CaddyProxy) error {
+	h := proxy.HTTPS
+	if h == nil {
+		return nil
+	}
+
+	id := tlsIDPrefix + proxy.ID
+	var entry interface{}
+	path := tlsEntryPaths[1]
+	if h.CertSource == config.CertSourceFiles {
+		entry = TLSCertificateFile{ID: id, Certificate: h.CertFile, Key: h.KeyFile}
+		path = tlsEntryPaths[0]
+	} else {
+		entry = TLSPolicy{
+			ID:             id,
+			Subjects:       []string{proxy.Hostname},
+			GetCertificate: []map[string]string{{"via": "tailscale"}},
+		}
+	}
+
+	raw, err := decodeConfig(entry)
+	if err != nil {
+		return fmt.Errorf("encode tls entry: %w", err)
+	}
+	parent, key := p.object(true, path[:len(path)-1]...), path[len(path)-1]
+	items, _ := parent[key].([]interface{})
+	parent[key] = append(items, raw)
+	p.tls = entry
+	return nil
+}
+
+// syncRedirect applies the redirect setting for port, like applyRedirect
+func (p *configPlan) syncRedirect(port int) error {
+	servers, err := p.servers()
+	if err != nil {
+		return err
+	}
+	name, ok := p.pm.serverForListen(servers, listenAddress(port))
+	if !ok {
+		return nil
+	}
+	wrappers, changed := redirectWrappers(servers[name].ListenerWrappers, wantsRedirect(p.proxies, port))
+	if !changed {
+		return nil
+	}
+
+	server := p.object(false, "apps", "http", "servers", name)
+	if wrappers == nil {
+		delete(server, "listener_wrappers")
+		return nil
+	}
+	raw, err := decodeConfig(wrappers)
+	if err != nil {
+		return fmt.Errorf("encode listener wrappers: %w", err)
+	}
+	server["listener_wrappers"] = raw
+	return nil
+}
+
+// ConfigChange is one difference between two configs. Path is the config
+// API path of the value that changed; array indexes refer to the old
+// config for removals and to the new one otherwise.
+type ConfigChange struct {
+	Op     string      `json:"op"` // add, remove or replace
+	Path   string      `json:"path"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// diffConfig lists the differences between two configs decoded from JSON
+func diffConfig(before, after interface{}) []ConfigChange {
+	changes := []ConfigChange{}
+	diffValue("", before, after, &changes)
+	return changes
+}
+
+func diffValue(path string, before, after interface{}, changes *[]ConfigChange) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		a, ok := after.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(b)+len(a))
+		for key := range b {
+			keys = append(keys, key)
+		}
+		for key := range a {
+			if _, ok := b[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			oldValue, inBefore := b[key]
+			newValue, inAfter := a[key]
+			switch {
+			case !inAfter:
+				*changes = append(*changes, ConfigChange{Op: "remove", Path: path + "/" + key, Before: oldValue})
+			case !inBefore:
+				*changes = append(*changes, ConfigChange{Op: "add", Path: path + "/" + key, After: newValue})
+			default:
+				diffValue(path+"/"+key, oldValue, newValue, changes)
+			}
+		}
+		return
+	case []interface{}:
+		a, ok := after.([]interface{})
+		if !ok {
+			break
+		}
+		// Skip the common ends, so inserting or removing one item does not
+		// show every item after it as changed
+		prefix := 0
+		for prefix < len(b) && prefix < len(a) && reflect.DeepEqual(b[prefix], a[prefix]) {
+			prefix++
+		}
+		suffix := 0
+		for suffix < len(b)-prefix && suffix < len(a)-prefix && reflect.DeepEqual(b[len(b)-1-suffix], a[len(a)-1-suffix]) {
+			suffix++
+		}
+		oldItems, newItems := b[prefix:len(b)-suffix], a[prefix:len(a)-suffix]
+		for i := 0; i < len(oldItems) || i < len(newItems); i++ {
+			itemPath := path + "/" + strconv.Itoa(prefix+i)
+			switch {
+			case i >= len(newItems):
+				*changes = append(*changes, ConfigChange{Op: "remove", Path: itemPath, Before: oldItems[i]})
+			case i >= len(oldItems):
+				*changes = append(*changes, ConfigChange{Op: "add", Path: itemPath, After: newItems[i]})
+			default:
+				diffValue(itemPath, oldItems[i], newItems[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, ConfigChange{Op: "replace", Path: path, Before: before, After: after})
+	}
+}
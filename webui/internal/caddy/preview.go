@@ -0,0 +1,88 @@
+package caddy
+
+import (
+	"fmt"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// Preview shows what a proxy change would do without making it: the route
+// and tls entry it would apply, the server the route would go to, and how
+// the running config would change
+type Preview struct {
+	Action  string             `json:"action"`
+	Proxy   *config.CaddyProxy `json:"proxy,omitempty"`
+	Server  string             `json:"server,omitempty"`
+	Route   *Route             `json:"route,omitempty"`
+	TLS     interface{}        `json:"tls,omitempty"`
+	Changes []ConfigChange     `json:"changes"`
+}
+
+// PreviewAddProxy shows what AddProxy would do. A proxy without an ID gets
+// one for the preview only.
+func (pm *ProxyManager) PreviewAddProxy(proxy config.CaddyProxy) (*Preview, error) {
+	proxy.Hostname = NormalizeHostname(proxy.Hostname)
+	if proxy.ID == "" {
+		id, err := config.GenerateToken()
+		if err != nil {
+			return nil, fmt.Errorf("generate proxy id: %w", err)
+		}
+		proxy.ID = id
+	}
+	return pm.preview("create", func(plan *configPlan) (*config.CaddyProxy, error) {
+		return &proxy, plan.add(proxy)
+	})
+}
+
+// PreviewUpdateProxy shows what UpdateProxy would do
+func (pm *ProxyManager) PreviewUpdateProxy(proxy config.CaddyProxy) (*Preview, error) {
+	if proxy.ID == "" {
+		return nil, fmt.Errorf("proxy ID is required for update")
+	}
+	proxy.Hostname = NormalizeHostname(proxy.Hostname)
+	return pm.preview("update", func(plan *configPlan) (*config.CaddyProxy, error) {
+		return &proxy, plan.update(proxy)
+	})
+}
+
+// PreviewToggleProxy shows what ToggleProxy would do
+func (pm *ProxyManager) PreviewToggleProxy(id string, enabled bool) (*Preview, error) {
+	return pm.preview("toggle", func(plan *configPlan) (*config.CaddyProxy, error) {
+		return plan.toggle(id, enabled)
+	})
+}
+
+// PreviewDeleteProxy shows what DeleteProxy would do
+func (pm *ProxyManager) PreviewDeleteProxy(id string) (*Preview, error) {
+	return pm.preview("delete", func(plan *configPlan) (*config.CaddyProxy, error) {
+		return plan.remove(id)
+	})
+}
+
+// preview makes a change to a plan of the running config and reports it
+func (pm *ProxyManager) preview(action string, change func(*configPlan) (*config.CaddyProxy, error)) (*Preview, error) {
+	plan, err := pm.newPlan()
+	if err != nil {
+		return nil, err
+	}
+	before, err := decodeConfig(plan.root)
+	if err != nil {
+		return nil, fmt.Errorf("copy config: %w", err)
+	}
+
+	proxy, err := change(plan)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPortHTTPS(plan.proxies, proxy.Port); err != nil {
+		return nil, err
+	}
+	return &Preview{
+		Action:  action,
+		Proxy:   proxy,
+		Server:  plan.server,
+		Route:   plan.route,
+		TLS:     plan.tls,
+		Changes: diffConfig(before, plan.root),
+	}, nil
+}
@@ -0,0 +1,128 @@
+package caddy
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// TestPreview_MatchesAppliedChanges verifies that a preview leaves Caddy and
+// the metadata alone, and that the config it plans is the config the real
+// change produces
+func TestPreview_MatchesAppliedChanges(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	secure := config.CaddyProxy{
+		ID: "c", Hostname: "c.tail1234.ts.net", Port: 443, Target: "localhost:3", Enabled: true,
+		HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale, RedirectHTTP: true},
+	}
+	// Proxies sharing the https port must use https too
+	moved := config.CaddyProxy{ID: "b", Hostname: "b.tail1234.ts.net", Port: 443, Target: "localhost:2", Enabled: true,
+		HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale}}
+
+	steps := []struct {
+		name  string
+		plan  func(*configPlan) error
+		apply func() error
+	}{
+		{"add a",
+			func(p *configPlan) error {
+				return p.add(config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true})
+			},
+			func() error {
+				_, err := pm.AddProxy(config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true})
+				return err
+			}},
+		{"add b",
+			func(p *configPlan) error {
+				return p.add(config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2", Enabled: true})
+			},
+			func() error {
+				_, err := pm.AddProxy(config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2", Enabled: true})
+				return err
+			}},
+		{"add https c",
+			func(p *configPlan) error { return p.add(secure) },
+			func() error { _, err := pm.AddProxy(secure); return err }},
+		{"move b",
+			func(p *configPlan) error { return p.update(moved) },
+			func() error { return pm.UpdateProxy(moved) }},
+		{"disable a",
+			func(p *configPlan) error { _, err := p.toggle("a", false); return err },
+			func() error { return pm.ToggleProxy("a", false) }},
+		{"delete c",
+			func(p *configPlan) error { _, err := p.remove("c"); return err },
+			func() error { return pm.DeleteProxy("c") }},
+	}
+
+	for _, step := range steps {
+		plan, err := pm.newPlan()
+		if err != nil {
+			t.Fatalf("%s: newPlan() returned unexpected error: %v", step.name, err)
+		}
+		if err := step.plan(plan); err != nil {
+			t.Fatalf("%s: planning returned unexpected error: %v", step.name, err)
+		}
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: applying returned unexpected error: %v", step.name, err)
+		}
+		if !sameConfig(plan.root, fake.config) {
+			t.Errorf("%s: planned config %v, applied config %v", step.name, plan.root, fake.config)
+		}
+	}
+
+	before, _ := decodeConfig(fake.config)
+	proxies, _ := LoadProxyMetadata(pm.metadataPath)
+
+	preview, err := pm.PreviewUpdateProxy(config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 443, Target: "localhost:9", Enabled: true})
+	if err != nil {
+		t.Fatalf("PreviewUpdateProxy() returned unexpected error: %v", err)
+	}
+	if preview.Server == "" || preview.Route == nil || len(preview.Changes) == 0 {
+		t.Errorf("PreviewUpdateProxy() = %+v, want the route, its server and changes", preview)
+	}
+	if _, err := pm.PreviewDeleteProxy("a"); err != nil {
+		t.Errorf("PreviewDeleteProxy() returned unexpected error: %v", err)
+	}
+	if _, err := pm.PreviewToggleProxy("missing", true); err == nil {
+		t.Error("PreviewToggleProxy() of an unknown proxy returned no error")
+	}
+
+	if !sameConfig(before, fake.config) {
+		t.Error("previews changed the running config")
+	}
+	if after, _ := LoadProxyMetadata(pm.metadataPath); !reflect.DeepEqual(proxies, after) {
+		t.Error("previews changed the metadata")
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	before := map[string]interface{}{
+		"hosts":  []interface{}{"x", "y"},
+		"listen": []interface{}{":80"},
+		"old":    true,
+		"routes": []interface{}{"a", "b", "c"},
+	}
+	after := map[string]interface{}{
+		"hosts":  []interface{}{"x", "z", "y"},
+		"listen": []interface{}{":8080"},
+		"new":    true,
+		"routes": []interface{}{"a", "c"},
+	}
+
+	want := []ConfigChange{
+		{Op: "add", Path: "/hosts/1", After: "z"},
+		{Op: "replace", Path: "/listen/0", Before: ":80", After: ":8080"},
+		{Op: "add", Path: "/new", After: true},
+		{Op: "remove", Path: "/old", Before: true},
+		{Op: "remove", Path: "/routes/1", Before: "b"},
+	}
+	if got := diffConfig(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfig() = %+v, want %+v", got, want)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sudocarlos/tailrelay/internal/config"
 	"github.com/sudocarlos/tailrelay/internal/logger"
@@ -22,6 +23,20 @@ type ProxyManager struct {
 	metadataPath  string
 	serverMap     *ServerMap
 	mapMu         sync.Mutex
+	routeMu       sync.Mutex // serializes changes to the running servers
+	proxyMu       sync.Mutex // serializes reading a proxy's metadata and applying it; taken before routeMu
+
+	forwardAuthDial string // web UI address Caddy checks access policies against
+	sitesDir        string // parent of file_server roots
+
+	caddyfileMu   sync.Mutex // serializes Caddyfile rewrites
+	caddyfilePath string     // Caddyfile kept in sync with the proxies, if set
+
+	driftMu        sync.Mutex // guards the reconciler's results
+	driftCheckedAt *time.Time
+	driftErr       error
+	driftInSync    bool
+	driftEvents    []DriftEvent // newest first
 }
 
 // NewProxyManager creates a new proxy manager
@@ -45,14 +60,88 @@ func NewProxyManager(apiURL, serverMapPath string) *ProxyManager {
 	}
 }
 
+// SetForwardAuthDial sets the address Caddy reaches the web UI's forward
+// auth endpoint on
+func (pm *ProxyManager) SetForwardAuthDial(addr string) {
+	pm.forwardAuthDial = addr
+}
+
+// SetSitesDir sets the directory file_server roots are resolved in
+func (pm *ProxyManager) SetSitesDir(dir string) {
+	pm.sitesDir = dir
+}
+
+// SetCaddyfilePath sets a Caddyfile to rewrite from the proxies after every
+// change, so Caddy starts with them when it restarts
+func (pm *ProxyManager) SetCaddyfilePath(path string) {
+	pm.caddyfilePath = path
+}
+
+// syncCaddyfile rewrites the Caddyfile set with SetCaddyfilePath, if any.
+// Failures are logged; the running config has already changed.
+func (pm *ProxyManager) syncCaddyfile() {
+	if pm.caddyfilePath == "" {
+		return
+	}
+	pm.caddyfileMu.Lock()
+	defer pm.caddyfileMu.Unlock()
+
+	proxies, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		logger.Error("caddy", "Failed to load proxy metadata for Caddyfile: %v", err)
+		return
+	}
+	if err := pm.WriteCaddyfile(proxies, pm.caddyfilePath); err != nil {
+		logger.Error("caddy", "Failed to update %s: %v", pm.caddyfilePath, err)
+		return
+	}
+	logger.Debug("caddy", "Updated %s with %d proxies", pm.caddyfilePath, len(proxies))
+}
+
 // NormalizeHostname trims whitespace and a trailing dot from hostnames.
 func NormalizeHostname(hostname string) string {
 	hostname = strings.TrimSpace(hostname)
 	return strings.TrimSuffix(hostname, ".")
 }
 
+// NormalizeProxy cleans up and validates a proxy received from a client
+// before it is stored
+func NormalizeProxy(proxy *config.CaddyProxy) error {
+	proxy.Hostname = NormalizeHostname(proxy.Hostname)
+	if err := NormalizeType(proxy); err != nil {
+		return err
+	}
+	if isReverseProxy(*proxy) {
+		if err := NormalizeUpstreams(proxy); err != nil {
+			return err
+		}
+	}
+	if err := NormalizeRoutes(proxy); err != nil {
+		return err
+	}
+	if err := NormalizeHTTPS(proxy); err != nil {
+		return err
+	}
+	if err := NormalizeAccess(proxy); err != nil {
+		return err
+	}
+	if err := NormalizeIPFilter(proxy); err != nil {
+		return err
+	}
+	if err := NormalizeHeaders(proxy); err != nil {
+		return err
+	}
+	if err := NormalizeTransport(proxy); err != nil {
+		return err
+	}
+	return NormalizeHealthChecks(proxy)
+}
+
 // AddProxy adds a new reverse proxy route to Caddy via API
 func (pm *ProxyManager) AddProxy(proxy config.CaddyProxy) (*config.CaddyProxy, error) {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+
 	proxy.Hostname = NormalizeHostname(proxy.Hostname)
 	logger.Debug("caddy", "AddProxy: building route for %s:%d -> %s", proxy.Hostname, proxy.Port, proxy.Target)
 
@@ -64,6 +153,14 @@ func (pm *ProxyManager) AddProxy(proxy config.CaddyProxy) (*config.CaddyProxy, e
 		proxy.ID = id
 	}
 
+	existing, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata: %w", err)
+	}
+	if err := checkPortHTTPS(withProxy(existing, proxy), proxy.Port); err != nil {
+		return nil, err
+	}
+
 	// Save metadata first
 	if err := AddProxyMetadata(pm.metadataPath, proxy); err != nil {
 		logger.Error("caddy", "Failed to save proxy metadata: %v", err)
@@ -80,37 +177,27 @@ func (pm *ProxyManager) AddProxy(proxy config.CaddyProxy) (*config.CaddyProxy, e
 			return nil, fmt.Errorf("build route: %w", err)
 		}
 
-		serverName, err := pm.allocateServerName()
-		if err != nil {
-			// Clean up metadata
+		// Certificates first, so the route never serves without them
+		if err := pm.applyTLS(proxy); err != nil {
+			logger.Error("caddy", "Failed to apply TLS for proxy %s via Caddy API: %v", proxy.ID, err)
 			DeleteProxyMetadata(pm.metadataPath, proxy.ID)
-			return nil, fmt.Errorf("allocate server name: %w", err)
+			return nil, fmt.Errorf("apply tls: %w", err)
 		}
 
-		path := fmt.Sprintf("/apps/http/servers/%s", serverName)
-		logger.Debug("caddy", "Creating server for proxy at path: %s", path)
-
-		server := &HTTPServer{
-			Listen: []string{fmt.Sprintf(":%d", proxy.Port)},
-			Routes: []Route{*route},
-		}
-
-		if err := pm.ensureHTTPServersPath(); err != nil {
-			logger.Error("caddy", "Failed to ensure HTTP path: %v", err)
-		}
-
-		if err := pm.client.PutConfig(path, server); err != nil {
-			logger.Error("caddy", "Failed to create server %s for %s:%d via Caddy API: %v", serverName, proxy.Hostname, proxy.Port, err)
+		if err := pm.applyRoute(proxy, route); err != nil {
+			logger.Error("caddy", "Failed to add route for %s:%d via Caddy API: %v", proxy.Hostname, proxy.Port, err)
 			// Clean up metadata
+			pm.removeTLS(proxy.ID)
 			DeleteProxyMetadata(pm.metadataPath, proxy.ID)
-			return nil, fmt.Errorf("create server: %w", err)
+			return nil, fmt.Errorf("add route: %w", err)
 		}
-
-		pm.updateServerMap(proxy, serverName)
+		pm.syncRedirect(proxy.Port)
 	} else {
 		logger.Debug("caddy", "Proxy %s created but not enabled, skipping Caddy route creation", proxy.ID)
 	}
 
+	pm.syncCaddyfile()
+
 	logger.Info("caddy", "Added Caddy proxy: %s:%d -> %s (ID: %s, Enabled: %v)", proxy.Hostname, proxy.Port, proxy.Target, proxy.ID, proxy.Enabled)
 	return &proxy, nil
 }
@@ -128,6 +215,13 @@ func (pm *ProxyManager) GetProxy(id string) (*config.CaddyProxy, error) {
 
 // UpdateProxy updates an existing proxy by ID
 func (pm *ProxyManager) UpdateProxy(proxy config.CaddyProxy) error {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+	return pm.updateProxy(proxy)
+}
+
+// updateProxy saves and applies a proxy. The caller must hold proxyMu.
+func (pm *ProxyManager) updateProxy(proxy config.CaddyProxy) error {
 	logger.Debug("caddy", "UpdateProxy: updating proxy ID %s (%s:%d -> %s)", proxy.ID, proxy.Hostname, proxy.Port, proxy.Target)
 
 	if proxy.ID == "" {
@@ -136,6 +230,15 @@ func (pm *ProxyManager) UpdateProxy(proxy config.CaddyProxy) error {
 	}
 
 	proxy.Hostname = NormalizeHostname(proxy.Hostname)
+	previous, _ := GetProxyMetadata(pm.metadataPath, proxy.ID)
+
+	existing, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return fmt.Errorf("load metadata: %w", err)
+	}
+	if err := checkPortHTTPS(withProxy(existing, proxy), proxy.Port); err != nil {
+		return err
+	}
 
 	// Update metadata first
 	if err := UpdateProxyMetadata(pm.metadataPath, proxy); err != nil {
@@ -151,89 +254,52 @@ func (pm *ProxyManager) UpdateProxy(proxy config.CaddyProxy) error {
 			return fmt.Errorf("build route: %w", err)
 		}
 
-		// Try to get server name from map
-		serverName, err := pm.getServerNameForProxy(proxy)
-		serverExists := false
-
-		if err == nil {
-			// Found in map, but verify it actually exists in Caddy
-			serverExists = pm.serverExistsInCaddy(serverName)
-			if !serverExists {
-				logger.Debug("caddy", "Server %s found in map but not in Caddy for proxy %s, will allocate new server", serverName, proxy.ID)
-				// Remove stale entry from map
-				pm.removeServerMapByID(proxy.ID, serverName)
-			}
-		}
-
-		if !serverExists {
-			// Server doesn't exist in Caddy (proxy was previously disabled or map is stale)
-			// Allocate a new server name
-			serverName, err = pm.allocateServerName()
-			if err != nil {
-				logger.Error("caddy", "Failed to allocate server for proxy %s: %v", proxy.ID, err)
-				return fmt.Errorf("allocate server: %w", err)
-			}
-			logger.Debug("caddy", "Allocated new server name %s for re-enabled proxy %s", serverName, proxy.ID)
-		}
-
-		server := &HTTPServer{
-			Listen: []string{fmt.Sprintf(":%d", proxy.Port)},
-			Routes: []Route{*route},
-		}
-
-		path := fmt.Sprintf("/apps/http/servers/%s", serverName)
-
-		// Use PUT if server doesn't exist (create), PATCH if it exists (update)
-		if err := pm.ensureHTTPServersPath(); err != nil {
-			logger.Error("caddy", "Failed to ensure HTTP path: %v", err)
-		}
-
-		var apiErr error
-		if serverExists {
-			apiErr = pm.client.PatchConfig(path, server)
-			logger.Debug("caddy", "Updating existing server %s for proxy %s", serverName, proxy.ID)
-		} else {
-			apiErr = pm.client.PutConfig(path, server)
-			logger.Debug("caddy", "Creating new server %s for proxy %s", serverName, proxy.ID)
+		if err := pm.applyTLS(proxy); err != nil {
+			logger.Error("caddy", "Failed to apply TLS for proxy %s via Caddy API: %v", proxy.ID, err)
+			return fmt.Errorf("apply tls: %w", err)
 		}
 
-		if apiErr != nil {
-			logger.Error("caddy", "Failed to %s server %s for proxy %s via Caddy API: %v",
-				map[bool]string{true: "update", false: "create"}[serverExists], serverName, proxy.ID, apiErr)
-			return fmt.Errorf("update server: %w", apiErr)
+		if err := pm.applyRoute(proxy, route); err != nil {
+			logger.Error("caddy", "Failed to apply route for proxy %s via Caddy API: %v", proxy.ID, err)
+			return fmt.Errorf("update route: %w", err)
 		}
-
-		pm.updateServerMap(proxy, serverName)
 	} else {
 		// If disabled, remove from Caddy but keep metadata
-		serverName, err := pm.getServerNameForProxy(proxy)
-		if err == nil {
-			path := fmt.Sprintf("/apps/http/servers/%s", serverName)
-			if err := pm.client.DeleteConfig(path); err != nil {
-				logger.Warn("caddy", "Failed to delete server %s for disabled proxy %s: %v", serverName, proxy.ID, err)
-			}
-			// Remove from server map since it no longer exists in Caddy
-			pm.removeServerMapByID(proxy.ID, serverName)
-			logger.Debug("caddy", "Removed server %s mapping for disabled proxy %s", serverName, proxy.ID)
+		if err := pm.removeRoute(proxy); err != nil {
+			logger.Warn("caddy", "Failed to remove route for disabled proxy %s: %v", proxy.ID, err)
+		}
+		if err := pm.removeTLS(proxy.ID); err != nil {
+			logger.Warn("caddy", "Failed to remove TLS for disabled proxy %s: %v", proxy.ID, err)
 		}
 	}
 
+	pm.syncRedirect(proxy.Port)
+	if previous != nil && previous.Port != proxy.Port {
+		pm.syncRedirect(previous.Port)
+	}
+	pm.syncCaddyfile()
+
 	logger.Info("caddy", "Updated Caddy proxy: %s (ID: %s, Enabled: %v)", proxy.Hostname, proxy.ID, proxy.Enabled)
 	return nil
 }
 
 // DeleteProxy removes a proxy by ID
 func (pm *ProxyManager) DeleteProxy(id string) error {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+
 	logger.Debug("caddy", "DeleteProxy: removing proxy ID %s", id)
 
 	// Delete from Caddy if it exists
-	serverName, err := pm.getServerNameForProxy(config.CaddyProxy{ID: id})
-	if err == nil {
-		path := fmt.Sprintf("/apps/http/servers/%s", serverName)
-		if err := pm.client.DeleteConfig(path); err != nil {
-			logger.Warn("caddy", "Failed to delete server %s for proxy %s via Caddy API: %v", serverName, id, err)
-		}
-		pm.removeServerMapByID(id, serverName)
+	proxy := config.CaddyProxy{ID: id}
+	if stored, err := GetProxyMetadata(pm.metadataPath, id); err == nil {
+		proxy = *stored
+	}
+	if err := pm.removeRoute(proxy); err != nil {
+		logger.Warn("caddy", "Failed to remove route for proxy %s via Caddy API: %v", id, err)
+	}
+	if err := pm.removeTLS(id); err != nil {
+		logger.Warn("caddy", "Failed to remove TLS for proxy %s via Caddy API: %v", id, err)
 	}
 
 	// Delete from metadata
@@ -241,6 +307,10 @@ func (pm *ProxyManager) DeleteProxy(id string) error {
 		logger.Error("caddy", "Failed to delete proxy metadata: %v", err)
 		return fmt.Errorf("delete metadata: %w", err)
 	}
+	if proxy.Port != 0 {
+		pm.syncRedirect(proxy.Port)
+	}
+	pm.syncCaddyfile()
 
 	logger.Info("caddy", "Deleted Caddy proxy: %s", id)
 	return nil
@@ -260,6 +330,9 @@ func (pm *ProxyManager) ListProxies() ([]config.CaddyProxy, error) {
 
 // ToggleProxy enables or disables a proxy
 func (pm *ProxyManager) ToggleProxy(id string, enabled bool) error {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+
 	// Get proxy from metadata
 	proxy, err := GetProxyMetadata(pm.metadataPath, id)
 	if err != nil {
@@ -268,7 +341,7 @@ func (pm *ProxyManager) ToggleProxy(id string, enabled bool) error {
 	}
 
 	proxy.Enabled = enabled
-	return pm.UpdateProxy(*proxy)
+	return pm.updateProxy(*proxy)
 }
 
 // GetStatus checks if Caddy API is accessible
@@ -285,6 +358,16 @@ func (pm *ProxyManager) GetUpstreams() ([]UpstreamStatus, error) {
 	return pm.client.GetReverseProxyUpstreams()
 }
 
+// GetProxyUpstreams returns the live state of each proxy's upstreams, keyed
+// by proxy ID
+func (pm *ProxyManager) GetProxyUpstreams(proxies []config.CaddyProxy) (map[string][]ProxyUpstream, error) {
+	statuses, err := pm.client.GetReverseProxyUpstreams()
+	if err != nil {
+		return nil, err
+	}
+	return JoinUpstreams(proxies, statuses), nil
+}
+
 // GetProxiesStatus returns a map of proxy IDs to their running status in Caddy
 func (pm *ProxyManager) GetProxiesStatus() (map[string]bool, error) {
 	statusMap := make(map[string]bool)
@@ -309,77 +392,48 @@ func (pm *ProxyManager) GetProxiesStatus() (map[string]bool, error) {
 
 // buildRoute converts a config.CaddyProxy to a Caddy Route with ReverseProxyHandler
 func (pm *ProxyManager) buildRoute(proxy config.CaddyProxy) (*Route, error) {
-	// Build the reverse proxy handler
-	reverseProxyHandler := make(Handler)
-	reverseProxyHandler["handler"] = "reverse_proxy"
-
-	// Add @id if provided
-	if proxy.ID != "" {
-		reverseProxyHandler["@id"] = proxy.ID
-	}
-
-	// Build upstreams
-	upstreams := []Upstream{
-		{Dial: proxy.Target},
-	}
-	reverseProxyHandler["upstreams"] = upstreams
-
-	// Build headers configuration using map form expected by Caddy
-	headers := HeaderConfig{
-		Request: &HeaderOps{
-			Set: map[string][]string{
-				"Host": []string{"{http.reverse_proxy.upstream.hostport}"},
-			},
-		},
-	}
-
-	// Add custom headers if provided
-	if len(proxy.CustomHeaders) > 0 {
-		if headers.Request.Set == nil {
-			headers.Request.Set = make(map[string][]string)
-		}
-		for key, value := range proxy.CustomHeaders {
-			headers.Request.Set[key] = []string{value}
-		}
-	}
-
-	reverseProxyHandler["headers"] = headers
-
-	// Add trusted proxies if enabled
-	if proxy.TrustedProxies {
-		reverseProxyHandler["trusted_proxies"] = []string{
-			"192.168.0.0/16",
-			"172.16.0.0/12",
-			"10.0.0.0/8",
-			"127.0.0.1/8",
-			"fd00::/8",
-			"::1",
+	var routes []Route
+	if isReverseProxy(proxy) {
+		// Path rules come first, in order; the proxy's upstreams catch the rest
+		for i, rule := range proxy.Routes {
+			ruleRoute, err := pm.buildRuleRoute(proxy, rule)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i+1, err)
+			}
+			routes = append(routes, ruleRoute)
 		}
-	}
 
-	// Configure TLS transport only when a CA file is provided (srv0-like config)
-	if proxy.TLSCertFile != "" {
-		transport := HTTPTransport{
-			Protocol: "http",
-			TLS:      &TLSConfig{},
+		// The route carries the proxy's @id; Caddy requires IDs to be unique, so
+		// the handlers inside do not repeat it
+		reverseProxyHandler, err := pm.buildReverseProxyHandler(proxy, proxy.UpstreamList())
+		if err != nil {
+			return nil, err
 		}
-
-		transport.TLS.CA = &TLSCAConfig{
-			Provider: "file",
-			PEMFiles: []string{proxy.TLSCertFile},
+		routes = append(routes, Route{
+			Handle: []Handler{reverseProxyHandler},
+		})
+	} else {
+		siteHandler, err := pm.buildSiteHandler(proxy)
+		if err != nil {
+			return nil, err
 		}
+		routes = append(routes, Route{
+			Handle: []Handler{siteHandler},
+		})
+	}
 
-		reverseProxyHandler["transport"] = transport
+	// Address filters run first, then the identity check
+	var checks []Route
+	checks = append(checks, buildIPFilterRoutes(proxy.IPFilter)...)
+	if proxy.Access != nil {
+		checks = append(checks, pm.buildForwardAuthRoute(proxy))
 	}
+	routes = append(checks, routes...)
 
 	// Build route with matchers
 	subrouteHandler := Handler{
 		"handler": "subroute",
-		"routes": []Route{
-			{
-				Handle: []Handler{reverseProxyHandler},
-			},
-		},
+		"routes":  routes,
 	}
 
 	route := &Route{
@@ -400,6 +454,46 @@ func (pm *ProxyManager) buildRoute(proxy config.CaddyProxy) (*Route, error) {
 	return route, nil
 }
 
+// buildReverseProxyHandler builds a reverse_proxy handler to the given
+// upstreams carrying the proxy's load balancing, health check, header and
+// transport settings
+func (pm *ProxyManager) buildReverseProxyHandler(proxy config.CaddyProxy, dials []string) (Handler, error) {
+	reverseProxyHandler := make(Handler)
+	reverseProxyHandler["handler"] = "reverse_proxy"
+
+	// Build upstreams
+	var upstreams []Upstream
+	for _, dial := range dials {
+		upstreams = append(upstreams, Upstream{Dial: dial})
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("proxy has no upstreams")
+	}
+	reverseProxyHandler["upstreams"] = upstreams
+
+	if lb := buildLoadBalancing(proxy.LoadBalancing); lb != nil {
+		reverseProxyHandler["load_balancing"] = lb
+	}
+
+	if hc := buildHealthChecks(proxy.HealthChecks); hc != nil {
+		reverseProxyHandler["health_checks"] = hc
+	}
+
+	reverseProxyHandler["headers"] = buildHeaderConfig(proxy)
+
+	// Add trusted proxies if enabled
+	if ranges := trustedProxyRanges(proxy); ranges != nil {
+		reverseProxyHandler["trusted_proxies"] = ranges
+	}
+
+	// Configure the transport only when it differs from Caddy's default
+	if transport := buildTransport(proxy); transport != nil {
+		reverseProxyHandler["transport"] = transport
+	}
+
+	return reverseProxyHandler, nil
+}
+
 // routeToProxy converts a Caddy Route back to a config.CaddyProxy
 func (pm *ProxyManager) routeToProxy(route Route) (*config.CaddyProxy, error) {
 	return pm.routeToProxyWithListen(route, nil)
@@ -410,15 +504,22 @@ func (pm *ProxyManager) routeToProxyWithListen(route Route, listenAddrs []string
 		return nil, fmt.Errorf("route has no handlers")
 	}
 
+	// Routes that are not reverse proxies leave reverseProxyHandler nil, so
+	// the upstream settings below read as unset
 	reverseProxyHandler, ok := extractReverseProxyHandler(route)
-	if !ok {
+	siteHandler, isSite := extractSiteHandler(route)
+	if !ok && !isSite {
 		return nil, fmt.Errorf("not a reverse_proxy handler")
 	}
 
 	proxy := &config.CaddyProxy{
 		ID:      route.ID,
+		Type:    config.ProxyTypeReverseProxy,
 		Enabled: true, // Default to enabled if route exists
 	}
+	if !ok {
+		pm.parseSiteHandler(siteHandler, proxy)
+	}
 
 	if proxy.ID == "" {
 		if handlerID, ok := reverseProxyHandler["@id"].(string); ok {
@@ -457,58 +558,69 @@ func (pm *ProxyManager) routeToProxyWithListen(route Route, listenAddrs []string
 	}
 
 	// Extract upstreams
-	if upstreams, ok := reverseProxyHandler["upstreams"].([]interface{}); ok && len(upstreams) > 0 {
-		if upstream, ok := upstreams[0].(map[string]interface{}); ok {
-			if dial, ok := upstream["dial"].(string); ok {
-				proxy.Target = dial
-			}
+	if dials := parseDials(reverseProxyHandler); len(dials) > 0 {
+		proxy.Target = dials[0]
+		if len(dials) > 1 {
+			proxy.Upstreams = dials
 		}
 	}
 
-	// Check for TLS transport
-	if transport, ok := reverseProxyHandler["transport"].(map[string]interface{}); ok {
-		if tlsConfig, hasTLS := transport["tls"].(map[string]interface{}); hasTLS {
-			proxy.TLS = true
-			if caCfg, ok := tlsConfig["ca"].(map[string]interface{}); ok {
-				if pemFiles, ok := caCfg["pem_files"].([]interface{}); ok && len(pemFiles) > 0 {
-					if pemFile, ok := pemFiles[0].(string); ok {
-						proxy.TLSCertFile = pemFile
-					}
+	// Extract path rules from the subroute
+	if first := route.Handle[0]; first["handler"] == "subroute" {
+		routesRaw, _ := first["routes"].([]interface{})
+		for _, routeRaw := range routesRaw {
+			routeMap, ok := routeRaw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if rule, ok := parseRuleRoute(routeMap, proxy); ok {
+				proxy.Routes = append(proxy.Routes, rule)
+			}
+			filter := proxy.IPFilter
+			if filter == nil {
+				filter = &config.ProxyIPFilter{}
+			}
+			if parseIPFilterRoute(routeMap, filter) {
+				proxy.IPFilter = filter
+			}
+			// The rules themselves are kept in metadata only
+			handles, _ := routeMap["handle"].([]interface{})
+			for _, h := range handles {
+				if handle, ok := h.(map[string]interface{}); ok && isForwardAuthHandler(handle) {
+					proxy.Access = &config.ProxyAccess{}
 				}
 			}
 		}
 	}
 
-	// Extract custom headers (excluding the default Host header)
+	if lb, ok := reverseProxyHandler["load_balancing"].(map[string]interface{}); ok {
+		proxy.LoadBalancing = parseLoadBalancing(lb)
+	}
+
+	if hc, ok := reverseProxyHandler["health_checks"].(map[string]interface{}); ok {
+		proxy.HealthChecks = parseHealthChecks(hc)
+	}
+
+	// Check for transport settings, including upstream TLS
+	if transport, ok := reverseProxyHandler["transport"].(map[string]interface{}); ok {
+		parseTransport(transport, proxy)
+	}
+
+	// Extract custom headers (excluding the default Host header) and the
+	// other header rules
 	if headers, ok := reverseProxyHandler["headers"].(map[string]interface{}); ok {
-		if request, ok := headers["request"].(map[string]interface{}); ok {
-			if setMap, ok := request["set"].(map[string]interface{}); ok {
-				proxy.CustomHeaders = make(map[string]string)
-				for field, val := range setMap {
-					if strings.EqualFold(field, "Host") {
-						continue
-					}
-					if values, ok := val.([]interface{}); ok && len(values) > 0 {
-						if value, ok := values[0].(string); ok {
-							proxy.CustomHeaders[field] = value
-						}
-					}
-				}
-			}
-		}
+		parseHeaderConfig(headers, proxy)
 	}
 
-	if trustedProxies, ok := reverseProxyHandler["trusted_proxies"]; ok {
-		switch values := trustedProxies.(type) {
-		case []interface{}:
-			if len(values) > 0 {
-				proxy.TrustedProxies = true
-			}
-		case []string:
-			if len(values) > 0 {
-				proxy.TrustedProxies = true
-			}
+	switch values := reverseProxyHandler["trusted_proxies"].(type) {
+	case []interface{}:
+		parseTrustedProxies(values, proxy)
+	case []string:
+		raw := make([]interface{}, len(values))
+		for i, v := range values {
+			raw[i] = v
 		}
+		parseTrustedProxies(raw, proxy)
 	}
 
 	return proxy, nil
@@ -529,11 +641,15 @@ func extractReverseProxyHandler(route Route) (Handler, bool) {
 			if !ok {
 				return nil, false
 			}
+			// The proxy's own handler lives in the catch-all entry after any
+			// path rules; fall back to the first reverse_proxy found
+			var fallback Handler
 			for _, routeRaw := range routesRaw {
 				routeMap, ok := routeRaw.(map[string]interface{})
 				if !ok {
 					continue
 				}
+				_, hasMatch := routeMap["match"]
 				handlesRaw, ok := routeMap["handle"].([]interface{})
 				if !ok {
 					continue
@@ -543,11 +659,19 @@ func extractReverseProxyHandler(route Route) (Handler, bool) {
 					if !ok {
 						continue
 					}
-					if nestedType, ok := handleMap["handler"].(string); ok && nestedType == "reverse_proxy" {
-						return handleMap, true
+					if nestedType, ok := handleMap["handler"].(string); ok && nestedType == "reverse_proxy" && !isForwardAuthHandler(handleMap) {
+						if !hasMatch {
+							return handleMap, true
+						}
+						if fallback == nil {
+							fallback = handleMap
+						}
 					}
 				}
 			}
+			if fallback != nil {
+				return fallback, true
+			}
 		}
 	}
 
@@ -642,13 +766,9 @@ func (pm *ProxyManager) ensureHTTPServersPath() error {
 
 	httpApp, ok := apps["http"].(map[string]interface{})
 	if !ok {
-		// Path doesn't exist, safely create it
-		initPayload := map[string]interface{}{
-			"apps": map[string]interface{}{
-				"http": map[string]interface{}{},
-			},
-		}
-		return pm.client.PatchConfig("/", initPayload)
+		// Path doesn't exist, safely create it without touching other apps
+		// such as tls
+		return pm.client.PutConfig("/apps/http", map[string]interface{}{})
 	}
 
 	if _, ok := httpApp["servers"]; !ok {
@@ -744,43 +864,6 @@ func (pm *ProxyManager) listServers() (map[string]*HTTPServer, error) {
 	return servers, nil
 }
 
-func (pm *ProxyManager) getServerNameForProxy(proxy config.CaddyProxy) (string, error) {
-	pm.mapMu.Lock()
-	if proxy.ID != "" {
-		if serverName, ok := pm.serverMap.ByProxyID[proxy.ID]; ok {
-			pm.mapMu.Unlock()
-			return serverName, nil
-		}
-	}
-	if proxy.Hostname != "" && proxy.Port != 0 {
-		if serverName, ok := pm.serverMap.ByHostPort[pm.hostPortKey(proxy)]; ok {
-			pm.mapMu.Unlock()
-			return serverName, nil
-		}
-	}
-	pm.mapMu.Unlock()
-
-	serverName, err := pm.findServerNameInCaddy(proxy)
-	if err != nil {
-		return "", err
-	}
-
-	pm.updateServerMap(proxy, serverName)
-	return serverName, nil
-}
-
-// serverExistsInCaddy checks if a server name actually exists in Caddy's configuration
-func (pm *ProxyManager) serverExistsInCaddy(serverName string) bool {
-	// Use listServers to avoid 400 errors when checking paths
-	servers, err := pm.listServers()
-	if err != nil {
-		return false
-	}
-	_, exists := servers[serverName]
-	logger.Debug("caddy", "Checking if server %s exists in Caddy: %v", serverName, exists)
-	return exists
-}
-
 func (pm *ProxyManager) allocateServerName() (string, error) {
 	pm.mapMu.Lock()
 	defer pm.mapMu.Unlock()
@@ -790,6 +873,18 @@ func (pm *ProxyManager) allocateServerName() (string, error) {
 		return "", err
 	}
 
+	name, next := pm.nextServerName(servers)
+	pm.serverMap.NextIndex = next
+	if err := SaveServerMap(pm.serverMapPath, pm.serverMap); err != nil {
+		logger.Error("caddy", "Failed to save server map: %v", err)
+	}
+	return name, nil
+}
+
+// nextServerName returns the first server name that is neither in servers
+// nor recorded in the server map, and the index to continue from. The
+// caller must hold pm.mapMu.
+func (pm *ProxyManager) nextServerName(servers map[string]*HTTPServer) (string, int) {
 	serverNames := make(map[string]bool)
 	for name := range servers {
 		serverNames[name] = true
@@ -797,18 +892,14 @@ func (pm *ProxyManager) allocateServerName() (string, error) {
 	for _, name := range pm.serverMap.ByProxyID {
 		serverNames[name] = true
 	}
-	for _, name := range pm.serverMap.ByHostPort {
+	for _, name := range pm.serverMap.ByListen {
 		serverNames[name] = true
 	}
 
 	for i := pm.serverMap.NextIndex; ; i++ {
 		candidate := fmt.Sprintf("srv%d", i)
 		if !serverNames[candidate] {
-			pm.serverMap.NextIndex = i + 1
-			if err := SaveServerMap(pm.serverMapPath, pm.serverMap); err != nil {
-				logger.Error("caddy", "Failed to save server map: %v", err)
-			}
-			return candidate, nil
+			return candidate, i + 1
 		}
 	}
 }
@@ -824,8 +915,8 @@ func (pm *ProxyManager) updateServerMap(proxy config.CaddyProxy, serverName stri
 	if proxy.ID != "" {
 		pm.serverMap.ByProxyID[proxy.ID] = serverName
 	}
-	if proxy.Hostname != "" && proxy.Port != 0 {
-		pm.serverMap.ByHostPort[pm.hostPortKey(proxy)] = serverName
+	if proxy.Port != 0 {
+		pm.serverMap.ByListen[listenAddress(proxy.Port)] = serverName
 	}
 
 	if err := SaveServerMap(pm.serverMapPath, pm.serverMap); err != nil {
@@ -841,9 +932,9 @@ func (pm *ProxyManager) removeServerMapByID(proxyID, serverName string) {
 		delete(pm.serverMap.ByProxyID, proxyID)
 	}
 	if serverName != "" {
-		for key, name := range pm.serverMap.ByHostPort {
+		for addr, name := range pm.serverMap.ByListen {
 			if name == serverName {
-				delete(pm.serverMap.ByHostPort, key)
+				delete(pm.serverMap.ByListen, addr)
 			}
 		}
 	}
@@ -853,39 +944,6 @@ func (pm *ProxyManager) removeServerMapByID(proxyID, serverName string) {
 	}
 }
 
-func (pm *ProxyManager) hostPortKey(proxy config.CaddyProxy) string {
-	return fmt.Sprintf("%s:%d", NormalizeHostname(proxy.Hostname), proxy.Port)
-}
-
-func (pm *ProxyManager) findServerNameInCaddy(proxy config.CaddyProxy) (string, error) {
-	servers, err := pm.listServers()
-	if err != nil {
-		return "", err
-	}
-
-	for serverName, server := range servers {
-		if server == nil {
-			continue
-		}
-		for _, route := range server.Routes {
-			if proxy.ID != "" && routeHasID(route, proxy.ID) {
-				return serverName, nil
-			}
-			candidate, err := pm.routeToProxyWithListen(route, server.Listen)
-			if err != nil {
-				continue
-			}
-			if proxy.Hostname != "" && proxy.Port != 0 {
-				if NormalizeHostname(candidate.Hostname) == NormalizeHostname(proxy.Hostname) && candidate.Port == proxy.Port {
-					return serverName, nil
-				}
-			}
-		}
-	}
-
-	return "", fmt.Errorf("server not found for proxy")
-}
-
 func routeHasID(route Route, id string) bool {
 	if route.ID == id {
 		return true
@@ -1,9 +1,14 @@
 package caddy
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
 )
 
 // newTestProxyManager creates a ProxyManager pointed at the given test server URL,
@@ -104,3 +109,668 @@ func TestListServers_RealError(t *testing.T) {
 		t.Fatal("listServers() expected an error for 500 response, got nil")
 	}
 }
+
+// roundTrip builds the route for a proxy, passes it through Caddy's JSON
+// form and parses it back
+func roundTrip(t *testing.T, pm *ProxyManager, proxy config.CaddyProxy) *config.CaddyProxy {
+	t.Helper()
+
+	route, err := pm.buildRoute(proxy)
+	if err != nil {
+		t.Fatalf("buildRoute() returned unexpected error: %v", err)
+	}
+	data, err := json.Marshal(route)
+	if err != nil {
+		t.Fatalf("marshal route: %v", err)
+	}
+	var decoded Route
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal route: %v", err)
+	}
+
+	parsed, err := pm.routeToProxyWithListen(decoded, []string{fmt.Sprintf(":%d", proxy.Port)})
+	if err != nil {
+		t.Fatalf("routeToProxyWithListen() returned unexpected error: %v", err)
+	}
+	return parsed
+}
+
+// TestBuildRoute_LoadBalancedRoundTrip verifies that multiple upstreams and
+// load balancing settings survive a round trip through the Caddy config.
+func TestBuildRoute_LoadBalancedRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+
+	proxy := config.CaddyProxy{
+		ID:        "lb",
+		Hostname:  "app.example.ts.net",
+		Port:      8443,
+		Target:    "10.0.0.1:8080",
+		Upstreams: []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"},
+		LoadBalancing: &config.ProxyLoadBalancing{
+			Policy:      config.LBPolicyLeastConn,
+			Retries:     2,
+			TryDuration: "5s",
+			TryInterval: "250ms",
+		},
+		Enabled: true,
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if parsed.Target != proxy.Target {
+		t.Errorf("Target = %q, want %q", parsed.Target, proxy.Target)
+	}
+	if !reflect.DeepEqual(parsed.Upstreams, proxy.Upstreams) {
+		t.Errorf("Upstreams = %v, want %v", parsed.Upstreams, proxy.Upstreams)
+	}
+	if parsed.LoadBalancing == nil || *parsed.LoadBalancing != *proxy.LoadBalancing {
+		t.Errorf("LoadBalancing = %+v, want %+v", parsed.LoadBalancing, proxy.LoadBalancing)
+	}
+
+	// A single upstream without load balancing keeps the old shape
+	single := roundTrip(t, pm, config.CaddyProxy{ID: "one", Hostname: "one.example", Port: 8000, Target: "localhost:3000"})
+	if single.Target != "localhost:3000" || single.Upstreams != nil || single.LoadBalancing != nil {
+		t.Errorf("unexpected single-upstream proxy: %+v", single)
+	}
+}
+
+// TestNormalizeUpstreams verifies upstream clean-up and load balancing validation.
+func TestNormalizeUpstreams(t *testing.T) {
+	proxy := config.CaddyProxy{
+		Target:        "ignored:1",
+		Upstreams:     []string{" a:1 ", "b:2", "a:1", ""},
+		LoadBalancing: &config.ProxyLoadBalancing{Policy: "Round_Robin"},
+	}
+	if err := NormalizeUpstreams(&proxy); err != nil {
+		t.Fatalf("NormalizeUpstreams() returned unexpected error: %v", err)
+	}
+	if proxy.Target != "a:1" || !reflect.DeepEqual(proxy.Upstreams, []string{"a:1", "b:2"}) {
+		t.Errorf("unexpected upstreams: target=%q upstreams=%v", proxy.Target, proxy.Upstreams)
+	}
+	if proxy.LoadBalancing.Policy != config.LBPolicyRoundRobin {
+		t.Errorf("policy = %q, want round_robin", proxy.LoadBalancing.Policy)
+	}
+
+	single := config.CaddyProxy{Upstreams: []string{"a:1"}, LoadBalancing: &config.ProxyLoadBalancing{}}
+	if err := NormalizeUpstreams(&single); err != nil {
+		t.Fatalf("NormalizeUpstreams() returned unexpected error: %v", err)
+	}
+	if single.Target != "a:1" || single.Upstreams != nil || single.LoadBalancing != nil {
+		t.Errorf("expected a plain single-upstream proxy, got %+v", single)
+	}
+
+	invalid := []config.CaddyProxy{
+		{},
+		{Target: "a:1", LoadBalancing: &config.ProxyLoadBalancing{Policy: "random_choose"}},
+		{Target: "a:1", LoadBalancing: &config.ProxyLoadBalancing{Retries: -1}},
+		{Target: "a:1", LoadBalancing: &config.ProxyLoadBalancing{TryDuration: "soon"}},
+	}
+	for i := range invalid {
+		if err := NormalizeUpstreams(&invalid[i]); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+// TestBuildRoute_HealthChecksRoundTrip verifies that health check settings
+// survive a round trip through the Caddy config.
+func TestBuildRoute_HealthChecksRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:1")
+	proxy := config.CaddyProxy{
+		ID:        "hc",
+		Hostname:  "hc.example",
+		Port:      8443,
+		Upstreams: []string{"a:1", "b:2"},
+		HealthChecks: &config.ProxyHealthChecks{
+			Active:  &config.ProxyActiveHealthCheck{URI: "/healthz", Interval: "10s", Timeout: "2s", ExpectStatus: 200, ExpectBody: "ok"},
+			Passive: &config.ProxyPassiveHealthCheck{MaxFails: 3},
+		},
+	}
+	if err := NormalizeProxy(&proxy); err != nil {
+		t.Fatalf("NormalizeProxy() returned unexpected error: %v", err)
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if !reflect.DeepEqual(parsed.HealthChecks, proxy.HealthChecks) {
+		t.Errorf("health checks = %+v, want %+v", parsed.HealthChecks, proxy.HealthChecks)
+	}
+	if parsed.HealthChecks.Passive.FailDuration != defaultFailDuration {
+		t.Errorf("fail_duration = %q, want default", parsed.HealthChecks.Passive.FailDuration)
+	}
+}
+
+// TestNormalizeHealthChecks verifies health check validation and clean-up.
+func TestNormalizeHealthChecks(t *testing.T) {
+	empty := config.CaddyProxy{HealthChecks: &config.ProxyHealthChecks{
+		Active:  &config.ProxyActiveHealthCheck{URI: " "},
+		Passive: &config.ProxyPassiveHealthCheck{},
+	}}
+	if err := NormalizeHealthChecks(&empty); err != nil {
+		t.Fatalf("NormalizeHealthChecks() returned unexpected error: %v", err)
+	}
+	if empty.HealthChecks != nil {
+		t.Errorf("expected empty health checks to be dropped, got %+v", empty.HealthChecks)
+	}
+
+	invalid := []*config.ProxyHealthChecks{
+		{Active: &config.ProxyActiveHealthCheck{URI: "healthz"}},
+		{Active: &config.ProxyActiveHealthCheck{URI: "/", ExpectStatus: 42}},
+		{Active: &config.ProxyActiveHealthCheck{URI: "/", ExpectBody: "("}},
+		{Active: &config.ProxyActiveHealthCheck{URI: "/", Interval: "often"}},
+		{Passive: &config.ProxyPassiveHealthCheck{MaxFails: -1}},
+		{Passive: &config.ProxyPassiveHealthCheck{UnhealthyLatency: "-1s"}},
+	}
+	for i, hc := range invalid {
+		proxy := config.CaddyProxy{HealthChecks: hc}
+		if err := NormalizeHealthChecks(&proxy); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+// TestJoinUpstreams verifies how upstream health is derived from Caddy's
+// failure counts.
+func TestJoinUpstreams(t *testing.T) {
+	proxies := []config.CaddyProxy{
+		{ID: "lb", Target: "a:1", Upstreams: []string{"a:1", "b:2"},
+			HealthChecks: &config.ProxyHealthChecks{Passive: &config.ProxyPassiveHealthCheck{MaxFails: 3}}},
+		{ID: "single", Target: "b:2"},
+	}
+	statuses := []UpstreamStatus{
+		{Address: "a:1", NumRequests: 4, Fails: 0},
+		{Address: "b:2", NumRequests: 1, Fails: 2},
+	}
+
+	joined := JoinUpstreams(proxies, statuses)
+	want := map[string][]ProxyUpstream{
+		"lb": {
+			{Address: "a:1", NumRequests: 4, Healthy: true},
+			{Address: "b:2", NumRequests: 1, Fails: 2, Healthy: true},
+		},
+		"single": {
+			{Address: "b:2", NumRequests: 1, Fails: 2, Healthy: false},
+		},
+	}
+	if !reflect.DeepEqual(joined, want) {
+		t.Errorf("JoinUpstreams() = %+v, want %+v", joined, want)
+	}
+}
+
+// TestBuildRoute_PathRulesRoundTrip verifies that path rules compile into
+// the subroute ahead of the catch-all and are parsed back in order.
+func TestBuildRoute_PathRulesRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+
+	proxy := config.CaddyProxy{
+		ID:       "paths",
+		Hostname: "app.example.ts.net",
+		Port:     8443,
+		Target:   "localhost:3000",
+		Routes: []config.ProxyRoute{
+			{Paths: []string{"/api/*"}, StripPrefix: "/api", Upstreams: []string{"localhost:4000", "localhost:4001"}},
+			{Paths: []string{"/docs", "/docs/*"}, Rewrite: "/v2{http.request.uri.path}"},
+		},
+		Enabled: true,
+	}
+
+	route, err := pm.buildRoute(proxy)
+	if err != nil {
+		t.Fatalf("buildRoute() returned unexpected error: %v", err)
+	}
+	routes := route.Handle[0]["routes"].([]Route)
+	if len(routes) != 3 || routes[2].Match != nil || routes[2].Handle[0]["handler"] != "reverse_proxy" {
+		t.Fatalf("expected two path rules followed by the catch-all, got %+v", routes)
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if parsed.ID != "paths" || parsed.Target != "localhost:3000" || parsed.Upstreams != nil {
+		t.Errorf("unexpected catch-all: id=%q target=%q upstreams=%v", parsed.ID, parsed.Target, parsed.Upstreams)
+	}
+	if !reflect.DeepEqual(parsed.Routes, proxy.Routes) {
+		t.Errorf("Routes = %+v, want %+v", parsed.Routes, proxy.Routes)
+	}
+}
+
+// TestNormalizeRoutes verifies path rule validation and clean-up.
+func TestNormalizeRoutes(t *testing.T) {
+	proxy := config.CaddyProxy{
+		Target: "a:1",
+		Routes: []config.ProxyRoute{{Paths: []string{" /api/* ", "/api/*"}, Upstreams: []string{" b:2", ""}}},
+	}
+	if err := NormalizeRoutes(&proxy); err != nil {
+		t.Fatalf("NormalizeRoutes() returned unexpected error: %v", err)
+	}
+	want := []config.ProxyRoute{{Paths: []string{"/api/*"}, Upstreams: []string{"b:2"}}}
+	if !reflect.DeepEqual(proxy.Routes, want) {
+		t.Errorf("Routes = %+v, want %+v", proxy.Routes, want)
+	}
+
+	invalid := []config.ProxyRoute{
+		{},
+		{Paths: []string{"api"}},
+		{Paths: []string{"/api/*"}, StripPrefix: "api"},
+		{Paths: []string{"/api/*"}, Rewrite: "v2"},
+	}
+	for i, rule := range invalid {
+		proxy := config.CaddyProxy{Target: "a:1", Routes: []config.ProxyRoute{rule}}
+		if err := NormalizeRoutes(&proxy); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+// TestBuildRoute_ForwardAuthRoundTrip verifies that an access policy puts
+// the identity check ahead of the proxy's handlers and that the check is not
+// mistaken for the proxy's upstream.
+func TestBuildRoute_ForwardAuthRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+	pm.SetForwardAuthDial("127.0.0.1:9999")
+
+	proxy := config.CaddyProxy{
+		ID:       "sso",
+		Hostname: "app.example.ts.net",
+		Port:     8443,
+		Target:   "localhost:3000",
+		Routes:   []config.ProxyRoute{{Paths: []string{"/api/*"}}},
+		Access:   &config.ProxyAccess{AllowedUsers: []string{"alice@example.com"}},
+		Enabled:  true,
+	}
+
+	route, err := pm.buildRoute(proxy)
+	if err != nil {
+		t.Fatalf("buildRoute() returned unexpected error: %v", err)
+	}
+	routes := route.Handle[0]["routes"].([]Route)
+	if len(routes) != 3 || routes[0].Match != nil || routes[0].Terminal {
+		t.Fatalf("expected the access check, one path rule and the catch-all, got %+v", routes)
+	}
+	check := routes[0].Handle
+	if check[0]["handler"] != "headers" || check[1]["upstreams"].([]Upstream)[0].Dial != "127.0.0.1:9999" {
+		t.Errorf("access check = %+v", check)
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if parsed.Target != "localhost:3000" || len(parsed.Routes) != 1 || parsed.Access == nil {
+		t.Errorf("unexpected parse: target=%q routes=%+v access=%+v", parsed.Target, parsed.Routes, parsed.Access)
+	}
+
+	proxy.Access = nil
+	if parsed := roundTrip(t, pm, proxy); parsed.Access != nil {
+		t.Errorf("Access = %+v, want nil without a policy", parsed.Access)
+	}
+}
+
+// TestAccessAllowed verifies how access policy rules match tailnet callers.
+func TestAccessAllowed(t *testing.T) {
+	groups := map[string][]string{"admins": {"Bob@example.com"}}
+	policy := &config.ProxyAccess{
+		AllowedUsers:  []string{"alice@example.com"},
+		AllowedGroups: []string{"admins"},
+		AllowedTags:   []string{"tag:ci"},
+	}
+
+	tests := []struct {
+		name   string
+		access *config.ProxyAccess
+		login  string
+		tags   []string
+		want   bool
+	}{
+		{name: "allowed user", access: policy, login: "Alice@example.com", want: true},
+		{name: "group member", access: policy, login: "bob@example.com", want: true},
+		{name: "allowed tag", access: policy, tags: []string{"tag:CI"}, want: true},
+		{name: "other user", access: policy, login: "eve@example.com", want: false},
+		{name: "other tag", access: policy, tags: []string{"tag:web"}, want: false},
+		{name: "no rules admits users", access: &config.ProxyAccess{}, login: "eve@example.com", want: true},
+		{name: "no rules needs an identity", access: &config.ProxyAccess{}, want: false},
+		{name: "no policy", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AccessAllowed(tt.access, groups, tt.login, tt.tags); got != tt.want {
+				t.Errorf("AccessAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildRoute_IPFilterRoundTrip verifies that allow and deny lists become
+// 403 entries ahead of the proxy's handlers and read back with their
+// shortcuts, along with custom trusted proxy ranges.
+func TestBuildRoute_IPFilterRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+
+	proxy := config.CaddyProxy{
+		ID:                 "filtered",
+		Hostname:           "app.example.ts.net",
+		Port:               8443,
+		Target:             "localhost:3000",
+		IPFilter:           &config.ProxyIPFilter{Allow: []string{"tailnet", "192.168.1.0/24"}, Deny: []string{"100.100.1.1"}},
+		TrustedProxies:     true,
+		TrustedProxyRanges: []string{"localhost", "10.1.0.0/16"},
+		Access:             &config.ProxyAccess{},
+		Enabled:            true,
+	}
+
+	route, err := pm.buildRoute(proxy)
+	if err != nil {
+		t.Fatalf("buildRoute() returned unexpected error: %v", err)
+	}
+	routes := route.Handle[0]["routes"].([]Route)
+	if len(routes) != 4 || routes[0].Match[0].RemoteIP == nil || routes[1].Match[0].Not == nil {
+		t.Fatalf("expected deny, allow, access check and catch-all, got %+v", routes)
+	}
+	if got := routes[1].Match[0].Not[0].RemoteIP.Ranges; len(got) != 3 || got[0] != "100.64.0.0/10" {
+		t.Errorf("allow ranges = %v, want tailnet expanded", got)
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if !reflect.DeepEqual(parsed.IPFilter, proxy.IPFilter) {
+		t.Errorf("IPFilter = %+v, want %+v", parsed.IPFilter, proxy.IPFilter)
+	}
+	if !parsed.TrustedProxies || !reflect.DeepEqual(parsed.TrustedProxyRanges, proxy.TrustedProxyRanges) {
+		t.Errorf("trusted proxies = %v %v, want %v", parsed.TrustedProxies, parsed.TrustedProxyRanges, proxy.TrustedProxyRanges)
+	}
+	if parsed.Target != "localhost:3000" || parsed.Access == nil {
+		t.Errorf("unexpected parse: target=%q access=%+v", parsed.Target, parsed.Access)
+	}
+
+	// The default trusted ranges are not stored
+	proxy.IPFilter, proxy.TrustedProxyRanges = nil, nil
+	parsed = roundTrip(t, pm, proxy)
+	if parsed.IPFilter != nil || !parsed.TrustedProxies || parsed.TrustedProxyRanges != nil {
+		t.Errorf("unexpected parse: ip_filter=%+v trusted=%v %v", parsed.IPFilter, parsed.TrustedProxies, parsed.TrustedProxyRanges)
+	}
+
+	// Nor are they in the order routes used to list them
+	legacy := &config.CaddyProxy{}
+	parseTrustedProxies([]interface{}{"192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8", "127.0.0.1/8", "fd00::/8", "::1"}, legacy)
+	if !legacy.TrustedProxies || legacy.TrustedProxyRanges != nil {
+		t.Errorf("legacy trusted proxies = %v %v, want the default", legacy.TrustedProxies, legacy.TrustedProxyRanges)
+	}
+}
+
+// TestNormalizeIPFilter verifies address list validation and clean-up.
+func TestNormalizeIPFilter(t *testing.T) {
+	proxy := config.CaddyProxy{
+		IPFilter:           &config.ProxyIPFilter{Allow: []string{" LAN ", "lan", "fd7a::1"}},
+		TrustedProxyRanges: []string{"10.0.0.0/8"},
+	}
+	if err := NormalizeIPFilter(&proxy); err != nil {
+		t.Fatalf("NormalizeIPFilter() returned unexpected error: %v", err)
+	}
+	if want := []string{"lan", "fd7a::1"}; !reflect.DeepEqual(proxy.IPFilter.Allow, want) {
+		t.Errorf("Allow = %v, want %v", proxy.IPFilter.Allow, want)
+	}
+	if !proxy.TrustedProxies {
+		t.Errorf("listing trusted proxy ranges should enable trusted proxies")
+	}
+
+	empty := config.CaddyProxy{IPFilter: &config.ProxyIPFilter{Allow: []string{" "}}}
+	if err := NormalizeIPFilter(&empty); err != nil || empty.IPFilter != nil {
+		t.Errorf("empty filter: err=%v filter=%+v, want it dropped", err, empty.IPFilter)
+	}
+
+	for _, bad := range []string{"office", "10.0.0.0/33"} {
+		p := config.CaddyProxy{IPFilter: &config.ProxyIPFilter{Deny: []string{bad}}}
+		if err := NormalizeIPFilter(&p); err == nil {
+			t.Errorf("NormalizeIPFilter(%q) should fail", bad)
+		}
+	}
+}
+
+// TestBuildRoute_HeadersRoundTrip verifies that header rules and presets
+// survive a round trip through the Caddy config.
+func TestBuildRoute_HeadersRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+
+	proxy := config.CaddyProxy{
+		ID:            "headers",
+		Hostname:      "app.example.ts.net",
+		Port:          8443,
+		Target:        "localhost:3000",
+		CustomHeaders: map[string]string{"X-Env": "prod"},
+		Headers: &config.ProxyHeaders{
+			Request:    &config.HeaderRules{Add: map[string]string{"X-Tag": "a"}, Delete: []string{"Cookie"}},
+			Response:   &config.HeaderRules{Set: map[string]string{"Cache-Control": "no-store"}, Delete: []string{"Server"}},
+			Presets:    []string{config.HeaderPresetHSTS, config.HeaderPresetNoSniff, config.HeaderPresetCORS},
+			CORSOrigin: "https://app.example.com",
+		},
+		Enabled: true,
+	}
+	if err := NormalizeHeaders(&proxy); err != nil {
+		t.Fatalf("NormalizeHeaders() returned unexpected error: %v", err)
+	}
+
+	headers := buildHeaderConfig(proxy)
+	if got := headers.Response.Set["Strict-Transport-Security"]; len(got) != 1 || got[0] != "max-age=31536000; includeSubDomains" {
+		t.Errorf("HSTS header = %v", got)
+	}
+	if got := headers.Response.Set["Access-Control-Allow-Origin"]; len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Errorf("CORS header = %v", got)
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if !reflect.DeepEqual(parsed.Headers, proxy.Headers) {
+		t.Errorf("Headers = %+v, want %+v", parsed.Headers, proxy.Headers)
+	}
+	if !reflect.DeepEqual(parsed.CustomHeaders, proxy.CustomHeaders) {
+		t.Errorf("CustomHeaders = %v, want %v", parsed.CustomHeaders, proxy.CustomHeaders)
+	}
+
+	// A preset header overridden with another value reads back as a rule
+	proxy.Headers = &config.ProxyHeaders{
+		Presets:  []string{config.HeaderPresetFrameAncestors},
+		Response: &config.HeaderRules{Set: map[string]string{"Content-Security-Policy": "default-src 'self'"}},
+	}
+	parsed = roundTrip(t, pm, proxy)
+	if parsed.Headers == nil || parsed.Headers.Presets != nil || parsed.Headers.Response.Set["Content-Security-Policy"] != "default-src 'self'" {
+		t.Errorf("overridden preset parsed as %+v", parsed.Headers)
+	}
+}
+
+// TestNormalizeHeaders verifies header rule validation and clean-up.
+func TestNormalizeHeaders(t *testing.T) {
+	proxy := config.CaddyProxy{
+		Headers: &config.ProxyHeaders{
+			Request:    &config.HeaderRules{Set: map[string]string{"x-api-key": "secret"}},
+			Response:   &config.HeaderRules{Delete: []string{" server ", "Server"}},
+			Presets:    []string{"CORS", "hsts"},
+			CORSOrigin: "*",
+		},
+	}
+	if err := NormalizeHeaders(&proxy); err != nil {
+		t.Fatalf("NormalizeHeaders() returned unexpected error: %v", err)
+	}
+	if proxy.CustomHeaders["X-Api-Key"] != "secret" || proxy.Headers.Request != nil {
+		t.Errorf("request set should move to CustomHeaders: %v %+v", proxy.CustomHeaders, proxy.Headers.Request)
+	}
+	if want := []string{"Server"}; !reflect.DeepEqual(proxy.Headers.Response.Delete, want) {
+		t.Errorf("Response.Delete = %v, want %v", proxy.Headers.Response.Delete, want)
+	}
+	if want := []string{"hsts", "cors"}; !reflect.DeepEqual(proxy.Headers.Presets, want) || proxy.Headers.CORSOrigin != "" {
+		t.Errorf("Presets = %v origin %q, want %v and no origin", proxy.Headers.Presets, proxy.Headers.CORSOrigin, want)
+	}
+
+	empty := config.CaddyProxy{Headers: &config.ProxyHeaders{Response: &config.HeaderRules{Delete: []string{" "}}}}
+	if err := NormalizeHeaders(&empty); err != nil || empty.Headers != nil {
+		t.Errorf("empty rules: err=%v headers=%+v, want them dropped", err, empty.Headers)
+	}
+
+	bad := config.CaddyProxy{Headers: &config.ProxyHeaders{Presets: []string{"csp"}}}
+	if err := NormalizeHeaders(&bad); err == nil {
+		t.Errorf("NormalizeHeaders() should reject an unknown preset")
+	}
+}
+
+// TestBuildRoute_TransportRoundTrip verifies that upstream timeouts,
+// keepalive and TLS client settings survive a round trip through the Caddy
+// config.
+func TestBuildRoute_TransportRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+
+	proxy := config.CaddyProxy{
+		ID:          "appliance",
+		Hostname:    "nas.example.ts.net",
+		Port:        8443,
+		Target:      "192.168.1.20:443",
+		TLSCertFile: "/data/nas-443.cert",
+		Transport: &config.ProxyTransport{
+			DialTimeout:    "5s",
+			ReadTimeout:    "1m0s",
+			KeepAlive:      &config.ProxyKeepAlive{IdleTimeout: "30s", MaxIdleConnsPerHost: 8},
+			ServerName:     "nas.lan",
+			ClientCertFile: "/data/nas-443.client.crt",
+			ClientKeyFile:  "/data/nas-443.client.key",
+		},
+		Enabled: true,
+	}
+	if err := NormalizeTransport(&proxy); err != nil {
+		t.Fatalf("NormalizeTransport() returned unexpected error: %v", err)
+	}
+	if !proxy.TLS {
+		t.Errorf("TLS settings should mark the upstream as TLS")
+	}
+
+	transport := buildTransport(proxy)
+	if transport.TLS == nil || transport.TLS.CA == nil || transport.TLS.ServerName != "nas.lan" {
+		t.Fatalf("transport TLS = %+v, want CA file and server name", transport.TLS)
+	}
+
+	parsed := roundTrip(t, pm, proxy)
+	if !reflect.DeepEqual(parsed.Transport, proxy.Transport) {
+		t.Errorf("Transport = %+v, want %+v", parsed.Transport, proxy.Transport)
+	}
+	if !parsed.TLS || parsed.TLSCertFile != proxy.TLSCertFile {
+		t.Errorf("TLS = %v %q, want true %q", parsed.TLS, parsed.TLSCertFile, proxy.TLSCertFile)
+	}
+
+	// Self-signed upstreams skip verification; disabled keepalive reads back
+	proxy.TLSCertFile = ""
+	proxy.Transport = &config.ProxyTransport{InsecureSkipVerify: true, KeepAlive: &config.ProxyKeepAlive{Disabled: true}}
+	parsed = roundTrip(t, pm, proxy)
+	if !reflect.DeepEqual(parsed.Transport, proxy.Transport) {
+		t.Errorf("Transport = %+v, want %+v", parsed.Transport, proxy.Transport)
+	}
+
+	// Without settings the transport is left to Caddy
+	proxy.Transport = nil
+	if transport := buildTransport(proxy); transport != nil {
+		t.Errorf("buildTransport() = %+v, want nil", transport)
+	}
+}
+
+// TestNormalizeTransport verifies transport validation and clean-up.
+func TestNormalizeTransport(t *testing.T) {
+	empty := config.CaddyProxy{Transport: &config.ProxyTransport{DialTimeout: " ", KeepAlive: &config.ProxyKeepAlive{}}}
+	if err := NormalizeTransport(&empty); err != nil || empty.Transport != nil || empty.TLS {
+		t.Errorf("empty transport: err=%v transport=%+v tls=%v, want it dropped", err, empty.Transport, empty.TLS)
+	}
+
+	bad := []config.ProxyTransport{
+		{DialTimeout: "soon"},
+		{KeepAlive: &config.ProxyKeepAlive{MaxIdleConnsPerHost: -1}},
+		{ClientCertFile: "/data/client.crt"},
+	}
+	for _, tr := range bad {
+		tr := tr
+		p := config.CaddyProxy{Transport: &tr}
+		if err := NormalizeTransport(&p); err == nil {
+			t.Errorf("NormalizeTransport(%+v) should fail", tr)
+		}
+	}
+}
+
+// TestBuildRoute_SiteTypesRoundTrip verifies that redirects, static
+// responses and file servers build their own handlers and read back with
+// their type.
+func TestBuildRoute_SiteTypesRoundTrip(t *testing.T) {
+	pm := newTestProxyManager(t, "http://127.0.0.1:0")
+	pm.SetSitesDir("/var/lib/tailscale/sites")
+
+	tests := []config.CaddyProxy{
+		{
+			ID: "old-name", Type: config.ProxyTypeRedirect, Hostname: "old.example.ts.net", Port: 8080, Enabled: true,
+			Redirect: &config.ProxyRedirect{To: "https://new.example.ts.net", Status: 301, PreservePath: true},
+		},
+		{
+			ID: "maintenance", Type: config.ProxyTypeStatic, Hostname: "app.example.ts.net", Port: 8081, Enabled: true,
+			Static:   &config.ProxyStatic{Status: 503, Body: "Back soon", ContentType: "text/plain"},
+			IPFilter: &config.ProxyIPFilter{Allow: []string{"tailnet"}},
+		},
+		{
+			ID: "docs", Type: config.ProxyTypeFileServer, Hostname: "docs.example.ts.net", Port: 8082, Enabled: true,
+			FileServer: &config.ProxyFileServer{Root: "docs/public", Browse: true},
+		},
+	}
+	for _, proxy := range tests {
+		t.Run(proxy.Type, func(t *testing.T) {
+			if err := NormalizeProxy(&proxy); err != nil {
+				t.Fatalf("NormalizeProxy() returned unexpected error: %v", err)
+			}
+			route, err := pm.buildRoute(proxy)
+			if err != nil {
+				t.Fatalf("buildRoute() returned unexpected error: %v", err)
+			}
+			routes := route.Handle[0]["routes"].([]Route)
+			last := routes[len(routes)-1]
+			if last.Match != nil || last.Handle[0]["handler"] == "reverse_proxy" {
+				t.Errorf("catch-all = %+v, want the site handler", last)
+			}
+
+			parsed := roundTrip(t, pm, proxy)
+			if parsed.Type != proxy.Type || !reflect.DeepEqual(parsed.Redirect, proxy.Redirect) ||
+				!reflect.DeepEqual(parsed.Static, proxy.Static) || !reflect.DeepEqual(parsed.FileServer, proxy.FileServer) {
+				t.Errorf("parsed = %+v, want %+v", parsed, proxy)
+			}
+			if !reflect.DeepEqual(parsed.IPFilter, proxy.IPFilter) || parsed.Target != "" {
+				t.Errorf("parsed ip_filter=%+v target=%q", parsed.IPFilter, parsed.Target)
+			}
+		})
+	}
+
+	if got := pm.SiteRoot("docs/public"); got != "/var/lib/tailscale/sites/docs/public" {
+		t.Errorf("SiteRoot() = %q", got)
+	}
+}
+
+// TestNormalizeType verifies route type validation and that other types
+// drop the upstream settings.
+func TestNormalizeType(t *testing.T) {
+	proxy := config.CaddyProxy{
+		Type:          "Redirect",
+		Target:        "localhost:3000",
+		Redirect:      &config.ProxyRedirect{To: "https://example.com/", PreservePath: true},
+		Static:        &config.ProxyStatic{Body: "unused"},
+		CustomHeaders: map[string]string{"X-Env": "prod"},
+	}
+	if err := NormalizeType(&proxy); err != nil {
+		t.Fatalf("NormalizeType() returned unexpected error: %v", err)
+	}
+	if proxy.Type != config.ProxyTypeRedirect || proxy.Redirect.Status != 302 || proxy.Redirect.To != "https://example.com" {
+		t.Errorf("redirect = %s %+v, want 302 to https://example.com", proxy.Type, proxy.Redirect)
+	}
+	if proxy.Static != nil || proxy.Target != "" || proxy.CustomHeaders != nil {
+		t.Errorf("unused settings kept: static=%+v target=%q headers=%v", proxy.Static, proxy.Target, proxy.CustomHeaders)
+	}
+
+	plain := config.CaddyProxy{Target: "localhost:3000"}
+	if err := NormalizeType(&plain); err != nil || plain.Type != config.ProxyTypeReverseProxy || plain.Target == "" {
+		t.Errorf("default type: err=%v type=%q target=%q", err, plain.Type, plain.Target)
+	}
+
+	bad := []config.CaddyProxy{
+		{Type: "lambda"},
+		{Type: config.ProxyTypeRedirect},
+		{Type: config.ProxyTypeRedirect, Redirect: &config.ProxyRedirect{To: "example.com"}},
+		{Type: config.ProxyTypeRedirect, Redirect: &config.ProxyRedirect{To: "/new", Status: 200}},
+		{Type: config.ProxyTypeStatic, Static: &config.ProxyStatic{Status: 700}},
+		{Type: config.ProxyTypeFileServer, FileServer: &config.ProxyFileServer{Root: "../etc"}},
+		{Type: config.ProxyTypeFileServer, FileServer: &config.ProxyFileServer{Root: "/srv"}},
+	}
+	for _, p := range bad {
+		p := p
+		if err := NormalizeType(&p); err == nil {
+			t.Errorf("NormalizeType(%s %+v %+v %+v) should fail", p.Type, p.Redirect, p.Static, p.FileServer)
+		}
+	}
+}
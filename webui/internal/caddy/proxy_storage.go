@@ -24,6 +24,13 @@ func LoadProxyMetadata(filePath string) ([]config.CaddyProxy, error) {
 		return nil, fmt.Errorf("failed to parse proxy metadata file: %w", err)
 	}
 
+	// Proxies saved before there were other route types are reverse proxies
+	for i := range proxyList.Proxies {
+		if proxyList.Proxies[i].Type == "" {
+			proxyList.Proxies[i].Type = config.ProxyTypeReverseProxy
+		}
+	}
+
 	return proxyList.Proxies, nil
 }
 
@@ -0,0 +1,232 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+// Kinds of drift between proxy metadata and the running config
+const (
+	DriftMissing  = "missing"  // an enabled proxy has no route
+	DriftChanged  = "changed"  // the route or its tls entry differs from what the metadata builds
+	DriftDisabled = "disabled" // a disabled proxy still has a route
+)
+
+// maxDriftEvents bounds the drift history kept in memory
+const maxDriftEvents = 100
+
+// DriftEvent records a difference found between a proxy's metadata and the
+// running Caddy config, and whether it was repaired
+type DriftEvent struct {
+	Time     time.Time `json:"time"`
+	ProxyID  string    `json:"proxy_id"`
+	Hostname string    `json:"hostname"`
+	Port     int       `json:"port"`
+	Kind     string    `json:"kind"`
+	Detail   string    `json:"detail"`
+	Repaired bool      `json:"repaired"`
+	Error    string    `json:"error,omitempty"`
+	Count    int       `json:"count"` // checks in a row that found this failure; Time is the latest
+}
+
+// DriftReport is the reconciler's state: when it last compared the
+// metadata with Caddy and the most recent drift it found, newest first
+type DriftReport struct {
+	CheckedAt *time.Time   `json:"checked_at,omitempty"`
+	InSync    bool         `json:"in_sync"`
+	Error     string       `json:"error,omitempty"`
+	Events    []DriftEvent `json:"events"`
+}
+
+// MonitorDrift periodically reconciles the running config with the proxy
+// metadata, so proxies come back after Caddy restarts, reloads its
+// Caddyfile or is changed through the admin API
+func (pm *ProxyManager) MonitorDrift(ctx context.Context, interval time.Duration) {
+	logger.Info("caddy", "Starting drift monitor (interval: %v)", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("caddy", "Drift monitor shutting down")
+			return
+		case <-ticker.C:
+			if _, err := pm.Reconcile(); err != nil {
+				logger.Debug("caddy", "Drift monitor: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile compares every proxy's metadata with the running config and
+// re-applies the proxies that drifted. It returns the drift found.
+func (pm *ProxyManager) Reconcile() ([]DriftEvent, error) {
+	events, err := pm.detectDrift()
+	now := time.Now()
+
+	if err != nil {
+		pm.driftMu.Lock()
+		pm.driftCheckedAt, pm.driftErr, pm.driftInSync = &now, err, false
+		pm.driftMu.Unlock()
+		return nil, err
+	}
+
+	inSync := true
+	for i := range events {
+		event := &events[i]
+		event.Time = now
+		event.Count = 1
+
+		if err := pm.repairProxy(event.ProxyID); err != nil {
+			event.Error = err.Error()
+			inSync = false
+			logger.Warn("caddy", "Drift: proxy %s %s (%s), repair failed: %v", event.ProxyID, event.Kind, event.Detail, err)
+			continue
+		}
+		event.Repaired = true
+		logger.Warn("caddy", "Drift: proxy %s %s (%s), re-applied", event.ProxyID, event.Kind, event.Detail)
+	}
+
+	pm.driftMu.Lock()
+	pm.driftCheckedAt, pm.driftErr, pm.driftInSync = &now, nil, inSync
+	for _, event := range events {
+		pm.recordDrift(event)
+	}
+	pm.driftMu.Unlock()
+	return events, nil
+}
+
+// repairProxy re-applies a proxy from its metadata. The metadata is read
+// under proxyMu, so an edit made since the drift was found is applied
+// rather than overwritten with the copy the check saw.
+func (pm *ProxyManager) repairProxy(id string) error {
+	pm.proxyMu.Lock()
+	defer pm.proxyMu.Unlock()
+
+	proxy, err := GetProxyMetadata(pm.metadataPath, id)
+	if err != nil {
+		return err
+	}
+	return pm.updateProxy(*proxy)
+}
+
+// recordDrift adds an event to the drift history, newest first. When the
+// proxy's last event is the same failed repair, that event is counted up
+// and moved to the front instead, so a proxy Caddy keeps rejecting does
+// not push the rest of the history out. The caller must hold driftMu.
+func (pm *ProxyManager) recordDrift(event DriftEvent) {
+	i := slices.IndexFunc(pm.driftEvents, func(e DriftEvent) bool { return e.ProxyID == event.ProxyID })
+	if i >= 0 && event.Error != "" {
+		last := pm.driftEvents[i]
+		if last.Error == event.Error && last.Kind == event.Kind && last.Detail == event.Detail {
+			event.Count += last.Count
+			pm.driftEvents = slices.Delete(pm.driftEvents, i, i+1)
+		}
+	}
+
+	pm.driftEvents = append([]DriftEvent{event}, pm.driftEvents...)
+	if len(pm.driftEvents) > maxDriftEvents {
+		pm.driftEvents = pm.driftEvents[:maxDriftEvents]
+	}
+}
+
+// DriftReport returns the reconciler's last result and recent drift
+func (pm *ProxyManager) DriftReport() DriftReport {
+	pm.driftMu.Lock()
+	defer pm.driftMu.Unlock()
+
+	report := DriftReport{
+		CheckedAt: pm.driftCheckedAt,
+		InSync:    pm.driftInSync,
+		Events:    append([]DriftEvent{}, pm.driftEvents...),
+	}
+	if pm.driftErr != nil {
+		report.Error = pm.driftErr.Error()
+	}
+	return report
+}
+
+// detectDrift lists the proxies whose route or tls entry in the running
+// config does not match their metadata
+func (pm *ProxyManager) detectDrift() ([]DriftEvent, error) {
+	proxies, err := LoadProxyMetadata(pm.metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("load metadata: %w", err)
+	}
+	servers, err := pm.listServers()
+	if err != nil {
+		return nil, fmt.Errorf("list servers: %w", err)
+	}
+
+	var events []DriftEvent
+	add := func(proxy config.CaddyProxy, kind, detail string) {
+		events = append(events, DriftEvent{
+			ProxyID:  proxy.ID,
+			Hostname: proxy.Hostname,
+			Port:     proxy.Port,
+			Kind:     kind,
+			Detail:   detail,
+		})
+	}
+
+	for _, proxy := range proxies {
+		name, index, found := pm.findProxyRoute(servers, proxy)
+		if !proxy.Enabled {
+			if found {
+				add(proxy, DriftDisabled, fmt.Sprintf("route still in server %s", name))
+			}
+			continue
+		}
+		if !found {
+			add(proxy, DriftMissing, "no route in Caddy")
+			continue
+		}
+
+		if !slices.Contains(servers[name].Listen, listenAddress(proxy.Port)) {
+			add(proxy, DriftChanged, fmt.Sprintf("route is in server %s, which does not listen on %s", name, listenAddress(proxy.Port)))
+			continue
+		}
+		want, err := pm.buildRoute(proxy)
+		if err != nil {
+			logger.Debug("caddy", "Drift check skipped proxy %s: %v", proxy.ID, err)
+			continue
+		}
+		if !sameConfig(want, servers[name].Routes[index]) {
+			add(proxy, DriftChanged, "route differs from metadata")
+			continue
+		}
+		if proxy.HTTPS != nil {
+			if _, err := pm.client.GetByID(tlsIDPrefix + proxy.ID); isNotFound(err) {
+				add(proxy, DriftChanged, "tls entry missing")
+			}
+		}
+	}
+	return events, nil
+}
+
+// sameConfig reports whether two values encode to the same JSON config
+func sameConfig(a, b interface{}) bool {
+	decodedA, errA := decodeConfig(a)
+	decodedB, errB := decodeConfig(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(decodedA, decodedB)
+}
+
+// decodeConfig returns v as it reads back from JSON, so values built in Go
+// compare equal to the same values read from Caddy
+func decodeConfig(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	err = json.Unmarshal(data, &decoded)
+	return decoded, err
+}
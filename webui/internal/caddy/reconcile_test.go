@@ -0,0 +1,105 @@
+package caddy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// TestReconcile_RepairsDrift verifies that routes removed or changed behind
+// the web UI's back, and routes of disabled proxies, are put back in line
+// with the metadata and reported.
+func TestReconcile_RepairsDrift(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	for _, p := range []config.CaddyProxy{
+		{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true},
+		{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2", Enabled: true},
+		{ID: "c", Hostname: "c.example", Port: 9000, Target: "localhost:3", Enabled: true},
+	} {
+		if _, err := pm.AddProxy(p); err != nil {
+			t.Fatalf("AddProxy(%s) returned unexpected error: %v", p.ID, err)
+		}
+	}
+
+	events, err := pm.Reconcile()
+	if err != nil || len(events) != 0 {
+		t.Fatalf("Reconcile() on a synced config = %+v, %v; want no drift", events, err)
+	}
+
+	// Drop a, point b somewhere else and disable c in metadata only
+	servers, _ := pm.listServers()
+	name, index, _ := pm.findProxyRoute(servers, config.CaddyProxy{ID: "a"})
+	if err := pm.client.DeleteConfig(fmt.Sprintf("%s/routes/%d", serverPath(name), index)); err != nil {
+		t.Fatal(err)
+	}
+	changed, _ := pm.buildRoute(config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:99"})
+	if err := pm.client.PatchByID("b", changed); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := GetProxyMetadata(pm.metadataPath, "c")
+	c.Enabled = false
+	if err := UpdateProxyMetadata(pm.metadataPath, *c); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err = pm.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() returned unexpected error: %v", err)
+	}
+	kinds := make(map[string]string)
+	for _, e := range events {
+		if !e.Repaired {
+			t.Errorf("event %+v not repaired", e)
+		}
+		kinds[e.ProxyID] = e.Kind
+	}
+	if kinds["a"] != DriftMissing || kinds["b"] != DriftChanged || kinds["c"] != DriftDisabled {
+		t.Errorf("drift kinds = %v", kinds)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"b", "a"}})
+
+	if events, err := pm.Reconcile(); err != nil || len(events) != 0 {
+		t.Errorf("Reconcile() after repair = %+v, %v; want no drift", events, err)
+	}
+	report := pm.DriftReport()
+	if !report.InSync || report.CheckedAt == nil || len(report.Events) != 3 {
+		t.Errorf("DriftReport() = %+v", report)
+	}
+}
+
+// TestReconcile_CollapsesRepeatedFailures verifies that a repair failing the
+// same way on every check is kept as one event with a count
+func TestReconcile_CollapsesRepeatedFailures(t *testing.T) {
+	fake := &fakeCaddy{config: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	if _, err := pm.AddProxy(config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1", Enabled: true}); err != nil {
+		t.Fatalf("AddProxy() returned unexpected error: %v", err)
+	}
+	// A redirect without a target cannot be built, so its repair fails
+	broken := config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Type: config.ProxyTypeRedirect, Enabled: true}
+	if err := AddProxyMetadata(pm.metadataPath, broken); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := pm.Reconcile(); err != nil {
+			t.Fatalf("Reconcile() returned unexpected error: %v", err)
+		}
+	}
+	report := pm.DriftReport()
+	if report.InSync || len(report.Events) != 1 {
+		t.Fatalf("DriftReport() = %+v, want one event for b", report)
+	}
+	if e := report.Events[0]; e.ProxyID != "b" || e.Repaired || e.Error == "" || e.Count != 3 {
+		t.Errorf("event = %+v, want b's failed repair counted 3 times", e)
+	}
+}
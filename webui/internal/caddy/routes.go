@@ -0,0 +1,169 @@
+package caddy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// NormalizeRoutes validates a proxy's path rules. Paths and upstreams are
+// trimmed and de-duplicated; rules without paths are rejected.
+func NormalizeRoutes(proxy *config.CaddyProxy) error {
+	for i := range proxy.Routes {
+		rule := &proxy.Routes[i]
+
+		rule.Paths = uniqueTrimmed(rule.Paths)
+		if len(rule.Paths) == 0 {
+			return fmt.Errorf("route %d: at least one path is required", i+1)
+		}
+		for _, path := range rule.Paths {
+			if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "*") {
+				return fmt.Errorf("route %d: path %q must start with / or *", i+1, path)
+			}
+		}
+
+		rule.StripPrefix = strings.TrimSpace(rule.StripPrefix)
+		if rule.StripPrefix != "" && !strings.HasPrefix(rule.StripPrefix, "/") {
+			return fmt.Errorf("route %d: strip_prefix must start with /", i+1)
+		}
+
+		rule.Rewrite = strings.TrimSpace(rule.Rewrite)
+		if rule.Rewrite != "" && !strings.HasPrefix(rule.Rewrite, "/") && !strings.HasPrefix(rule.Rewrite, "{") {
+			return fmt.Errorf("route %d: rewrite must start with / or a placeholder", i+1)
+		}
+
+		rule.Upstreams = uniqueTrimmed(rule.Upstreams)
+	}
+
+	if len(proxy.Routes) == 0 {
+		proxy.Routes = nil
+	}
+	return nil
+}
+
+// uniqueTrimmed trims values and drops empty and repeated ones, keeping the
+// original order
+func uniqueTrimmed(values []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	return out
+}
+
+// ruleUpstreams returns the upstreams a path rule proxies to
+func ruleUpstreams(proxy config.CaddyProxy, rule config.ProxyRoute) []string {
+	if len(rule.Upstreams) > 0 {
+		return rule.Upstreams
+	}
+	return proxy.UpstreamList()
+}
+
+// buildRuleRoute compiles a path rule into a subroute entry: an optional
+// rewrite followed by a reverse_proxy to the rule's upstreams
+func (pm *ProxyManager) buildRuleRoute(proxy config.CaddyProxy, rule config.ProxyRoute) (Route, error) {
+	var handle []Handler
+
+	if rule.StripPrefix != "" || rule.Rewrite != "" {
+		rewrite := Handler{"handler": "rewrite"}
+		if rule.StripPrefix != "" {
+			rewrite["strip_path_prefix"] = rule.StripPrefix
+		}
+		if rule.Rewrite != "" {
+			rewrite["uri"] = rule.Rewrite
+		}
+		handle = append(handle, rewrite)
+	}
+
+	reverseProxy, err := pm.buildReverseProxyHandler(proxy, ruleUpstreams(proxy, rule))
+	if err != nil {
+		return Route{}, err
+	}
+	handle = append(handle, reverseProxy)
+
+	return Route{
+		Match:    []MatcherSet{{Path: rule.Paths}},
+		Handle:   handle,
+		Terminal: true,
+	}, nil
+}
+
+// parseRuleRoute reads a path rule back from a subroute entry decoded from
+// Caddy's JSON config. It reports false for entries without a path matcher,
+// such as the proxy's catch-all route.
+func parseRuleRoute(raw map[string]interface{}, proxy *config.CaddyProxy) (config.ProxyRoute, bool) {
+	var rule config.ProxyRoute
+
+	matchers, ok := raw["match"].([]interface{})
+	if !ok || len(matchers) == 0 {
+		return rule, false
+	}
+	matcher, ok := matchers[0].(map[string]interface{})
+	if !ok {
+		return rule, false
+	}
+	paths, ok := matcher["path"].([]interface{})
+	if !ok || len(paths) == 0 {
+		return rule, false
+	}
+	for _, p := range paths {
+		if path, ok := p.(string); ok {
+			rule.Paths = append(rule.Paths, path)
+		}
+	}
+
+	handles, _ := raw["handle"].([]interface{})
+	for _, h := range handles {
+		handle, ok := h.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch handle["handler"] {
+		case "rewrite":
+			rule.StripPrefix, _ = handle["strip_path_prefix"].(string)
+			rule.Rewrite, _ = handle["uri"].(string)
+		case "reverse_proxy":
+			rule.Upstreams = parseDials(handle)
+		}
+	}
+
+	// Rules that reuse the proxy's upstreams are stored without their own
+	if equalStrings(rule.Upstreams, proxy.UpstreamList()) {
+		rule.Upstreams = nil
+	}
+	return rule, true
+}
+
+// parseDials returns the dial addresses of a reverse_proxy handler's
+// upstreams
+func parseDials(handler map[string]interface{}) []string {
+	var dials []string
+	upstreams, _ := handler["upstreams"].([]interface{})
+	for _, raw := range upstreams {
+		if upstream, ok := raw.(map[string]interface{}); ok {
+			if dial, ok := upstream["dial"].(string); ok {
+				dials = append(dials, dial)
+			}
+		}
+	}
+	return dials
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
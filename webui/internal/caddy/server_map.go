@@ -5,21 +5,75 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// serverMapVersion is the layout written by this version. Version 1 maps
+// had one server per proxy, keyed by hostname:port; version 2 shares one
+// server per listen address.
+const serverMapVersion = 2
+
 // ServerMap stores mappings between proxy identifiers and Caddy server names.
 type ServerMap struct {
+	Version    int               `json:"version"`
 	ByProxyID  map[string]string `json:"by_proxy_id"`
-	ByHostPort map[string]string `json:"by_host_port"`
+	ByListen   map[string]string `json:"by_listen"`
+	ByHostPort map[string]string `json:"by_host_port,omitempty"` // version 1 only
 	NextIndex  int               `json:"next_index"`
 }
 
 func NewServerMap() *ServerMap {
 	return &ServerMap{
-		ByProxyID:  make(map[string]string),
-		ByHostPort: make(map[string]string),
-		NextIndex:  0,
+		Version:   serverMapVersion,
+		ByProxyID: make(map[string]string),
+		ByListen:  make(map[string]string),
+		NextIndex: 0,
+	}
+}
+
+// migrate upgrades a version 1 map in place. Each port keeps the server of
+// its first hostname; the running config is consolidated to match on
+// startup.
+func (m *ServerMap) migrate() bool {
+	if m.Version >= serverMapVersion {
+		return false
+	}
+
+	keys := make([]string, 0, len(m.ByHostPort))
+	for key := range m.ByHostPort {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		idx := strings.LastIndex(key, ":")
+		if idx == -1 {
+			continue
+		}
+		addr := key[idx:]
+		if _, ok := m.ByListen[addr]; !ok {
+			m.ByListen[addr] = m.ByHostPort[key]
+		}
 	}
+
+	m.ByHostPort = nil
+	m.Version = serverMapVersion
+	return true
+}
+
+// clone returns a copy of the map that later changes do not affect
+func (m *ServerMap) clone() *ServerMap {
+	c := *m
+	c.ByProxyID = make(map[string]string, len(m.ByProxyID))
+	for id, name := range m.ByProxyID {
+		c.ByProxyID[id] = name
+	}
+	c.ByListen = make(map[string]string, len(m.ByListen))
+	for addr, name := range m.ByListen {
+		c.ByListen[addr] = name
+	}
+	return &c
 }
 
 func LoadServerMap(filePath string) (*ServerMap, error) {
@@ -43,8 +97,14 @@ func LoadServerMap(filePath string) (*ServerMap, error) {
 	if m.ByProxyID == nil {
 		m.ByProxyID = make(map[string]string)
 	}
-	if m.ByHostPort == nil {
-		m.ByHostPort = make(map[string]string)
+	if m.ByListen == nil {
+		m.ByListen = make(map[string]string)
+	}
+
+	if m.migrate() {
+		if err := SaveServerMap(filePath, &m); err != nil {
+			return nil, fmt.Errorf("save migrated server map: %w", err)
+		}
 	}
 
 	return &m, nil
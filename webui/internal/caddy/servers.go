@@ -0,0 +1,274 @@
+package caddy
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+// serverPath returns the config path of a named HTTP server
+func serverPath(name string) string {
+	return fmt.Sprintf("/apps/http/servers/%s", name)
+}
+
+// listenAddress returns the address proxies on port share a server on
+func listenAddress(port int) string {
+	return fmt.Sprintf(":%d", port)
+}
+
+// sortedServerNames returns server names in allocation order, so srv2 comes
+// before srv10
+func sortedServerNames(servers map[string]*HTTPServer) []string {
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// findProxyRoute locates a proxy's route in the running config by @id,
+// falling back to hostname and port for routes created without one
+func (pm *ProxyManager) findProxyRoute(servers map[string]*HTTPServer, proxy config.CaddyProxy) (string, int, bool) {
+	names := sortedServerNames(servers)
+
+	if proxy.ID != "" {
+		for _, name := range names {
+			if servers[name] == nil {
+				continue
+			}
+			for i, route := range servers[name].Routes {
+				if routeHasID(route, proxy.ID) {
+					return name, i, true
+				}
+			}
+		}
+	}
+
+	if proxy.Hostname == "" || proxy.Port == 0 {
+		return "", 0, false
+	}
+	for _, name := range names {
+		server := servers[name]
+		if server == nil {
+			continue
+		}
+		for i, route := range server.Routes {
+			candidate, err := pm.routeToProxyWithListen(route, server.Listen)
+			if err != nil || candidate.ID != "" {
+				continue
+			}
+			if NormalizeHostname(candidate.Hostname) == NormalizeHostname(proxy.Hostname) && candidate.Port == proxy.Port {
+				return name, i, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// serverForListen returns the server listening on addr, preferring the one
+// recorded in the server map
+func (pm *ProxyManager) serverForListen(servers map[string]*HTTPServer, addr string) (string, bool) {
+	pm.mapMu.Lock()
+	mapped := pm.serverMap.ByListen[addr]
+	pm.mapMu.Unlock()
+
+	if server := servers[mapped]; server != nil && slices.Contains(server.Listen, addr) {
+		return mapped, true
+	}
+	for _, name := range sortedServerNames(servers) {
+		if server := servers[name]; server != nil && slices.Contains(server.Listen, addr) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// applyRoute puts a proxy's route into the server listening on the proxy's
+// port, replacing the route it already has. Proxies on the same port share
+// one server and are told apart by their host matchers.
+func (pm *ProxyManager) applyRoute(proxy config.CaddyProxy, route *Route) error {
+	pm.routeMu.Lock()
+	defer pm.routeMu.Unlock()
+
+	servers, err := pm.listServers()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	addr := listenAddress(proxy.Port)
+
+	if name, index, ok := pm.findProxyRoute(servers, proxy); ok {
+		if slices.Contains(servers[name].Listen, addr) {
+			path := fmt.Sprintf("%s/routes/%d", serverPath(name), index)
+			if err := pm.client.PatchConfig(path, route); err != nil {
+				return fmt.Errorf("replace route in server %s: %w", name, err)
+			}
+			logger.Debug("caddy", "Replaced route for proxy %s in server %s", proxy.ID, name)
+			pm.updateServerMap(proxy, name)
+			return nil
+		}
+
+		// The proxy moved to another port
+		if err := pm.deleteRoute(servers, name, index, proxy.ID); err != nil {
+			return err
+		}
+	}
+
+	if name, ok := pm.serverForListen(servers, addr); ok {
+		if err := pm.appendConfig(serverPath(name)+"/routes", route); err != nil {
+			return fmt.Errorf("add route to server %s: %w", name, err)
+		}
+		logger.Debug("caddy", "Added route for proxy %s to shared server %s (%s)", proxy.ID, name, addr)
+		pm.updateServerMap(proxy, name)
+		return nil
+	}
+
+	if err := pm.ensureHTTPServersPath(); err != nil {
+		logger.Error("caddy", "Failed to ensure HTTP path: %v", err)
+	}
+
+	name, err := pm.allocateServerName()
+	if err != nil {
+		return fmt.Errorf("allocate server name: %w", err)
+	}
+	server := &HTTPServer{
+		Listen: []string{addr},
+		Routes: []Route{*route},
+	}
+	if err := pm.client.PutConfig(serverPath(name), server); err != nil {
+		return fmt.Errorf("create server %s: %w", name, err)
+	}
+	logger.Debug("caddy", "Created server %s on %s for proxy %s", name, addr, proxy.ID)
+	pm.updateServerMap(proxy, name)
+	return nil
+}
+
+// removeRoute takes a proxy's route out of the running config. It is not an
+// error if the proxy has no route.
+func (pm *ProxyManager) removeRoute(proxy config.CaddyProxy) error {
+	pm.routeMu.Lock()
+	defer pm.routeMu.Unlock()
+
+	servers, err := pm.listServers()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+
+	name, index, ok := pm.findProxyRoute(servers, proxy)
+	if !ok {
+		pm.removeServerMapByID(proxy.ID, "")
+		return nil
+	}
+	return pm.deleteRoute(servers, name, index, proxy.ID)
+}
+
+// deleteRoute removes route index from server name, and the server itself
+// when that was its last route. servers is updated to match. The caller
+// must hold pm.routeMu.
+func (pm *ProxyManager) deleteRoute(servers map[string]*HTTPServer, name string, index int, proxyID string) error {
+	server := servers[name]
+
+	if len(server.Routes) <= 1 {
+		if err := pm.client.DeleteConfig(serverPath(name)); err != nil {
+			return fmt.Errorf("delete server %s: %w", name, err)
+		}
+		delete(servers, name)
+		pm.removeServerMapByID(proxyID, name)
+		logger.Debug("caddy", "Removed server %s with the route of proxy %s", name, proxyID)
+		return nil
+	}
+
+	if err := pm.client.DeleteConfig(fmt.Sprintf("%s/routes/%d", serverPath(name), index)); err != nil {
+		return fmt.Errorf("delete route from server %s: %w", name, err)
+	}
+	server.Routes = append(server.Routes[:index], server.Routes[index+1:]...)
+	pm.removeServerMapByID(proxyID, "")
+	logger.Debug("caddy", "Removed route of proxy %s from shared server %s", proxyID, name)
+	return nil
+}
+
+// consolidateServers merges servers left over from the one-server-per-proxy
+// layout that listen on the same address, then rebuilds the server map from
+// the running config
+func (pm *ProxyManager) consolidateServers() error {
+	pm.routeMu.Lock()
+	defer pm.routeMu.Unlock()
+
+	servers, err := pm.listServers()
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+
+	byListen := make(map[string][]string)
+	for _, name := range sortedServerNames(servers) {
+		server := servers[name]
+		if server == nil || len(server.Listen) != 1 {
+			continue
+		}
+		byListen[server.Listen[0]] = append(byListen[server.Listen[0]], name)
+	}
+
+	for addr, names := range byListen {
+		if len(names) < 2 {
+			continue
+		}
+		keep := servers[names[0]]
+		for _, name := range names[1:] {
+			if routes := servers[name].Routes; len(routes) > 0 {
+				items := make([]interface{}, len(routes))
+				for i := range routes {
+					items[i] = routes[i]
+				}
+				if err := pm.appendConfig(serverPath(names[0])+"/routes", items...); err != nil {
+					return fmt.Errorf("move routes from %s to %s: %w", name, names[0], err)
+				}
+				keep.Routes = append(keep.Routes, routes...)
+			}
+			if err := pm.client.DeleteConfig(serverPath(name)); err != nil {
+				return fmt.Errorf("delete server %s: %w", name, err)
+			}
+			delete(servers, name)
+		}
+		logger.Info("caddy", "Merged %d servers listening on %s into %s", len(names)-1, addr, names[0])
+	}
+
+	pm.mapMu.Lock()
+	defer pm.mapMu.Unlock()
+
+	pm.rebuildServerMap(servers)
+	if err := SaveServerMap(pm.serverMapPath, pm.serverMap); err != nil {
+		logger.Error("caddy", "Failed to save server map: %v", err)
+	}
+	return nil
+}
+
+// rebuildServerMap points the server map at the servers proxies' routes are
+// in. The caller must hold pm.mapMu and save the map.
+func (pm *ProxyManager) rebuildServerMap(servers map[string]*HTTPServer) {
+	pm.serverMap.ByListen = make(map[string]string)
+	pm.serverMap.ByProxyID = make(map[string]string)
+	for _, name := range sortedServerNames(servers) {
+		server := servers[name]
+		if server == nil {
+			continue
+		}
+		for _, addr := range server.Listen {
+			if _, ok := pm.serverMap.ByListen[addr]; !ok {
+				pm.serverMap.ByListen[addr] = name
+			}
+		}
+		for _, route := range server.Routes {
+			if proxy, err := pm.routeToProxyWithListen(route, server.Listen); err == nil && proxy.ID != "" {
+				pm.serverMap.ByProxyID[proxy.ID] = name
+			}
+		}
+	}
+}
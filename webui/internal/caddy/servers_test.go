@@ -0,0 +1,383 @@
+package caddy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// fakeCaddy keeps a config tree and implements enough of the admin API's
+// /config/ traversal for the proxy manager: GET, PUT, POST (including
+// "..." appends), PATCH and DELETE. /id/ requests are resolved to the
+// /config/ path of the object with that @id. GET of the root sets an Etag
+// that If-Match on the root is checked against, and /load replaces the
+// config unless rejectLoads is set. onLoad, when set, runs before a load is
+// answered.
+type fakeCaddy struct {
+	mu          sync.Mutex
+	config      interface{}
+	rejectLoads int // status loads fail with, 0 to accept them
+	onLoad      func()
+}
+
+// fakeETag mimics Caddy's ETag of the config at path
+func fakeETag(path string, node interface{}) string {
+	data, _ := json.Marshal(node)
+	return fmt.Sprintf(`"%s %x"`, path, sha256.Sum256(data))
+}
+
+func (f *fakeCaddy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	isRoot := r.URL.Path == "/load" || r.URL.Path == "/config/"
+	if isRoot && r.Method == http.MethodPost {
+		if match := r.Header.Get("If-Match"); match != "" && match != fakeETag("/config/", f.config) {
+			http.Error(w, `{"error":"precondition failed"}`, http.StatusPreconditionFailed)
+			return
+		}
+		if f.onLoad != nil {
+			f.onLoad()
+		}
+		if f.rejectLoads != 0 {
+			http.Error(w, `{"error":"loading new config: rejected"}`, f.rejectLoads)
+			return
+		}
+		var body interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.config = body
+		return
+	}
+
+	var parts []string
+	if id, ok := strings.CutPrefix(r.URL.Path, "/id/"); ok {
+		path, found := findFakeID(f.config, id)
+		if !found {
+			http.Error(w, `{"error":"unknown object ID"}`, http.StatusNotFound)
+			return
+		}
+		parts = path
+	} else {
+		for _, part := range strings.Split(strings.TrimPrefix(r.URL.Path, "/config"), "/") {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		node := f.config
+		for _, part := range parts {
+			switch n := node.(type) {
+			case map[string]interface{}:
+				node = n[part]
+			case []interface{}:
+				i, err := strconv.Atoi(part)
+				if err != nil || i >= len(n) {
+					node = nil
+				} else {
+					node = n[i]
+				}
+			default:
+				node = nil
+			}
+			if node == nil {
+				http.Error(w, `{"error":"path not found"}`, http.StatusNotFound)
+				return
+			}
+		}
+		if isRoot {
+			w.Header().Set("Etag", fakeETag(r.URL.Path, node))
+		}
+		json.NewEncoder(w).Encode(node)
+		return
+	}
+
+	var body interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	updated, err := applyFake(f.config, parts, r.Method, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	f.config = updated
+}
+
+// findFakeID returns the path parts of the object whose @id is id
+func findFakeID(node interface{}, id string) ([]string, bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if n["@id"] == id {
+			return nil, true
+		}
+		for key, child := range n {
+			if path, ok := findFakeID(child, id); ok {
+				return append([]string{key}, path...), true
+			}
+		}
+	case []interface{}:
+		for i, child := range n {
+			if path, ok := findFakeID(child, id); ok {
+				return append([]string{strconv.Itoa(i)}, path...), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func applyFake(node interface{}, parts []string, method string, body interface{}) (interface{}, error) {
+	if len(parts) == 0 {
+		return body, nil
+	}
+	key, last := parts[0], len(parts) == 1
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[key]
+		if last {
+			switch {
+			case method == http.MethodDelete && exists:
+				delete(n, key)
+			case method == http.MethodPut && !exists, method == http.MethodPatch && exists:
+				n[key] = body
+			case method == http.MethodPost:
+				if arr, ok := child.([]interface{}); ok {
+					n[key] = append(arr, body)
+				} else {
+					n[key] = body
+				}
+			default:
+				return nil, fmt.Errorf("%s %s: bad key", method, key)
+			}
+			return n, nil
+		}
+		if !exists {
+			// Like Caddy, PUT creates the objects above the new value
+			if method != http.MethodPut {
+				return nil, fmt.Errorf("%s: path not found", key)
+			}
+			child = map[string]interface{}{}
+		}
+		updated, err := applyFake(child, parts[1:], method, body)
+		if err != nil {
+			return nil, err
+		}
+		n[key] = updated
+		return n, nil
+
+	case []interface{}:
+		if key == "..." && last && method == http.MethodPost {
+			items, _ := body.([]interface{})
+			return append(n, items...), nil
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i >= len(n) {
+			return nil, fmt.Errorf("%s: bad index", key)
+		}
+		if !last {
+			updated, err := applyFake(n[i], parts[1:], method, body)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = updated
+			return n, nil
+		}
+		switch method {
+		case http.MethodDelete:
+			return append(n[:i], n[i+1:]...), nil
+		case http.MethodPatch:
+			n[i] = body
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("%s %s: unsupported", method, key)
+}
+
+// routeIDsByListen summarizes the running servers as listen address ->
+// route @ids
+func routeIDsByListen(t *testing.T, pm *ProxyManager) map[string][]string {
+	t.Helper()
+	servers, err := pm.listServers()
+	if err != nil {
+		t.Fatalf("listServers() returned unexpected error: %v", err)
+	}
+	out := make(map[string][]string)
+	for _, server := range servers {
+		addr := strings.Join(server.Listen, ",")
+		if _, ok := out[addr]; ok {
+			t.Fatalf("more than one server listens on %s", addr)
+		}
+		out[addr] = []string{}
+		for _, route := range server.Routes {
+			out[addr] = append(out[addr], route.ID)
+		}
+	}
+	return out
+}
+
+// TestApplyRoute_SharesServerPerPort verifies that proxies on the same port
+// share one server and that routes move and disappear with their proxies.
+func TestApplyRoute_SharesServerPerPort(t *testing.T) {
+	srv := httptest.NewServer(&fakeCaddy{config: map[string]interface{}{}})
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	for _, p := range []config.CaddyProxy{
+		{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1"},
+		{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2"},
+		{ID: "c", Hostname: "c.example", Port: 9000, Target: "localhost:3"},
+	} {
+		p.Enabled = true
+		if _, err := pm.AddProxy(p); err != nil {
+			t.Fatalf("AddProxy(%s) returned unexpected error: %v", p.ID, err)
+		}
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"a", "b"}, ":9000": {"c"}})
+
+	// Updating in place keeps the route where it is
+	b, _ := pm.GetProxy("b")
+	b.Target = "localhost:22"
+	if err := pm.UpdateProxy(*b); err != nil {
+		t.Fatalf("UpdateProxy() returned unexpected error: %v", err)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"a", "b"}, ":9000": {"c"}})
+
+	// Changing port moves the route to the other shared server
+	b.Port = 9000
+	if err := pm.UpdateProxy(*b); err != nil {
+		t.Fatalf("UpdateProxy() returned unexpected error: %v", err)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"a"}, ":9000": {"c", "b"}})
+
+	// Disabling the last proxy on a port removes its server
+	if err := pm.ToggleProxy("a", false); err != nil {
+		t.Fatalf("ToggleProxy() returned unexpected error: %v", err)
+	}
+	if err := pm.DeleteProxy("c"); err != nil {
+		t.Fatalf("DeleteProxy() returned unexpected error: %v", err)
+	}
+	assertLayout(t, pm, map[string][]string{":9000": {"b"}})
+
+	if pm.serverMap.ByListen[":9000"] == "" || pm.serverMap.ByProxyID["a"] != "" {
+		t.Errorf("server map out of date: %+v", pm.serverMap)
+	}
+}
+
+// TestSharedPort_RejectsMixedHTTPS verifies that HTTPS and plain HTTP
+// proxies cannot be enabled on the same port, since they would share one
+// server and its TLS and redirect settings
+func TestSharedPort_RejectsMixedHTTPS(t *testing.T) {
+	srv := httptest.NewServer(&fakeCaddy{config: map[string]interface{}{}})
+	defer srv.Close()
+	pm := newTestProxyManager(t, srv.URL)
+
+	secure := config.CaddyProxy{ID: "secure", Hostname: "app.tail1.ts.net", Port: 8443, Target: "localhost:1", Enabled: true,
+		HTTPS: &config.ProxyHTTPS{CertSource: config.CertSourceTailscale, RedirectHTTP: true}}
+	if _, err := pm.AddProxy(secure); err != nil {
+		t.Fatalf("AddProxy(secure) returned unexpected error: %v", err)
+	}
+	plain := config.CaddyProxy{ID: "plain", Hostname: "plain.example", Port: 8443, Target: "localhost:2", Enabled: true}
+
+	if _, err := pm.AddProxy(plain); !errors.Is(err, ErrMixedHTTPS) {
+		t.Errorf("AddProxy(plain) on an https port returned %v, want ErrMixedHTTPS", err)
+	}
+	if _, err := pm.PreviewAddProxy(plain); !errors.Is(err, ErrMixedHTTPS) {
+		t.Errorf("PreviewAddProxy(plain) returned %v, want ErrMixedHTTPS", err)
+	}
+	if _, err := pm.ApplyBatch([]BatchOp{{Op: BatchCreate, Proxy: &plain}}, "", false); !errors.Is(err, ErrMixedHTTPS) {
+		t.Errorf("ApplyBatch() creating plain returned %v, want ErrMixedHTTPS", err)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"secure"}})
+
+	// A disabled plain proxy may wait on the port, but not be enabled there
+	plain.Enabled = false
+	if _, err := pm.AddProxy(plain); err != nil {
+		t.Fatalf("AddProxy(disabled plain) returned unexpected error: %v", err)
+	}
+	if err := pm.ToggleProxy("plain", true); !errors.Is(err, ErrMixedHTTPS) {
+		t.Errorf("ToggleProxy(plain) returned %v, want ErrMixedHTTPS", err)
+	}
+
+	// Moving both to plain HTTP in one batch is fine
+	plain.Enabled = true
+	secure.HTTPS = nil
+	secure.Hostname = "app.example"
+	if _, err := pm.ApplyBatch([]BatchOp{
+		{Op: BatchUpdate, Proxy: &plain},
+		{Op: BatchUpdate, Proxy: &secure},
+	}, "", false); err != nil {
+		t.Fatalf("ApplyBatch() switching the port to plain http returned unexpected error: %v", err)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"secure", "plain"}})
+}
+
+func assertLayout(t *testing.T, pm *ProxyManager, want map[string][]string) {
+	t.Helper()
+	got := routeIDsByListen(t, pm)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("layout = %v, want %v", got, want)
+	}
+}
+
+// TestConsolidateServers_MigratesLegacyLayout verifies that a server map and
+// running config from the one-server-per-proxy layout are migrated.
+func TestConsolidateServers_MigratesLegacyLayout(t *testing.T) {
+	dir := t.TempDir()
+	mapPath := filepath.Join(dir, "caddy_servers.json")
+	legacy := `{"by_proxy_id":{"a":"srv0","b":"srv1"},"by_host_port":{"a.example:8443":"srv0","b.example:8443":"srv1"},"next_index":2}`
+	if err := os.WriteFile(mapPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	builder := &ProxyManager{}
+	server := func(listen string, proxies ...config.CaddyProxy) map[string]interface{} {
+		var routes []interface{}
+		for _, p := range proxies {
+			route, err := builder.buildRoute(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded interface{}
+			data, _ := json.Marshal(route)
+			json.Unmarshal(data, &decoded)
+			routes = append(routes, decoded)
+		}
+		return map[string]interface{}{"listen": []interface{}{listen}, "routes": routes}
+	}
+	fake := &fakeCaddy{config: map[string]interface{}{
+		"apps": map[string]interface{}{"http": map[string]interface{}{"servers": map[string]interface{}{
+			"srv0": server(":8443", config.CaddyProxy{ID: "a", Hostname: "a.example", Port: 8443, Target: "localhost:1"}),
+			"srv1": server(":8443", config.CaddyProxy{ID: "b", Hostname: "b.example", Port: 8443, Target: "localhost:2"}),
+		}}},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	pm := NewProxyManager(srv.URL, mapPath)
+	if pm.serverMap.Version != serverMapVersion || pm.serverMap.ByListen[":8443"] != "srv0" || pm.serverMap.ByHostPort != nil {
+		t.Fatalf("server map not migrated on load: %+v", pm.serverMap)
+	}
+	saved, _ := os.ReadFile(mapPath)
+	if strings.Contains(string(saved), "by_host_port") {
+		t.Errorf("migrated server map still has by_host_port: %s", saved)
+	}
+
+	if err := pm.MigrateExistingProxies(); err != nil {
+		t.Fatalf("MigrateExistingProxies() returned unexpected error: %v", err)
+	}
+	assertLayout(t, pm, map[string][]string{":8443": {"a", "b"}})
+	if pm.serverMap.ByProxyID["b"] != "srv0" {
+		t.Errorf("ByProxyID[b] = %q, want srv0", pm.serverMap.ByProxyID["b"])
+	}
+}
@@ -0,0 +1,219 @@
+package caddy
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// DefaultSitesDir is where file_server roots live when the state dir is not
+// configured
+const DefaultSitesDir = "/var/lib/tailscale/sites"
+
+// requestURIPlaceholder is appended to redirect targets that keep the path
+const requestURIPlaceholder = "{http.request.uri}"
+
+// NormalizeType validates a proxy's route type and the settings for it.
+// Routes that are not reverse proxies drop the upstream settings, which
+// would otherwise be stored without being used.
+func NormalizeType(proxy *config.CaddyProxy) error {
+	proxy.Type = strings.ToLower(strings.TrimSpace(proxy.Type))
+	if proxy.Type == "" {
+		proxy.Type = config.ProxyTypeReverseProxy
+	}
+
+	redirect, static, files := proxy.Redirect, proxy.Static, proxy.FileServer
+	proxy.Redirect, proxy.Static, proxy.FileServer = nil, nil, nil
+
+	switch proxy.Type {
+	case config.ProxyTypeReverseProxy:
+		return nil
+	case config.ProxyTypeRedirect:
+		if redirect == nil || strings.TrimSpace(redirect.To) == "" {
+			return fmt.Errorf("redirect requires a target URL")
+		}
+		redirect.To = strings.TrimSpace(redirect.To)
+		if u, err := url.Parse(redirect.To); err != nil || (!u.IsAbs() && !strings.HasPrefix(redirect.To, "/")) {
+			return fmt.Errorf("invalid redirect target %q: must be an absolute URL or a path", redirect.To)
+		}
+		if redirect.PreservePath {
+			redirect.To = strings.TrimSuffix(redirect.To, "/")
+		}
+		switch redirect.Status {
+		case 0:
+			redirect.Status = 302
+		case 301, 302, 307, 308:
+		default:
+			return fmt.Errorf("invalid redirect status %d: must be 301, 302, 307 or 308", redirect.Status)
+		}
+		proxy.Redirect = redirect
+	case config.ProxyTypeStatic:
+		if static == nil {
+			static = &config.ProxyStatic{}
+		}
+		if static.Status == 0 {
+			static.Status = 200
+		}
+		if static.Status < 100 || static.Status > 599 {
+			return fmt.Errorf("invalid status %d", static.Status)
+		}
+		static.ContentType = strings.TrimSpace(static.ContentType)
+		proxy.Static = static
+	case config.ProxyTypeFileServer:
+		if files == nil || strings.TrimSpace(files.Root) == "" {
+			return fmt.Errorf("file_server requires a root directory")
+		}
+		files.Root = filepath.Clean(strings.TrimSpace(files.Root))
+		if !filepath.IsLocal(files.Root) {
+			return fmt.Errorf("invalid root %q: must be a directory inside the sites dir", files.Root)
+		}
+		proxy.FileServer = files
+	default:
+		return fmt.Errorf("invalid type %q: must be reverse_proxy, redirect, static or file_server", proxy.Type)
+	}
+
+	proxy.Target, proxy.Upstreams = "", nil
+	proxy.LoadBalancing, proxy.HealthChecks, proxy.Routes = nil, nil, nil
+	proxy.TLS, proxy.TLSCertFile, proxy.Transport = false, "", nil
+	proxy.TrustedProxies, proxy.TrustedProxyRanges = false, nil
+	proxy.CustomHeaders, proxy.Headers = nil, nil
+	return nil
+}
+
+// isReverseProxy reports whether a proxy proxies to upstreams. Proxies
+// built before route types existed have no type.
+func isReverseProxy(proxy config.CaddyProxy) bool {
+	return proxy.Type == "" || proxy.Type == config.ProxyTypeReverseProxy
+}
+
+// SiteRoot returns the directory a file_server route serves
+func (pm *ProxyManager) SiteRoot(root string) string {
+	dir := pm.sitesDir
+	if dir == "" {
+		dir = DefaultSitesDir
+	}
+	return filepath.Join(dir, root)
+}
+
+// buildSiteHandler builds the handler answering requests for routes that
+// are not reverse proxies
+func (pm *ProxyManager) buildSiteHandler(proxy config.CaddyProxy) (Handler, error) {
+	switch proxy.Type {
+	case config.ProxyTypeRedirect:
+		if proxy.Redirect == nil {
+			return nil, fmt.Errorf("redirect has no target")
+		}
+		location := proxy.Redirect.To
+		if proxy.Redirect.PreservePath {
+			location += requestURIPlaceholder
+		}
+		return Handler{
+			"handler":     "static_response",
+			"status_code": proxy.Redirect.Status,
+			"headers":     map[string][]string{"Location": {location}},
+		}, nil
+	case config.ProxyTypeStatic:
+		static := proxy.Static
+		if static == nil {
+			static = &config.ProxyStatic{Status: 200}
+		}
+		handler := Handler{
+			"handler":     "static_response",
+			"status_code": static.Status,
+		}
+		if static.Body != "" {
+			handler["body"] = static.Body
+		}
+		if static.ContentType != "" {
+			handler["headers"] = map[string][]string{"Content-Type": {static.ContentType}}
+		}
+		return handler, nil
+	case config.ProxyTypeFileServer:
+		if proxy.FileServer == nil {
+			return nil, fmt.Errorf("file_server has no root")
+		}
+		handler := Handler{
+			"handler": "file_server",
+			"root":    pm.SiteRoot(proxy.FileServer.Root),
+		}
+		if proxy.FileServer.Browse {
+			handler["browse"] = map[string]interface{}{}
+		}
+		return handler, nil
+	}
+	return nil, fmt.Errorf("unknown route type %q", proxy.Type)
+}
+
+// extractSiteHandler returns the catch-all handler of a route built by
+// buildSiteHandler
+func extractSiteHandler(route Route) (map[string]interface{}, bool) {
+	if len(route.Handle) == 0 || route.Handle[0]["handler"] != "subroute" {
+		return nil, false
+	}
+	routesRaw, _ := route.Handle[0]["routes"].([]interface{})
+	for _, routeRaw := range routesRaw {
+		routeMap, ok := routeRaw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, hasMatch := routeMap["match"]; hasMatch {
+			continue
+		}
+		handles, _ := routeMap["handle"].([]interface{})
+		for _, h := range handles {
+			handle, ok := h.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if handle["handler"] == "static_response" || handle["handler"] == "file_server" {
+				return handle, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// parseSiteHandler reads a handler found by extractSiteHandler back into a
+// proxy
+func (pm *ProxyManager) parseSiteHandler(handler map[string]interface{}, proxy *config.CaddyProxy) {
+	if handler["handler"] == "file_server" {
+		root, _ := handler["root"].(string)
+		sitesDir := pm.SiteRoot("")
+		if rel, err := filepath.Rel(sitesDir, root); err == nil && filepath.IsLocal(rel) {
+			root = rel
+		}
+		_, browse := handler["browse"].(map[string]interface{})
+		proxy.Type = config.ProxyTypeFileServer
+		proxy.FileServer = &config.ProxyFileServer{Root: root, Browse: browse}
+		return
+	}
+
+	status := 200
+	switch code := handler["status_code"].(type) {
+	case float64:
+		status = int(code)
+	case string:
+		if n, err := strconv.Atoi(code); err == nil {
+			status = n
+		}
+	}
+	headers := parseHeaderValues(handler["headers"])
+
+	if location, ok := headers["Location"]; ok && status >= 300 && status < 400 {
+		redirect := &config.ProxyRedirect{To: location, Status: status}
+		if to, found := strings.CutSuffix(location, requestURIPlaceholder); found {
+			redirect.To, redirect.PreservePath = to, true
+		}
+		proxy.Type = config.ProxyTypeRedirect
+		proxy.Redirect = redirect
+		return
+	}
+
+	body, _ := handler["body"].(string)
+	proxy.Type = config.ProxyTypeStatic
+	proxy.Static = &config.ProxyStatic{Status: status, Body: body, ContentType: headers["Content-Type"]}
+}
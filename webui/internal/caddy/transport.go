@@ -0,0 +1,150 @@
+package caddy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// NormalizeTransport validates a proxy's upstream transport settings. TLS
+// settings turn on the proxy's TLS flag, since they only apply to upstreams
+// spoken to over TLS.
+func NormalizeTransport(proxy *config.CaddyProxy) error {
+	t := proxy.Transport
+	if t == nil {
+		return nil
+	}
+
+	t.DialTimeout = strings.TrimSpace(t.DialTimeout)
+	t.ReadTimeout = strings.TrimSpace(t.ReadTimeout)
+	t.WriteTimeout = strings.TrimSpace(t.WriteTimeout)
+	t.ServerName = strings.TrimSpace(t.ServerName)
+	t.ClientCertFile = strings.TrimSpace(t.ClientCertFile)
+	t.ClientKeyFile = strings.TrimSpace(t.ClientKeyFile)
+	if err := validateDurations(map[string]string{
+		"dial_timeout":  t.DialTimeout,
+		"read_timeout":  t.ReadTimeout,
+		"write_timeout": t.WriteTimeout,
+	}); err != nil {
+		return err
+	}
+
+	if ka := t.KeepAlive; ka != nil {
+		ka.IdleTimeout = strings.TrimSpace(ka.IdleTimeout)
+		if err := validateDurations(map[string]string{"keep_alive idle_timeout": ka.IdleTimeout}); err != nil {
+			return err
+		}
+		if ka.MaxIdleConnsPerHost < 0 {
+			return fmt.Errorf("max_idle_conns_per_host must not be negative")
+		}
+		if *ka == (config.ProxyKeepAlive{}) {
+			t.KeepAlive = nil
+		}
+	}
+
+	if (t.ClientCertFile == "") != (t.ClientKeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	if transportUsesTLS(t) {
+		proxy.TLS = true
+	}
+
+	if *t == (config.ProxyTransport{}) {
+		proxy.Transport = nil
+	}
+	return nil
+}
+
+func transportUsesTLS(t *config.ProxyTransport) bool {
+	return t.InsecureSkipVerify || t.ServerName != "" || t.ClientCertFile != ""
+}
+
+// buildTransport converts a proxy's transport settings and trusted CA file
+// to the reverse_proxy http transport, or nil when Caddy's defaults apply
+func buildTransport(proxy config.CaddyProxy) *HTTPTransport {
+	t := proxy.Transport
+	if t == nil && proxy.TLSCertFile == "" {
+		return nil
+	}
+
+	transport := &HTTPTransport{Protocol: "http"}
+	if proxy.TLSCertFile != "" {
+		transport.TLS = &TLSConfig{
+			CA: &TLSCAConfig{
+				Provider: "file",
+				PEMFiles: []string{proxy.TLSCertFile},
+			},
+		}
+	}
+	if t == nil {
+		return transport
+	}
+
+	transport.DialTimeout = t.DialTimeout
+	transport.ReadTimeout = t.ReadTimeout
+	transport.WriteTimeout = t.WriteTimeout
+	if ka := t.KeepAlive; ka != nil {
+		transport.KeepAlive = &KeepAlive{
+			IdleConnTimeout:     ka.IdleTimeout,
+			MaxIdleConnsPerHost: ka.MaxIdleConnsPerHost,
+		}
+		if ka.Disabled {
+			enabled := false
+			transport.KeepAlive.Enabled = &enabled
+		}
+	}
+
+	if transportUsesTLS(t) {
+		if transport.TLS == nil {
+			transport.TLS = &TLSConfig{}
+		}
+		transport.TLS.InsecureSkipVerify = t.InsecureSkipVerify
+		transport.TLS.ServerName = t.ServerName
+		transport.TLS.ClientCertificateFile = t.ClientCertFile
+		transport.TLS.ClientCertificateKey = t.ClientKeyFile
+	}
+	return transport
+}
+
+// parseTransport reads a reverse_proxy http transport decoded from Caddy's
+// JSON config back into a proxy
+func parseTransport(raw map[string]interface{}, proxy *config.CaddyProxy) {
+	t := &config.ProxyTransport{
+		DialTimeout:  durationString(raw["dial_timeout"]),
+		ReadTimeout:  durationString(raw["read_timeout"]),
+		WriteTimeout: durationString(raw["write_timeout"]),
+	}
+
+	if ka, ok := raw["keep_alive"].(map[string]interface{}); ok {
+		keepAlive := config.ProxyKeepAlive{IdleTimeout: durationString(ka["idle_timeout"])}
+		if enabled, ok := ka["enabled"].(bool); ok && !enabled {
+			keepAlive.Disabled = true
+		}
+		if n, ok := ka["max_idle_conns_per_host"].(float64); ok {
+			keepAlive.MaxIdleConnsPerHost = int(n)
+		}
+		if keepAlive != (config.ProxyKeepAlive{}) {
+			t.KeepAlive = &keepAlive
+		}
+	}
+
+	if tlsConfig, ok := raw["tls"].(map[string]interface{}); ok {
+		proxy.TLS = true
+		if caCfg, ok := tlsConfig["ca"].(map[string]interface{}); ok {
+			if pemFiles, ok := caCfg["pem_files"].([]interface{}); ok && len(pemFiles) > 0 {
+				if pemFile, ok := pemFiles[0].(string); ok {
+					proxy.TLSCertFile = pemFile
+				}
+			}
+		}
+		t.InsecureSkipVerify, _ = tlsConfig["insecure_skip_verify"].(bool)
+		t.ServerName, _ = tlsConfig["server_name"].(string)
+		t.ClientCertFile, _ = tlsConfig["client_certificate_file"].(string)
+		t.ClientKeyFile, _ = tlsConfig["client_certificate_key_file"].(string)
+	}
+
+	if *t != (config.ProxyTransport{}) {
+		proxy.Transport = t
+	}
+}
@@ -0,0 +1,112 @@
+package caddy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// lbPolicies are the selection policies a proxy may use
+var lbPolicies = map[string]bool{
+	config.LBPolicyRoundRobin: true,
+	config.LBPolicyLeastConn:  true,
+	config.LBPolicyIPHash:     true,
+	config.LBPolicyFirst:      true,
+}
+
+// NormalizeUpstreams validates a proxy's upstreams and load balancing
+// settings. Upstreams, when given, replace Target; they are trimmed and
+// de-duplicated. Target is set to the first upstream and Upstreams is only
+// kept when there is more than one.
+func NormalizeUpstreams(proxy *config.CaddyProxy) error {
+	candidates := proxy.Upstreams
+	if len(candidates) == 0 {
+		candidates = []string{proxy.Target}
+	}
+
+	upstreams := uniqueTrimmed(candidates)
+	if len(upstreams) == 0 {
+		return fmt.Errorf("at least one upstream is required")
+	}
+
+	proxy.Target = upstreams[0]
+	proxy.Upstreams = nil
+	if len(upstreams) > 1 {
+		proxy.Upstreams = upstreams
+	}
+
+	lb := proxy.LoadBalancing
+	if lb == nil {
+		return nil
+	}
+
+	lb.Policy = strings.ToLower(strings.TrimSpace(lb.Policy))
+	if lb.Policy != "" && !lbPolicies[lb.Policy] {
+		return fmt.Errorf("invalid load balancing policy %q: must be round_robin, least_conn, ip_hash or first", lb.Policy)
+	}
+	if lb.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if err := validateDurations(map[string]string{"try_duration": lb.TryDuration, "try_interval": lb.TryInterval}); err != nil {
+		return err
+	}
+
+	if *lb == (config.ProxyLoadBalancing{}) {
+		proxy.LoadBalancing = nil
+	}
+	return nil
+}
+
+// buildLoadBalancing converts a proxy's load balancing settings to the
+// reverse_proxy load_balancing block, or nil when Caddy's defaults apply
+func buildLoadBalancing(lb *config.ProxyLoadBalancing) *LoadBalancing {
+	if lb == nil || *lb == (config.ProxyLoadBalancing{}) {
+		return nil
+	}
+
+	out := &LoadBalancing{
+		TryDuration: lb.TryDuration,
+		TryInterval: lb.TryInterval,
+		Retries:     lb.Retries,
+	}
+	if lb.Policy != "" {
+		out.SelectionPolicy = map[string]string{"policy": lb.Policy}
+	}
+	return out
+}
+
+// parseLoadBalancing reads a reverse_proxy load_balancing block decoded
+// from Caddy's JSON config
+func parseLoadBalancing(raw map[string]interface{}) *config.ProxyLoadBalancing {
+	lb := &config.ProxyLoadBalancing{}
+
+	if policy, ok := raw["selection_policy"].(map[string]interface{}); ok {
+		if name, ok := policy["policy"].(string); ok {
+			lb.Policy = name
+		}
+	}
+	if retries, ok := raw["retries"].(float64); ok {
+		lb.Retries = int(retries)
+	}
+	lb.TryDuration = durationString(raw["try_duration"])
+	lb.TryInterval = durationString(raw["try_interval"])
+
+	if *lb == (config.ProxyLoadBalancing{}) {
+		return nil
+	}
+	return lb
+}
+
+// durationString reads a Caddy duration, which is either a string such as
+// "5s" or a number of nanoseconds
+func durationString(v interface{}) string {
+	switch d := v.(type) {
+	case string:
+		return d
+	case float64:
+		return time.Duration(d).String()
+	}
+	return ""
+}
@@ -160,34 +160,3 @@ func GenerateToken() (string, error) {
 	}
 	return hex.EncodeToString(bytes), nil
 }
-
-// LoadOrGenerateToken loads token from file or generates a new one
-func LoadOrGenerateToken(filename string) (string, error) {
-	// Check if file exists
-	if _, err := os.Stat(filename); err == nil {
-		data, err := os.ReadFile(filename)
-		if err != nil {
-			return "", fmt.Errorf("failed to read token file: %w", err)
-		}
-		return string(data), nil
-	}
-
-	// Generate new token
-	token, err := GenerateToken()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate token: %w", err)
-	}
-
-	// Ensure directory exists
-	dir := filepath.Dir(filename)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create directory: %w", err)
-	}
-
-	// Save token to file
-	if err := os.WriteFile(filename, []byte(token), 0600); err != nil {
-		return "", fmt.Errorf("failed to save token: %w", err)
-	}
-
-	return token, nil
-}
@@ -41,7 +41,8 @@ func MigrateFromEnvVar(relaysConfigPath string) error {
 }
 
 // parseRelayList parses the RELAY_LIST environment variable format
-// Format: port:host:port,port:host:port
+// Format: port[/protocol]:host:port,port[/protocol]:host:port
+// where protocol is tcp (default), udp or both, e.g. 53/udp:dns.local:53
 func parseRelayList(relayList string) ([]SocatRelay, error) {
 	items := strings.Split(relayList, ",")
 	relays := make([]SocatRelay, 0, len(items))
@@ -54,12 +55,24 @@ func parseRelayList(relayList string) ([]SocatRelay, error) {
 
 		parts := strings.Split(item, ":")
 		if len(parts) != 3 {
-			return nil, fmt.Errorf("invalid format for item '%s': expected format is 'port:host:port'", item)
+			return nil, fmt.Errorf("invalid format for item '%s': expected format is 'port[/protocol]:host:port'", item)
 		}
 
-		listenPort, err := strconv.Atoi(parts[0])
+		listenSpec := parts[0]
+		protocol := RelayProtocolTCP
+		if idx := strings.Index(listenSpec, "/"); idx != -1 {
+			protocol = strings.ToLower(listenSpec[idx+1:])
+			listenSpec = listenSpec[:idx]
+			switch protocol {
+			case RelayProtocolTCP, RelayProtocolUDP, RelayProtocolBoth:
+			default:
+				return nil, fmt.Errorf("invalid protocol '%s' in item '%s': must be tcp, udp or both", protocol, item)
+			}
+		}
+
+		listenPort, err := strconv.Atoi(listenSpec)
 		if err != nil {
-			return nil, fmt.Errorf("invalid listen port '%s': %w", parts[0], err)
+			return nil, fmt.Errorf("invalid listen port '%s': %w", listenSpec, err)
 		}
 
 		targetHost := parts[1]
@@ -74,6 +87,7 @@ func parseRelayList(relayList string) ([]SocatRelay, error) {
 
 		relay := SocatRelay{
 			ID:         fmt.Sprintf("relay-%d", i+1),
+			Protocol:   protocol,
 			ListenPort: listenPort,
 			TargetHost: targetHost,
 			TargetPort: targetPort,
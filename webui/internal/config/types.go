@@ -9,6 +9,8 @@ type Config struct {
 	Paths   PathsConfig   `yaml:"paths"`
 	Backup  BackupConfig  `yaml:"backup"`
 	Logging LoggingConfig `yaml:"logging"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Caddy   CaddySettings `yaml:"caddy"`
 	// Internal fields
 	ConfigFile string `yaml:"-"`
 }
@@ -24,6 +26,21 @@ type AuthConfig struct {
 	TokenFile           string `yaml:"token_file"`
 	EnableTailscaleAuth bool   `yaml:"enable_tailscale_auth"`
 	EnableTokenAuth     bool   `yaml:"enable_token_auth"`
+
+	// Tailnet access rules, checked against the caller's Tailscale WhoIs
+	// identity. When all are empty, every tailnet device has full access.
+	AllowedUsers  []string `yaml:"allowed_users,omitempty"`   // login names with full access
+	AllowedTags   []string `yaml:"allowed_tags,omitempty"`    // node tags with full access, e.g. tag:admin
+	ReadOnlyUsers []string `yaml:"read_only_users,omitempty"` // login names that may only view
+
+	// Groups names sets of login names that proxy access policies can
+	// allow together, e.g. admins: [alice@example.com, bob@example.com]
+	Groups map[string][]string `yaml:"groups,omitempty"`
+}
+
+// HasTailnetRules reports whether any tailnet identity rule is configured
+func (a AuthConfig) HasTailnetRules() bool {
+	return len(a.AllowedUsers) > 0 || len(a.AllowedTags) > 0 || len(a.ReadOnlyUsers) > 0
 }
 
 // PathsConfig contains file paths for various configurations
@@ -50,18 +67,225 @@ type LoggingConfig struct {
 	Format string `yaml:"format"`
 }
 
+// MetricsConfig contains Prometheus metrics settings
+type MetricsConfig struct {
+	// TailnetNoAuth serves /metrics to tailnet IPs without a session, so
+	// Prometheus can scrape it over Tailscale. Tailnet callers are still
+	// checked against the auth allow rules; other clients are refused.
+	TailnetNoAuth bool `yaml:"tailnet_no_auth"`
+}
+
+// CaddySettings contains settings for how proxies are kept in Caddy
+type CaddySettings struct {
+	// SyncCaddyfile rewrites Paths.CaddyConfig from the proxies after every
+	// change, so Caddy starts with them when it restarts. Anything else in
+	// that Caddyfile is replaced.
+	SyncCaddyfile bool `yaml:"sync_caddyfile"`
+}
+
 // CaddyProxy represents a Caddy reverse proxy configuration
 type CaddyProxy struct {
-	ID             string            `json:"id"`
-	Hostname       string            `json:"hostname"`
-	Port           int               `json:"port"`
-	Target         string            `json:"target"`
-	TLS            bool              `json:"tls"`
-	TLSCertFile    string            `json:"tls_cert_file,omitempty"`
-	TrustedProxies bool              `json:"trusted_proxies"`
-	CustomHeaders  map[string]string `json:"custom_headers,omitempty"`
-	Enabled        bool              `json:"enabled"`
-	Autostart      bool              `json:"autostart"` // Start automatically on container boot
+	ID                 string              `json:"id"`
+	Type               string              `json:"type"` // reverse_proxy (default), redirect, static or file_server
+	Hostname           string              `json:"hostname"`
+	Port               int                 `json:"port"`
+	Redirect           *ProxyRedirect      `json:"redirect,omitempty"`       // set for the redirect type
+	Static             *ProxyStatic        `json:"static,omitempty"`         // set for the static type
+	FileServer         *ProxyFileServer    `json:"file_server,omitempty"`    // set for the file_server type
+	Target             string              `json:"target"`                   // first upstream
+	Upstreams          []string            `json:"upstreams,omitempty"`      // all upstreams when there are several
+	LoadBalancing      *ProxyLoadBalancing `json:"load_balancing,omitempty"` // how requests are spread over Upstreams
+	HealthChecks       *ProxyHealthChecks  `json:"health_checks,omitempty"`
+	Routes             []ProxyRoute        `json:"routes,omitempty"`        // path rules tried in order before Upstreams
+	HTTPS              *ProxyHTTPS         `json:"https,omitempty"`         // serve HTTPS with a Tailscale certificate
+	Access             *ProxyAccess        `json:"access,omitempty"`        // restrict callers by tailnet identity
+	TLS                bool                `json:"tls"`                     // upstream uses TLS
+	TLSCertFile        string              `json:"tls_cert_file,omitempty"` // CA file trusted for the upstream
+	Transport          *ProxyTransport     `json:"transport,omitempty"`     // timeouts, keepalive and TLS client settings for the upstream
+	TrustedProxies     bool                `json:"trusted_proxies"`
+	TrustedProxyRanges []string            `json:"trusted_proxy_ranges,omitempty"` // defaults to lan and localhost
+	IPFilter           *ProxyIPFilter      `json:"ip_filter,omitempty"`            // allow and deny callers by address
+	CustomHeaders      map[string]string   `json:"custom_headers,omitempty"`       // request headers set for the upstream
+	Headers            *ProxyHeaders       `json:"headers,omitempty"`              // other request and response header rules
+	Enabled            bool                `json:"enabled"`
+	Autostart          bool                `json:"autostart"` // Start automatically on container boot
+}
+
+// Route types for CaddyProxy.Type. Only reverse proxies have upstreams and
+// the settings that go with them.
+const (
+	ProxyTypeReverseProxy = "reverse_proxy"
+	ProxyTypeRedirect     = "redirect"    // answer with a redirect to another URL
+	ProxyTypeStatic       = "static"      // answer with a fixed response, e.g. a maintenance page
+	ProxyTypeFileServer   = "file_server" // serve files from a directory under the state dir
+)
+
+// ProxyRedirect sends every request to another URL
+type ProxyRedirect struct {
+	To           string `json:"to"`                      // absolute URL or path
+	Status       int    `json:"status,omitempty"`        // 301, 302 (default), 307 or 308
+	PreservePath bool   `json:"preserve_path,omitempty"` // append the request path and query to To
+}
+
+// ProxyStatic answers every request with a fixed response
+type ProxyStatic struct {
+	Status      int    `json:"status,omitempty"` // default 200
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// ProxyFileServer serves a static site
+type ProxyFileServer struct {
+	Root   string `json:"root"`             // directory under <state_dir>/sites
+	Browse bool   `json:"browse,omitempty"` // list directories without an index file
+}
+
+// Load balancing policies supported by ProxyLoadBalancing
+const (
+	LBPolicyRoundRobin = "round_robin"
+	LBPolicyLeastConn  = "least_conn"
+	LBPolicyIPHash     = "ip_hash"
+	LBPolicyFirst      = "first"
+)
+
+// ProxyLoadBalancing selects an upstream for each request and controls
+// retries when an upstream is unavailable
+type ProxyLoadBalancing struct {
+	Policy      string `json:"policy,omitempty"`       // round_robin (default), least_conn, ip_hash or first
+	Retries     int    `json:"retries,omitempty"`      // extra attempts after the first upstream fails
+	TryDuration string `json:"try_duration,omitempty"` // keep retrying for this long, e.g. 5s
+	TryInterval string `json:"try_interval,omitempty"` // wait between retries, e.g. 250ms
+}
+
+// ProxyRoute sends requests whose path matches one of Paths to its own
+// upstreams, optionally rewriting the path first. Paths use Caddy's path
+// matcher syntax, e.g. /api/*.
+type ProxyRoute struct {
+	Paths       []string `json:"paths"`
+	StripPrefix string   `json:"strip_prefix,omitempty"` // removed from the start of the path
+	Rewrite     string   `json:"rewrite,omitempty"`      // replaces the request URI, may use placeholders
+	Upstreams   []string `json:"upstreams,omitempty"`    // defaults to the proxy's upstreams
+}
+
+// ProxyTransport tunes the connection to the upstreams. Durations use Go
+// syntax, e.g. 10s. Any TLS setting implies the upstream uses TLS.
+type ProxyTransport struct {
+	DialTimeout        string          `json:"dial_timeout,omitempty"`
+	ReadTimeout        string          `json:"read_timeout,omitempty"`
+	WriteTimeout       string          `json:"write_timeout,omitempty"`
+	KeepAlive          *ProxyKeepAlive `json:"keep_alive,omitempty"`
+	InsecureSkipVerify bool            `json:"insecure_skip_verify,omitempty"` // accept any upstream certificate
+	ServerName         string          `json:"server_name,omitempty"`          // SNI and name verified, defaults to the dial host
+	ClientCertFile     string          `json:"client_cert_file,omitempty"`     // presented to upstreams requiring mTLS
+	ClientKeyFile      string          `json:"client_key_file,omitempty"`
+}
+
+// ProxyKeepAlive controls reuse of upstream connections
+type ProxyKeepAlive struct {
+	Disabled            bool   `json:"disabled,omitempty"`
+	IdleTimeout         string `json:"idle_timeout,omitempty"` // close idle connections after this long
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty"`
+}
+
+// Security header presets for ProxyHeaders
+const (
+	HeaderPresetHSTS           = "hsts"            // Strict-Transport-Security for a year, with subdomains
+	HeaderPresetFrameAncestors = "frame_ancestors" // Content-Security-Policy: frame-ancestors 'self'
+	HeaderPresetNoSniff        = "nosniff"         // X-Content-Type-Options: nosniff
+	HeaderPresetCORS           = "cors"            // Access-Control-Allow-Origin: CORSOrigin or *
+)
+
+// ProxyHeaders changes headers on the way to and from the upstream.
+// Request headers to set live in CaddyProxy.CustomHeaders. Response rules
+// apply to upstream responses and can remove upstream headers such as
+// Server.
+type ProxyHeaders struct {
+	Request    *HeaderRules `json:"request,omitempty"`
+	Response   *HeaderRules `json:"response,omitempty"`
+	Presets    []string     `json:"presets,omitempty"`     // response header presets, see HeaderPreset*
+	CORSOrigin string       `json:"cors_origin,omitempty"` // origin for the cors preset, defaults to *
+}
+
+// HeaderRules are header operations, applied as delete, then set and add
+type HeaderRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Delete []string          `json:"delete,omitempty"`
+}
+
+// Shortcut names accepted in place of IP ranges
+const (
+	IPRangeTailnet   = "tailnet"   // Tailscale addresses
+	IPRangeLAN       = "lan"       // private IPv4 ranges and IPv6 ULAs
+	IPRangeLocalhost = "localhost" // loopback
+)
+
+// ProxyIPFilter answers 403 to callers by address. Deny wins over Allow;
+// when Allow is set, only callers in it get through. Entries are CIDRs,
+// single IPs or the IPRange shortcuts.
+type ProxyIPFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// ProxyAccess limits a proxy to tailnet callers matching any of the rules.
+// Allowed callers' login and display name are passed to the upstream in the
+// Tailscale-User-Login and Tailscale-User-Name headers. Without rules, any
+// identified tailnet caller is allowed.
+type ProxyAccess struct {
+	AllowedUsers  []string `json:"allowed_users,omitempty"`  // login names
+	AllowedGroups []string `json:"allowed_groups,omitempty"` // names from auth.groups in config.yaml
+	AllowedTags   []string `json:"allowed_tags,omitempty"`   // node tags, e.g. tag:server
+}
+
+// Certificate sources for ProxyHTTPS
+const (
+	CertSourceTailscale = "tailscale" // Caddy fetches and renews certificates from tailscaled
+	CertSourceFiles     = "files"     // certificates written by `tailscale cert` to the certificates dir
+)
+
+// ProxyHTTPS serves a proxy over HTTPS on its MagicDNS name using a
+// certificate issued through Tailscale
+type ProxyHTTPS struct {
+	CertSource   string `json:"cert_source"`             // tailscale (default) or files
+	CertFile     string `json:"cert_file,omitempty"`     // set for the files source
+	KeyFile      string `json:"key_file,omitempty"`      // set for the files source
+	RedirectHTTP bool   `json:"redirect_http,omitempty"` // redirect plain HTTP on the proxy's port to HTTPS
+}
+
+// ProxyHealthChecks configures how Caddy decides an upstream is healthy.
+// Unhealthy upstreams are skipped until they recover.
+type ProxyHealthChecks struct {
+	Active  *ProxyActiveHealthCheck  `json:"active,omitempty"`
+	Passive *ProxyPassiveHealthCheck `json:"passive,omitempty"`
+}
+
+// ProxyActiveHealthCheck probes every upstream in the background
+type ProxyActiveHealthCheck struct {
+	URI          string `json:"uri"`                     // path to request, e.g. /healthz
+	Interval     string `json:"interval,omitempty"`      // time between probes, default 30s
+	Timeout      string `json:"timeout,omitempty"`       // probe timeout, default 5s
+	ExpectStatus int    `json:"expect_status,omitempty"` // required status code, default any 2xx
+	ExpectBody   string `json:"expect_body,omitempty"`   // regular expression the body must match
+}
+
+// ProxyPassiveHealthCheck marks upstreams unhealthy based on proxied requests
+type ProxyPassiveHealthCheck struct {
+	FailDuration     string `json:"fail_duration,omitempty"`     // how long a failure counts, default 30s
+	MaxFails         int    `json:"max_fails,omitempty"`         // failures within FailDuration before unhealthy, default 1
+	UnhealthyLatency string `json:"unhealthy_latency,omitempty"` // responses slower than this count as failures
+}
+
+// UpstreamList returns the proxy's upstream addresses, falling back to
+// Target for proxies with a single upstream
+func (p CaddyProxy) UpstreamList() []string {
+	if len(p.Upstreams) > 0 {
+		return p.Upstreams
+	}
+	if p.Target != "" {
+		return []string{p.Target}
+	}
+	return nil
 }
 
 // CaddyProxyList represents the list of Caddy proxies
@@ -69,15 +293,23 @@ type CaddyProxyList struct {
 	Proxies []CaddyProxy `json:"proxies"`
 }
 
-// SocatRelay represents a socat TCP relay configuration
+// Relay protocols supported by SocatRelay
+const (
+	RelayProtocolTCP  = "tcp"
+	RelayProtocolUDP  = "udp"
+	RelayProtocolBoth = "both"
+)
+
+// SocatRelay represents a socat TCP/UDP relay configuration
 type SocatRelay struct {
-	ID         string `json:"id"`
-	ListenPort int    `json:"listen_port"`
-	TargetHost string `json:"target_host"`
-	TargetPort int    `json:"target_port"`
-	Enabled    bool   `json:"enabled"`
-	Autostart  bool   `json:"autostart"`     // Start automatically on container boot
-	PID        int    `json:"pid,omitempty"` // Runtime tracking
+	ID          string `json:"id"`
+	Protocol    string `json:"protocol,omitempty"` // tcp (default), udp or both
+	ListenPort  int    `json:"listen_port"`
+	TargetHost  string `json:"target_host"`
+	TargetPort  int    `json:"target_port"`
+	IdleTimeout int    `json:"idle_timeout,omitempty"` // UDP session idle timeout in seconds
+	Enabled     bool   `json:"enabled"`
+	Autostart   bool   `json:"autostart"` // Start automatically on container boot
 }
 
 // SocatRelayList represents the list of socat relays
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/audit"
+)
+
+// AuditHandler serves the audit journal
+type AuditHandler struct {
+	journal *audit.Journal
+}
+
+// NewAuditHandler creates a new audit handler
+func NewAuditHandler(journal *audit.Journal) *AuditHandler {
+	return &AuditHandler{journal: journal}
+}
+
+// List returns audit entries, newest first. Supported query parameters:
+// resource, action, resource_id, actor, since and until (RFC 3339), offset
+// and limit.
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.journal.Query(filter)
+	if err != nil {
+		log.Printf("Error reading audit journal: %v", err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseAuditFilter builds an audit filter from the request query
+func parseAuditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	filter := audit.Filter{
+		Resource:   q.Get("resource"),
+		Action:     q.Get("action"),
+		ResourceID: q.Get("resource_id"),
+		Actor:      q.Get("actor"),
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: must be an RFC 3339 time", name)
+			}
+			*dst = t
+		}
+	}
+
+	for name, dst := range map[string]*int{"offset": &filter.Offset, "limit": &filter.Limit} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("invalid %s", name)
+			}
+			*dst = n
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/audit"
+	"github.com/sudocarlos/tailrelay/internal/auth"
+)
+
+// AuthHandler handles token and session management requests
+type AuthHandler struct {
+	authMW *auth.Middleware
+}
+
+// NewAuthHandler creates a new auth handler
+func NewAuthHandler(authMW *auth.Middleware) *AuthHandler {
+	return &AuthHandler{
+		authMW: authMW,
+	}
+}
+
+// WhoAmI returns the authenticated caller, including the tailnet identity
+// when the request came over Tailscale
+func (h *AuthHandler) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auth.PrincipalFromContext(r.Context()))
+}
+
+// RotateToken replaces the API token and revokes all sessions. The caller
+// gets a fresh session so the UI stays logged in; the new token is returned
+// once and cannot be retrieved again.
+func (h *AuthHandler) RotateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := h.authMW.RotateToken()
+	if err != nil {
+		log.Printf("Error rotating token: %v", err)
+		http.Error(w, "Failed to rotate token", http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, "auth", "rotate_token", "", nil, nil)
+
+	if h.authMW.TokenAuthEnabled() {
+		if err := h.authMW.SetSessionCookie(w, r); err != nil {
+			log.Printf("Error creating session after token rotation: %v", err)
+		}
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "Token rotated; all existing sessions were revoked",
+		"token":   token,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Sessions lists active sessions (GET) or revokes all of them (DELETE)
+func (h *AuthHandler) Sessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.authMW.Sessions())
+
+	case http.MethodDelete:
+		revoked := h.authMW.RevokeSessions()
+		log.Printf("Revoked %d sessions", revoked)
+		audit.Record(r, "auth", "revoke_sessions", "", nil, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "success",
+			"message": "All sessions revoked",
+			"revoked": revoked,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiKeyRequest is the body accepted when creating or updating an API key
+type apiKeyRequest struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ListAPIKeys returns all API keys and the scopes that can be granted
+func (h *AuthHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":   h.authMW.APIKeys().List(),
+		"scopes": auth.Scopes,
+	})
+}
+
+// CreateAPIKey creates a new API key. The secret is returned once.
+func (h *AuthHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, secret, err := h.authMW.APIKeys().Create(req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to create API key: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Created API key %s (%s) with scopes %v", key.Name, key.ID, key.Scopes)
+	audit.Record(r, "api_key", "create", key.ID, nil, key)
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "API key created; store the key now, it cannot be shown again",
+		"api_key": key,
+		"key":     secret,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// UpdateAPIKey changes the name, scopes or expiry of an API key
+func (h *AuthHandler) UpdateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ID == "" {
+		http.Error(w, "API key ID is required", http.StatusBadRequest)
+		return
+	}
+
+	before, _ := h.authMW.APIKeys().Get(req.ID)
+	key, err := h.authMW.APIKeys().Update(req.ID, req.Name, req.Scopes, req.ExpiresAt)
+	if errors.Is(err, auth.ErrAPIKeyNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating API key: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to update API key: %v", err), http.StatusBadRequest)
+		return
+	}
+	audit.Record(r, "api_key", "update", key.ID, before, key)
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "API key updated successfully",
+		"api_key": key,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteAPIKey revokes an API key
+func (h *AuthHandler) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyID := r.URL.Query().Get("id")
+	if keyID == "" {
+		http.Error(w, "API key ID is required", http.StatusBadRequest)
+		return
+	}
+
+	before, _ := h.authMW.APIKeys().Get(keyID)
+	err := h.authMW.APIKeys().Delete(keyID)
+	if errors.Is(err, auth.ErrAPIKeyNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting API key: %v", err)
+		http.Error(w, "Failed to delete API key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted API key %s", keyID)
+	audit.Record(r, "api_key", "delete", keyID, before, nil)
+
+	response := map[string]string{
+		"status":  "success",
+		"message": "API key deleted successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -10,8 +11,11 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/sudocarlos/tailrelay/internal/audit"
+	"github.com/sudocarlos/tailrelay/internal/auth"
 	"github.com/sudocarlos/tailrelay/internal/backup"
 	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/scheduler"
 )
 
 // BackupHandler handles backup-related requests
@@ -19,17 +23,60 @@ type BackupHandler struct {
 	cfg       *config.Config
 	templates *template.Template
 	manager   *backup.Manager
+	authMW    *auth.Middleware
+	scheduler *scheduler.Scheduler
+	schedErr  error
 }
 
 // NewBackupHandler creates a new backup handler
-func NewBackupHandler(cfg *config.Config, templates *template.Template) *BackupHandler {
+func NewBackupHandler(cfg *config.Config, templates *template.Template, authMW *auth.Middleware) *BackupHandler {
 	manager := backup.NewManager(cfg)
 
-	return &BackupHandler{
+	h := &BackupHandler{
 		cfg:       cfg,
 		templates: templates,
 		manager:   manager,
+		authMW:    authMW,
 	}
+
+	if cfg.Backup.AutoBackupEnabled {
+		sched, err := scheduler.New("backup", cfg.Backup.AutoBackupSchedule, h.runScheduledBackup)
+		if err != nil {
+			log.Printf("Warning: invalid auto backup schedule %q: %v", cfg.Backup.AutoBackupSchedule, err)
+			h.schedErr = err
+		} else {
+			h.scheduler = sched
+		}
+	}
+
+	return h
+}
+
+// StartScheduler runs the automatic backup scheduler until the context is cancelled
+func (h *BackupHandler) StartScheduler(ctx context.Context) {
+	if h.scheduler == nil {
+		log.Printf("Automatic backups disabled")
+		return
+	}
+	h.scheduler.Run(ctx)
+}
+
+// runScheduledBackup creates a full backup and prunes old ones
+func (h *BackupHandler) runScheduledBackup() error {
+	backupPath, err := h.manager.Create("full")
+	if err != nil {
+		return fmt.Errorf("create backup: %w", err)
+	}
+	log.Printf("Scheduled backup created: %s", filepath.Base(backupPath))
+	audit.RecordSystem("scheduler", "backup", "create", filepath.Base(backupPath), nil, nil)
+
+	if h.cfg.Backup.RetentionCount > 0 {
+		if err := h.manager.CleanupOldBackups(h.cfg.Backup.RetentionCount); err != nil {
+			return fmt.Errorf("cleanup old backups: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // List renders the backup management page
@@ -77,6 +124,7 @@ func (h *BackupHandler) Create(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to create backup: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "backup", "create", filepath.Base(backupPath), nil, nil)
 
 	// Cleanup old backups
 	if h.cfg.Backup.RetentionCount > 0 {
@@ -96,7 +144,10 @@ func (h *BackupHandler) Create(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Restore handles restoring from a backup
+// Restore handles restoring from a backup. The admin token and API keys in
+// the backup are only restored for callers with the admin scope, so a key
+// limited to restoring backups cannot grant itself more access; restored
+// API keys take effect immediately.
 func (h *BackupHandler) Restore(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -119,15 +170,30 @@ func (h *BackupHandler) Restore(w http.ResponseWriter, r *http.Request) {
 
 	backupPath := filepath.Join(h.cfg.Paths.BackupDir, request.Filename)
 
-	if err := h.manager.Restore(backupPath); err != nil {
+	principal := auth.PrincipalFromContext(r.Context())
+	withCredentials := principal != nil && principal.HasScope(auth.ScopeAdmin)
+	if err := h.manager.Restore(backupPath, withCredentials); err != nil {
 		log.Printf("Error restoring backup: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to restore backup: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "backup", "restore", request.Filename, nil, nil)
 
+	if withCredentials && h.authMW != nil && h.authMW.APIKeys() != nil {
+		if err := h.authMW.APIKeys().Reload(); err != nil {
+			log.Printf("Error reloading restored API keys: %v", err)
+			http.Error(w, fmt.Sprintf("Backup restored, but failed to load its API keys: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	message := "Backup restored successfully. Please restart services for changes to take effect."
+	if !withCredentials {
+		message = "Backup restored successfully, except for the admin token and API keys, which require the admin scope. Please restart services for changes to take effect."
+	}
 	response := map[string]string{
 		"status":  "success",
-		"message": "Backup restored successfully. Please restart services for changes to take effect.",
+		"message": message,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -152,6 +218,7 @@ func (h *BackupHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to delete backup: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "backup", "delete", filename, nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -269,6 +336,7 @@ func (h *BackupHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to save backup", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "backup", "upload", handler.Filename, nil, nil)
 
 	response := map[string]interface{}{
 		"status":   "success",
@@ -292,3 +360,31 @@ func (h *BackupHandler) APIList(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(backups)
 }
+
+// Schedule returns the automatic backup schedule status as JSON
+func (h *BackupHandler) Schedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := scheduler.Status{
+		Name:     "backup",
+		Schedule: h.cfg.Backup.AutoBackupSchedule,
+	}
+	if h.scheduler != nil {
+		status = h.scheduler.Status()
+	}
+
+	response := map[string]interface{}{
+		"auto_backup_enabled": h.cfg.Backup.AutoBackupEnabled,
+		"retention_count":     h.cfg.Backup.RetentionCount,
+		"scheduler":           status,
+	}
+	if h.schedErr != nil {
+		response["schedule_error"] = h.schedErr.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
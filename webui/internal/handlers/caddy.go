@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,37 +14,66 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/sudocarlos/tailrelay/internal/audit"
+	"github.com/sudocarlos/tailrelay/internal/auth"
 	"github.com/sudocarlos/tailrelay/internal/caddy"
 	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/scheduler"
 	"github.com/sudocarlos/tailrelay/internal/tailscale"
 )
 
+// Certificate files from `tailscale cert` are checked daily and fetched
+// again when they expire within certRenewBefore; they are valid for 90 days
+const (
+	certRenewSchedule = "17 4 * * *"
+	certRenewBefore   = 30 * 24 * time.Hour
+)
+
 // CaddyHandler handles Caddy-related requests
 type CaddyHandler struct {
 	cfg       *config.Config
 	templates *template.Template
 	manager   *caddy.Manager
 	tsClient  *tailscale.Client
+	authMW    *auth.Middleware
+	certRenew *scheduler.Scheduler
 }
 
 // NewCaddyHandler creates a new Caddy handler
-func NewCaddyHandler(cfg *config.Config, templates *template.Template) *CaddyHandler {
+func NewCaddyHandler(cfg *config.Config, templates *template.Template, authMW *auth.Middleware) *CaddyHandler {
 	// Use Caddy API instead of file-based config
 	// Pass empty string for server name to enable auto-discovery
 	manager := caddy.NewManager(
 		caddy.DefaultAdminAPI,
 		cfg.Paths.CaddyServerMap,
 	)
+	// Caddy runs in the same container and checks access policies against
+	// the forward auth endpoint over loopback
+	manager.SetForwardAuthDial(fmt.Sprintf("127.0.0.1:%d", cfg.Server.Port))
+	manager.SetSitesDir(filepath.Join(cfg.Paths.StateDir, "sites"))
+	if cfg.Caddy.SyncCaddyfile {
+		manager.SetCaddyfilePath(cfg.Paths.CaddyConfig)
+	}
 
-	return &CaddyHandler{
+	h := &CaddyHandler{
 		cfg:       cfg,
 		templates: templates,
 		manager:   manager,
 		tsClient:  tailscale.NewClient(),
+		authMW:    authMW,
+	}
+	sched, err := scheduler.New("certificate renewal", certRenewSchedule, h.renewCertificates)
+	if err != nil {
+		log.Printf("Warning: invalid certificate renewal schedule %q: %v", certRenewSchedule, err)
+	} else {
+		h.certRenew = sched
 	}
+	return h
 }
 
 // MigrateExistingProxies migrates existing Caddy proxies to metadata storage
@@ -49,9 +81,62 @@ func (h *CaddyHandler) MigrateExistingProxies() error {
 	return h.manager.MigrateExistingProxies()
 }
 
-// InitializeAutostart starts all proxies with autostart enabled
+// InitializeAutostart starts all proxies with autostart enabled. Certificate
+// files fetched with `tailscale cert` are renewed first; while proxies run,
+// StartCertificateRenewal renews them before they expire.
 func (h *CaddyHandler) InitializeAutostart() error {
-	return h.manager.InitializeAutostart()
+	if proxies, err := h.manager.ListProxies(); err == nil {
+		for _, proxy := range proxies {
+			if proxy.Autostart && proxy.HTTPS != nil && proxy.HTTPS.CertSource == config.CertSourceFiles {
+				if err := h.prepareCertificate(&proxy); err != nil {
+					log.Printf("Warning: failed to renew certificate for proxy %s (ID: %s): %v", proxy.Hostname, proxy.ID, err)
+				}
+			}
+		}
+	}
+	err := h.manager.InitializeAutostart()
+
+	// Catch the Caddyfile up with changes made while it was not synced
+	h.manager.SyncCaddyfile()
+	return err
+}
+
+// StartCertificateRenewal renews certificate files from `tailscale cert`
+// on schedule until the context is cancelled
+func (h *CaddyHandler) StartCertificateRenewal(ctx context.Context) {
+	if h.certRenew == nil {
+		return
+	}
+	h.certRenew.Run(ctx)
+}
+
+// renewCertificates fetches the certificate files that expire soon again
+// and has Caddy load them
+func (h *CaddyHandler) renewCertificates() error {
+	due, err := h.manager.CertificatesDue(certRenewBefore)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, proxy := range due {
+		if err := h.prepareCertificate(&proxy); err != nil {
+			log.Printf("Warning: failed to renew certificate for proxy %s (ID: %s): %v", proxy.Hostname, proxy.ID, err)
+			failed = append(failed, proxy.Hostname)
+			continue
+		}
+		if err := h.manager.ReloadCertificate(proxy.ID); err != nil {
+			log.Printf("Warning: failed to reload certificate for proxy %s (ID: %s): %v", proxy.Hostname, proxy.ID, err)
+			failed = append(failed, proxy.Hostname)
+			continue
+		}
+		log.Printf("Renewed certificate for proxy %s (ID: %s)", proxy.Hostname, proxy.ID)
+		audit.RecordSystem("scheduler", "proxy", "renew_certificate", proxy.ID, nil, nil)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to renew certificates for %s", strings.Join(failed, ", "))
+	}
+	return nil
 }
 
 // List renders the Caddy proxy management page
@@ -106,7 +191,30 @@ func (h *CaddyHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	proxy.Hostname = caddy.NormalizeHostname(proxy.Hostname)
+	if err := caddy.NormalizeProxy(&proxy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		proxy.Enabled = true
+		h.previewCertificate(&proxy)
+		preview, err := h.manager.PreviewAddProxy(proxy)
+		h.writePreview(w, preview, err)
+		return
+	}
+
+	if err := h.prepareCertificate(&proxy); err != nil {
+		log.Printf("Error fetching certificate: %v", err)
+		http.Error(w, "Failed to fetch certificate", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.prepareSite(proxy); err != nil {
+		log.Printf("Error creating site directory: %v", err)
+		http.Error(w, "Failed to create site directory", http.StatusInternalServerError)
+		return
+	}
 
 	// Set default enabled state
 	if !proxy.Enabled {
@@ -115,11 +223,16 @@ func (h *CaddyHandler) Create(w http.ResponseWriter, r *http.Request) {
 
 	// Add proxy via API (no reload needed - API handles it instantly)
 	createdProxy, err := h.manager.AddProxy(proxy)
+	if errors.Is(err, caddy.ErrMixedHTTPS) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("Error adding proxy: %v", err)
 		http.Error(w, "Failed to add proxy", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "proxy", "create", createdProxy.ID, nil, createdProxy)
 
 	response := map[string]interface{}{
 		"status":  "success",
@@ -149,14 +262,42 @@ func (h *CaddyHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	proxy.Hostname = caddy.NormalizeHostname(proxy.Hostname)
+	if err := caddy.NormalizeProxy(&proxy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		h.previewCertificate(&proxy)
+		preview, err := h.manager.PreviewUpdateProxy(proxy)
+		h.writePreview(w, preview, err)
+		return
+	}
+
+	if err := h.prepareCertificate(&proxy); err != nil {
+		log.Printf("Error fetching certificate: %v", err)
+		http.Error(w, "Failed to fetch certificate", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.prepareSite(proxy); err != nil {
+		log.Printf("Error creating site directory: %v", err)
+		http.Error(w, "Failed to create site directory", http.StatusInternalServerError)
+		return
+	}
+
+	before, _ := h.manager.GetProxy(proxy.ID)
 
 	// Update proxy via API (no reload needed - API handles it instantly)
-	if err := h.manager.UpdateProxy(proxy); err != nil {
+	if err := h.manager.UpdateProxy(proxy); errors.Is(err, caddy.ErrMixedHTTPS) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("Error updating proxy: %v", err)
 		http.Error(w, "Failed to update proxy", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "proxy", "update", proxy.ID, before, proxy)
 
 	response := map[string]interface{}{
 		"status":  "success",
@@ -181,12 +322,21 @@ func (h *CaddyHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isDryRun(r) {
+		preview, err := h.manager.PreviewDeleteProxy(proxyID)
+		h.writePreview(w, preview, err)
+		return
+	}
+
+	before, _ := h.manager.GetProxy(proxyID)
+
 	// Delete proxy via API (no reload needed - API handles it instantly)
 	if err := h.manager.DeleteProxy(proxyID); err != nil {
 		log.Printf("Error deleting proxy: %v", err)
 		http.Error(w, "Failed to delete proxy", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "proxy", "delete", proxyID, before, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -219,12 +369,25 @@ func (h *CaddyHandler) Toggle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isDryRun(r) {
+		preview, err := h.manager.PreviewToggleProxy(request.ID, request.Enabled)
+		h.writePreview(w, preview, err)
+		return
+	}
+
+	before, _ := h.manager.GetProxy(request.ID)
+
 	// Toggle proxy via API (no reload needed - API handles it instantly)
-	if err := h.manager.ToggleProxy(request.ID, request.Enabled); err != nil {
+	if err := h.manager.ToggleProxy(request.ID, request.Enabled); errors.Is(err, caddy.ErrMixedHTTPS) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("Error toggling proxy: %v", err)
 		http.Error(w, "Failed to toggle proxy", http.StatusInternalServerError)
 		return
 	}
+	after, _ := h.manager.GetProxy(request.ID)
+	audit.Record(r, "proxy", "toggle", request.ID, before, after)
 
 	response := map[string]string{
 		"status":  "success",
@@ -235,6 +398,30 @@ func (h *CaddyHandler) Toggle(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// isDryRun reports whether a proxy change should only be previewed
+func isDryRun(r *http.Request) bool {
+	return parseBool(r.URL.Query().Get("dry_run"))
+}
+
+// writePreview answers a dry run with the config the change would apply and
+// its diff against the running config
+func (h *CaddyHandler) writePreview(w http.ResponseWriter, preview *caddy.Preview, err error) {
+	if err != nil {
+		log.Printf("Error previewing proxy change: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to preview change: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"dry_run": true,
+		"preview": preview,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // Reload handles reloading Caddy configuration
 // Note: This is now a no-op since Caddy API handles changes instantly
 // Kept for backwards compatibility with the Web UI
@@ -282,11 +469,23 @@ func (h *CaddyHandler) APIList(w http.ResponseWriter, r *http.Request) {
 		proxyStatuses = make(map[string]bool)
 	}
 
-	response := make([]struct {
+	// Join Caddy's upstream counters onto each proxy
+	var upstreams map[string][]caddy.ProxyUpstream
+	if caddyRunning {
+		if upstreams, err = h.manager.GetProxyUpstreams(proxies); err != nil {
+			log.Printf("Error getting upstream status: %v", err)
+		}
+	}
+
+	type proxyStatus struct {
 		config.CaddyProxy
-		Running bool `json:"running"`
-	}, 0, len(proxies))
+		Running     bool                     `json:"running"`
+		Upstreams   []caddy.ProxyUpstream    `json:"upstream_status,omitempty"`
+		Certificate *caddy.CertificateStatus `json:"certificate,omitempty"`
+	}
+	response := make([]proxyStatus, 0, len(proxies))
 
+	var running []config.CaddyProxy
 	for _, proxy := range proxies {
 		isRunning := false
 		if caddyRunning && proxy.Enabled {
@@ -296,19 +495,309 @@ func (h *CaddyHandler) APIList(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		response = append(response, struct {
-			config.CaddyProxy
-			Running bool `json:"running"`
-		}{
+		status := proxyStatus{
 			CaddyProxy: proxy,
 			Running:    isRunning,
-		})
+		}
+		if isRunning {
+			status.Upstreams = upstreams[proxy.ID]
+			running = append(running, proxy)
+		}
+		response = append(response, status)
+	}
+
+	// Probed together, so unreachable ports cost one timeout in total
+	certificates := caddy.ProbeCertificates(running, 2*time.Second)
+	for i := range response {
+		response[i].Certificate = certificates[response[i].ID]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StartDriftMonitor starts the background reconciler between the proxy
+// metadata and the running Caddy config
+func (h *CaddyHandler) StartDriftMonitor(ctx context.Context, interval time.Duration) {
+	h.manager.MonitorDrift(ctx, interval)
+}
+
+// Drift returns the reconciler's last result and recent drift events. A
+// POST runs a reconciliation first.
+func (h *CaddyHandler) Drift(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		events, err := h.manager.Reconcile()
+		if err != nil {
+			log.Printf("Error reconciling proxies: %v", err)
+			http.Error(w, "Failed to reconcile proxies", http.StatusBadGateway)
+			return
+		}
+		if len(events) > 0 {
+			audit.Record(r, "proxy", "reconcile", "", nil, events)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.manager.DriftReport())
+}
+
+// Export renders the managed proxies as a Caddyfile and as the part of the
+// running Caddy JSON config that serves them. ?format=caddyfile or
+// ?format=json returns just that rendering, for saving as a file.
+func (h *CaddyHandler) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	export, err := h.manager.Export()
+	if err != nil {
+		log.Printf("Error exporting proxies: %v", err)
+		http.Error(w, "Failed to export proxies", http.StatusBadGateway)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	case "caddyfile":
+		w.Header().Set("Content-Type", "text/caddyfile; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=Caddyfile")
+		io.WriteString(w, export.Caddyfile)
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=caddy.json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(export.Config)
+	default:
+		http.Error(w, "format must be caddyfile or json", http.StatusBadRequest)
+	}
+}
+
+// Batch applies a set of proxy changes in one Caddy config load, so either
+// all of them are made or none is. GET returns the ETag of the running
+// config; a POST with If-Match set to it fails with 412 if the config has
+// changed since.
+func (h *CaddyHandler) Batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		etag, err := h.manager.ConfigETag()
+		if err != nil {
+			log.Printf("Error reading Caddy config: %v", err)
+			http.Error(w, "Failed to read Caddy config", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"etag": etag})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Operations []caddy.BatchOp `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(request.Operations) == 0 {
+		http.Error(w, "No operations given", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := isDryRun(r)
+	for i, op := range request.Operations {
+		if op.Proxy == nil {
+			continue
+		}
+		if err := caddy.NormalizeProxy(op.Proxy); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d (%s): %v", i, op.Op, err), http.StatusBadRequest)
+			return
+		}
+		if err := h.checkCertPaths(*op.Proxy); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d (%s): %v", i, op.Op, err), http.StatusBadRequest)
+			return
+		}
+		if dryRun {
+			h.previewCertificate(op.Proxy)
+			continue
+		}
+		if err := h.prepareCertificate(op.Proxy); err != nil {
+			log.Printf("Error fetching certificate: %v", err)
+			http.Error(w, "Failed to fetch certificate", http.StatusInternalServerError)
+			return
+		}
+		if err := h.prepareSite(*op.Proxy); err != nil {
+			log.Printf("Error creating site directory: %v", err)
+			http.Error(w, "Failed to create site directory", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	before, _ := h.manager.ListProxies()
+	result, err := h.manager.ApplyBatch(request.Operations, r.Header.Get("If-Match"), dryRun)
+	var opErr *caddy.BatchOpError
+	switch {
+	case errors.As(err, &opErr), errors.Is(err, caddy.ErrMixedHTTPS):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, caddy.ErrConfigChanged):
+		http.Error(w, "Caddy config changed since the ETag was read", http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		log.Printf("Error applying proxy batch: %v", err)
+		http.Error(w, "Failed to apply proxy changes", http.StatusBadGateway)
+		return
+	}
+	if !dryRun {
+		after, _ := h.manager.ListProxies()
+		audit.Record(r, "proxy", "batch", "", before, after)
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"dry_run": dryRun,
+		"result":  result,
+	}
+
+	w.Header().Set("ETag", result.ETag)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Import reads a Caddyfile, uploaded as the caddyfile form field or sent as
+// the request body, and reports which of its sites map to proxies. Sites
+// named in select (hostname:port keys, or "all") are imported in one batch.
+func (h *CaddyHandler) Import(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var caddyfile []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+			return
+		}
+		if file, _, err := r.FormFile("caddyfile"); err == nil {
+			defer file.Close()
+			caddyfile, err = io.ReadAll(file)
+			if err != nil {
+				http.Error(w, "Failed to read Caddyfile", http.StatusBadRequest)
+				return
+			}
+		} else {
+			caddyfile = []byte(r.FormValue("caddyfile"))
+		}
+	} else {
+		data, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, "Failed to read Caddyfile", http.StatusBadRequest)
+			return
+		}
+		caddyfile = data
+	}
+	if len(strings.TrimSpace(string(caddyfile))) == 0 {
+		http.Error(w, "Caddyfile is required", http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.manager.ImportCaddyfile(caddyfile)
+	if err != nil {
+		log.Printf("Error adapting Caddyfile: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to read Caddyfile: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"report": report,
+	}
+
+	if keys := splitList(r.FormValue("select")); len(keys) > 0 {
+		ops, err := report.Select(keys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		imported := []config.CaddyProxy{}
+		if len(ops) > 0 {
+			for _, op := range ops {
+				if err := h.checkCertPaths(*op.Proxy); err != nil {
+					http.Error(w, fmt.Sprintf("site %s:%d: %v", op.Proxy.Hostname, op.Proxy.Port, err), http.StatusBadRequest)
+					return
+				}
+				if err := h.prepareSite(*op.Proxy); err != nil {
+					log.Printf("Error creating site directory: %v", err)
+					http.Error(w, "Failed to create site directory", http.StatusInternalServerError)
+					return
+				}
+			}
+			result, err := h.manager.ApplyBatch(ops, "", false)
+			if errors.Is(err, caddy.ErrMixedHTTPS) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("Error importing Caddyfile sites: %v", err)
+				http.Error(w, "Failed to import sites", http.StatusBadGateway)
+				return
+			}
+			imported = result.Proxies
+			audit.Record(r, "proxy", "import", "", nil, imported)
+		}
+		response["imported"] = imported
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// ForwardAuth answers Caddy's access checks for proxies with an access
+// policy. Caddy passes the client address in X-Forwarded-For; allowed
+// callers get their identity back in headers that Caddy copies to the
+// upstream request.
+func (h *CaddyHandler) ForwardAuth(w http.ResponseWriter, r *http.Request) {
+	proxyID := r.URL.Query().Get("proxy")
+	proxy, err := h.manager.GetProxy(proxyID)
+	if err != nil {
+		log.Printf("Forward auth for unknown proxy %q: %v", proxyID, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	clientIP := strings.TrimSpace(forwarded[len(forwarded)-1])
+	identity, err := h.authMW.LookupIdentity(clientIP)
+	if err != nil {
+		log.Printf("Denied %s access to proxy %s: identity lookup failed: %v", clientIP, proxy.ID, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !caddy.AccessAllowed(proxy.Access, h.cfg.Auth.Groups, identity.LoginName, identity.Tags) {
+		log.Printf("Denied %s (user %q, node %q, tags %v) access to proxy %s: not allowed by its access policy",
+			clientIP, identity.LoginName, identity.NodeName, identity.Tags, proxy.ID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set(caddy.HeaderUserLogin, identity.LoginName)
+	w.Header().Set(caddy.HeaderUserName, identity.DisplayName)
+	w.WriteHeader(http.StatusOK)
+}
+
 // APIGet returns a single proxy as JSON
 func (h *CaddyHandler) APIGet(w http.ResponseWriter, r *http.Request) {
 	proxyID := r.URL.Query().Get("id")
@@ -338,6 +827,9 @@ func (h *CaddyHandler) parseProxyFromRequest(r *http.Request) (config.CaddyProxy
 	if err := json.NewDecoder(r.Body).Decode(&proxy); err != nil {
 		return config.CaddyProxy{}, fmt.Errorf("invalid request body")
 	}
+	if err := h.checkCertPaths(proxy); err != nil {
+		return config.CaddyProxy{}, err
+	}
 
 	return proxy, nil
 }
@@ -346,12 +838,38 @@ func (h *CaddyHandler) parseProxyFromMultipart(r *http.Request) (config.CaddyPro
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		return config.CaddyProxy{}, fmt.Errorf("failed to parse form data")
 	}
+	if isDryRun(r) && len(r.MultipartForm.File) > 0 {
+		// Uploads are saved while the form is read
+		return config.CaddyProxy{}, fmt.Errorf("file uploads are not supported in a dry run")
+	}
 
+	// The form only carries the basic fields; start from the stored proxy so
+	// an edit does not drop settings the form does not know about
 	proxy := config.CaddyProxy{}
+	if id := r.FormValue("id"); id != "" {
+		if existing, err := h.manager.GetProxy(id); err == nil {
+			proxy = *existing
+		}
+	}
 	proxy.ID = r.FormValue("id")
 	proxy.Hostname = r.FormValue("hostname")
+	if err := parseTypeForm(r, &proxy); err != nil {
+		return config.CaddyProxy{}, err
+	}
+	if _, ok := r.MultipartForm.Value["tls_cert_file"]; ok {
+		proxy.TLSCertFile = r.FormValue("tls_cert_file")
+		if err := h.checkCertPath("tls_cert_file", proxy.TLSCertFile); err != nil {
+			return config.CaddyProxy{}, err
+		}
+	}
+
+	if _, ok := r.MultipartForm.Value["upstreams"]; ok {
+		proxy.Upstreams = splitList(r.FormValue("upstreams"))
+	} else if target := r.FormValue("target"); target != proxy.Target {
+		// A changed target replaces any stored upstream list
+		proxy.Upstreams = nil
+	}
 	proxy.Target = r.FormValue("target")
-	proxy.TLSCertFile = r.FormValue("tls_cert_file")
 
 	if portStr := r.FormValue("port"); portStr != "" {
 		port, err := strconv.Atoi(portStr)
@@ -366,8 +884,95 @@ func (h *CaddyHandler) parseProxyFromMultipart(r *http.Request) (config.CaddyPro
 		return config.CaddyProxy{}, fmt.Errorf("port is required")
 	}
 
+	if policy := r.FormValue("lb_policy"); policy != "" || r.FormValue("lb_retries") != "" || r.FormValue("lb_try_duration") != "" {
+		lb := &config.ProxyLoadBalancing{
+			Policy:      policy,
+			TryDuration: r.FormValue("lb_try_duration"),
+		}
+		if retries := r.FormValue("lb_retries"); retries != "" {
+			n, err := strconv.Atoi(retries)
+			if err != nil {
+				return config.CaddyProxy{}, fmt.Errorf("invalid retries")
+			}
+			lb.Retries = n
+		}
+		proxy.LoadBalancing = lb
+	}
+
+	if err := parseHealthChecksForm(r, &proxy); err != nil {
+		return config.CaddyProxy{}, err
+	}
+
+	// HTTPS is only changed when the form carries the field
+	if _, ok := r.MultipartForm.Value["https"]; ok {
+		proxy.HTTPS = nil
+		if parseBool(r.FormValue("https")) {
+			proxy.HTTPS = &config.ProxyHTTPS{
+				CertSource:   r.FormValue("https_cert_source"),
+				RedirectHTTP: parseBool(r.FormValue("https_redirect")),
+			}
+		}
+	}
+
+	// Address lists are comma or newline separated, like the access lists
+	_, hasAllow := r.MultipartForm.Value["ip_allow"]
+	_, hasDeny := r.MultipartForm.Value["ip_deny"]
+	if hasAllow || hasDeny {
+		proxy.IPFilter = &config.ProxyIPFilter{
+			Allow: splitList(r.FormValue("ip_allow")),
+			Deny:  splitList(r.FormValue("ip_deny")),
+		}
+	}
+	if _, ok := r.MultipartForm.Value["trusted_proxy_ranges"]; ok {
+		proxy.TrustedProxyRanges = splitList(r.FormValue("trusted_proxy_ranges"))
+	}
+
+	// Access policy lists are comma or newline separated
+	if _, ok := r.MultipartForm.Value["access"]; ok {
+		proxy.Access = nil
+		if parseBool(r.FormValue("access")) {
+			proxy.Access = &config.ProxyAccess{
+				AllowedUsers:  splitList(r.FormValue("access_users")),
+				AllowedGroups: splitList(r.FormValue("access_groups")),
+				AllowedTags:   splitList(r.FormValue("access_tags")),
+			}
+		}
+	}
+
+	// Header rules are sent as a JSON object; presets can also be picked on
+	// their own
+	if _, ok := r.MultipartForm.Value["headers"]; ok {
+		proxy.Headers = nil
+		if raw := strings.TrimSpace(r.FormValue("headers")); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &proxy.Headers); err != nil {
+				return config.CaddyProxy{}, fmt.Errorf("invalid headers")
+			}
+		}
+	}
+	if _, ok := r.MultipartForm.Value["header_presets"]; ok {
+		if proxy.Headers == nil {
+			proxy.Headers = &config.ProxyHeaders{}
+		}
+		proxy.Headers.Presets = splitList(r.FormValue("header_presets"))
+		proxy.Headers.CORSOrigin = r.FormValue("cors_origin")
+	}
+
+	// Path rules are sent as a JSON array
+	if _, ok := r.MultipartForm.Value["routes"]; ok {
+		proxy.Routes = nil
+		if raw := strings.TrimSpace(r.FormValue("routes")); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &proxy.Routes); err != nil {
+				return config.CaddyProxy{}, fmt.Errorf("invalid routes")
+			}
+		}
+	}
+
 	proxy.Enabled = parseBool(r.FormValue("enabled"))
 	proxy.TrustedProxies = parseBool(r.FormValue("trusted_proxies"))
+	if !proxy.TrustedProxies {
+		// Stored ranges would otherwise turn it back on
+		proxy.TrustedProxyRanges = nil
+	}
 	proxy.TLS = parseBool(r.FormValue("tls"))
 	proxy.Autostart = parseBool(r.FormValue("autostart"))
 
@@ -389,17 +994,122 @@ func (h *CaddyHandler) parseProxyFromMultipart(r *http.Request) (config.CaddyPro
 			return config.CaddyProxy{}, fmt.Errorf("invalid certificate file type: must be .pem, .crt, or .cer")
 		}
 
-		certPath, err := h.saveTLSCertFile(proxy.Target, file, fileHeader)
+		certPath, err := h.saveTLSCertFile(proxy.Target, "cert", 0644, file)
 		if err != nil {
 			return config.CaddyProxy{}, err
 		}
 		proxy.TLSCertFile = certPath
 	}
 
+	if err := h.parseTransportForm(r, &proxy); err != nil {
+		return config.CaddyProxy{}, err
+	}
+
 	return proxy, nil
 }
 
-func (h *CaddyHandler) saveTLSCertFile(target string, file multipart.File, header *multipart.FileHeader) (string, error) {
+// parseTransportForm applies the upstream transport fields and the client
+// certificate and key uploads. Stored settings are replaced only when the
+// form carries transport fields.
+func (h *CaddyHandler) parseTransportForm(r *http.Request, proxy *config.CaddyProxy) (err error) {
+	// Uploads are saved before the pair can be checked; a rejected form
+	// must not leave them, least of all the private key, behind
+	var saved []string
+	defer func() {
+		if err != nil {
+			for _, path := range saved {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	fields := []string{"dial_timeout", "read_timeout", "write_timeout", "keepalive", "keepalive_idle_timeout",
+		"keepalive_idle_conns_per_host", "tls_insecure_skip_verify", "tls_server_name"}
+	present := false
+	for _, field := range fields {
+		if _, ok := r.MultipartForm.Value[field]; ok {
+			present = true
+		}
+	}
+
+	var clientCert, clientKey string
+	if proxy.Transport != nil {
+		clientCert, clientKey = proxy.Transport.ClientCertFile, proxy.Transport.ClientKeyFile
+	}
+	if present {
+		t := &config.ProxyTransport{
+			DialTimeout:        r.FormValue("dial_timeout"),
+			ReadTimeout:        r.FormValue("read_timeout"),
+			WriteTimeout:       r.FormValue("write_timeout"),
+			InsecureSkipVerify: parseBool(r.FormValue("tls_insecure_skip_verify")),
+			ServerName:         r.FormValue("tls_server_name"),
+		}
+		ka := &config.ProxyKeepAlive{
+			Disabled:    r.FormValue("keepalive") == "off",
+			IdleTimeout: r.FormValue("keepalive_idle_timeout"),
+		}
+		if n := r.FormValue("keepalive_idle_conns_per_host"); n != "" {
+			conns, err := strconv.Atoi(n)
+			if err != nil {
+				return fmt.Errorf("invalid keepalive_idle_conns_per_host")
+			}
+			ka.MaxIdleConnsPerHost = conns
+		}
+		if *ka != (config.ProxyKeepAlive{}) {
+			t.KeepAlive = ka
+		}
+		proxy.Transport = t
+	}
+
+	if parseBool(r.FormValue("remove_tls_client_cert")) {
+		clientCert, clientKey = "", ""
+	}
+	uploads := []struct {
+		field string
+		kind  string
+		perm  os.FileMode
+		exts  []string
+		path  *string
+	}{
+		{"tls_client_cert_upload", "client.crt", 0644, []string{".pem", ".crt", ".cer"}, &clientCert},
+		{"tls_client_key_upload", "client.key", 0600, []string{".pem", ".key"}, &clientKey},
+	}
+	for _, u := range uploads {
+		file, fileHeader, err := r.FormFile(u.field)
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+
+		fileName := strings.ToLower(fileHeader.Filename)
+		if !slices.ContainsFunc(u.exts, func(ext string) bool { return strings.HasSuffix(fileName, ext) }) {
+			return fmt.Errorf("invalid %s file type: must be %s", u.kind, strings.Join(u.exts, ", "))
+		}
+		path, err := h.saveTLSCertFile(proxy.Target, u.kind, u.perm, file)
+		if err != nil {
+			return err
+		}
+		saved = append(saved, path)
+		*u.path = path
+	}
+
+	if clientCert != "" && clientKey != "" {
+		if _, err := tls.LoadX509KeyPair(clientCert, clientKey); err != nil {
+			return fmt.Errorf("invalid client certificate and key: %v", err)
+		}
+	}
+	if clientCert != "" || clientKey != "" || proxy.Transport != nil {
+		if proxy.Transport == nil {
+			proxy.Transport = &config.ProxyTransport{}
+		}
+		proxy.Transport.ClientCertFile, proxy.Transport.ClientKeyFile = clientCert, clientKey
+	}
+	return nil
+}
+
+// saveTLSCertFile stores an uploaded certificate or key for the target in
+// the certificates dir, naming it after the target and kind
+func (h *CaddyHandler) saveTLSCertFile(target, kind string, perm os.FileMode, file multipart.File) (string, error) {
 	if target == "" {
 		return "", fmt.Errorf("target is required for cert upload")
 	}
@@ -424,12 +1134,9 @@ func (h *CaddyHandler) saveTLSCertFile(target string, file multipart.File, heade
 	}
 
 	nameBase := sanitizeName(host)
-	fileName := fmt.Sprintf("%s-%s.cert", nameBase, port)
+	fileName := fmt.Sprintf("%s-%s.%s", nameBase, port, kind)
 
-	certDir := h.cfg.Paths.CertificatesDir
-	if certDir == "" {
-		certDir = "/data"
-	}
+	certDir := h.certDir()
 
 	if err := os.MkdirAll(certDir, 0755); err != nil {
 		return "", fmt.Errorf("create cert dir: %w", err)
@@ -438,21 +1145,68 @@ func (h *CaddyHandler) saveTLSCertFile(target string, file multipart.File, heade
 	fullPath := filepath.Join(certDir, fileName)
 	fullPath = ensureUniqueFile(fullPath)
 
-	out, err := os.Create(fullPath)
+	out, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return "", fmt.Errorf("create cert file: %w", err)
 	}
 	defer out.Close()
 
 	if _, err := io.Copy(out, file); err != nil {
+		os.Remove(fullPath)
 		return "", fmt.Errorf("write cert file: %w", err)
 	}
 
-	if header != nil && header.Filename != "" {
-		_ = header
+	return fullPath, nil
+}
+
+// certDir returns the directory certificate uploads are stored in
+func (h *CaddyHandler) certDir() string {
+	if h.cfg.Paths.CertificatesDir == "" {
+		return "/data"
 	}
+	return h.cfg.Paths.CertificatesDir
+}
 
-	return fullPath, nil
+// checkCertPaths rejects certificate and key paths outside the certificates
+// dir, so a caller cannot make Caddy open arbitrary files in the container
+func (h *CaddyHandler) checkCertPaths(proxy config.CaddyProxy) error {
+	paths := [][2]string{{"tls_cert_file", proxy.TLSCertFile}}
+	if proxy.Transport != nil {
+		paths = append(paths,
+			[2]string{"client_cert_file", proxy.Transport.ClientCertFile},
+			[2]string{"client_key_file", proxy.Transport.ClientKeyFile})
+	}
+	if proxy.HTTPS != nil {
+		paths = append(paths,
+			[2]string{"cert_file", proxy.HTTPS.CertFile},
+			[2]string{"key_file", proxy.HTTPS.KeyFile})
+	}
+	for _, p := range paths {
+		if err := h.checkCertPath(p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCertPath rejects a non-empty path that is not inside the
+// certificates dir
+func (h *CaddyHandler) checkCertPath(field, path string) error {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(h.certDir())
+	if err != nil {
+		return fmt.Errorf("resolve certificates dir: %w", err)
+	}
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(dir, filepath.Clean(path))
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be a file in %s", field, dir)
 }
 
 func sanitizeName(input string) string {
@@ -478,6 +1232,147 @@ func ensureUniqueFile(path string) string {
 	}
 }
 
+// prepareCertificate fetches the certificate files for proxies that load
+// them from disk rather than letting Caddy ask Tailscale
+func (h *CaddyHandler) prepareCertificate(proxy *config.CaddyProxy) error {
+	if proxy.HTTPS == nil || proxy.HTTPS.CertSource != config.CertSourceFiles {
+		return nil
+	}
+
+	dir := h.cfg.Paths.CertificatesDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create certificates dir: %w", err)
+	}
+	certFile, keyFile := caddy.CertificateFiles(dir, proxy.Hostname)
+	if err := h.tsClient.Cert(proxy.Hostname, certFile, keyFile); err != nil {
+		return err
+	}
+	proxy.HTTPS.CertFile = certFile
+	proxy.HTTPS.KeyFile = keyFile
+	return nil
+}
+
+// previewCertificate fills in where prepareCertificate would store the
+// certificate files, without fetching them
+func (h *CaddyHandler) previewCertificate(proxy *config.CaddyProxy) {
+	if proxy.HTTPS == nil || proxy.HTTPS.CertSource != config.CertSourceFiles {
+		return
+	}
+	proxy.HTTPS.CertFile, proxy.HTTPS.KeyFile = caddy.CertificateFiles(h.cfg.Paths.CertificatesDir, proxy.Hostname)
+}
+
+// prepareSite creates the directory a file_server route serves, so a new
+// site answers with an empty listing rather than an error
+func (h *CaddyHandler) prepareSite(proxy config.CaddyProxy) error {
+	if proxy.Type != config.ProxyTypeFileServer || proxy.FileServer == nil {
+		return nil
+	}
+	return os.MkdirAll(h.manager.SiteRoot(proxy.FileServer.Root), 0755)
+}
+
+// parseTypeForm reads the route type and the fields for redirects, static
+// responses and file servers. Each type's settings are replaced only when
+// the form carries its main field.
+func parseTypeForm(r *http.Request, proxy *config.CaddyProxy) error {
+	if _, ok := r.MultipartForm.Value["type"]; ok {
+		proxy.Type = r.FormValue("type")
+	}
+	has := func(field string) bool {
+		_, ok := r.MultipartForm.Value[field]
+		return ok
+	}
+
+	switch {
+	case proxy.Type == config.ProxyTypeRedirect && has("redirect_to"):
+		redirect := &config.ProxyRedirect{
+			To:           r.FormValue("redirect_to"),
+			PreservePath: parseBool(r.FormValue("redirect_preserve_path")),
+		}
+		if status := r.FormValue("redirect_status"); status != "" {
+			n, err := strconv.Atoi(status)
+			if err != nil {
+				return fmt.Errorf("invalid redirect status")
+			}
+			redirect.Status = n
+		}
+		proxy.Redirect = redirect
+	case proxy.Type == config.ProxyTypeStatic && (has("static_status") || has("static_body")):
+		static := &config.ProxyStatic{
+			Body:        r.FormValue("static_body"),
+			ContentType: r.FormValue("static_content_type"),
+		}
+		if status := r.FormValue("static_status"); status != "" {
+			n, err := strconv.Atoi(status)
+			if err != nil {
+				return fmt.Errorf("invalid status")
+			}
+			static.Status = n
+		}
+		proxy.Static = static
+	case proxy.Type == config.ProxyTypeFileServer && has("file_root"):
+		proxy.FileServer = &config.ProxyFileServer{
+			Root:   r.FormValue("file_root"),
+			Browse: parseBool(r.FormValue("file_browse")),
+		}
+	}
+	return nil
+}
+
+// parseHealthChecksForm reads the optional health check form fields
+func parseHealthChecksForm(r *http.Request, proxy *config.CaddyProxy) error {
+	if uri := r.FormValue("health_uri"); uri != "" {
+		active := &config.ProxyActiveHealthCheck{
+			URI:        uri,
+			Interval:   r.FormValue("health_interval"),
+			Timeout:    r.FormValue("health_timeout"),
+			ExpectBody: r.FormValue("health_expect_body"),
+		}
+		if status := r.FormValue("health_expect_status"); status != "" {
+			n, err := strconv.Atoi(status)
+			if err != nil {
+				return fmt.Errorf("invalid expected status")
+			}
+			active.ExpectStatus = n
+		}
+		if proxy.HealthChecks == nil {
+			proxy.HealthChecks = &config.ProxyHealthChecks{}
+		}
+		proxy.HealthChecks.Active = active
+	}
+
+	maxFails := r.FormValue("max_fails")
+	if maxFails != "" || r.FormValue("fail_duration") != "" || r.FormValue("unhealthy_latency") != "" {
+		passive := &config.ProxyPassiveHealthCheck{
+			FailDuration:     r.FormValue("fail_duration"),
+			UnhealthyLatency: r.FormValue("unhealthy_latency"),
+		}
+		if maxFails != "" {
+			n, err := strconv.Atoi(maxFails)
+			if err != nil {
+				return fmt.Errorf("invalid max_fails")
+			}
+			passive.MaxFails = n
+		}
+		if proxy.HealthChecks == nil {
+			proxy.HealthChecks = &config.ProxyHealthChecks{}
+		}
+		proxy.HealthChecks.Passive = passive
+	}
+
+	return nil
+}
+
+// splitList splits a comma or newline separated form value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func parseBool(value string) bool {
 	value = strings.ToLower(strings.TrimSpace(value))
 	return value == "true" || value == "1" || value == "on" || value == "yes"
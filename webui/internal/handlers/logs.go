@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/sudocarlos/tailrelay/internal/audit"
 	"github.com/sudocarlos/tailrelay/internal/logger"
 )
 
@@ -117,7 +118,9 @@ http.Error(w, fmt.Sprintf("Invalid log level: %s", req.Level), http.StatusBadReq
 return
 }
 
+before := logger.Get().GetLevelName()
 logger.Get().SetLevel(level)
+audit.Record(r, "logs", "set_level", "", map[string]string{"level": before}, map[string]string{"level": logger.Get().GetLevelName()})
 logger.Info("logs", "Log level changed to %s by user %s", strings.ToUpper(req.Level), r.RemoteAddr)
 
 w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/backup"
+	"github.com/sudocarlos/tailrelay/internal/caddy"
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/metrics"
+	"github.com/sudocarlos/tailrelay/internal/socat"
+	"github.com/sudocarlos/tailrelay/internal/tailscale"
+)
+
+// MetricsHandler serves Prometheus metrics for relays, proxies, Tailscale,
+// backups and the web UI itself
+type MetricsHandler struct {
+	cfg         *config.Config
+	relays      *socat.Manager
+	caddyMgr    *caddy.Manager
+	tsClient    *tailscale.Client
+	backups     *backup.Manager
+	httpMetrics *metrics.HTTPMetrics
+}
+
+// NewMetricsHandler creates a new metrics handler. The relay manager must be
+// the one that owns the running relays.
+func NewMetricsHandler(cfg *config.Config, relays *socat.Manager, httpMetrics *metrics.HTTPMetrics) *MetricsHandler {
+	return &MetricsHandler{
+		cfg:         cfg,
+		relays:      relays,
+		caddyMgr:    caddy.NewManager(caddy.DefaultAdminAPI, cfg.Paths.CaddyServerMap),
+		tsClient:    tailscale.NewClient(),
+		backups:     backup.NewManager(cfg),
+		httpMetrics: httpMetrics,
+	}
+}
+
+// Metrics writes all metrics in the Prometheus text format
+func (h *MetricsHandler) Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buf bytes.Buffer
+	mw := metrics.NewWriter(&buf)
+
+	h.writeRelayMetrics(mw)
+	h.writeCaddyMetrics(mw)
+	h.writeTailscaleMetrics(mw)
+	h.writeBackupMetrics(mw)
+	h.httpMetrics.Write(mw)
+
+	if err := mw.Err(); err != nil {
+		log.Printf("Error rendering metrics: %v", err)
+		http.Error(w, "Failed to render metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.Write(buf.Bytes())
+}
+
+// writeRelayMetrics reports relay state and traffic from the socat manager
+func (h *MetricsHandler) writeRelayMetrics(mw *metrics.Writer) {
+	statuses, err := h.relays.GetStatus()
+	if err != nil {
+		log.Printf("Metrics: failed to load relays: %v", err)
+		statuses = nil
+	}
+
+	labels := func(s socat.RelayStatus) metrics.Labels {
+		protocol, _ := socat.NormalizeProtocol(s.Relay.Protocol)
+		return metrics.Labels{
+			"relay":       s.Relay.ID,
+			"protocol":    protocol,
+			"listen_port": strconv.Itoa(s.Relay.ListenPort),
+		}
+	}
+
+	families := []struct {
+		name, help, typ string
+		value           func(socat.RelayStatus) float64
+	}{
+		{"tailrelay_relay_up", "Whether the relay is accepting traffic.", metrics.TypeGauge,
+			func(s socat.RelayStatus) float64 { return metrics.Bool(s.Running) }},
+		{"tailrelay_relay_enabled", "Whether the relay is enabled in the configuration.", metrics.TypeGauge,
+			func(s socat.RelayStatus) float64 { return metrics.Bool(s.Relay.Enabled) }},
+		{"tailrelay_relay_restarts_total", "Number of times the relay was restarted.", metrics.TypeCounter,
+			func(s socat.RelayStatus) float64 { return float64(s.Restarts) }},
+		{"tailrelay_relay_active_connections", "Open connections (TCP) or sessions (UDP) through the relay.", metrics.TypeGauge,
+			func(s socat.RelayStatus) float64 { return float64(s.Stats.ActiveConnections) }},
+		{"tailrelay_relay_connections_total", "Connections accepted since the relay was started.", metrics.TypeCounter,
+			func(s socat.RelayStatus) float64 { return float64(s.Stats.TotalConnections) }},
+		{"tailrelay_relay_received_bytes_total", "Bytes forwarded from clients to the target since the relay was started.", metrics.TypeCounter,
+			func(s socat.RelayStatus) float64 { return float64(s.Stats.BytesIn) }},
+		{"tailrelay_relay_sent_bytes_total", "Bytes forwarded from the target to clients since the relay was started.", metrics.TypeCounter,
+			func(s socat.RelayStatus) float64 { return float64(s.Stats.BytesOut) }},
+	}
+
+	for _, f := range families {
+		mw.Header(f.name, f.help, f.typ)
+		for _, s := range statuses {
+			mw.Sample(f.name, labels(s), f.value(s))
+		}
+	}
+}
+
+// writeCaddyMetrics reports proxy state and upstream counters from Caddy
+func (h *MetricsHandler) writeCaddyMetrics(mw *metrics.Writer) {
+	caddyUp, _ := h.caddyMgr.GetStatus()
+	mw.Gauge("tailrelay_caddy_up", "Whether the Caddy admin API is reachable.", metrics.Bool(caddyUp))
+
+	proxies, err := h.caddyMgr.ListProxies()
+	if err != nil {
+		log.Printf("Metrics: failed to load proxies: %v", err)
+	}
+
+	running := map[string]bool{}
+	if caddyUp {
+		if running, err = h.caddyMgr.GetProxiesStatus(); err != nil {
+			log.Printf("Metrics: failed to get proxy status: %v", err)
+			running = map[string]bool{}
+		}
+	}
+
+	mw.Header("tailrelay_proxy_enabled", "Whether the proxy is enabled in the configuration.", metrics.TypeGauge)
+	for _, p := range proxies {
+		mw.Sample("tailrelay_proxy_enabled", proxyLabels(p), metrics.Bool(p.Enabled))
+	}
+	mw.Header("tailrelay_proxy_running", "Whether the proxy is loaded in the running Caddy config.", metrics.TypeGauge)
+	for _, p := range proxies {
+		mw.Sample("tailrelay_proxy_running", proxyLabels(p), metrics.Bool(running[p.ID]))
+	}
+
+	var upstreams []caddy.UpstreamStatus
+	if caddyUp {
+		if upstreams, err = h.caddyMgr.GetUpstreams(); err != nil {
+			log.Printf("Metrics: failed to get upstreams: %v", err)
+		}
+	}
+
+	mw.Header("tailrelay_caddy_upstream_requests", "Requests currently in flight to the upstream, as reported by Caddy.", metrics.TypeGauge)
+	for _, u := range upstreams {
+		mw.Sample("tailrelay_caddy_upstream_requests", metrics.Labels{"upstream": u.Address}, float64(u.NumRequests))
+	}
+	mw.Header("tailrelay_caddy_upstream_fails", "Recent failed requests to the upstream, as reported by Caddy.", metrics.TypeGauge)
+	for _, u := range upstreams {
+		mw.Sample("tailrelay_caddy_upstream_fails", metrics.Labels{"upstream": u.Address}, float64(u.Fails))
+	}
+}
+
+// writeTailscaleMetrics reports the Tailscale backend state and peer counts
+func (h *MetricsHandler) writeTailscaleMetrics(mw *metrics.Writer) {
+	summary, err := h.tsClient.GetStatusSummary()
+	if err != nil {
+		log.Printf("Metrics: failed to get Tailscale status: %v", err)
+		summary = &tailscale.StatusSummary{BackendState: "Unknown"}
+	}
+
+	mw.Gauge("tailrelay_tailscale_connected", "Whether Tailscale is connected to the tailnet.", metrics.Bool(summary.Connected))
+	mw.Header("tailrelay_tailscale_backend_state", "Current Tailscale backend state; the sample with value 1 is the active state.", metrics.TypeGauge)
+	mw.Sample("tailrelay_tailscale_backend_state", metrics.Labels{"state": summary.BackendState}, 1)
+	mw.Gauge("tailrelay_tailscale_peers", "Number of peers in the tailnet.", float64(summary.PeerCount))
+	mw.Gauge("tailrelay_tailscale_active_peers", "Number of peers that are currently online.", float64(summary.ActivePeers))
+}
+
+// writeBackupMetrics reports the number of backups and the age of the newest one
+func (h *MetricsHandler) writeBackupMetrics(mw *metrics.Writer) {
+	backups, err := h.backups.List()
+	if err != nil {
+		log.Printf("Metrics: failed to list backups: %v", err)
+	}
+
+	mw.Gauge("tailrelay_backup_count", "Number of backups in the backup directory.", float64(len(backups)))
+
+	// List sorts newest first
+	if len(backups) > 0 {
+		newest := backups[0].Timestamp
+		mw.Gauge("tailrelay_backup_last_timestamp_seconds", "Unix time of the newest backup.", float64(newest.Unix()))
+		mw.Gauge("tailrelay_backup_age_seconds", "Age of the newest backup.", time.Since(newest).Seconds())
+	}
+}
+
+func proxyLabels(p config.CaddyProxy) metrics.Labels {
+	return metrics.Labels{
+		"proxy":    p.ID,
+		"hostname": p.Hostname,
+		"port":     strconv.Itoa(p.Port),
+	}
+}
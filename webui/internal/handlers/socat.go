@@ -9,8 +9,10 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/sudocarlos/tailrelay/internal/audit"
 	"github.com/sudocarlos/tailrelay/internal/config"
 	"github.com/sudocarlos/tailrelay/internal/socat"
 )
@@ -24,10 +26,7 @@ type SocatHandler struct {
 
 // NewSocatHandler creates a new socat handler
 func NewSocatHandler(cfg *config.Config, templates *template.Template) *SocatHandler {
-	manager := socat.NewManager(
-		"socat",
-		cfg.Paths.SocatRelayConfig,
-	)
+	manager := socat.NewManager(cfg.Paths.SocatRelayConfig)
 
 	return &SocatHandler{
 		cfg:       cfg,
@@ -41,11 +40,16 @@ func (h *SocatHandler) InitializeAutostart() error {
 	return h.manager.StartAll()
 }
 
-// StartProcessMonitor starts the background process monitor
+// StartProcessMonitor starts the background relay monitor
 func (h *SocatHandler) StartProcessMonitor(ctx context.Context, interval time.Duration) {
 	h.manager.MonitorProcesses(ctx, interval)
 }
 
+// RelayManager returns the manager that owns the running relays
+func (h *SocatHandler) RelayManager() *socat.Manager {
+	return h.manager
+}
+
 // StopAllRelays stops all running relays
 func (h *SocatHandler) StopAllRelays() error {
 	return h.manager.StopAll()
@@ -97,6 +101,13 @@ func (h *SocatHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	protocol, err := socat.NormalizeProtocol(relay.Protocol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	relay.Protocol = protocol
+
 	// Generate ID if not provided
 	if relay.ID == "" {
 		relay.ID = generateRelayID()
@@ -114,6 +125,8 @@ func (h *SocatHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.Record(r, "relay", "create", relay.ID, nil, relay)
+
 	// Start relay if enabled
 	if relay.Enabled {
 		if err := h.manager.StartRelay(&relay); err != nil {
@@ -149,6 +162,13 @@ func (h *SocatHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	protocol, err := socat.NormalizeProtocol(relay.Protocol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	relay.Protocol = protocol
+
 	// Get existing relay to check if it's running
 	existing, err := socat.GetRelay(h.cfg.Paths.SocatRelayConfig, relay.ID)
 	if err != nil {
@@ -158,7 +178,7 @@ func (h *SocatHandler) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Stop if running
-	if existing.PID != 0 {
+	if h.manager.IsRunning(existing.ID) {
 		if err := h.manager.StopRelay(existing); err != nil {
 			log.Printf("Error stopping relay before update: %v", err)
 			http.Error(w, fmt.Sprintf("Failed to stop existing relay: %v", err), http.StatusInternalServerError)
@@ -172,6 +192,7 @@ func (h *SocatHandler) Update(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to update relay", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "relay", "update", relay.ID, existing, relay)
 
 	// Restart if enabled
 	if relay.Enabled {
@@ -212,7 +233,7 @@ func (h *SocatHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Stop if running
-	if relay.PID != 0 {
+	if h.manager.IsRunning(relay.ID) {
 		if err := h.manager.StopRelay(relay); err != nil {
 			log.Printf("Error stopping relay before delete: %v", err)
 			http.Error(w, fmt.Sprintf("Failed to stop relay: %v", err), http.StatusInternalServerError)
@@ -226,6 +247,7 @@ func (h *SocatHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to delete relay", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "relay", "delete", relayID, relay, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -272,6 +294,9 @@ func (h *SocatHandler) Toggle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to toggle relay", http.StatusInternalServerError)
 		return
 	}
+	toggled := *relay
+	toggled.Enabled = request.Enabled
+	audit.Record(r, "relay", "toggle", relay.ID, relay, toggled)
 
 	// Start or stop based on enabled state
 	if request.Enabled {
@@ -282,7 +307,7 @@ func (h *SocatHandler) Toggle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		if relay.PID != 0 {
+		if h.manager.IsRunning(relay.ID) {
 			if err := h.manager.StopRelay(relay); err != nil {
 				log.Printf("Error stopping relay: %v", err)
 				http.Error(w, fmt.Sprintf("Failed to stop relay: %v", err), http.StatusInternalServerError)
@@ -325,6 +350,7 @@ func (h *SocatHandler) Start(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to start relay: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "relay", "start", relay.ID, nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -360,6 +386,7 @@ func (h *SocatHandler) Stop(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to stop relay: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "relay", "stop", relay.ID, nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -395,6 +422,7 @@ func (h *SocatHandler) Restart(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to restart relay: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "relay", "restart", relay.ID, nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -417,6 +445,7 @@ func (h *SocatHandler) RestartAll(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to restart relays: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "relay", "restart_all", "", nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -440,6 +469,49 @@ func (h *SocatHandler) APIList(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(statuses)
 }
 
+// StatsStream pushes relay status and traffic counters via Server-Sent Events.
+// The push interval defaults to 2 seconds and can be set with ?interval=<seconds>.
+func (h *SocatHandler) StatsStream(w http.ResponseWriter, r *http.Request) {
+	interval := 2 * time.Second
+	if v := r.URL.Query().Get("interval"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 1 || seconds > 60 {
+			http.Error(w, "Interval must be between 1 and 60 seconds", http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		statuses, err := h.manager.GetStatus()
+		if err != nil {
+			log.Printf("Error loading relays for stats stream: %v", err)
+		} else if data, err := json.Marshal(statuses); err == nil {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // APIGet returns a single relay as JSON
 func (h *SocatHandler) APIGet(w http.ResponseWriter, r *http.Request) {
 	relayID := r.URL.Query().Get("id")
@@ -2,30 +2,44 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/sudocarlos/tailrelay/internal/audit"
 	"github.com/sudocarlos/tailrelay/internal/auth"
 	"github.com/sudocarlos/tailrelay/internal/config"
 	"github.com/sudocarlos/tailrelay/internal/tailscale"
 )
 
+// TailscaleClient is the part of the Tailscale client used by
+// TailscaleHandler
+type TailscaleClient interface {
+	IsConnected() (bool, error)
+	GetStatusSummary() (*tailscale.StatusSummary, error)
+	GetPeers() ([]tailscale.PeerInfo, error)
+	LoginWithQR() (string, error)
+	Logout() error
+	Up() error
+	Down() error
+}
+
 // TailscaleHandler handles Tailscale-related requests
 type TailscaleHandler struct {
 	cfg       *config.Config
 	templates *template.Template
-	tsClient  *tailscale.Client
+	tsClient  TailscaleClient
 	authMW    *auth.Middleware
 }
 
 // NewTailscaleHandler creates a new Tailscale handler
-func NewTailscaleHandler(cfg *config.Config, templates *template.Template, authMW *auth.Middleware) *TailscaleHandler {
+func NewTailscaleHandler(cfg *config.Config, templates *template.Template, authMW *auth.Middleware, tsClient TailscaleClient) *TailscaleHandler {
 	return &TailscaleHandler{
 		cfg:       cfg,
 		templates: templates,
-		tsClient:  tailscale.NewClient(),
+		tsClient:  tsClient,
 		authMW:    authMW,
 	}
 }
@@ -60,19 +74,48 @@ func (h *TailscaleHandler) Status(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Login handles Tailscale login initiation
+// Login handles Tailscale login initiation. It is a public route: the
+// browser that starts the login gets a one-time nonce which PollStatus
+// exchanges for a session once the node is connected. Logins are only
+// allowed while the node needs one, since in any other state the node can
+// come up without anyone visiting the auth URL. Only one login can be
+// pending: while it is, other browsers are refused and no new `tailscale up`
+// is started.
 func (h *TailscaleHandler) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	authURL, err := h.tsClient.LoginWithQR()
+	summary, err := h.tsClient.GetStatusSummary()
+	if err != nil {
+		log.Printf("Error checking status: %v", err)
+		h.authMW.CancelTailscaleLogin(w, r)
+		http.Error(w, "Failed to check status", http.StatusInternalServerError)
+		return
+	}
+	if summary.BackendState != "NeedsLogin" {
+		h.authMW.CancelTailscaleLogin(w, r)
+		http.Error(w, "Tailscale does not need a login; sign in with the access token or from a tailnet device", http.StatusConflict)
+		return
+	}
+
+	var authURL string
+	err = h.authMW.BeginTailscaleLogin(w, r, func() error {
+		var err error
+		authURL, err = h.tsClient.LoginWithQR()
+		return err
+	})
+	if errors.Is(err, auth.ErrLoginPending) {
+		http.Error(w, "Another Tailscale login is in progress; try again later", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error initiating login: %v", err)
 		http.Error(w, "Failed to initiate login", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "tailscale", "login", "", nil, nil)
 
 	response := map[string]string{
 		"status":   "success",
@@ -96,6 +139,7 @@ func (h *TailscaleHandler) Logout(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to logout", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "tailscale", "logout", "", nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -118,6 +162,7 @@ func (h *TailscaleHandler) Connect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to connect", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "tailscale", "connect", "", nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -140,6 +185,7 @@ func (h *TailscaleHandler) Disconnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to disconnect", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, "tailscale", "disconnect", "", nil, nil)
 
 	response := map[string]string{
 		"status":  "success",
@@ -176,7 +222,8 @@ func (h *TailscaleHandler) APIPeers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(peers)
 }
 
-// PollStatus polls for login completion
+// PollStatus polls for login completion. A session is only granted to the
+// browser holding the nonce of the pending login started by Login.
 func (h *TailscaleHandler) PollStatus(w http.ResponseWriter, r *http.Request) {
 	// Check if connected
 	connected, err := h.tsClient.IsConnected()
@@ -186,14 +233,18 @@ func (h *TailscaleHandler) PollStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If connected and token auth is enabled, set session cookie to allow access from localhost
-	if connected && h.authMW != nil {
-		h.authMW.SetSessionCookie(w, r)
+	authenticated := false
+	if connected {
+		authenticated, err = h.authMW.CompleteTailscaleLogin(w, r)
+		if err != nil {
+			log.Printf("Error creating session: %v", err)
+		}
 	}
 
 	response := map[string]interface{}{
-		"connected": connected,
-		"timestamp": time.Now().Unix(),
+		"connected":     connected,
+		"authenticated": authenticated,
+		"timestamp":     time.Now().Unix(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the histogram upper bounds in seconds for request latencies
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestKey identifies one histogram series
+type requestKey struct {
+	handler string
+	method  string
+	code    string
+}
+
+// histogram is a cumulative latency histogram
+type histogram struct {
+	counts []uint64 // one per bucket, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+// HTTPMetrics records HTTP handler latencies
+type HTTPMetrics struct {
+	mu     sync.Mutex
+	series map[requestKey]*histogram
+}
+
+// NewHTTPMetrics creates an empty HTTP latency recorder
+func NewHTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{
+		series: make(map[requestKey]*histogram),
+	}
+}
+
+// Observe records the duration of a single request
+func (m *HTTPMetrics) Observe(handler, method string, code int, d time.Duration) {
+	key := requestKey{handler: handler, method: methodLabel(method), code: strconv.Itoa(code)}
+	seconds := d.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.series[key] = h
+	}
+	for i, upper := range durationBuckets {
+		if seconds <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// methodLabel maps a request method to a fixed set of label values, so
+// clients cannot create series by sending arbitrary methods
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// Middleware times every request to next. The route function maps a request
+// to a low-cardinality handler label, usually the matched mux pattern.
+func (m *HTTPMetrics) Middleware(next http.Handler, route func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		m.Observe(route(r), r.Method, rec.status, time.Since(start))
+	})
+}
+
+// Write writes the latency histograms to w
+func (m *HTTPMetrics) Write(w *Writer) {
+	const name = "tailrelay_http_request_duration_seconds"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	w.Header(name, "Latency of HTTP requests handled by the web UI.", TypeHistogram)
+	for _, key := range keys {
+		h := m.series[key]
+		labels := Labels{"handler": key.handler, "method": key.method, "code": key.code}
+
+		var cumulative uint64
+		for i, upper := range durationBuckets {
+			cumulative += h.counts[i]
+			w.Sample(name+"_bucket", withLabel(labels, "le", formatValue(upper)), float64(cumulative))
+		}
+		w.Sample(name+"_bucket", withLabel(labels, "le", "+Inf"), float64(h.count))
+		w.Sample(name+"_sum", labels, h.sum)
+		w.Sample(name+"_count", labels, float64(h.count))
+	}
+}
+
+// withLabel returns a copy of labels with one extra label set
+func withLabel(labels Labels, name, value string) Labels {
+	out := make(Labels, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[name] = value
+	return out
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streaming handlers (SSE) flush through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
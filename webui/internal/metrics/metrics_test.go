@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWriter_Format verifies HELP/TYPE lines, sorted labels and escaping
+func TestWriter_Format(t *testing.T) {
+	var b strings.Builder
+	w := NewWriter(&b)
+	w.Header("test_up", "Whether the\nthing is up.", TypeGauge)
+	w.Sample("test_up", Labels{"b": "2", "a": `say "hi"`}, 1)
+	w.Gauge("test_count", "A count.", 2.5)
+
+	if err := w.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "# HELP test_up Whether the\\nthing is up.\n" +
+		"# TYPE test_up gauge\n" +
+		"test_up{a=\"say \\\"hi\\\"\",b=\"2\"} 1\n" +
+		"# HELP test_count A count.\n" +
+		"# TYPE test_count gauge\n" +
+		"test_count 2.5\n"
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+// TestHTTPMetrics_Middleware verifies requests are recorded per handler and status
+func TestHTTPMetrics_Middleware(t *testing.T) {
+	m := NewHTTPMetrics()
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}), func(r *http.Request) string { return r.URL.Path })
+
+	for _, path := range []string{"/ok", "/ok", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// Unknown methods share one series rather than adding one each
+	for _, method := range []string{"FOO1", "FOO2", "get"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/ok", nil))
+	}
+	m.Observe("/slow", http.MethodPost, http.StatusOK, 30*time.Second)
+
+	var b strings.Builder
+	m.Write(NewWriter(&b))
+	out := b.String()
+
+	for _, want := range []string{
+		`tailrelay_http_request_duration_seconds_count{code="200",handler="/ok",method="GET"} 2`,
+		`tailrelay_http_request_duration_seconds_count{code="404",handler="/missing",method="GET"} 1`,
+		`tailrelay_http_request_duration_seconds_bucket{code="200",handler="/slow",le="10",method="POST"} 0`,
+		`tailrelay_http_request_duration_seconds_bucket{code="200",handler="/slow",le="+Inf",method="POST"} 1`,
+		`tailrelay_http_request_duration_seconds_count{code="200",handler="/ok",method="other"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{`method="FOO1"`, `method="FOO2"`, `method="get"`} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("expected output not to contain %q", unwanted)
+		}
+	}
+}
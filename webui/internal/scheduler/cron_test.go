@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@sometimes",
+	}
+
+	for _, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) expected error, got nil", expr)
+		}
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	base := time.Date(2026, 3, 10, 14, 30, 15, 0, time.UTC) // Tuesday
+
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{
+			name: "daily at 2am",
+			expr: "0 2 * * *",
+			want: time.Date(2026, 3, 11, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "every 15 minutes",
+			expr: "*/15 * * * *",
+			want: time.Date(2026, 3, 10, 14, 45, 0, 0, time.UTC),
+		},
+		{
+			name: "every minute",
+			expr: "* * * * *",
+			want: time.Date(2026, 3, 10, 14, 31, 0, 0, time.UTC),
+		},
+		{
+			name: "hourly descriptor",
+			expr: "@hourly",
+			want: time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "weekdays list",
+			expr: "0 9 * * 1,3,5",
+			want: time.Date(2026, 3, 11, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "sunday as 7",
+			expr: "0 0 * * 7",
+			want: time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "first of month",
+			expr: "30 3 1 * *",
+			want: time.Date(2026, 4, 1, 3, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "day of month or day of week",
+			expr: "0 0 20 * 5",
+			want: time.Date(2026, 3, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "leap day",
+			expr: "0 0 29 2 *",
+			want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.expr, err)
+			}
+			got := schedule.Next(base)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", base, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduler_RunNowRecordsFailures(t *testing.T) {
+	fail := true
+	sched, err := New("test", "@daily", func() error {
+		if fail {
+			return errors.New("job failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if err := sched.RunNow(); err == nil {
+		t.Fatal("expected RunNow to return job error")
+	}
+	status := sched.Status()
+	if status.FailureCount != 1 || status.LastError == "" || status.LastSuccess != nil {
+		t.Fatalf("unexpected status after failure: %+v", status)
+	}
+
+	fail = false
+	if err := sched.RunNow(); err != nil {
+		t.Fatalf("RunNow returned error: %v", err)
+	}
+	status = sched.Status()
+	if status.RunCount != 2 || status.LastError != "" || status.LastSuccess == nil {
+		t.Fatalf("unexpected status after success: %+v", status)
+	}
+}
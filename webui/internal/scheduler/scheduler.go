@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+// Job is the work executed on each scheduled run
+type Job func() error
+
+// Status reports the state of a scheduled job
+type Status struct {
+	Name         string     `json:"name"`
+	Enabled      bool       `json:"enabled"`
+	Schedule     string     `json:"schedule"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	RunCount     int        `json:"run_count"`
+	FailureCount int        `json:"failure_count"`
+}
+
+// Scheduler runs a job according to a cron schedule
+type Scheduler struct {
+	name     string
+	expr     string
+	schedule *Schedule
+	job      Job
+
+	mu     sync.RWMutex
+	status Status
+	now    func() time.Time
+}
+
+// New creates a scheduler for the given cron expression and job
+func New(name, expr string, job Job) (*Scheduler, error) {
+	schedule, err := Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("parse schedule: %w", err)
+	}
+
+	return &Scheduler{
+		name:     name,
+		expr:     expr,
+		schedule: schedule,
+		job:      job,
+		status: Status{
+			Name:     name,
+			Schedule: expr,
+		},
+		now: time.Now,
+	}, nil
+}
+
+// Run executes the job on schedule until the context is cancelled.
+// This blocks and should be started in its own goroutine.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.status.Enabled = true
+	s.mu.Unlock()
+
+	logger.Info("scheduler", "Starting %s scheduler (schedule: %s)", s.name, s.expr)
+
+	defer func() {
+		s.mu.Lock()
+		s.status.Enabled = false
+		s.status.NextRun = nil
+		s.mu.Unlock()
+	}()
+
+	for {
+		next := s.schedule.Next(s.now())
+		if next.IsZero() {
+			logger.Error("scheduler", "Schedule %q for %s never fires, stopping", s.expr, s.name)
+			return
+		}
+
+		s.mu.Lock()
+		s.status.NextRun = &next
+		s.mu.Unlock()
+		logger.Debug("scheduler", "Next %s run at %s", s.name, next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Info("scheduler", "%s scheduler shutting down", s.name)
+			return
+		case <-timer.C:
+			s.RunNow()
+		}
+	}
+}
+
+// RunNow executes the job immediately and records the outcome
+func (s *Scheduler) RunNow() error {
+	s.mu.Lock()
+	if s.status.Running {
+		s.mu.Unlock()
+		logger.Warn("scheduler", "Skipping %s run: previous run still in progress", s.name)
+		return fmt.Errorf("%s is already running", s.name)
+	}
+	started := s.now()
+	s.status.Running = true
+	s.status.LastRun = &started
+	s.mu.Unlock()
+
+	logger.Info("scheduler", "Running scheduled %s", s.name)
+	err := s.job()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.RunCount++
+	if err != nil {
+		s.status.FailureCount++
+		s.status.LastError = err.Error()
+		logger.Error("scheduler", "Scheduled %s failed: %v", s.name, err)
+		return err
+	}
+
+	finished := s.now()
+	s.status.LastSuccess = &finished
+	s.status.LastError = ""
+	logger.Info("scheduler", "Scheduled %s completed in %v", s.name, finished.Sub(started).Round(time.Millisecond))
+	return nil
+}
+
+// Status returns a snapshot of the scheduler state
+func (s *Scheduler) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.status
+}
@@ -0,0 +1,284 @@
+package socat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+// dialTimeout bounds how long a relay waits to connect to its target
+const dialTimeout = 10 * time.Second
+
+// halfCloseTimeout is how long a connection stays open after one side has
+// finished sending while the other sends nothing, like socat's -t. A
+// variable so tests can shorten it.
+var halfCloseTimeout = 10 * time.Second
+
+// relayListener is implemented by the TCP and UDP relay engines
+type relayListener interface {
+	stop()
+	failed() (bool, error)
+}
+
+// relayInstance is a running relay with one listener per protocol
+type relayInstance struct {
+	relay     config.SocatRelay
+	listeners []relayListener
+	startedAt time.Time
+	counters  *relayCounters
+}
+
+// startRelayInstance starts the listeners required by the relay protocol
+func startRelayInstance(ctx context.Context, relay config.SocatRelay) (*relayInstance, error) {
+	protocol, err := NormalizeProtocol(relay.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &relayInstance{
+		relay:     relay,
+		startedAt: time.Now(),
+		counters:  &relayCounters{},
+	}
+
+	if protocol == config.RelayProtocolTCP || protocol == config.RelayProtocolBoth {
+		r, err := startTCPRelay(ctx, relay, ri.counters)
+		if err != nil {
+			return nil, err
+		}
+		ri.listeners = append(ri.listeners, r)
+	}
+
+	if protocol == config.RelayProtocolUDP || protocol == config.RelayProtocolBoth {
+		r, err := startUDPRelay(ctx, relay, ri.counters)
+		if err != nil {
+			ri.stop()
+			return nil, err
+		}
+		ri.listeners = append(ri.listeners, r)
+	}
+
+	return ri, nil
+}
+
+// protocol returns the normalized protocol the relay was started with
+func (ri *relayInstance) protocol() string {
+	protocol, _ := NormalizeProtocol(ri.relay.Protocol)
+	return protocol
+}
+
+// stop stops every listener of the relay
+func (ri *relayInstance) stop() {
+	for _, l := range ri.listeners {
+		l.stop()
+	}
+}
+
+// failed reports whether any listener of the relay exited on its own
+func (ri *relayInstance) failed() (bool, error) {
+	for _, l := range ri.listeners {
+		if failed, err := l.failed(); failed {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// tcpRelay is an in-process TCP relay: a listener that forwards each accepted
+// connection to the relay target with a bidirectional copy
+type tcpRelay struct {
+	relay    config.SocatRelay
+	listener net.Listener
+	counters *relayCounters
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	// done is closed when the accept loop exits
+	done chan struct{}
+	// err records why the accept loop exited, nil if it was stopped
+	err error
+}
+
+// startTCPRelay binds the listen port and starts accepting connections
+func startTCPRelay(parent context.Context, relay config.SocatRelay, counters *relayCounters) (*tcpRelay, error) {
+	addr := net.JoinHostPort("", strconv.Itoa(relay.ListenPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on tcp %s: %w", addr, err)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	r := &tcpRelay{
+		relay:    relay,
+		listener: listener,
+		counters: counters,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	// Close the listener when the relay is cancelled to unblock Accept
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go r.serve()
+
+	return r, nil
+}
+
+// serve accepts connections until the listener is closed
+func (r *tcpRelay) serve() {
+	defer close(r.done)
+
+	target := net.JoinHostPort(r.relay.TargetHost, strconv.Itoa(r.relay.TargetPort))
+	var tempDelay time.Duration
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// Back off on transient accept errors, as net/http does
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				logger.Warn("socat", "Relay %s accept error: %v; retrying in %v", r.relay.ID, err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			logger.Error("socat", "Relay %s listener failed: %v", r.relay.ID, err)
+			r.err = err
+			r.cancel()
+			return
+		}
+		tempDelay = 0
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.handleConn(conn, target)
+		}()
+	}
+}
+
+// handleConn dials the target and copies data in both directions until
+// either side closes or the relay is stopped
+func (r *tcpRelay) handleConn(client net.Conn, target string) {
+	defer client.Close()
+
+	r.counters.connOpened()
+	defer r.counters.connClosed()
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	upstream, err := dialer.DialContext(r.ctx, "tcp", target)
+	if err != nil {
+		logger.Warn("socat", "Relay %s failed to connect to %s for %s: %v", r.relay.ID, target, client.RemoteAddr(), err)
+		return
+	}
+	defer upstream.Close()
+
+	logger.Debug("socat", "Relay %s: %s -> %s connected", r.relay.ID, client.RemoteAddr(), target)
+
+	// Tear down both sides when the relay is stopped
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			client.Close()
+			upstream.Close()
+		case <-connDone:
+		}
+	}()
+
+	clientSide, upstreamSide := &relayConn{Conn: client}, &relayConn{Conn: upstream}
+	var copyWG sync.WaitGroup
+	copyWG.Add(2)
+	go func() {
+		defer copyWG.Done()
+		pipe(upstreamSide, clientSide, r.counters.addIn)
+	}()
+	go func() {
+		defer copyWG.Done()
+		pipe(clientSide, upstreamSide, r.counters.addOut)
+	}()
+	copyWG.Wait()
+
+	logger.Debug("socat", "Relay %s: %s -> %s closed", r.relay.ID, client.RemoteAddr(), target)
+}
+
+// pipe copies src to dst, counting bytes written. When src ends cleanly,
+// dst is half-closed so the peer sees EOF, and the peer's remaining data
+// must keep arriving within halfCloseTimeout. When the copy fails, both
+// connections are closed, since the other direction may otherwise wait on
+// a peer that never closes.
+func pipe(dst, src *relayConn, count func(int)) {
+	if _, err := io.Copy(countingWriter{w: dst, add: count}, src); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	tcp, ok := dst.Conn.(*net.TCPConn)
+	if !ok {
+		dst.Close()
+		return
+	}
+	tcp.CloseWrite()
+	dst.linger()
+}
+
+// relayConn is one side of a relayed TCP connection. Once the other side
+// has finished sending, each read must arrive within halfCloseTimeout.
+type relayConn struct {
+	net.Conn
+	lingering atomic.Bool
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.lingering.Load() {
+		c.Conn.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+	}
+	return n, err
+}
+
+// linger starts the half-close deadline on reads from c
+func (c *relayConn) linger() {
+	c.lingering.Store(true)
+	c.Conn.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+}
+
+// stop closes the listener and all active connections, then waits for the
+// relay goroutines to finish
+func (r *tcpRelay) stop() {
+	r.cancel()
+	<-r.done
+	r.wg.Wait()
+}
+
+// failed reports whether the accept loop exited on its own
+func (r *tcpRelay) failed() (bool, error) {
+	select {
+	case <-r.done:
+		return r.err != nil, r.err
+	default:
+		return false, nil
+	}
+}
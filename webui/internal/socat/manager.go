@@ -3,183 +3,85 @@ package socat
 import (
 	"context"
 	"fmt"
-	"os"
-	"os/exec"
-	"strings"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/sudocarlos/tailrelay/internal/config"
 	"github.com/sudocarlos/tailrelay/internal/logger"
 )
 
-// Manager handles socat process management
+// Manager runs socat-style TCP and UDP relays in-process
 type Manager struct {
-	socatBinary string
-	relaysFile  string
-}
+	relaysFile string
 
-// NewManager creates a new socat manager
-func NewManager(socatBinary, relaysFile string) *Manager {
-	if socatBinary == "" {
-		socatBinary = "socat" // Default to PATH
-	}
+	mu       sync.Mutex
+	running  map[string]*relayInstance
+	restarts map[string]int
+}
 
+// NewManager creates a new relay manager
+func NewManager(relaysFile string) *Manager {
 	return &Manager{
-		socatBinary: socatBinary,
-		relaysFile:  relaysFile,
+		relaysFile: relaysFile,
+		running:    make(map[string]*relayInstance),
+		restarts:   make(map[string]int),
 	}
 }
 
-// StartRelay starts a single socat relay process
+// StartRelay starts a single relay
 func (m *Manager) StartRelay(relay *config.SocatRelay) error {
-	logger.Debug("socat", "StartRelay called for relay %s (listen=%d, target=%s:%d)",
-		relay.ID, relay.ListenPort, relay.TargetHost, relay.TargetPort)
+	logger.Debug("socat", "StartRelay called for relay %s (protocol=%s, listen=%d, target=%s:%d)",
+		relay.ID, relay.Protocol, relay.ListenPort, relay.TargetHost, relay.TargetPort)
 
 	if !relay.Enabled {
 		logger.Warn("socat", "Attempted to start disabled relay %s", relay.ID)
 		return fmt.Errorf("relay is disabled")
 	}
 
-	// If relay has a PID, check if it's actually running
-	// If not, clear the stale PID
-	if relay.PID != 0 {
-		isRunning := m.IsProcessRunning(relay.PID)
-		logger.Info("socat", "Relay %s has PID %d, checking if running: %v", relay.ID, relay.PID, isRunning)
-		if isRunning {
-			logger.Warn("socat", "Relay %s already running with PID %d", relay.ID, relay.PID)
-			return fmt.Errorf("relay already running with PID %d", relay.PID)
-		}
-		// Clear stale PID
-		logger.Info("socat", "Clearing stale PID %d for relay %s before starting", relay.PID, relay.ID)
-		relay.PID = 0
-		if err := UpdateRelayPID(m.relaysFile, relay.ID, 0); err != nil {
-			logger.Warn("socat", "Failed to clear stale PID: %v", err)
-		}
-	}
-
-	// Build socat command
-	// socat tcp-listen:PORT,fork,reuseaddr tcp:HOST:PORT
-	listenAddr := fmt.Sprintf("tcp-listen:%d,fork,reuseaddr", relay.ListenPort)
-	targetAddr := fmt.Sprintf("tcp:%s:%d", relay.TargetHost, relay.TargetPort)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	logger.Debug("socat", "Starting socat: %s %s %s", m.socatBinary, listenAddr, targetAddr)
-
-	cmd := exec.Command(m.socatBinary, listenAddr, targetAddr)
-
-	// Set process group ID to the process PID so we can kill the entire group
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
+	if existing, ok := m.running[relay.ID]; ok {
+		if failed, _ := existing.failed(); !failed {
+			logger.Warn("socat", "Relay %s already running", relay.ID)
+			return fmt.Errorf("relay already running")
+		}
+		// A listener died; stop the others so their ports are free before
+		// starting again
+		existing.stop()
+		delete(m.running, relay.ID)
 	}
 
-	// Start the process in background
-	if err := cmd.Start(); err != nil {
+	r, err := startRelayInstance(context.Background(), *relay)
+	if err != nil {
 		logger.Error("socat", "Failed to start relay %s on port %d: %v", relay.ID, relay.ListenPort, err)
-		return fmt.Errorf("failed to start socat: %w", err)
+		return fmt.Errorf("failed to start relay: %w", err)
 	}
+	m.running[relay.ID] = r
 
-	// Update PID in relay config
-	relay.PID = cmd.Process.Pid
-	logger.Debug("socat", "Relay %s started with PID %d, updating config file", relay.ID, relay.PID)
-
-	if err := UpdateRelayPID(m.relaysFile, relay.ID, relay.PID); err != nil {
-		logger.Warn("socat", "Failed to update PID for relay %s in config: %v", relay.ID, err)
-	}
-
-	logger.Info("socat", "Started socat relay %s (PID %d): 0.0.0.0:%d -> %s:%d",
-		relay.ID, relay.PID, relay.ListenPort, relay.TargetHost, relay.TargetPort)
+	logger.Info("socat", "Started %s relay %s: 0.0.0.0:%d -> %s:%d",
+		r.protocol(), relay.ID, relay.ListenPort, relay.TargetHost, relay.TargetPort)
 
 	return nil
 }
 
-// StopRelay stops a running socat relay process
+// StopRelay stops a running relay and closes its active connections
 func (m *Manager) StopRelay(relay *config.SocatRelay) error {
-	logger.Debug("socat", "StopRelay called for relay %s (PID=%d)", relay.ID, relay.PID)
-
-	if relay.PID == 0 {
-		logger.Debug("socat", "Relay %s has no PID - already stopped", relay.ID)
-		return nil // Idempotent: already stopped
-	}
-
-	// Check if process is already dead before attempting to kill
-	if !m.IsProcessRunning(relay.PID) {
-		logger.Debug("socat", "Process %d for relay %s is already dead, clearing PID", relay.PID, relay.ID)
-		relay.PID = 0
-		if err := UpdateRelayPID(m.relaysFile, relay.ID, 0); err != nil {
-			logger.Warn("socat", "Failed to clear PID for relay %s in config: %v", relay.ID, err)
-		}
-		return nil // Idempotent: process was already dead
-	}
+	logger.Debug("socat", "StopRelay called for relay %s", relay.ID)
 
-	// Kill the entire process group (socat uses fork)
-	// Use negative PID to target the process group
-	logger.Debug("socat", "Killing process group -%d (SIGTERM)", relay.PID)
-	if err := syscall.Kill(-relay.PID, syscall.SIGTERM); err != nil {
-		// If process group kill fails, try killing just the process
-		logger.Debug("socat", "Process group kill failed (%v), trying single process", err)
-		process, err := os.FindProcess(relay.PID)
-		if err != nil {
-			logger.Debug("socat", "Failed to find process %d for relay %s: %v (likely already dead)", relay.PID, relay.ID, err)
-			// Process is gone - treat as success
-			relay.PID = 0
-			if err := UpdateRelayPID(m.relaysFile, relay.ID, 0); err != nil {
-				logger.Warn("socat", "Failed to clear PID for relay %s in config: %v", relay.ID, err)
-			}
-			return nil
-		}
+	m.mu.Lock()
+	r, ok := m.running[relay.ID]
+	delete(m.running, relay.ID)
+	m.mu.Unlock()
 
-		logger.Debug("socat", "Sending SIGTERM to PID %d", relay.PID)
-		if err := process.Signal(syscall.SIGTERM); err != nil {
-			// Process might already be dead - check the error
-			logger.Debug("socat", "Failed to signal process %d: %v (likely already dead)", relay.PID, err)
-			// Verify the process is actually gone
-			if !m.IsProcessRunning(relay.PID) {
-				logger.Debug("socat", "Confirmed process %d is not running", relay.PID)
-				relay.PID = 0
-				if err := UpdateRelayPID(m.relaysFile, relay.ID, 0); err != nil {
-					logger.Warn("socat", "Failed to clear PID for relay %s in config: %v", relay.ID, err)
-				}
-				return nil
-			}
-			// Process exists but we couldn't signal it - this is a real error
-			logger.Error("socat", "Failed to stop relay %s (PID %d): %v", relay.ID, relay.PID, err)
-			return fmt.Errorf("failed to stop process: %w", err)
-		}
-	}
-
-	// Wait for processes to terminate gracefully
-	// If SIGTERM doesn't work, send SIGKILL to process group
-	logger.Debug("socat", "Waiting for process group to terminate...")
-	for i := 0; i < 5; i++ {
-		if !m.IsProcessRunning(relay.PID) {
-			logger.Debug("socat", "Process %d terminated successfully", relay.PID)
-			break
-		}
-		if i == 4 {
-			// Last resort: SIGKILL to process group
-			logger.Warn("socat", "Process %d did not terminate gracefully, sending SIGKILL to group", relay.PID)
-			if err := syscall.Kill(-relay.PID, syscall.SIGKILL); err != nil {
-				logger.Debug("socat", "SIGKILL to process group failed: %v (process may already be dead)", err)
-				// Try single process SIGKILL
-				if err := syscall.Kill(relay.PID, syscall.SIGKILL); err != nil {
-					logger.Debug("socat", "SIGKILL to process failed: %v", err)
-				}
-			}
-		}
-		// Wait 200ms between checks (total ~1 second for graceful shutdown)
-		time.Sleep(200 * time.Millisecond)
+	if !ok {
+		logger.Debug("socat", "Relay %s is not running - already stopped", relay.ID)
+		return nil // Idempotent: already stopped
 	}
 
-	// Clear PID
-	oldPID := relay.PID
-	relay.PID = 0
-	logger.Debug("socat", "Clearing PID for relay %s in config", relay.ID)
-
-	if err := UpdateRelayPID(m.relaysFile, relay.ID, 0); err != nil {
-		logger.Warn("socat", "Failed to clear PID for relay %s in config: %v", relay.ID, err)
-	}
+	r.stop()
 
-	logger.Info("socat", "Stopped socat relay %s (was PID %d)", relay.ID, oldPID)
+	logger.Info("socat", "Stopped relay %s", relay.ID)
 	return nil
 }
 
@@ -187,15 +89,19 @@ func (m *Manager) StopRelay(relay *config.SocatRelay) error {
 func (m *Manager) RestartRelay(relay *config.SocatRelay) error {
 	logger.Debug("socat", "RestartRelay called for relay %s", relay.ID)
 
-	// Stop if running
-	if relay.PID != 0 {
-		if err := m.StopRelay(relay); err != nil {
-			logger.Warn("socat", "Failed to stop relay %s during restart: %v", relay.ID, err)
-		}
+	if err := m.StopRelay(relay); err != nil {
+		logger.Warn("socat", "Failed to stop relay %s during restart: %v", relay.ID, err)
+	}
+
+	if err := m.StartRelay(relay); err != nil {
+		return err
 	}
 
-	// Start relay
-	return m.StartRelay(relay)
+	m.mu.Lock()
+	m.restarts[relay.ID]++
+	m.mu.Unlock()
+
+	return nil
 }
 
 // StartAll starts all relays with autostart enabled
@@ -208,24 +114,6 @@ func (m *Manager) StartAll() error {
 		return fmt.Errorf("failed to load relays: %w", err)
 	}
 
-	// First pass: clear any stale PIDs from previous runs
-	logger.Info("socat", "Checking for stale PIDs before starting autostart relays...")
-	staleCleaned := 0
-	for i := range relays {
-		if relays[i].PID != 0 && !m.IsProcessRunning(relays[i].PID) {
-			logger.Info("socat", "Clearing stale PID %d for relay %s", relays[i].PID, relays[i].ID)
-			if err := UpdateRelayPID(m.relaysFile, relays[i].ID, 0); err != nil {
-				logger.Warn("socat", "Failed to clear stale PID for relay %s: %v", relays[i].ID, err)
-			} else {
-				relays[i].PID = 0
-				staleCleaned++
-			}
-		}
-	}
-	if staleCleaned > 0 {
-		logger.Info("socat", "Cleared %d stale PID(s)", staleCleaned)
-	}
-
 	started := 0
 	failed := 0
 
@@ -255,32 +143,17 @@ func (m *Manager) StartAll() error {
 
 // StopAll stops all running relays
 func (m *Manager) StopAll() error {
-	logger.Debug("socat", "StopAll: loading relays from %s", m.relaysFile)
-
-	relays, err := LoadRelays(m.relaysFile)
-	if err != nil {
-		logger.Error("socat", "Failed to load relays from %s: %v", m.relaysFile, err)
-		return fmt.Errorf("failed to load relays: %w", err)
-	}
-
-	stopped := 0
-	failed := 0
-
-	for i := range relays {
-		if relays[i].PID == 0 {
-			logger.Debug("socat", "Skipping relay %s (no PID)", relays[i].ID)
-			continue
-		}
+	m.mu.Lock()
+	running := m.running
+	m.running = make(map[string]*relayInstance)
+	m.mu.Unlock()
 
-		if err := m.StopRelay(&relays[i]); err != nil {
-			logger.Error("socat", "Failed to stop relay %s: %v", relays[i].ID, err)
-			failed++
-		} else {
-			stopped++
-		}
+	for id, r := range running {
+		r.stop()
+		logger.Debug("socat", "Stopped relay %s", id)
 	}
 
-	logger.Info("socat", "StopAll complete: %d stopped, %d failed", stopped, failed)
+	logger.Info("socat", "StopAll complete: %d stopped", len(running))
 	return nil
 }
 
@@ -297,70 +170,17 @@ func (m *Manager) RestartAll() error {
 	return m.StartAll()
 }
 
-// IsProcessRunning checks if a process with given PID is running
-// and is actually a socat process (not a zombie, thread, or unrelated process)
-func (m *Manager) IsProcessRunning(pid int) bool {
-	if pid <= 0 {
-		return false
-	}
+// IsRunning reports whether the relay with the given ID is accepting connections
+func (m *Manager) IsRunning(relayID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	// Check if process/thread exists
-	process, err := os.FindProcess(pid)
-	if err != nil {
+	r, ok := m.running[relayID]
+	if !ok {
 		return false
 	}
-
-	// Send signal 0 to check if process exists
-	err = process.Signal(syscall.Signal(0))
-	if err != nil {
-		return false
-	}
-
-	// Check /proc/PID/status to verify:
-	// 1. It's actually a socat process (Name field)
-	// 2. It's a process, not a thread (Tgid == Pid)
-	// 3. It's not a zombie (State field)
-	statusPath := fmt.Sprintf("/proc/%d/status", pid)
-	statusData, err := os.ReadFile(statusPath)
-	if err != nil {
-		// /proc entry doesn't exist or can't be read - process is gone
-		return false
-	}
-
-	var name, state string
-	var tgid, pidVal int
-	lines := strings.Split(string(statusData), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "Name:\t") {
-			name = strings.TrimSpace(strings.TrimPrefix(line, "Name:\t"))
-		} else if strings.HasPrefix(line, "State:\t") {
-			state = strings.TrimSpace(strings.TrimPrefix(line, "State:\t"))
-		} else if strings.HasPrefix(line, "Tgid:\t") {
-			fmt.Sscanf(line, "Tgid:\t%d", &tgid)
-		} else if strings.HasPrefix(line, "Pid:\t") {
-			fmt.Sscanf(line, "Pid:\t%d", &pidVal)
-		}
-	}
-
-	// Check if it's a thread (Tgid != Pid means it's a thread)
-	if tgid != pidVal {
-		logger.Debug("socat", "PID %d is a thread (Tgid=%d), not a process", pid, tgid)
-		return false
-	}
-
-	// Check if it's a zombie process (State starts with 'Z')
-	if strings.HasPrefix(state, "Z") {
-		logger.Debug("socat", "PID %d is a zombie process", pid)
-		return false
-	}
-
-	// Check if it's actually socat
-	if name != "socat" {
-		logger.Debug("socat", "PID %d is '%s', not socat", pid, name)
-		return false
-	}
-
-	return true
+	failed, _ := r.failed()
+	return !failed
 }
 
 // GetStatus returns status of all relays
@@ -370,22 +190,29 @@ func (m *Manager) GetStatus() ([]RelayStatus, error) {
 		return nil, fmt.Errorf("failed to load relays: %w", err)
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	statuses := make([]RelayStatus, len(relays))
 	for i, relay := range relays {
-		running := false
-		if relay.PID != 0 {
-			running = m.IsProcessRunning(relay.PID)
+		status := RelayStatus{
+			Relay:    relay,
+			Restarts: m.restarts[relay.ID],
+		}
 
-			// Clear stale PID if process is not running
-			if !running && relay.PID != 0 {
-				UpdateRelayPID(m.relaysFile, relay.ID, 0)
+		if r, ok := m.running[relay.ID]; ok {
+			failed, err := r.failed()
+			status.Running = !failed
+			if failed {
+				status.Error = err.Error()
+			} else {
+				startedAt := r.startedAt
+				status.StartedAt = &startedAt
 			}
+			status.Stats = r.counters.snapshot()
 		}
 
-		statuses[i] = RelayStatus{
-			Relay:   relay,
-			Running: running,
-		}
+		statuses[i] = status
 	}
 
 	return statuses, nil
@@ -393,54 +220,50 @@ func (m *Manager) GetStatus() ([]RelayStatus, error) {
 
 // RelayStatus represents the status of a relay
 type RelayStatus struct {
-	Relay   config.SocatRelay
-	Running bool
+	Relay     config.SocatRelay
+	Running   bool
+	StartedAt *time.Time `json:",omitempty"`
+	Restarts  int
+	Stats     RelayStats
+	Error     string `json:",omitempty"`
 }
 
-// MonitorProcesses periodically checks for dead processes and cleans up stale PIDs
+// MonitorProcesses periodically restarts relays whose listener failed.
 // This runs in a background goroutine and should be called with a context that
 // can be cancelled when the application shuts down.
 func (m *Manager) MonitorProcesses(ctx context.Context, interval time.Duration) {
-	logger.Info("socat", "Starting process monitor (interval: %v)", interval)
+	logger.Info("socat", "Starting relay monitor (interval: %v)", interval)
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			logger.Info("socat", "Process monitor shutting down")
+			logger.Info("socat", "Relay monitor shutting down")
 			return
 		case <-ticker.C:
-			m.checkAndCleanDeadProcesses()
+			m.restartFailedRelays()
 		}
 	}
 }
 
-// checkAndCleanDeadProcesses checks all relay processes and clears stale PIDs
-func (m *Manager) checkAndCleanDeadProcesses() {
-	relays, err := LoadRelays(m.relaysFile)
-	if err != nil {
-		logger.Warn("socat", "Monitor: failed to load relays: %v", err)
-		return
-	}
-
-	cleanedCount := 0
-	for i := range relays {
-		if relays[i].PID == 0 {
-			continue // No PID to check
-		}
-
-		if !m.IsProcessRunning(relays[i].PID) {
-			logger.Info("socat", "Monitor: detected dead process for relay %s (PID %d), cleaning up", relays[i].ID, relays[i].PID)
-			if err := UpdateRelayPID(m.relaysFile, relays[i].ID, 0); err != nil {
-				logger.Warn("socat", "Monitor: failed to clear PID for relay %s: %v", relays[i].ID, err)
-			} else {
-				cleanedCount++
-			}
+// restartFailedRelays restarts relays whose listener exited unexpectedly
+func (m *Manager) restartFailedRelays() {
+	m.mu.Lock()
+	var failed []config.SocatRelay
+	for id, r := range m.running {
+		if isFailed, err := r.failed(); isFailed {
+			logger.Warn("socat", "Monitor: relay %s listener stopped: %v", id, err)
+			failed = append(failed, r.relay)
 		}
 	}
+	m.mu.Unlock()
 
-	if cleanedCount > 0 {
-		logger.Info("socat", "Monitor: cleaned up %d dead process(es)", cleanedCount)
+	for i := range failed {
+		if err := m.RestartRelay(&failed[i]); err != nil {
+			logger.Warn("socat", "Monitor: failed to restart relay %s: %v", failed[i].ID, err)
+		} else {
+			logger.Info("socat", "Monitor: restarted relay %s", failed[i].ID)
+		}
 	}
 }
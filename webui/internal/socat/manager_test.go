@@ -0,0 +1,338 @@
+package socat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+)
+
+// startEchoServer starts a TCP server that echoes each line back to the client
+func startEchoServer(t *testing.T) (string, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// freePort returns a TCP port that is currently unused
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to allocate port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestManager_RelayLifecycle(t *testing.T) {
+	host, port := startEchoServer(t)
+	relaysFile := filepath.Join(t.TempDir(), "relays.json")
+
+	relay := config.SocatRelay{
+		ID:         "echo",
+		ListenPort: freePort(t),
+		TargetHost: host,
+		TargetPort: port,
+		Enabled:    true,
+	}
+	if err := AddRelay(relaysFile, relay); err != nil {
+		t.Fatalf("AddRelay failed: %v", err)
+	}
+
+	m := NewManager(relaysFile)
+	if err := m.StartRelay(&relay); err != nil {
+		t.Fatalf("StartRelay failed: %v", err)
+	}
+	if err := m.StartRelay(&relay); err == nil {
+		t.Error("expected error starting an already running relay")
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", relay.ListenPort), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "hello\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read from relay: %v", err)
+	}
+	if line != "hello\n" {
+		t.Errorf("expected echoed line, got %q", line)
+	}
+
+	// Counters are updated after each write completes, so allow them to settle
+	var statuses []RelayStatus
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		statuses, err = m.GetStatus()
+		if err != nil {
+			t.Fatalf("GetStatus failed: %v", err)
+		}
+		if len(statuses) == 1 && statuses[0].Stats.BytesOut == 6 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(statuses) != 1 || !statuses[0].Running {
+		t.Fatalf("expected relay to be running, got %+v", statuses)
+	}
+
+	stats := statuses[0].Stats
+	if stats.ActiveConnections != 1 || stats.TotalConnections != 1 {
+		t.Errorf("expected 1 active and 1 total connection, got %+v", stats)
+	}
+	if stats.BytesIn != 6 || stats.BytesOut != 6 {
+		t.Errorf("expected 6 bytes in each direction, got in=%d out=%d", stats.BytesIn, stats.BytesOut)
+	}
+	if stats.LastActivity == nil {
+		t.Error("expected last activity to be set")
+	}
+
+	if err := m.StopRelay(&relay); err != nil {
+		t.Fatalf("StopRelay failed: %v", err)
+	}
+	if m.IsRunning(relay.ID) {
+		t.Error("relay still reported running after stop")
+	}
+
+	// Active connections are closed when the relay stops
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected relayed connection to be closed after stop")
+	}
+
+	// Stopping again is a no-op
+	if err := m.StopRelay(&relay); err != nil {
+		t.Errorf("second StopRelay returned error: %v", err)
+	}
+
+	// The port is released and the relay can start again
+	if err := m.RestartRelay(&relay); err != nil {
+		t.Fatalf("RestartRelay failed: %v", err)
+	}
+	if err := m.StopAll(); err != nil {
+		t.Fatalf("StopAll failed: %v", err)
+	}
+}
+
+func TestManager_StartRelay_Disabled(t *testing.T) {
+	m := NewManager(filepath.Join(t.TempDir(), "relays.json"))
+	relay := config.SocatRelay{ID: "off", ListenPort: freePort(t), TargetHost: "127.0.0.1", TargetPort: 1}
+
+	if err := m.StartRelay(&relay); err == nil {
+		t.Fatal("expected error starting a disabled relay")
+	}
+}
+
+func TestManager_UDPRelay(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start UDP echo server: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	target := upstream.LocalAddr().(*net.UDPAddr)
+	relay := config.SocatRelay{
+		ID:         "dns",
+		Protocol:   config.RelayProtocolUDP,
+		ListenPort: freePort(t),
+		TargetHost: target.IP.String(),
+		TargetPort: target.Port,
+		Enabled:    true,
+	}
+
+	m := NewManager(filepath.Join(t.TempDir(), "relays.json"))
+	if err := m.StartRelay(&relay); err != nil {
+		t.Fatalf("StartRelay failed: %v", err)
+	}
+	defer m.StopAll()
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", relay.ListenPort))
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write to relay: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("expected echoed datagram, got %q", buf[:n])
+	}
+}
+
+func TestNormalizeProtocol(t *testing.T) {
+	tests := map[string]string{
+		"":     config.RelayProtocolTCP,
+		"TCP":  config.RelayProtocolTCP,
+		"udp":  config.RelayProtocolUDP,
+		"both": config.RelayProtocolBoth,
+	}
+	for input, want := range tests {
+		got, err := NormalizeProtocol(input)
+		if err != nil || got != want {
+			t.Errorf("NormalizeProtocol(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+
+	if _, err := NormalizeProtocol("sctp"); err == nil {
+		t.Error("expected error for unsupported protocol")
+	}
+}
+
+// TestManager_HalfCloseTimeout verifies that a connection whose client has
+// finished sending is closed once the target stays silent for the
+// half-close timeout, rather than staying open until the relay stops
+func TestManager_HalfCloseTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { halfCloseTimeout = timeout }(halfCloseTimeout)
+	halfCloseTimeout = 100 * time.Millisecond
+
+	// A target that reads everything but never answers or closes
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start target: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	relay := config.SocatRelay{ID: "silent", ListenPort: freePort(t), TargetHost: addr.IP.String(), TargetPort: addr.Port, Enabled: true}
+	relaysFile := filepath.Join(t.TempDir(), "relays.json")
+	if err := AddRelay(relaysFile, relay); err != nil {
+		t.Fatalf("AddRelay failed: %v", err)
+	}
+	m := NewManager(relaysFile)
+	if err := m.StartRelay(&relay); err != nil {
+		t.Fatalf("StartRelay failed: %v", err)
+	}
+	defer m.StopAll()
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", relay.ListenPort), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "hello\n")
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the relay to close the connection, got %v", err)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		statuses, _ := m.GetStatus()
+		if len(statuses) == 1 && statuses[0].Stats.ActiveConnections == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection still counted as active: %+v", statuses)
+		}
+	}
+}
+
+// TestManager_StartRelay_AfterPartialFailure verifies that restarting a
+// dual-protocol relay whose UDP listener died releases the TCP listener
+// that was still running, so the relay can bind its port again
+func TestManager_StartRelay_AfterPartialFailure(t *testing.T) {
+	host, port := startEchoServer(t)
+	relay := config.SocatRelay{
+		ID:         "both",
+		Protocol:   config.RelayProtocolBoth,
+		ListenPort: freePort(t),
+		TargetHost: host,
+		TargetPort: port,
+		Enabled:    true,
+	}
+
+	m := NewManager(filepath.Join(t.TempDir(), "relays.json"))
+	if err := m.StartRelay(&relay); err != nil {
+		t.Fatalf("StartRelay failed: %v", err)
+	}
+	defer m.StopAll()
+
+	// Kill only the UDP side
+	m.mu.Lock()
+	for _, l := range m.running[relay.ID].listeners {
+		if u, ok := l.(*udpRelay); ok {
+			u.conn.Close()
+		}
+	}
+	m.mu.Unlock()
+
+	for deadline := time.Now().Add(time.Second); m.IsRunning(relay.ID); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the relay to be reported as failed")
+		}
+	}
+
+	if err := m.StartRelay(&relay); err != nil {
+		t.Fatalf("StartRelay after partial failure failed: %v", err)
+	}
+	if !m.IsRunning(relay.ID) {
+		t.Fatal("expected relay to be running again")
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", relay.ListenPort), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to restarted relay: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "hello\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("expected echo through restarted relay, got %q, %v", line, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/sudocarlos/tailrelay/internal/config"
 )
@@ -67,10 +68,6 @@ func UpdateRelay(filePath string, updatedRelay config.SocatRelay) error {
 	found := false
 	for i, relay := range relays {
 		if relay.ID == updatedRelay.ID {
-			// Preserve PID if running
-			if relays[i].PID != 0 {
-				updatedRelay.PID = relays[i].PID
-			}
 			relays[i] = updatedRelay
 			found = true
 			break
@@ -147,25 +144,14 @@ func GetRelay(filePath string, relayID string) (*config.SocatRelay, error) {
 	return nil, fmt.Errorf("relay with ID %s not found", relayID)
 }
 
-// UpdateRelayPID updates the PID for a relay
-func UpdateRelayPID(filePath string, relayID string, pid int) error {
-	relays, err := LoadRelays(filePath)
-	if err != nil {
-		return err
+// NormalizeProtocol validates a relay protocol, defaulting to TCP when empty
+func NormalizeProtocol(protocol string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(protocol)); p {
+	case "":
+		return config.RelayProtocolTCP, nil
+	case config.RelayProtocolTCP, config.RelayProtocolUDP, config.RelayProtocolBoth:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid protocol %q: must be tcp, udp or both", protocol)
 	}
-
-	found := false
-	for i, relay := range relays {
-		if relay.ID == relayID {
-			relays[i].PID = pid
-			found = true
-			break
-		}
-	}
-
-	if !found {
-		return fmt.Errorf("relay with ID %s not found", relayID)
-	}
-
-	return SaveRelays(filePath, relays)
 }
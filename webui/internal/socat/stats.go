@@ -0,0 +1,79 @@
+package socat
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// RelayStats reports live traffic counters for a relay since it was started
+type RelayStats struct {
+	ActiveConnections int64      `json:"active_connections"`
+	TotalConnections  int64      `json:"total_connections"`
+	BytesIn           int64      `json:"bytes_in"`  // client -> target
+	BytesOut          int64      `json:"bytes_out"` // target -> client
+	LastActivity      *time.Time `json:"last_activity,omitempty"`
+}
+
+// relayCounters holds the counters shared by all listeners of a relay.
+// UDP sessions are counted as connections.
+type relayCounters struct {
+	active       atomic.Int64
+	total        atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64 // unix nanoseconds
+}
+
+func (c *relayCounters) connOpened() {
+	c.active.Add(1)
+	c.total.Add(1)
+	c.touch()
+}
+
+func (c *relayCounters) connClosed() {
+	c.active.Add(-1)
+}
+
+func (c *relayCounters) addIn(n int) {
+	c.bytesIn.Add(int64(n))
+	c.touch()
+}
+
+func (c *relayCounters) addOut(n int) {
+	c.bytesOut.Add(int64(n))
+	c.touch()
+}
+
+func (c *relayCounters) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// snapshot returns the current counter values
+func (c *relayCounters) snapshot() RelayStats {
+	stats := RelayStats{
+		ActiveConnections: c.active.Load(),
+		TotalConnections:  c.total.Load(),
+		BytesIn:           c.bytesIn.Load(),
+		BytesOut:          c.bytesOut.Load(),
+	}
+	if ns := c.lastActivity.Load(); ns != 0 {
+		last := time.Unix(0, ns)
+		stats.LastActivity = &last
+	}
+	return stats
+}
+
+// countingWriter reports every successful write to a counter function
+type countingWriter struct {
+	w   io.Writer
+	add func(int)
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.add(n)
+	}
+	return n, err
+}
@@ -0,0 +1,286 @@
+package socat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/logger"
+)
+
+const (
+	// defaultUDPIdleTimeout closes client sessions with no traffic in either direction
+	defaultUDPIdleTimeout = 60 * time.Second
+	// maxUDPPacketSize is the largest datagram the relay will forward
+	maxUDPPacketSize = 65535
+	// maxPendingDatagrams bounds what is queued for a client while its
+	// upstream socket is dialed; later datagrams are dropped
+	maxPendingDatagrams = 64
+)
+
+// udpRelay is an in-process UDP relay. Each client address gets its own
+// upstream socket so replies can be routed back to the right client.
+type udpRelay struct {
+	relay       config.SocatRelay
+	conn        net.PacketConn
+	target      string
+	idleTimeout time.Duration
+	counters    *relayCounters
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	pending  map[string][][]byte // datagrams from clients whose upstream is being dialed
+
+	// done is closed when the read loop exits
+	done chan struct{}
+	// err records why the read loop exited, nil if it was stopped
+	err error
+}
+
+// udpSession tracks one client and its dedicated upstream socket
+type udpSession struct {
+	client   net.Addr
+	upstream net.Conn
+
+	mu         sync.Mutex
+	lastActive time.Time
+}
+
+// startUDPRelay binds the listen port and starts forwarding datagrams
+func startUDPRelay(parent context.Context, relay config.SocatRelay, counters *relayCounters) (*udpRelay, error) {
+	addr := net.JoinHostPort("", strconv.Itoa(relay.ListenPort))
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on udp %s: %w", addr, err)
+	}
+
+	idleTimeout := defaultUDPIdleTimeout
+	if relay.IdleTimeout > 0 {
+		idleTimeout = time.Duration(relay.IdleTimeout) * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	r := &udpRelay{
+		relay:       relay,
+		conn:        conn,
+		target:      net.JoinHostPort(relay.TargetHost, strconv.Itoa(relay.TargetPort)),
+		idleTimeout: idleTimeout,
+		counters:    counters,
+		ctx:         ctx,
+		cancel:      cancel,
+		sessions:    make(map[string]*udpSession),
+		pending:     make(map[string][][]byte),
+		done:        make(chan struct{}),
+	}
+
+	// Close the socket and all sessions when the relay is cancelled
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		r.closeSessions()
+	}()
+
+	go r.serve()
+
+	return r, nil
+}
+
+// serve reads datagrams from clients and forwards them upstream
+func (r *udpRelay) serve() {
+	defer close(r.done)
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, client, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			logger.Error("socat", "Relay %s UDP listener failed: %v", r.relay.ID, err)
+			r.err = err
+			r.cancel()
+			return
+		}
+
+		session, ok := r.getSession(client, buf[:n])
+		if !ok {
+			continue // sent once the client's upstream is dialed
+		}
+		r.forward(session, buf[:n])
+	}
+}
+
+// forward sends a client's datagram upstream
+func (r *udpRelay) forward(session *udpSession, packet []byte) {
+	session.touch()
+	if written, err := session.upstream.Write(packet); err != nil {
+		logger.Debug("socat", "Relay %s: write to %s failed: %v", r.relay.ID, r.target, err)
+	} else {
+		r.counters.addIn(written)
+	}
+}
+
+// getSession returns the session for a client. On a client's first packet
+// there is none yet: the packet is queued and the upstream dialed in the
+// background, so a slow dial does not stall the read loop.
+func (r *udpRelay) getSession(client net.Addr, packet []byte) (*udpSession, bool) {
+	key := client.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[key]; ok {
+		return session, true
+	}
+
+	queued, dialing := r.pending[key]
+	if len(queued) < maxPendingDatagrams {
+		r.pending[key] = append(queued, append([]byte(nil), packet...))
+	}
+	if !dialing {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.openSession(client)
+		}()
+	}
+	return nil, false
+}
+
+// openSession dials the upstream socket for a new client without holding
+// r.mu, then sends the datagrams queued meanwhile and relays replies
+func (r *udpRelay) openSession(client net.Addr) {
+	key := client.String()
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	upstream, err := dialer.DialContext(r.ctx, "udp", r.target)
+
+	r.mu.Lock()
+	queued := r.pending[key]
+	delete(r.pending, key)
+	if err == nil && r.ctx.Err() != nil {
+		// Stopped while dialing; closeSessions has run or will not see it
+		upstream.Close()
+		err = r.ctx.Err()
+	}
+	if err != nil {
+		r.mu.Unlock()
+		if r.ctx.Err() == nil {
+			logger.Warn("socat", "Relay %s failed to open UDP session to %s for %s: %v", r.relay.ID, r.target, client, err)
+		}
+		return
+	}
+
+	session := &udpSession{
+		client:     client,
+		upstream:   upstream,
+		lastActive: time.Now(),
+	}
+	// Queued datagrams go first, before serve can send newer ones
+	for _, packet := range queued {
+		r.forward(session, packet)
+	}
+	r.sessions[key] = session
+	r.counters.connOpened()
+	r.mu.Unlock()
+
+	logger.Debug("socat", "Relay %s: UDP session %s -> %s opened", r.relay.ID, key, r.target)
+	r.handleReplies(session)
+}
+
+// handleReplies copies datagrams from upstream back to the client until the
+// session has been idle for longer than the idle timeout
+func (r *udpRelay) handleReplies(session *udpSession) {
+	defer r.removeSession(session)
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		session.upstream.SetReadDeadline(time.Now().Add(r.idleTimeout))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if session.idleFor() < r.idleTimeout {
+					continue // Client sent traffic recently
+				}
+				logger.Debug("socat", "Relay %s: UDP session %s idle, closing", r.relay.ID, session.client)
+			}
+			return
+		}
+
+		session.touch()
+		written, err := r.conn.WriteTo(buf[:n], session.client)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			logger.Debug("socat", "Relay %s: write to %s failed: %v", r.relay.ID, session.client, err)
+			continue
+		}
+		r.counters.addOut(written)
+	}
+}
+
+// removeSession closes a session and forgets it
+func (r *udpRelay) removeSession(session *udpSession) {
+	session.upstream.Close()
+
+	r.mu.Lock()
+	if current, ok := r.sessions[session.client.String()]; ok && current == session {
+		delete(r.sessions, session.client.String())
+	}
+	r.mu.Unlock()
+	r.counters.connClosed()
+}
+
+// closeSessions closes every upstream socket, unblocking the reply readers
+func (r *udpRelay) closeSessions() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, session := range r.sessions {
+		session.upstream.Close()
+	}
+}
+
+// stop closes the socket and all sessions, then waits for the relay
+// goroutines to finish
+func (r *udpRelay) stop() {
+	r.cancel()
+	<-r.done
+	r.wg.Wait()
+}
+
+// failed reports whether the read loop exited on its own
+func (r *udpRelay) failed() (bool, error) {
+	select {
+	case <-r.done:
+		return r.err != nil, r.err
+	default:
+		return false, nil
+	}
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
@@ -49,15 +49,17 @@ type CurrentTailnet struct {
 	MagicDNSEnabled bool   `json:"MagicDNSEnabled"`
 }
 
-// Client is a wrapper for the tailscale CLI
+// Client is a wrapper for the tailscale CLI and the tailscaled local API
 type Client struct {
 	binaryPath string
+	socketPath string
 }
 
 // NewClient creates a new Tailscale client
 func NewClient() *Client {
 	return &Client{
 		binaryPath: "tailscale",
+		socketPath: DefaultSocketPath,
 	}
 }
 
@@ -182,6 +184,16 @@ func (c *Client) Up() error {
 	return nil
 }
 
+// Cert fetches or renews the TLS certificate for a MagicDNS name and writes
+// it to certFile and keyFile
+func (c *Client) Cert(domain, certFile, keyFile string) error {
+	cmd := exec.Command(c.binaryPath, "cert", "--cert-file", certFile, "--key-file", keyFile, domain)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to get certificate for %s: %w: %s", domain, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 // GetVersion returns the Tailscale version
 func (c *Client) GetVersion() (string, error) {
 	cmd := exec.Command(c.binaryPath, "--version")
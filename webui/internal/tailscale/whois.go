@@ -0,0 +1,104 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultSocketPath is where tailscaled serves its local API in the container
+const DefaultSocketPath = "/var/run/tailscale/tailscaled.sock"
+
+// Identity is the tailnet user and node behind a Tailscale address
+type Identity struct {
+	LoginName   string   `json:"login_name"`
+	DisplayName string   `json:"display_name,omitempty"`
+	NodeName    string   `json:"node_name"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// IsTagged reports whether the node is owned by tags rather than a user
+func (i *Identity) IsTagged() bool {
+	return len(i.Tags) > 0
+}
+
+// whoIsResponse is the subset of the local API WhoIs response we use
+type whoIsResponse struct {
+	Node *struct {
+		Name         string   `json:"Name"`
+		ComputedName string   `json:"ComputedName"`
+		Tags         []string `json:"Tags"`
+	} `json:"Node"`
+	UserProfile *struct {
+		LoginName   string `json:"LoginName"`
+		DisplayName string `json:"DisplayName"`
+	} `json:"UserProfile"`
+}
+
+// localAPIClient returns an HTTP client that talks to tailscaled over its
+// unix socket
+func (c *Client) localAPIClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.socketPath)
+			},
+		},
+	}
+}
+
+// WhoIs looks up the user and node that own a Tailscale IP (or IP:port)
+// using the tailscaled local API
+func (c *Client) WhoIs(addr string) (*Identity, error) {
+	req, err := http.NewRequest(http.MethodGet,
+		"http://local-tailscaled.sock/localapi/v0/whois?addr="+url.QueryEscape(addr), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build whois request: %w", err)
+	}
+	req.Header.Set("Sec-Tailscale", "localapi")
+
+	resp, err := c.localAPIClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query whois: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read whois response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("whois %s: %s: %s", addr, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var who whoIsResponse
+	if err := json.Unmarshal(body, &who); err != nil {
+		return nil, fmt.Errorf("failed to parse whois response: %w", err)
+	}
+	if who.Node == nil {
+		return nil, fmt.Errorf("whois %s: no node in response", addr)
+	}
+
+	identity := &Identity{
+		NodeName: strings.TrimSuffix(who.Node.Name, "."),
+		Tags:     who.Node.Tags,
+	}
+	if identity.NodeName == "" {
+		identity.NodeName = who.Node.ComputedName
+	}
+	// Tagged nodes report a placeholder "tagged-devices" user
+	if who.UserProfile != nil && !identity.IsTagged() {
+		identity.LoginName = who.UserProfile.LoginName
+		identity.DisplayName = who.UserProfile.DisplayName
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,311 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sudocarlos/tailrelay/internal/auth"
+	"github.com/sudocarlos/tailrelay/internal/config"
+	"github.com/sudocarlos/tailrelay/internal/handlers"
+	"github.com/sudocarlos/tailrelay/internal/tailscale"
+)
+
+// fakeTailscale stands in for the tailscale CLI
+type fakeTailscale struct {
+	connected bool
+	logins    int // LoginWithQR calls
+	// loginErr, when set, makes LoginWithQR fail after bringing the node
+	// up, like `tailscale up` does for a stopped node that is logged in
+	loginErr error
+}
+
+func (f *fakeTailscale) IsConnected() (bool, error) { return f.connected, nil }
+func (f *fakeTailscale) GetStatusSummary() (*tailscale.StatusSummary, error) {
+	if f.connected {
+		return &tailscale.StatusSummary{Connected: true, BackendState: "Running"}, nil
+	}
+	return &tailscale.StatusSummary{BackendState: "NeedsLogin"}, nil
+}
+func (f *fakeTailscale) GetPeers() ([]tailscale.PeerInfo, error) { return nil, nil }
+func (f *fakeTailscale) LoginWithQR() (string, error) {
+	f.logins++
+	if f.loginErr != nil {
+		f.connected = true
+		return "", f.loginErr
+	}
+	return "https://login.tailscale.com/a/test", nil
+}
+func (f *fakeTailscale) Logout() error { return nil }
+func (f *fakeTailscale) Up() error     { return nil }
+func (f *fakeTailscale) Down() error   { return nil }
+
+// newRouteTestServer builds a server with just enough wired up to exercise
+// the public routes and the authentication in front of the rest
+func newRouteTestServer(t *testing.T) (http.Handler, *fakeTailscale) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.Auth.EnableTokenAuth = true
+	cfg.Auth.EnableTailscaleAuth = true
+	cfg.Paths.StateDir = dir
+
+	tokens, _, err := auth.LoadOrCreateTokenStore(filepath.Join(dir, ".webui_token"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateTokenStore failed: %v", err)
+	}
+	apiKeys, err := auth.NewAPIKeyStore(filepath.Join(dir, "api_keys.json"))
+	if err != nil {
+		t.Fatalf("NewAPIKeyStore failed: %v", err)
+	}
+
+	ts := &fakeTailscale{}
+	authMW := auth.NewMiddleware(tokens, apiKeys, cfg.Auth, nil)
+	s := &Server{
+		cfg:        cfg,
+		authMW:     authMW,
+		templates:  template.Must(template.New("login.html").Parse(`login {{.Error}}`)),
+		tailscaleH: handlers.NewTailscaleHandler(cfg, nil, authMW, ts),
+		authH:      handlers.NewAuthHandler(authMW),
+		staticFS:   fstest.MapFS{"app.css": &fstest.MapFile{Data: []byte("body{}")}},
+	}
+	return s.setupRoutes(), ts
+}
+
+// do sends a request from a non-tailnet address with the given cookies
+func do(h http.Handler, method, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return doFrom(h, "192.0.2.1:1234", method, path, cookies...)
+}
+
+// doFrom sends a request from remoteAddr with the given cookies
+func doFrom(h http.Handler, remoteAddr, method, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func pollResult(t *testing.T, w *httptest.ResponseRecorder) (connected, authenticated bool) {
+	t.Helper()
+	var body struct {
+		Connected     bool `json:"connected"`
+		Authenticated bool `json:"authenticated"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("invalid poll response: %v", err)
+	}
+	return body.Connected, body.Authenticated
+}
+
+// TestPublicRoutes verifies which routes answer without credentials and
+// that none of them hands out a session
+func TestPublicRoutes(t *testing.T) {
+	h, ts := newRouteTestServer(t)
+	ts.connected = true
+
+	public := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/login", http.StatusOK},
+		{http.MethodPost, "/login", http.StatusUnauthorized},
+		{http.MethodGet, "/logout", http.StatusSeeOther},
+		{http.MethodGet, "/static/app.css", http.StatusOK},
+		{http.MethodGet, "/api/tailscale/poll", http.StatusOK},
+		{http.MethodPost, "/api/tailscale/login", http.StatusConflict},
+		// Only Caddy, over loopback, may ask for access checks
+		{http.MethodGet, "/api/caddy/forward-auth?proxy=x", http.StatusForbidden},
+	}
+	for _, tt := range public {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := do(h, tt.method, tt.path)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+			if c := responseCookie(w, "tailrelay_session"); c != nil {
+				t.Errorf("public route set a session cookie")
+			}
+		})
+	}
+
+	protected := []string{
+		"/",
+		"/tailscale",
+		"/api/status",
+		"/api/auth/whoami",
+		"/api/auth/keys",
+		"/api/caddy/proxies",
+		"/api/caddy/drift",
+		"/api/caddy/batch",
+		"/api/caddy/import",
+		"/api/caddy/export",
+		"/api/socat/relays",
+		"/api/backup/list",
+		"/api/logs",
+		"/api/audit",
+		"/metrics",
+	}
+	for _, path := range protected {
+		t.Run("protected "+path, func(t *testing.T) {
+			w := do(h, http.MethodGet, path)
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+				t.Errorf("expected redirect to /login, got %d %q", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+// TestTailscaleLogin_SessionBoundToInitiator verifies that only the browser
+// that started a Tailscale login receives a session, and only once
+func TestTailscaleLogin_SessionBoundToInitiator(t *testing.T) {
+	h, ts := newRouteTestServer(t)
+
+	// The initiating browser gets the login nonce
+	w := do(h, http.MethodPost, "/api/tailscale/login")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	nonce := responseCookie(w, "tailrelay_login")
+	if nonce == nil || !nonce.HttpOnly {
+		t.Fatal("expected an HttpOnly login nonce cookie")
+	}
+
+	// Another client cannot start a competing login or a new attempt
+	logins := ts.logins
+	w = doFrom(h, "192.0.2.2:1234", http.MethodPost, "/api/tailscale/login")
+	if w.Code != http.StatusConflict {
+		t.Errorf("second login: expected 409, got %d", w.Code)
+	}
+	otherNonce := responseCookie(w, "tailrelay_login")
+	if otherNonce != nil {
+		t.Error("second login was given a nonce")
+	}
+	if ts.logins != logins {
+		t.Error("second login started another tailscale login")
+	}
+
+	// Nothing is granted while the node is still disconnected
+	w = do(h, http.MethodGet, "/api/tailscale/poll", nonce)
+	if connected, authenticated := pollResult(t, w); connected || authenticated {
+		t.Fatal("expected poll to report not connected")
+	}
+
+	ts.connected = true
+
+	// A client without the nonce only learns that the node is connected
+	w = do(h, http.MethodGet, "/api/tailscale/poll")
+	if connected, authenticated := pollResult(t, w); !connected || authenticated {
+		t.Errorf("poll without nonce: connected=%v authenticated=%v", connected, authenticated)
+	}
+	if responseCookie(w, "tailrelay_session") != nil {
+		t.Fatal("poll without nonce set a session cookie")
+	}
+
+	// The initiating browser is logged in
+	w = do(h, http.MethodGet, "/api/tailscale/poll", nonce)
+	if _, authenticated := pollResult(t, w); !authenticated {
+		t.Fatal("expected the initiating browser to be authenticated")
+	}
+	session := responseCookie(w, "tailrelay_session")
+	if session == nil {
+		t.Fatal("expected a session cookie")
+	}
+	if w := do(h, http.MethodGet, "/api/auth/whoami", session); w.Code != http.StatusOK {
+		t.Errorf("whoami with session: expected 200, got %d", w.Code)
+	}
+
+	// The nonce cannot be replayed
+	w = do(h, http.MethodGet, "/api/tailscale/poll", nonce)
+	if _, authenticated := pollResult(t, w); authenticated || responseCookie(w, "tailrelay_session") != nil {
+		t.Error("expected the nonce to be single use")
+	}
+
+}
+
+// TestTailscaleLogin_SecondClientGetsNoSession verifies that a client
+// calling Login while another login is pending cannot win the session once
+// the node connects, even by polling first
+func TestTailscaleLogin_SecondClientGetsNoSession(t *testing.T) {
+	h, ts := newRouteTestServer(t)
+
+	w := do(h, http.MethodPost, "/api/tailscale/login")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d", w.Code)
+	}
+	nonce := responseCookie(w, "tailrelay_login")
+
+	w = doFrom(h, "192.0.2.2:1234", http.MethodPost, "/api/tailscale/login")
+	otherCookies := w.Result().Cookies()
+
+	ts.connected = true
+
+	w = doFrom(h, "192.0.2.2:1234", http.MethodGet, "/api/tailscale/poll", otherCookies...)
+	if _, authenticated := pollResult(t, w); authenticated || responseCookie(w, "tailrelay_session") != nil {
+		t.Fatal("expected the second client not to be authenticated")
+	}
+
+	w = do(h, http.MethodGet, "/api/tailscale/poll", nonce)
+	if _, authenticated := pollResult(t, w); !authenticated {
+		t.Error("expected the initiating browser to keep its login")
+	}
+}
+
+// TestTailscaleLogin_FailedLoginGrantsNothing verifies that a login attempt
+// which fails, but brings the node up anyway, leaves the caller without a
+// usable nonce
+func TestTailscaleLogin_FailedLoginGrantsNothing(t *testing.T) {
+	h, ts := newRouteTestServer(t)
+
+	// The caller holds a nonce from an earlier attempt
+	w := do(h, http.MethodPost, "/api/tailscale/login")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d", w.Code)
+	}
+	nonce := responseCookie(w, "tailrelay_login")
+
+	ts.loginErr = errors.New("no auth URL found")
+	w = do(h, http.MethodPost, "/api/tailscale/login", nonce)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed login: expected 500, got %d", w.Code)
+	}
+	if responseCookie(w, "tailrelay_login") != nil {
+		t.Error("failed login issued a nonce")
+	}
+	if !ts.connected {
+		t.Fatal("expected the fake to have brought the node up")
+	}
+
+	w = do(h, http.MethodGet, "/api/tailscale/poll", nonce)
+	if connected, authenticated := pollResult(t, w); !connected || authenticated {
+		t.Errorf("poll after failed login: connected=%v authenticated=%v", connected, authenticated)
+	}
+	if responseCookie(w, "tailrelay_session") != nil {
+		t.Error("poll after failed login set a session cookie")
+	}
+
+	// Once up, the node no longer accepts logins through this route
+	ts.loginErr = nil
+	if w := do(h, http.MethodPost, "/api/tailscale/login"); w.Code != http.StatusConflict {
+		t.Errorf("login while running: expected 409, got %d", w.Code)
+	}
+}
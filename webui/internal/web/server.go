@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/fs"
@@ -9,13 +10,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/sudocarlos/tailrelay/internal/audit"
 	"github.com/sudocarlos/tailrelay/internal/auth"
 	"github.com/sudocarlos/tailrelay/internal/config"
 	"github.com/sudocarlos/tailrelay/internal/handlers"
+	"github.com/sudocarlos/tailrelay/internal/metrics"
+	"github.com/sudocarlos/tailrelay/internal/tailscale"
 )
 
 // Server represents the HTTP server
@@ -29,6 +34,10 @@ type Server struct {
 	socatH     *handlers.SocatHandler
 	backupH    *handlers.BackupHandler
 	logsH      *handlers.Handler
+	authH      *handlers.AuthHandler
+	metricsH   *handlers.MetricsHandler
+	auditH     *handlers.AuditHandler
+	httpStats  *metrics.HTTPMetrics
 	staticFS   fs.FS
 	templateFS fs.FS
 	ctx        context.Context
@@ -36,15 +45,27 @@ type Server struct {
 }
 
 // NewServer creates a new HTTP server
-func NewServer(cfg *config.Config, authToken string, staticFS, templateFS fs.FS) (*Server, error) {
+func NewServer(cfg *config.Config, tokens *auth.TokenStore, staticFS, templateFS fs.FS) (*Server, error) {
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Load API keys
+	apiKeys, err := auth.NewAPIKeyStore(filepath.Join(cfg.Paths.StateDir, "api_keys.json"))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load api keys: %w", err)
+	}
+
+	// Open the audit journal of configuration changes
+	audit.Init(filepath.Join(cfg.Paths.StateDir, "audit.jsonl"))
+
 	// Create authentication middleware
+	tsClient := tailscale.NewClient()
 	authMW := auth.NewMiddleware(
-		authToken,
-		cfg.Auth.EnableTailscaleAuth,
-		cfg.Auth.EnableTokenAuth,
+		tokens,
+		apiKeys,
+		cfg.Auth,
+		tsClient,
 	)
 
 	// Parse templates
@@ -56,11 +77,15 @@ func NewServer(cfg *config.Config, authToken string, staticFS, templateFS fs.FS)
 
 	// Create handlers
 	dashboardH := handlers.NewDashboardHandler(cfg, tmpl)
-	tailscaleH := handlers.NewTailscaleHandler(cfg, tmpl, authMW)
-	caddyH := handlers.NewCaddyHandler(cfg, tmpl)
+	tailscaleH := handlers.NewTailscaleHandler(cfg, tmpl, authMW, tsClient)
+	caddyH := handlers.NewCaddyHandler(cfg, tmpl, authMW)
 	socatH := handlers.NewSocatHandler(cfg, tmpl)
-	backupH := handlers.NewBackupHandler(cfg, tmpl)
+	backupH := handlers.NewBackupHandler(cfg, tmpl, authMW)
 	logsH := handlers.NewHandler(tmpl)
+	authH := handlers.NewAuthHandler(authMW)
+	httpStats := metrics.NewHTTPMetrics()
+	metricsH := handlers.NewMetricsHandler(cfg, socatH.RelayManager(), httpStats)
+	auditH := handlers.NewAuditHandler(audit.Default())
 
 	return &Server{
 		cfg:        cfg,
@@ -72,6 +97,10 @@ func NewServer(cfg *config.Config, authToken string, staticFS, templateFS fs.FS)
 		socatH:     socatH,
 		backupH:    backupH,
 		logsH:      logsH,
+		authH:      authH,
+		metricsH:   metricsH,
+		auditH:     auditH,
+		httpStats:  httpStats,
 		staticFS:   staticFS,
 		templateFS: templateFS,
 		ctx:        ctx,
@@ -93,17 +122,32 @@ func (s *Server) Start() error {
 		log.Printf("Warning: failed to start autostart relays: %v", err)
 	}
 
-	// Start socat process monitor (checks every 10 seconds)
-	log.Printf("Starting socat process monitor...")
+	// Start relay monitor (restarts failed listeners every 10 seconds)
+	log.Printf("Starting socat relay monitor...")
 	go s.socatH.StartProcessMonitor(s.ctx, 10*time.Second)
 
+	// Start automatic backup scheduler
+	log.Printf("Starting backup scheduler...")
+	go s.backupH.StartScheduler(s.ctx)
+
 	// Initialize autostart proxies
 	log.Printf("Initializing autostart proxies...")
 	if err := s.caddyH.InitializeAutostart(); err != nil {
 		log.Printf("Warning: failed to start autostart proxies: %v", err)
 	}
 
+	// Renew certificate files from `tailscale cert` before they expire
+	go s.caddyH.StartCertificateRenewal(s.ctx)
+
+	// Start proxy drift monitor (re-applies proxies missing from Caddy)
+	log.Printf("Starting Caddy drift monitor...")
+	go s.caddyH.StartDriftMonitor(s.ctx, 30*time.Second)
+
 	mux := s.setupRoutes()
+	handler := s.httpStats.Middleware(mux, func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		return pattern
+	})
 
 	addr := fmt.Sprintf("%s:%d", s.cfg.Server.Host, s.cfg.Server.Port)
 	log.Printf("Starting Web UI server on %s", addr)
@@ -111,7 +155,7 @@ func (s *Server) Start() error {
 	// Create HTTP server for graceful shutdown support
 	httpServer := &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: handler,
 	}
 
 	// Set up signal handling for graceful shutdown
@@ -168,59 +212,88 @@ func (s *Server) setupRoutes() *http.ServeMux {
 	mux.Handle("/api/tailscale/login", http.HandlerFunc(s.tailscaleH.Login))
 	mux.Handle("/api/tailscale/poll", http.HandlerFunc(s.tailscaleH.PollStatus))
 
+	// Caddy checks proxy access policies here from inside the container
+	mux.Handle("/api/caddy/forward-auth", s.authMW.RequireLoopback(http.HandlerFunc(s.caddyH.ForwardAuth)))
+
 	// Static files with proper MIME types
 	fileServer := http.FileServer(http.FS(s.staticFS))
 	mux.Handle("/static/", http.StripPrefix("/static/", s.staticFileHandler(fileServer)))
 
-	// Protected routes (authentication required)
+	// Protected routes (authentication required). API keys are limited to
+	// the scope given for each /api route; pages and key management need admin.
 	mux.Handle("/", s.authMW.RequireAuth(http.HandlerFunc(s.handleSPAFallback)))
-	mux.Handle("/api/status", s.authMW.RequireAuth(http.HandlerFunc(s.dashboardH.APIStatus)))
+	mux.Handle("/api/status", s.authMW.RequireScope("", http.HandlerFunc(s.dashboardH.APIStatus)))
+
+	// Auth routes
+	mux.Handle("/api/auth/whoami", s.authMW.RequireScope("", http.HandlerFunc(s.authH.WhoAmI)))
+	mux.Handle("/api/auth/rotate-token", s.authMW.RequireAuth(http.HandlerFunc(s.authH.RotateToken)))
+	mux.Handle("/api/auth/sessions", s.authMW.RequireAuth(http.HandlerFunc(s.authH.Sessions)))
+	mux.Handle("/api/auth/keys", s.authMW.RequireAuth(http.HandlerFunc(s.authH.ListAPIKeys)))
+	mux.Handle("/api/auth/keys/create", s.authMW.RequireAuth(http.HandlerFunc(s.authH.CreateAPIKey)))
+	mux.Handle("/api/auth/keys/update", s.authMW.RequireAuth(http.HandlerFunc(s.authH.UpdateAPIKey)))
+	mux.Handle("/api/auth/keys/delete", s.authMW.RequireAuth(http.HandlerFunc(s.authH.DeleteAPIKey)))
 
 	// Tailscale routes
 	mux.Handle("/tailscale", s.authMW.RequireAuth(http.HandlerFunc(s.tailscaleH.Status)))
-	mux.Handle("/api/tailscale/logout", s.authMW.RequireAuth(http.HandlerFunc(s.tailscaleH.Logout)))
-	mux.Handle("/api/tailscale/connect", s.authMW.RequireAuth(http.HandlerFunc(s.tailscaleH.Connect)))
-	mux.Handle("/api/tailscale/disconnect", s.authMW.RequireAuth(http.HandlerFunc(s.tailscaleH.Disconnect)))
-	mux.Handle("/api/tailscale/status", s.authMW.RequireAuth(http.HandlerFunc(s.tailscaleH.APIStatus)))
-	mux.Handle("/api/tailscale/peers", s.authMW.RequireAuth(http.HandlerFunc(s.tailscaleH.APIPeers)))
+	mux.Handle("/api/tailscale/logout", s.authMW.RequireScope(auth.ScopeTailscaleWrite, http.HandlerFunc(s.tailscaleH.Logout)))
+	mux.Handle("/api/tailscale/connect", s.authMW.RequireScope(auth.ScopeTailscaleWrite, http.HandlerFunc(s.tailscaleH.Connect)))
+	mux.Handle("/api/tailscale/disconnect", s.authMW.RequireScope(auth.ScopeTailscaleWrite, http.HandlerFunc(s.tailscaleH.Disconnect)))
+	mux.Handle("/api/tailscale/status", s.authMW.RequireScope(auth.ScopeTailscaleRead, http.HandlerFunc(s.tailscaleH.APIStatus)))
+	mux.Handle("/api/tailscale/peers", s.authMW.RequireScope(auth.ScopeTailscaleRead, http.HandlerFunc(s.tailscaleH.APIPeers)))
 
 	// Caddy routes
 	mux.Handle("/caddy", s.authMW.RequireAuth(http.HandlerFunc(s.handleSPARedirect)))
-	mux.Handle("/api/caddy/create", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.Create)))
-	mux.Handle("/api/caddy/update", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.Update)))
-	mux.Handle("/api/caddy/delete", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.Delete)))
-	mux.Handle("/api/caddy/toggle", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.Toggle)))
-	mux.Handle("/api/caddy/reload", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.Reload)))
-	mux.Handle("/api/caddy/proxies", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.APIList)))
-	mux.Handle("/api/caddy/proxy", s.authMW.RequireAuth(http.HandlerFunc(s.caddyH.APIGet)))
+	mux.Handle("/api/caddy/create", s.authMW.RequireScope(auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Create)))
+	mux.Handle("/api/caddy/update", s.authMW.RequireScope(auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Update)))
+	mux.Handle("/api/caddy/delete", s.authMW.RequireScope(auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Delete)))
+	mux.Handle("/api/caddy/toggle", s.authMW.RequireScope(auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Toggle)))
+	mux.Handle("/api/caddy/reload", s.authMW.RequireScope(auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Reload)))
+	mux.Handle("/api/caddy/proxies", s.authMW.RequireScope(auth.ScopeCaddyRead, http.HandlerFunc(s.caddyH.APIList)))
+	mux.Handle("/api/caddy/proxy", s.authMW.RequireScope(auth.ScopeCaddyRead, http.HandlerFunc(s.caddyH.APIGet)))
+	mux.Handle("/api/caddy/batch", s.authMW.RequireReadWrite(auth.ScopeCaddyRead, auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Batch)))
+	mux.Handle("/api/caddy/import", s.authMW.RequireScope(auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Import)))
+	mux.Handle("/api/caddy/export", s.authMW.RequireScope(auth.ScopeCaddyRead, http.HandlerFunc(s.caddyH.Export)))
+	mux.Handle("/api/caddy/drift", s.authMW.RequireReadWrite(auth.ScopeCaddyRead, auth.ScopeCaddyWrite, http.HandlerFunc(s.caddyH.Drift)))
 
 	// Socat routes
 	mux.Handle("/socat", s.authMW.RequireAuth(http.HandlerFunc(s.handleSPARedirect)))
-	mux.Handle("/api/socat/create", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Create)))
-	mux.Handle("/api/socat/update", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Update)))
-	mux.Handle("/api/socat/delete", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Delete)))
-	mux.Handle("/api/socat/toggle", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Toggle)))
-	mux.Handle("/api/socat/start", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Start)))
-	mux.Handle("/api/socat/stop", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Stop)))
-	mux.Handle("/api/socat/restart", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.Restart)))
-	mux.Handle("/api/socat/restart-all", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.RestartAll)))
-	mux.Handle("/api/socat/relays", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.APIList)))
-	mux.Handle("/api/socat/relay", s.authMW.RequireAuth(http.HandlerFunc(s.socatH.APIGet)))
+	mux.Handle("/api/socat/create", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Create)))
+	mux.Handle("/api/socat/update", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Update)))
+	mux.Handle("/api/socat/delete", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Delete)))
+	mux.Handle("/api/socat/toggle", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Toggle)))
+	mux.Handle("/api/socat/start", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Start)))
+	mux.Handle("/api/socat/stop", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Stop)))
+	mux.Handle("/api/socat/restart", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.Restart)))
+	mux.Handle("/api/socat/restart-all", s.authMW.RequireScope(auth.ScopeSocatWrite, http.HandlerFunc(s.socatH.RestartAll)))
+	mux.Handle("/api/socat/relays", s.authMW.RequireScope(auth.ScopeSocatRead, http.HandlerFunc(s.socatH.APIList)))
+	mux.Handle("/api/socat/relay", s.authMW.RequireScope(auth.ScopeSocatRead, http.HandlerFunc(s.socatH.APIGet)))
+	mux.Handle("/api/socat/stream", s.authMW.RequireScope(auth.ScopeSocatRead, http.HandlerFunc(s.socatH.StatsStream)))
 
 	// Backup routes
 	mux.Handle("/backup", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.List)))
-	mux.Handle("/api/backup/create", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.Create)))
-	mux.Handle("/api/backup/restore", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.Restore)))
-	mux.Handle("/api/backup/delete", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.Delete)))
-	mux.Handle("/api/backup/download", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.Download)))
-	mux.Handle("/api/backup/upload", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.Upload)))
-	mux.Handle("/api/backup/list", s.authMW.RequireAuth(http.HandlerFunc(s.backupH.APIList)))
+	mux.Handle("/api/backup/create", s.authMW.RequireScope(auth.ScopeBackupWrite, http.HandlerFunc(s.backupH.Create)))
+	mux.Handle("/api/backup/restore", s.authMW.RequireScope(auth.ScopeBackupRestore, http.HandlerFunc(s.backupH.Restore)))
+	mux.Handle("/api/backup/delete", s.authMW.RequireScope(auth.ScopeBackupWrite, http.HandlerFunc(s.backupH.Delete)))
+	mux.Handle("/api/backup/download", s.authMW.RequireScope(auth.ScopeBackupRead, http.HandlerFunc(s.backupH.Download)))
+	mux.Handle("/api/backup/upload", s.authMW.RequireScope(auth.ScopeBackupWrite, http.HandlerFunc(s.backupH.Upload)))
+	mux.Handle("/api/backup/list", s.authMW.RequireScope(auth.ScopeBackupRead, http.HandlerFunc(s.backupH.APIList)))
+	mux.Handle("/api/backup/schedule", s.authMW.RequireScope(auth.ScopeBackupRead, http.HandlerFunc(s.backupH.Schedule)))
 
 	// Logs routes
 	mux.Handle("/logs", s.authMW.RequireAuth(http.HandlerFunc(s.logsH.LogsPageHandler)))
-	mux.Handle("/api/logs", s.authMW.RequireAuth(http.HandlerFunc(s.logsH.LogsAPIHandler)))
-	mux.Handle("/api/logs/stream", s.authMW.RequireAuth(http.HandlerFunc(s.logsH.LogsStreamHandler)))
-	mux.Handle("/api/logs/level", s.authMW.RequireAuth(http.HandlerFunc(s.logsH.LogsLevelHandler)))
+	mux.Handle("/api/logs", s.authMW.RequireScope(auth.ScopeLogsRead, http.HandlerFunc(s.logsH.LogsAPIHandler)))
+	mux.Handle("/api/logs/stream", s.authMW.RequireScope(auth.ScopeLogsRead, http.HandlerFunc(s.logsH.LogsStreamHandler)))
+	mux.Handle("/api/logs/level", s.authMW.RequireReadWrite(auth.ScopeLogsRead, auth.ScopeLogsWrite, http.HandlerFunc(s.logsH.LogsLevelHandler)))
+
+	// Audit log
+	mux.Handle("/api/audit", s.authMW.RequireScope(auth.ScopeAuditRead, http.HandlerFunc(s.auditH.List)))
+
+	// Prometheus metrics
+	if s.cfg.Metrics.TailnetNoAuth {
+		mux.Handle("/metrics", s.authMW.RequireTailnet(http.HandlerFunc(s.metricsH.Metrics)))
+	} else {
+		mux.Handle("/metrics", s.authMW.RequireScope(auth.ScopeMetricsRead, http.HandlerFunc(s.metricsH.Metrics)))
+	}
 
 	return mux
 }
@@ -253,20 +326,78 @@ func (s *Server) handleSPARedirect(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// handleLogin handles the login page
+// handleLogin shows the login page and accepts token logins.
+// POST accepts the token as a form field or a JSON body {"token": "..."}.
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// Show login instructions and tailscale login link
+		s.renderLogin(w, "")
+
+	case http.MethodPost:
+		isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+
+		var token string
+		if isJSON {
+			var req struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			token = req.Token
+		} else {
+			token = r.FormValue("token")
+		}
+
+		if !s.authMW.ValidateToken(strings.TrimSpace(token)) {
+			log.Printf("Failed login attempt from %s", r.RemoteAddr)
+			if isJSON {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			s.renderLogin(w, "Invalid token")
+			return
+		}
+
+		if err := s.authMW.SetSessionCookie(w, r); err != nil {
+			log.Printf("Error creating session: %v", err)
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Token login from %s", r.RemoteAddr)
+
+		if isJSON {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "success",
+				"message": "Logged in",
+			})
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
+}
 
-	// Show login instructions and tailscale login link
-	s.templates.ExecuteTemplate(w, "login.html", nil)
+// renderLogin renders the login page with an optional error message
+func (s *Server) renderLogin(w http.ResponseWriter, loginError string) {
+	data := map[string]interface{}{
+		"TokenAuth": s.authMW.TokenAuthEnabled(),
+		"Error":     loginError,
+	}
+	if err := s.templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		log.Printf("Error rendering login template: %v", err)
+	}
 }
 
 // handleLogout handles the logout action
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	s.authMW.ClearSessionCookie(w)
+	s.authMW.ClearSessionCookie(w, r)
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 